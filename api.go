@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noelukwa/localbase/pkg/client"
+)
+
+// newAPIHandler exposes the daemon over a small REST API. Requests are
+// translated into protocol requests and served by the same dispatch path as
+// the TCP protocol.
+//
+//	GET    /v1/health            503 if any check fails
+//	GET    /v1/schema            JSON Schema of the protocol
+//	GET    /v1/status
+//	GET    /v1/events            server-sent events, ?event=domain_added&token=...
+//	GET    /v1/domains           ?cursor=a.local&limit=100
+//	POST   /v1/domains           {"domain": "hello", "port": 3000}
+//	GET    /v1/domains/{domain}  also accepts aliases and DNS TLD names
+//	PATCH  /v1/domains/{domain}  {"port": 4000}
+//	DELETE /v1/domains/{domain}
+//
+// Browsers may call the API from corsOrigins, e.g. a browser extension's
+// chrome-extension:// origin. Requests from any other origin are refused,
+// as are Host headers other than localhost unless tokens are required, so
+// web pages can't reach the API directly or through DNS rebinding.
+func newAPIHandler(lb *LocalBase, corsOrigins []string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		req := &Request{Method: "health", client: "api " + r.RemoteAddr}
+		req.Auth = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		result, err := dispatch(lb, req)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		status := http.StatusOK
+		if health, ok := result.(*Health); ok && !health.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, result)
+	})
+
+	mux.HandleFunc("/v1/schema", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write(client.Schema())
+	})
+
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		serveRequest(w, r, lb, &Request{Method: "status"}, http.StatusOK)
+	})
+
+	mux.HandleFunc("/v1/events", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		serveEvents(w, r, lb)
+	})
+
+	mux.HandleFunc("/v1/domains", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			params := ListParams{Cursor: r.URL.Query().Get("cursor")}
+			if limit := r.URL.Query().Get("limit"); limit != "" {
+				n, err := strconv.Atoi(limit)
+				if err != nil {
+					writeAPIError(w, errorf(CodeInvalidRequest, "invalid limit %q", limit))
+					return
+				}
+				params.Limit = n
+			}
+			data, _ := json.Marshal(&params)
+			serveRequest(w, r, lb, &Request{Method: "list", Params: data}, http.StatusOK)
+			return
+		}
+
+		if !requireJSON(w, r) {
+			return
+		}
+		var params AddParams
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			writeAPIError(w, errorf(CodeInvalidRequest, "invalid request body: %v", err))
+			return
+		}
+		data, _ := json.Marshal(&params)
+		serveRequest(w, r, lb, &Request{Method: "add", Params: data}, http.StatusCreated)
+	})
+
+	mux.HandleFunc("/v1/domains/", func(w http.ResponseWriter, r *http.Request) {
+		domain := strings.TrimPrefix(r.URL.Path, "/v1/domains/")
+		if name, action, ok := strings.Cut(domain, "/"); ok && (action == "pause" || action == "resume") {
+			if !allowMethods(w, r, http.MethodPost) {
+				return
+			}
+			data, _ := json.Marshal(&PauseParams{Domain: name})
+			serveRequest(w, r, lb, &Request{Method: action, Params: data}, http.StatusOK)
+			return
+		}
+		if !allowMethods(w, r, http.MethodGet, http.MethodPatch, http.MethodDelete) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			data, _ := json.Marshal(&GetParams{Domain: domain})
+			serveRequest(w, r, lb, &Request{Method: "get", Params: data}, http.StatusOK)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			if !requireJSON(w, r) {
+				return
+			}
+			var params UpdateParams
+			if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+				writeAPIError(w, errorf(CodeInvalidRequest, "invalid request body: %v", err))
+				return
+			}
+			params.Domain = domain
+			data, _ := json.Marshal(&params)
+			serveRequest(w, r, lb, &Request{Method: "update", Params: data}, http.StatusOK)
+			return
+		}
+		data, _ := json.Marshal(&RemoveParams{Domain: domain})
+		serveRequest(w, r, lb, &Request{Method: "remove", Params: data}, http.StatusOK)
+	})
+
+	return withHostCheck(withCORS(mux, corsOrigins), lb)
+}
+
+// withHostCheck refuses requests whose Host isn't localhost or a loopback
+// address, which is what a DNS rebinding attack sends, unless the daemon
+// requires tokens, which a rebound page doesn't have.
+func withHostCheck(h http.Handler, lb *LocalBase) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lb.requireAuth && !loopbackHost(r.Host) {
+			writeJSON(w, http.StatusForbidden, map[string]*Error{"error": errorf(CodeUnauthorized, "host %s not allowed", r.Host)})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loopbackHost reports whether host, with or without a port, is localhost
+// or a loopback address.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireJSON refuses request bodies that aren't JSON. Browsers send
+// cross-origin text/plain and form posts without a preflight.
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		return true
+	}
+	writeJSON(w, http.StatusUnsupportedMediaType, map[string]*Error{"error": errorf(CodeInvalidRequest, "Content-Type must be application/json")})
+	return false
+}
+
+// withCORS lets browsers call h from the given origins. Requests from
+// other origins are refused outright rather than left to the browser to
+// block, since simple requests reach the API without a preflight; there
+// is no wildcard, since any web page could otherwise manage domains.
+// Requests without an Origin don't come from a web page and are served.
+func withCORS(h http.Handler, origins []string) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[strings.TrimSuffix(o, "/")] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !allowed[origin] {
+			writeJSON(w, http.StatusForbidden, map[string]*Error{"error": errorf(CodeUnauthorized, "origin %s not allowed", origin)})
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func serveRequest(w http.ResponseWriter, r *http.Request, lb *LocalBase, req *Request, status int) {
+	req.client = "api " + r.RemoteAddr
+	req.Auth = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	result, err := dispatch(lb, req)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, status, result)
+}
+
+// sseKeepAlive is how often an idle event stream gets a comment, so
+// proxies and browsers don't time it out.
+const sseKeepAlive = 30 * time.Second
+
+// serveEvents streams daemon events as server-sent events, one per message
+// with the event type as the SSE event name. EventSource can't set
+// headers, so the token may also be passed as ?token=.
+func serveEvents(w http.ResponseWriter, r *http.Request, lb *LocalBase) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, errorf(CodeInternal, "streaming is not supported"))
+		return
+	}
+
+	req := &Request{Method: "subscribe", client: "api " + r.RemoteAddr}
+	req.Auth = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token := r.URL.Query().Get("token"); token != "" {
+		req.Auth = token
+	}
+	if err := lb.authorize(req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	events := lb.events.subscribe(r.URL.Query()["event"])
+	defer lb.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if !req.inScope(ev.Domain) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("error encoding event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, errorf(CodeInvalidRequest, "method %s not allowed", r.Method))
+	return false
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	e := toError(err)
+
+	status := http.StatusInternalServerError
+	switch e.Code {
+	case CodeInvalidRequest:
+		status = http.StatusBadRequest
+	case CodeDomainNotFound:
+		status = http.StatusNotFound
+	case CodeDomainExists:
+		status = http.StatusConflict
+	case CodeUnauthorized:
+		status = http.StatusUnauthorized
+	case CodeRateLimited:
+		status = http.StatusTooManyRequests
+	}
+	if w.Header().Get("Allow") != "" {
+		status = http.StatusMethodNotAllowed
+	}
+
+	writeJSON(w, status, map[string]*Error{"error": e})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing api response: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// auditedMethods are the requests that change daemon state.
+var auditedMethods = map[string]bool{
+	"add":    true,
+	"update": true,
+	"remove": true,
+	"pause":  true,
+	"resume": true,
+	"undo":   true,
+	"stop":   true,
+}
+
+// AuditEntry records a single state change, as one line of audit.log.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Action  string    `json:"action"`
+	Domain  string    `json:"domain,omitempty"`
+	Port    int       `json:"port,omitempty"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func getAuditFile() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "audit.log"), nil
+}
+
+// auditLog appends entries to the audit file. The file is only ever
+// appended to; nothing in localbase truncates or rotates it.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	// suffix qualifies the bare names of requests that failed.
+	suffix string
+}
+
+func openAuditLog(path, suffix string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f, suffix: suffix}, nil
+}
+
+func (a *auditLog) record(entry *AuditEntry) {
+	if a == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding audit entry: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// auditRequest records the outcome of req if it changes daemon state.
+func (a *auditLog) auditRequest(req *Request, result interface{}, err error) {
+	if a == nil || !auditedMethods[req.Method] {
+		return
+	}
+
+	entry := &AuditEntry{Client: req.client, Action: req.Method, Outcome: "ok"}
+	if d, ok := result.(*Domain); ok && d != nil {
+		entry.Domain = d.Domain
+		entry.Port = d.Port
+	} else if u, ok := result.(*UndoResult); ok && u != nil {
+		entry.Action = "undo " + u.Undone.Action
+		entry.Domain = u.Undone.Domain.Domain
+	} else {
+		var params struct {
+			Domain string `json:"domain"`
+			Port   int    `json:"port"`
+		}
+		json.Unmarshal(req.Params, &params)
+		if params.Domain != "" {
+			entry.Domain = qualifyDomain(params.Domain, a.suffix)
+		}
+		entry.Port = params.Port
+	}
+	if err != nil {
+		entry.Outcome = "error"
+		entry.Error = err.Error()
+	}
+	a.record(entry)
+}
+
+// describeClient identifies the client on the other end of conn for the
+// audit log.
+func describeClient(conn net.Conn) string {
+	if uc, ok := conn.(*net.UnixConn); ok {
+		if cred := peerCredentials(uc); cred != "" {
+			return "unix " + cred
+		}
+		return "unix"
+	}
+	return conn.RemoteAddr().Network() + " " + conn.RemoteAddr().String()
+}
+
+func auditCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Args:  noArgs,
+		Short: "Show the audit log",
+		Long: `Show every add, update, remove and stop handled by the daemon, with the
+client that requested it and whether it succeeded.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			domain, _ := cmd.Flags().GetString("domain")
+			tail, _ := cmd.Flags().GetInt("tail")
+
+			path, err := getAuditFile()
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return fmt.Errorf("no audit log at %s", path)
+				}
+				return err
+			}
+			defer f.Close()
+
+			config, err := readConfig()
+			if err != nil {
+				return err
+			}
+			entries, err := readAuditEntries(f, domain, config.suffix())
+			if err != nil {
+				return err
+			}
+			if tail > 0 && len(entries) > tail {
+				entries = entries[len(entries)-tail:]
+			}
+
+			return printResult(cmd, entries, func() {
+				for _, e := range entries {
+					fmt.Println(formatAuditEntry(&e))
+				}
+			})
+		},
+	}
+	cmd.Flags().String("domain", "", "only show entries for this domain")
+	cmd.Flags().IntP("tail", "n", 0, "only show the last n entries")
+	return cmd
+}
+
+func readAuditEntries(r io.Reader, domain, suffix string) ([]AuditEntry, error) {
+	if domain != "" {
+		domain = qualifyDomain(domain, suffix)
+	}
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if domain != "" && qualifyDomain(e.Domain, suffix) != domain {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func formatAuditEntry(e *AuditEntry) string {
+	line := fmt.Sprintf("%s %-8s", e.Time.Local().Format(time.DateTime), e.Action)
+	if e.Domain != "" {
+		line += " " + e.Domain
+	}
+	if e.Port != 0 {
+		line += fmt.Sprintf(" (port %d)", e.Port)
+	}
+	line += fmt.Sprintf(" by %s: %s", e.Client, e.Outcome)
+	if e.Error != "" {
+		line += ": " + strings.TrimSpace(e.Error)
+	}
+	return line
+}
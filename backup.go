@@ -0,0 +1,430 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// backupVersion is the format of backup tarballs. restore refuses newer
+// ones.
+const backupVersion = 1
+
+// maxBackupFileSize bounds each file restore reads from a tarball.
+const maxBackupFileSize = 64 << 20
+
+// Files in a backup besides those copied from the config dir.
+const (
+	backupManifestName = "manifest.json"
+	backupDomainsName  = "domains.json"
+)
+
+// backupManifest describes a backup, as manifest.json in the tarball.
+type backupManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Profile string    `json:"profile,omitempty"`
+	Files   []string  `json:"files"`
+	Domains int       `json:"domains"`
+}
+
+// backupFiles returns the files of the config dir a backup holds, relative
+// to it: the config, tokens, webhooks, the daemon's certificate, Caddy's
+// exported root and the hooks. Logs, the pid file and the socket aren't
+// worth moving to another machine.
+func backupFiles(configDir string) ([]string, error) {
+	names := append([]string{}, configFileNames...)
+	names = append(names, "tokens.json", "webhooks.json", "cert.pem", "key.pem", caddyRootName+".crt")
+	hooks, err := os.ReadDir(filepath.Join(configDir, "hooks"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, hook := range hooks {
+		if hook.Type().IsRegular() {
+			names = append(names, "hooks/"+hook.Name())
+		}
+	}
+
+	var files []string
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(configDir, filepath.FromSlash(name)))
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, name)
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// backupAllowed reports whether restore may write name, from a tarball, to
+// the config dir.
+func backupAllowed(name string) bool {
+	if dir, hook, ok := strings.Cut(name, "/"); ok {
+		return dir == "hooks" && hook != "" && !strings.Contains(hook, "/") && hook != "." && hook != ".."
+	}
+	for _, n := range configFileNames {
+		if name == n {
+			return true
+		}
+	}
+	switch name {
+	case "tokens.json", "webhooks.json", "cert.pem", "key.pem", caddyRootName + ".crt":
+		return true
+	}
+	return false
+}
+
+func backupCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "backup [file]",
+		Args:  rangeArgs(0, 1, "usage: localbase backup [file]"),
+		Short: "Save the config, tokens, certificates and domains to a tarball",
+		Long: `Write a gzipped tarball of the config dir's config file, tokens, webhooks,
+daemon certificate, exported Caddy root and hooks, along with the registered
+domains if the daemon is running, for localbase restore on this or another
+machine. The file defaults to localbase-backup-<time>.tar.gz in the current
+directory; use - for stdout. It holds the daemon's private key, so keep it
+safe.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file := fmt.Sprintf("%s-%s.tar.gz", profileName("localbase-backup"), time.Now().Format("20060102-150405"))
+			if len(args) == 1 {
+				file = args[0]
+			}
+			if file != "-" {
+				if _, err := os.Stat(file); err == nil {
+					return fmt.Errorf("%s already exists", file)
+				}
+			}
+
+			configDir, err := getConfigDir()
+			if err != nil {
+				return err
+			}
+			files, err := backupFiles(configDir)
+			if err != nil {
+				return err
+			}
+			domains, err := listDomains(clientTimeout())
+			if exitCode(err) == ExitDaemonNotRunning {
+				fmt.Fprintln(os.Stderr, "Daemon not running, the backup has no domains")
+			} else if err != nil {
+				return err
+			}
+
+			manifest := &backupManifest{Version: backupVersion, Created: time.Now().UTC(), Profile: profile, Files: files, Domains: len(domains)}
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gz)
+			add := func(name string, data []byte, mode os.FileMode) error {
+				hdr := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(data)), ModTime: manifest.Created, Typeflag: tar.TypeReg}
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				_, err := tw.Write(data)
+				return err
+			}
+
+			data, err := json.MarshalIndent(manifest, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := add(backupManifestName, data, 0644); err != nil {
+				return err
+			}
+			for _, name := range files {
+				path := filepath.Join(configDir, filepath.FromSlash(name))
+				info, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				if err := add(name, data, info.Mode().Perm()); err != nil {
+					return err
+				}
+			}
+			if len(domains) > 0 {
+				data, err := json.MarshalIndent(&ListResult{Domains: domains}, "", "  ")
+				if err != nil {
+					return err
+				}
+				if err := add(backupDomainsName, data, 0600); err != nil {
+					return err
+				}
+			}
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			if err := gz.Close(); err != nil {
+				return err
+			}
+
+			if file == "-" {
+				_, err := os.Stdout.Write(buf.Bytes())
+				return err
+			}
+			if err := writeFileAtomic(file, buf.Bytes(), 0600); err != nil {
+				return err
+			}
+			fmt.Printf("Backed up %d files and %d domains to %s\n", len(files), len(domains), file)
+			return nil
+		},
+	}
+}
+
+// readBackup reads the manifest and files of the tarball in r, refusing
+// anything restore wouldn't write.
+func readBackup(r io.Reader) (*backupManifest, map[string]*tar.Header, map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid backup: %v", err)
+	}
+	defer gz.Close()
+
+	headers := make(map[string]*tar.Header)
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid backup: %v", err)
+		}
+		name := hdr.Name
+		if hdr.Typeflag != tar.TypeReg || path.Clean(name) != name ||
+			(name != backupManifestName && name != backupDomainsName && !backupAllowed(name)) {
+			return nil, nil, nil, fmt.Errorf("invalid backup: unexpected file %s", name)
+		}
+		if _, ok := files[name]; ok {
+			return nil, nil, nil, fmt.Errorf("invalid backup: %s is in it twice", name)
+		}
+		if hdr.Size > maxBackupFileSize {
+			return nil, nil, nil, fmt.Errorf("invalid backup: %s is too large", name)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxBackupFileSize))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid backup: %v", err)
+		}
+		headers[name] = hdr
+		files[name] = data
+	}
+
+	data, ok := files[backupManifestName]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("invalid backup: no %s, not a localbase backup?", backupManifestName)
+	}
+	var manifest backupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid backup: %s: %v", backupManifestName, err)
+	}
+	if manifest.Version < 1 || manifest.Version > backupVersion {
+		return nil, nil, nil, fmt.Errorf("backup version %d is not one this localbase understands (%d), upgrade localbase", manifest.Version, backupVersion)
+	}
+	delete(files, backupManifestName)
+	return &manifest, headers, files, nil
+}
+
+// validateBackup checks that the files of a backup would load: the config
+// is valid, the state files decode and the certificate matches its key.
+func validateBackup(files map[string][]byte) error {
+	dir, err := os.MkdirTemp("", "localbase-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var configs []string
+	for _, name := range configFileNames {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		configs = append(configs, name)
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return err
+		}
+		cfg, _, problems, err := loadConfigFile(path)
+		if err != nil {
+			return fmt.Errorf("invalid %s in backup: %v", name, err)
+		}
+		problems = append(problems, cfg.validate()...)
+		if len(problems) > 0 {
+			return fmt.Errorf("invalid %s in backup: %s", name, strings.Join(problems, "; "))
+		}
+	}
+	if len(configs) > 1 {
+		return fmt.Errorf("invalid backup: it has more than one config file, %s", strings.Join(configs, " and "))
+	}
+
+	for name, key := range map[string]string{"tokens.json": "tokens", "webhooks.json": "webhooks"} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		// Older files are upgraded in place, so they need to be there.
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return err
+		}
+		var list []interface{}
+		if err := decodeStateFile(path, data, key, &list); err != nil {
+			return fmt.Errorf("invalid %s in backup: %v", name, err)
+		}
+	}
+
+	cert, hasCert := files["cert.pem"]
+	key, hasKey := files["key.pem"]
+	switch {
+	case hasCert != hasKey:
+		return fmt.Errorf("invalid backup: cert.pem and key.pem must be restored together")
+	case hasCert:
+		if _, err := tls.X509KeyPair(cert, key); err != nil {
+			return fmt.Errorf("invalid cert.pem or key.pem in backup: %v", err)
+		}
+	}
+
+	if data, ok := files[backupDomainsName]; ok {
+		var list ListResult
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("invalid %s in backup: %v", backupDomainsName, err)
+		}
+	}
+	return nil
+}
+
+func restoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore <file>",
+		Args:  rangeArgs(1, 1, "usage: localbase restore <file>"),
+		Short: "Restore a backup made by localbase backup",
+		Long: `Check a backup made by localbase backup and write its files into the config
+dir. Files that differ from ones already there are only overwritten with
+--force, and nothing is written if any file is invalid. The backup's domains
+are registered if the daemon is running; otherwise start it and restore again,
+which leaves the unchanged files alone. Use - to read from stdin.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			force, _ := cmd.Flags().GetBool("force")
+
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			manifest, headers, files, err := readBackup(r)
+			if err != nil {
+				return err
+			}
+			if err := validateBackup(files); err != nil {
+				return err
+			}
+			if manifest.Profile != profile {
+				fmt.Fprintf(os.Stderr, "Note: the backup is of profile %q, restoring to profile %q\n", manifest.Profile, profile)
+			}
+
+			configDir, err := getConfigDir()
+			if err != nil {
+				return err
+			}
+			var names []string
+			for name := range files {
+				if name != backupDomainsName {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+
+			// A config file of another format would take precedence over,
+			// or be shadowed by, the restored one.
+			var stale []string
+			for _, name := range names {
+				if !strings.HasPrefix(name, "config.") {
+					continue
+				}
+				for _, other := range configFileNames {
+					if _, err := os.Stat(filepath.Join(configDir, other)); other != name && err == nil {
+						stale = append(stale, other)
+					}
+				}
+			}
+
+			changed := make(map[string]bool)
+			conflicts := append([]string{}, stale...)
+			for _, name := range names {
+				existing, err := os.ReadFile(filepath.Join(configDir, filepath.FromSlash(name)))
+				switch {
+				case errors.Is(err, os.ErrNotExist):
+					changed[name] = true
+				case err != nil:
+					return err
+				case !bytes.Equal(existing, files[name]):
+					changed[name] = true
+					conflicts = append(conflicts, name)
+				}
+			}
+			if len(conflicts) > 0 && !force {
+				return fmt.Errorf("%s already in %s, pass --force to overwrite", strings.Join(conflicts, ", "), configDir)
+			}
+
+			for _, name := range names {
+				if !changed[name] {
+					fmt.Printf("%s: unchanged\n", name)
+					continue
+				}
+				perm := headers[name].FileInfo().Mode().Perm()
+				if err := writeFileAtomic(filepath.Join(configDir, filepath.FromSlash(name)), files[name], perm); err != nil {
+					return fmt.Errorf("failed to restore %s: %v", name, err)
+				}
+				fmt.Printf("%s: restored\n", name)
+			}
+			for _, name := range stale {
+				if err := os.Remove(filepath.Join(configDir, name)); err != nil {
+					return err
+				}
+				fmt.Printf("%s: removed\n", name)
+			}
+
+			var list ListResult
+			if data, ok := files[backupDomainsName]; ok {
+				json.Unmarshal(data, &list)
+			}
+			_, err = listDomains(clientTimeout())
+			running := exitCode(err) != ExitDaemonNotRunning
+			if running && len(changed) > 0 {
+				fmt.Println("Restart the daemon to apply the restored files: localbase stop && localbase start")
+			}
+			if len(list.Domains) == 0 {
+				return nil
+			}
+			if !running {
+				fmt.Printf("Daemon not running, start it and run localbase restore %s again to register %d domains\n", args[0], len(list.Domains))
+				return nil
+			}
+			return importDomains(list.Domains)
+		},
+	}
+	cmd.Flags().Bool("force", false, "overwrite files in the config dir that differ from the backup's")
+	return cmd
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func TestBackupAllowed(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"config.json", true},
+		{"config.yaml", true},
+		{"config.toml", true},
+		{"tokens.json", true},
+		{"webhooks.json", true},
+		{"cert.pem", true},
+		{"key.pem", true},
+		{caddyRootName + ".crt", true},
+		{"hooks/pre-add", true},
+		{"localbase.log", false},
+		{"localbase.pid", false},
+		{"audit.log", false},
+		{"hooks/", false},
+		{"hooks/..", false},
+		{"hooks/a/b", false},
+		{"other/pre-add", false},
+		{"../config.json", false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if got := backupAllowed(tt.name); got != tt.want {
+			t.Errorf("backupAllowed(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+type tarEntry struct {
+	name     string
+	data     string
+	typeflag byte
+}
+
+// makeBackup returns a gzipped tarball of entries.
+func makeBackup(t *testing.T, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		typeflag := e.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		hdr := &tar.Header{Name: e.name, Mode: 0600, Size: int64(len(e.data)), Typeflag: typeflag}
+		if typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadBackup(t *testing.T) {
+	manifest := tarEntry{name: backupManifestName, data: `{"version":1,"files":["config.json"],"domains":1}`}
+	tests := []struct {
+		name    string
+		backup  []byte
+		files   []string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			backup: makeBackup(t, manifest,
+				tarEntry{name: "config.json", data: "{}"},
+				tarEntry{name: "hooks/pre-add", data: "#!/bin/sh"},
+				tarEntry{name: backupDomainsName, data: `{"domains":[]}`}),
+			files: []string{backupDomainsName, "config.json", "hooks/pre-add"},
+		},
+		{
+			name:    "not gzip",
+			backup:  []byte("config.json"),
+			wantErr: "invalid backup",
+		},
+		{
+			name:    "no manifest",
+			backup:  makeBackup(t, tarEntry{name: "config.json", data: "{}"}),
+			wantErr: "not a localbase backup",
+		},
+		{
+			name:    "invalid manifest",
+			backup:  makeBackup(t, tarEntry{name: backupManifestName, data: "{"}),
+			wantErr: "invalid backup: manifest.json",
+		},
+		{
+			name:    "newer version",
+			backup:  makeBackup(t, tarEntry{name: backupManifestName, data: `{"version":99}`}),
+			wantErr: "upgrade localbase",
+		},
+		{
+			name:    "unexpected file",
+			backup:  makeBackup(t, manifest, tarEntry{name: "localbase.log", data: "x"}),
+			wantErr: "unexpected file localbase.log",
+		},
+		{
+			name:    "path traversal",
+			backup:  makeBackup(t, manifest, tarEntry{name: "hooks/../../.bashrc", data: "x"}),
+			wantErr: "unexpected file",
+		},
+		{
+			name:    "unclean path",
+			backup:  makeBackup(t, manifest, tarEntry{name: "./config.json", data: "{}"}),
+			wantErr: "unexpected file",
+		},
+		{
+			name:    "symlink",
+			backup:  makeBackup(t, manifest, tarEntry{name: "config.json", typeflag: tar.TypeSymlink}),
+			wantErr: "unexpected file config.json",
+		},
+		{
+			name:    "duplicate",
+			backup:  makeBackup(t, manifest, tarEntry{name: "config.json", data: "{}"}, tarEntry{name: "config.json", data: "{}"}),
+			wantErr: "config.json is in it twice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, headers, files, err := readBackup(bytes.NewReader(tt.backup))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Version != 1 || m.Domains != 1 {
+				t.Errorf("got manifest %+v", m)
+			}
+			for _, name := range tt.files {
+				if _, ok := files[name]; !ok {
+					t.Errorf("%s is missing", name)
+				}
+				if headers[name] == nil {
+					t.Errorf("%s has no header", name)
+				}
+			}
+			if len(files) != len(tt.files) {
+				t.Errorf("got %d files, want %d", len(files), len(tt.files))
+			}
+			if _, ok := files[backupManifestName]; ok {
+				t.Errorf("the manifest is returned as a file")
+			}
+		})
+	}
+}
@@ -4,14 +4,168 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// caddyClient talks to the Caddy admin API. Its timeout is set from the
+// config when the daemon starts.
+var caddyClient = &http.Client{Timeout: defaultCaddyTimeout, Transport: newCaddyTransport()}
+
+// caddyOrigin is the Origin sent to the Caddy admin API, whose host is
+// also sent as the Host. Empty means the admin address. It is set from the
+// config when the daemon starts.
+var caddyOrigin string
+
+// errCaddyOrigin is returned when Caddy's admin API rejects localbase's
+// Origin or Host, as Caddy does when its admin config sets origins.
+var errCaddyOrigin = errors.New("caddy rejected localbase's origin, set caddy_origin (--caddy-origin) to one of the origins in caddy's admin config")
+
+// caddySocketKey is the context key of the unix socket a Caddy admin
+// request is dialed over.
+type caddySocketKey struct{}
+
+// newCaddyTransport returns a transport that dials the unix socket set on
+// a request's context by newCaddyRequest, and TCP otherwise.
+func newCaddyTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	var d net.Dialer
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if socket, ok := ctx.Value(caddySocketKey{}).(string); ok {
+			return d.DialContext(ctx, "unix", socket)
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	return t
+}
+
+// newCaddyRequest builds a request for path on the Caddy admin API at
+// caddyAdmin, which is an http URL or, as in Caddy's own config, a unix
+// socket address such as unix//run/caddy/admin.sock.
+func newCaddyRequest(ctx context.Context, caddyAdmin, method, path string, body io.Reader) (*http.Request, error) {
+	target := caddyAdmin + path
+	if socket, ok := caddySocket(caddyAdmin); ok {
+		// Caddy only accepts a few Host values over its socket, localhost
+		// among them.
+		ctx = context.WithValue(ctx, caddySocketKey{}, socket)
+		target = "http://localhost" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Caddy requires an allowed Origin when its admin config enforces
+	// origins, and otherwise ignores it.
+	origin := req.URL.Scheme + "://" + req.URL.Host
+	if caddyOrigin != "" {
+		origin = caddyOrigin
+		if u, err := url.Parse(caddyOrigin); err == nil && u.Host != "" {
+			req.Host = u.Host
+		}
+	}
+	req.Header.Set("Origin", origin)
+	return req, nil
+}
+
+// caddyOriginErrors start the errors Caddy's admin API rejects a request's
+// Host or Origin with.
+var caddyOriginErrors = []string{
+	"host not allowed: ",
+	"required Origin header is missing or invalid",
+	"client is not allowed to access from origin ",
+}
+
+// caddyDo sends req to the Caddy admin API, turning Caddy's rejection of
+// the Origin or Host into errCaddyOrigin.
+func caddyDo(req *http.Request) (*http.Response, error) {
+	resp, err := caddyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(resp.Body)
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(msg, &body) == nil {
+		for _, prefix := range caddyOriginErrors {
+			if strings.HasPrefix(body.Error, prefix) {
+				return nil, fmt.Errorf("%w: %s", errCaddyOrigin, body.Error)
+			}
+		}
+	}
+	return nil, fmt.Errorf("caddy refused %s %s: %s", req.Method, req.URL.Path, bytes.TrimSpace(msg))
+}
+
+// caddySocket returns the socket path of a unix admin address. Caddy
+// allows file mode bits after a "|", which aren't part of the path.
+func caddySocket(caddyAdmin string) (string, bool) {
+	if !strings.HasPrefix(caddyAdmin, "unix/") {
+		return "", false
+	}
+	socket := strings.TrimPrefix(caddyAdmin, "unix/")
+	if i := strings.LastIndex(socket, "|"); i >= 0 {
+		socket = socket[:i]
+	}
+	return socket, true
+}
+
+// caddyGet fetches path from the Caddy admin API.
+func caddyGet(caddyAdmin, path string) (*http.Response, error) {
+	req, err := newCaddyRequest(context.Background(), caddyAdmin, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return caddyDo(req)
+}
+
+// Localbase keeps its routes in its own Caddy servers and tags the servers
+// and every route it creates with an @id, so it never changes Caddy config
+// it didn't create. Route IDs are caddyIDPrefix + domain + ":" + index,
+// as Caddy's /id/ API doesn't allow slashes in IDs.
+const (
+	caddyServerKey     = "localbase"
+	caddyServerID      = "localbase"
+	caddyHTTPServerKey = "localbase_http"
+	caddyHTTPServerID  = "localbase_http"
+	caddyIDPrefix      = "localbase:"
+)
+
+func caddyRouteID(domain string, i int) string {
+	return fmt.Sprintf("%s%s:%d", caddyIDPrefix, domain, i)
+}
+
+// caddyID returns the @id of a Caddy config object, or "".
+func caddyID(v interface{}) string {
+	obj, _ := v.(map[string]interface{})
+	id, _ := obj["@id"].(string)
+	return id
+}
+
+// routeOwnedBy reports whether route is one localbase created for domain.
+func routeOwnedBy(route interface{}, domain string) bool {
+	return strings.HasPrefix(caddyID(route), caddyIDPrefix+domain+":")
+}
+
 func getCaddyConfig(caddyAdmin string) (map[string]interface{}, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/config/", caddyAdmin))
+	resp, err := caddyGet(caddyAdmin, "/config/")
 	if err != nil {
 		return nil, err
 	}
@@ -30,116 +184,902 @@ func getCaddyConfig(caddyAdmin string) (map[string]interface{}, error) {
 	return config, nil
 }
 
-func addCaddyServerBlock(domains []string, port int, caddyAdmin string) error {
-	config, err := getCaddyConfig(caddyAdmin)
+// addCaddyServerBlock appends the routes serving hosts to localbase's Caddy
+// servers, creating the servers if needed. hosts[0] is the domain. Routes
+// left over for the domain, say from before the daemon restarted, are
+// deleted first since Caddy rejects duplicate IDs.
+func addCaddyServerBlock(hosts []string, port int, opts *RouteOptions, cfg *Config) error {
+	servers, err := ensureCaddyServers(cfg)
 	if err != nil {
 		return err
 	}
+	for _, server := range servers {
+		routes, _ := server["routes"].([]interface{})
+		errs, _ := server["errors"].(map[string]interface{})
+		errorRoutes, _ := errs["routes"].([]interface{})
+		for _, r := range append(routes, errorRoutes...) {
+			if !routeOwnedBy(r, hosts[0]) {
+				continue
+			}
+			err := caddyRequest(cfg.CaddyAdmin, http.MethodDelete, "/id/"+caddyID(r), nil, nil)
+			if err != nil && err != errCaddyNotFound {
+				return err
+			}
+		}
+	}
+	serverID := caddyRouteServer(opts)
+	if opts.AccessLog {
+		if err := setCaddyAccessLog(cfg.CaddyAdmin, serverID, hosts); err != nil {
+			return err
+		}
+	}
+	if err := setCaddyTLSPolicy(cfg.CaddyAdmin, hosts, opts); err != nil {
+		return err
+	}
+	if err := caddyRequest(cfg.CaddyAdmin, http.MethodPost, "/id/"+serverID+"/routes/...", buildRoutes(hosts, port, opts), nil); err != nil {
+		return err
+	}
+	if route := buildRedirectRoute(hosts, cfg.httpsPort(), opts); route != nil {
+		if err := caddyRequest(cfg.CaddyAdmin, http.MethodPost, "/id/"+caddyHTTPServerID+"/routes", route, nil); err != nil {
+			return err
+		}
+	}
+	return setCaddyErrorRoute(cfg.CaddyAdmin, hosts, port, opts)
+}
 
-	// Ensure the config structure is initialized
-	if config == nil {
-		config = make(map[string]interface{})
+// caddyServer is one of localbase's Caddy servers.
+type caddyServer struct {
+	key, id   string
+	listen    []string
+	protocols []string
+	autoHTTPS map[string]interface{}
+}
+
+// caddyServers returns localbase's Caddy servers: one serving HTTPS on the
+// HTTPS port, and a plain one on the HTTP port, serving --no-tls domains
+// and redirecting the others to HTTPS. Caddy serves TLS on every listener
+// of a server with certificates except the http app's http_port, which
+// other servers share, so the HTTP port gets a server without automatic
+// HTTPS instead of changing it.
+func caddyServers(cfg *Config) []caddyServer {
+	protocols := []string{"h1", "h2", "h3"}
+	if cfg.DisableHTTP3 {
+		protocols = []string{"h1", "h2"}
+	}
+	return []caddyServer{
+		{
+			key:       caddyServerKey,
+			id:        caddyServerID,
+			listen:    []string{fmt.Sprintf(":%d", cfg.httpsPort())},
+			protocols: protocols,
+			// Caddy would redirect to HTTPS on http_port, which
+			// localbase's HTTP server does itself.
+			autoHTTPS: map[string]interface{}{"disable_redirects": true},
+		},
+		{
+			key:       caddyHTTPServerKey,
+			id:        caddyHTTPServerID,
+			listen:    []string{fmt.Sprintf(":%d", cfg.httpPort())},
+			autoHTTPS: map[string]interface{}{"disable": true},
+		},
 	}
+}
 
-	if _, ok := config["apps"]; !ok {
-		config["apps"] = make(map[string]interface{})
+// caddyRouteServer returns the ID of the server with the routes of a
+// domain added with opts.
+func caddyRouteServer(opts *RouteOptions) string {
+	if opts.NoTLS {
+		return caddyHTTPServerID
 	}
+	return caddyServerID
+}
 
-	apps := config["apps"].(map[string]interface{})
-	if _, ok := apps["http"]; !ok {
-		apps["http"] = make(map[string]interface{})
+// ensureCaddyServers creates localbase's Caddy servers if they don't
+// exist, and keeps their listeners, protocols and automatic HTTPS in line
+// with the config. It returns the servers as they were by ID, leaving out
+// those just created.
+func ensureCaddyServers(cfg *Config) (map[string]map[string]interface{}, error) {
+	servers := make(map[string]map[string]interface{})
+	for _, s := range caddyServers(cfg) {
+		server, err := ensureCaddyServer(cfg.CaddyAdmin, s)
+		if err != nil {
+			return nil, err
+		}
+		if server != nil {
+			servers[s.id] = server
+		}
 	}
+	return servers, nil
+}
 
-	httpApp := apps["http"].(map[string]interface{})
-	if _, ok := httpApp["servers"]; !ok {
-		httpApp["servers"] = make(map[string]interface{})
+// ensureCaddyServer creates s if it doesn't exist, or updates the settings
+// of it that differ. It returns the server as it was, or nil if it was just
+// created.
+func ensureCaddyServer(caddyAdmin string, s caddyServer) (map[string]interface{}, error) {
+	var server map[string]interface{}
+	err := caddyRequest(caddyAdmin, http.MethodGet, "/id/"+s.id, nil, &server)
+	if err == errCaddyNotFound && s.id == caddyServerID {
+		server, err = adoptLegacyServer(caddyAdmin)
+	}
+	if err != nil && err != errCaddyNotFound {
+		return nil, err
+	}
+	if server == nil {
+		created := map[string]interface{}{
+			"@id":             s.id,
+			"listen":          s.listen,
+			"automatic_https": s.autoHTTPS,
+			"routes":          []interface{}{},
+			"errors":          map[string]interface{}{"routes": []interface{}{}},
+			"logs":            newCaddyServerLogs(),
+		}
+		if s.protocols != nil {
+			created["protocols"] = s.protocols
+		}
+		return nil, caddyRequest(caddyAdmin, http.MethodPut, "/config/apps/http/servers/"+s.key, created, nil)
 	}
 
-	servers := httpApp["servers"].(map[string]interface{})
-	serverName := "default"
-	if existingServer, ok := servers[serverName]; ok {
-		server := existingServer.(map[string]interface{})
-		routes := server["routes"].([]interface{})
+	if !reflect.DeepEqual(server["listen"], toInterfaces(s.listen)) {
+		if err := caddySet(caddyAdmin, "/id/"+s.id+"/listen", s.listen); err != nil {
+			return nil, err
+		}
+	}
+	if s.protocols != nil && !reflect.DeepEqual(server["protocols"], toInterfaces(s.protocols)) {
+		if err := caddySet(caddyAdmin, "/id/"+s.id+"/protocols", s.protocols); err != nil {
+			return nil, err
+		}
+	}
+	// This also drops the skip list older versions kept --no-tls hosts in.
+	if !sameJSON(server["automatic_https"], s.autoHTTPS) {
+		if err := caddySet(caddyAdmin, "/id/"+s.id+"/automatic_https", s.autoHTTPS); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := server["errors"]; !ok {
+		if err := caddySet(caddyAdmin, "/id/"+s.id+"/errors", map[string]interface{}{"routes": []interface{}{}}); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := server["logs"]; !ok {
+		if err := caddySet(caddyAdmin, "/id/"+s.id+"/logs", newCaddyServerLogs()); err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
+}
 
-		for _, domain := range domains {
-			routes = append(routes, map[string]interface{}{
-				"match": []map[string]interface{}{
-					{"host": []string{domain}},
-				},
-				"handle": []map[string]interface{}{
-					{
-						"handler": "reverse_proxy",
-						"upstreams": []map[string]interface{}{
-							{"dial": fmt.Sprintf("localhost:%d", port)},
-						},
-					},
+// newCaddyServerLogs returns the logs config of localbase's server, which
+// only logs hosts added with access logging.
+func newCaddyServerLogs() map[string]interface{} {
+	return map[string]interface{}{
+		"skip_unmapped_hosts": true,
+		"logger_names":        map[string]interface{}{},
+	}
+}
+
+func toInterfaces(s []string) []interface{} {
+	v := make([]interface{}, len(s))
+	for i := range s {
+		v[i] = s[i]
+	}
+	return v
+}
+
+// adoptLegacyServer moves the "default" server older versions of localbase
+// created to localbase's own key and tags it, so its routes keep working.
+// It returns the adopted server, or nil if there was none.
+func adoptLegacyServer(caddyAdmin string) (map[string]interface{}, error) {
+	var servers map[string]interface{}
+	if err := caddyRequest(caddyAdmin, http.MethodGet, "/config/apps/http/servers", nil, &servers); err != nil {
+		// The http app doesn't exist yet.
+		return nil, nil
+	}
+	legacy, ok := servers["default"].(map[string]interface{})
+	if !ok || caddyID(legacy) != "" {
+		return nil, nil
+	}
+	listen, _ := legacy["listen"].([]interface{})
+	if len(listen) != 2 || listen[0] != ":80" || listen[1] != ":443" {
+		return nil, nil
+	}
+
+	legacy["@id"] = caddyServerID
+	servers[caddyServerKey] = legacy
+	delete(servers, "default")
+	// One update for the servers, so Caddy never sees both or neither.
+	if err := caddyRequest(caddyAdmin, http.MethodPatch, "/config/apps/http/servers", servers, nil); err != nil {
+		return nil, err
+	}
+	return legacy, nil
+}
+
+// caddyLocalSuffixes are the suffixes Caddy already gets certificates for
+// from its local CA. For any other name it would try a public CA.
+var caddyLocalSuffixes = []string{".localhost", ".local", ".internal", ".home.arpa"}
+
+func caddyTLSPolicyID(domain string) string {
+	return caddyIDPrefix + domain + ":tls"
+}
+
+// buildTLSPolicy returns the TLS automation policy having Caddy's local CA
+// issue certificates for those of hosts it would otherwise get from a
+// public CA, such as hello.test, or nil if there are none.
+func buildTLSPolicy(hosts []string, opts *RouteOptions) map[string]interface{} {
+	if opts.NoTLS {
+		return nil
+	}
+	var subjects []string
+	for _, h := range hosts {
+		local := h == "localhost"
+		for _, suffix := range caddyLocalSuffixes {
+			local = local || strings.HasSuffix(h, suffix)
+		}
+		if !local {
+			subjects = append(subjects, h)
+		}
+	}
+	if len(subjects) == 0 {
+		return nil
+	}
+	return map[string]interface{}{
+		"@id":      caddyTLSPolicyID(hosts[0]),
+		"subjects": subjects,
+		"issuers":  []interface{}{map[string]interface{}{"module": "internal"}},
+	}
+}
+
+// setCaddyTLSPolicy replaces the TLS automation policy of hosts. The policy
+// goes first, since Caddy uses the first policy matching a name.
+func setCaddyTLSPolicy(caddyAdmin string, hosts []string, opts *RouteOptions) error {
+	err := caddyRequest(caddyAdmin, http.MethodDelete, "/id/"+caddyTLSPolicyID(hosts[0]), nil, nil)
+	if err != nil && err != errCaddyNotFound {
+		return err
+	}
+	policy := buildTLSPolicy(hosts, opts)
+	if policy == nil {
+		return nil
+	}
+
+	var tlsApp map[string]interface{}
+	if err := caddyRequest(caddyAdmin, http.MethodGet, "/config/apps/tls", nil, &tlsApp); err != nil {
+		return err
+	}
+	automation, _ := tlsApp["automation"].(map[string]interface{})
+	policies, _ := automation["policies"].([]interface{})
+	switch {
+	case tlsApp == nil:
+		return caddyRequest(caddyAdmin, http.MethodPut, "/config/apps/tls", map[string]interface{}{
+			"automation": map[string]interface{}{"policies": []interface{}{policy}},
+		}, nil)
+	case automation == nil:
+		return caddyRequest(caddyAdmin, http.MethodPut, "/config/apps/tls/automation", map[string]interface{}{
+			"policies": []interface{}{policy},
+		}, nil)
+	case policies == nil:
+		return caddyRequest(caddyAdmin, http.MethodPut, "/config/apps/tls/automation/policies", []interface{}{policy}, nil)
+	default:
+		// PUT to an index inserts before it.
+		return caddyRequest(caddyAdmin, http.MethodPut, "/config/apps/tls/automation/policies/0", policy, nil)
+	}
+}
+
+// setCaddyAccessLog has Caddy log requests for hosts to the access log
+// file of the first host. Caddy writes and rolls the file itself.
+// serverID is the server with the routes of hosts.
+func setCaddyAccessLog(caddyAdmin, serverID string, hosts []string) error {
+	path, err := getAccessLogFile(hosts[0])
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	name := caddyLoggerName(hosts[0])
+
+	if err := caddySet(caddyAdmin, "/config/logging/logs/"+name, map[string]interface{}{
+		"writer":  map[string]interface{}{"output": "file", "filename": path},
+		"encoder": map[string]interface{}{"format": "json"},
+		"include": []string{"http.log.access." + name},
+	}); err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if err := caddySet(caddyAdmin, "/id/"+serverID+"/logs/logger_names/"+host, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func caddyLoggerName(domain string) string {
+	return "localbase_" + strings.ReplaceAll(domain, ".", "_")
+}
+
+// replaceCaddyRoutes swaps the routes serving hosts for freshly built ones
+// in place, by their IDs. hosts[0] is the domain.
+func replaceCaddyRoutes(hosts []string, port int, opts *RouteOptions, caddyAdmin string) error {
+	for _, route := range buildRoutes(hosts, port, opts) {
+		err := caddyRequest(caddyAdmin, http.MethodPatch, "/id/"+caddyID(route), route, nil)
+		if err == errCaddyNotFound {
+			// Caddy lost the route, so add it back.
+			err = caddyRequest(caddyAdmin, http.MethodPost, "/id/"+caddyRouteServer(opts)+"/routes", route, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return setCaddyErrorRoute(caddyAdmin, hosts, port, opts)
+}
+
+// removeCaddyRoutes deletes the routes serving hosts, and their access log
+// config. Routes that are already gone are skipped.
+func removeCaddyRoutes(hosts []string, opts *RouteOptions, caddyAdmin string) error {
+	for _, route := range buildRoutes(hosts, 0, opts) {
+		err := caddyRequest(caddyAdmin, http.MethodDelete, "/id/"+caddyID(route), nil, nil)
+		if err != nil && err != errCaddyNotFound {
+			return err
+		}
+	}
+	if opts.AccessLog {
+		// Best effort: a leftover logger does no harm.
+		for _, host := range hosts {
+			caddyRequest(caddyAdmin, http.MethodDelete, "/id/"+caddyRouteServer(opts)+"/logs/logger_names/"+host, nil, nil)
+		}
+		caddyRequest(caddyAdmin, http.MethodDelete, "/config/logging/logs/"+caddyLoggerName(hosts[0]), nil, nil)
+	}
+	for _, id := range []string{caddyRedirectRouteID(hosts[0]), caddyErrorRouteID(hosts[0]), caddyTLSPolicyID(hosts[0])} {
+		err := caddyRequest(caddyAdmin, http.MethodDelete, "/id/"+id, nil, nil)
+		if err != nil && err != errCaddyNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// errCaddyNotFound is returned by caddyRequest for unknown object IDs.
+var errCaddyNotFound = errors.New("not found in Caddy config")
+
+// caddyRequest sends a request for the config at path, such as
+// /id/localbase/routes, to the Caddy admin API. body is sent as JSON
+// unless nil, and the response is decoded into out unless out is nil.
+func caddyRequest(caddyAdmin, method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := newCaddyRequest(context.Background(), caddyAdmin, method, path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := caddyDo(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/id/") {
+		return errCaddyNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to update Caddy config: %s %s: %s", method, path, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// caddySet sets the config at path whether or not it exists. PATCH
+// replaces existing values, and PUT creates missing ones along with their
+// parents.
+func caddySet(caddyAdmin, path string, value interface{}) error {
+	if err := caddyRequest(caddyAdmin, http.MethodPatch, path, value, nil); err == nil {
+		return nil
+	}
+	return caddyRequest(caddyAdmin, http.MethodPut, path, value, nil)
+}
+
+// buildRoutes returns the Caddy routes serving hosts, tagged with IDs for
+// hosts[0]. Path routes come first so they take precedence over the
+// catch-all route to port.
+func buildRoutes(hosts []string, port int, opts *RouteOptions) []interface{} {
+	var routes []interface{}
+
+	// Response headers are changed by a deferred headers handler rather
+	// than the proxy, so headers Caddy adds itself, like Server, can be
+	// removed too.
+	// CORS comes first since browsers send preflight requests without
+	// credentials.
+	var first []map[string]interface{}
+	if len(opts.CORS) > 0 {
+		first = append(first, corsHandler(opts.CORS))
+	}
+	if len(opts.BasicAuth) > 0 {
+		accounts := make([]map[string]interface{}, len(opts.BasicAuth))
+		for i, acct := range opts.BasicAuth {
+			accounts[i] = map[string]interface{}{"username": acct.Username, "password": acct.Password}
+		}
+		first = append(first, map[string]interface{}{
+			"handler": "authentication",
+			"providers": map[string]interface{}{
+				"http_basic": map[string]interface{}{
+					"hash":     map[string]interface{}{"algorithm": "bcrypt"},
+					"accounts": accounts,
+					"realm":    "localbase",
 				},
+			},
+		})
+	}
+	if ops := caddyHeaderOps(opts.ResponseHeaders); ops != nil {
+		ops["deferred"] = true
+		first = append(first, map[string]interface{}{"handler": "headers", "response": ops})
+	}
+	if len(opts.Rewrites) > 0 {
+		first = append(first, rewriteHandler(opts.Rewrites))
+	}
+	if opts.Compress {
+		first = append(first, map[string]interface{}{
+			"handler": "encode",
+			"encodings": map[string]interface{}{
+				"zstd": map[string]interface{}{},
+				"gzip": map[string]interface{}{},
+			},
+			"prefer": []string{"zstd", "gzip"},
+		})
+	}
+
+	for _, pr := range opts.Routes {
+		handle := append([]map[string]interface{}{}, first...)
+		if !pr.KeepPrefix {
+			handle = append(handle, map[string]interface{}{
+				"handler":           "rewrite",
+				"strip_path_prefix": pr.Path,
 			})
 		}
+		handle = append(handle, reverseProxyHandler([]int{pr.Port}, opts))
+
+		routes = append(routes, map[string]interface{}{
+			"match": []map[string]interface{}{
+				{"host": hosts, "path": []string{pr.Path, pr.Path + "/*"}},
+			},
+			"handle": handle,
+		})
+	}
+
+	routes = append(routes, map[string]interface{}{
+		"match": []map[string]interface{}{
+			{"host": hosts},
+		},
+		"handle": append(first, mainHandler(port, opts)),
+	})
+
+	if !opts.ExposeLAN {
+		ranges := localRanges()
+		for _, r := range routes {
+			for _, m := range r.(map[string]interface{})["match"].([]map[string]interface{}) {
+				m["remote_ip"] = map[string]interface{}{"ranges": ranges}
+			}
+		}
+	}
+
+	for i, r := range routes {
+		route := r.(map[string]interface{})
+		if opts.Caddy != nil {
+			mergeCaddyRoute(route, opts.Caddy)
+		}
+		route["@id"] = caddyRouteID(hosts[0], i)
+	}
+
+	// Other devices get a 403 rather than falling through to whatever
+	// else Caddy serves.
+	if !opts.ExposeLAN {
+		routes = append(routes, map[string]interface{}{
+			"@id": caddyRouteID(hosts[0], len(routes)),
+			"match": []map[string]interface{}{
+				{"host": hosts},
+			},
+			"handle": []map[string]interface{}{{
+				"handler":     "static_response",
+				"status_code": http.StatusForbidden,
+				"body":        localOnlyMessage(hosts[0]) + "\n",
+			}},
+		})
+	}
+
+	return routes
+}
+
+// localOnlyMessage is the body of the 403 other devices get for a domain
+// not exposed to the LAN.
+func localOnlyMessage(domain string) string {
+	return domain + " is only served to the machine running localbase, add it with --expose-lan or run localbase share to reach it from other devices"
+}
+
+// localRanges returns the addresses requests from this machine come from:
+// loopback, every address of its interfaces, and the subnets of the bridges
+// mDNS is reflected onto, whose containers and VMs count as this machine.
+func localRanges() []string {
+	ranges := []string{"127.0.0.0/8", "::1/128"}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			ranges = append(ranges, ip4.String()+"/32")
+		} else {
+			ranges = append(ranges, ipnet.IP.String()+"/128")
+		}
+	}
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if !matchInterface(reflectInterfaces, iface.Name) {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			subnet := &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+			ranges = appendUnique(ranges, subnet.String())
+		}
+	}
+	sort.Strings(ranges[2:])
+	return ranges
+}
+
+func caddyRedirectRouteID(domain string) string {
+	return caddyIDPrefix + domain + ":redirect"
+}
+
+// buildRedirectRoute returns the route of localbase's HTTP server
+// redirecting hosts to HTTPS on httpsPort, as Caddy does on its own, or nil
+// for --no-tls domains.
+func buildRedirectRoute(hosts []string, httpsPort int, opts *RouteOptions) map[string]interface{} {
+	if opts.NoTLS {
+		return nil
+	}
+	port := ""
+	if httpsPort != 443 {
+		port = fmt.Sprintf(":%d", httpsPort)
+	}
+	return map[string]interface{}{
+		"@id":   caddyRedirectRouteID(hosts[0]),
+		"match": []map[string]interface{}{{"host": hosts}},
+		"handle": []map[string]interface{}{{
+			"handler":     "static_response",
+			"status_code": http.StatusPermanentRedirect,
+			"headers": map[string][]string{
+				"Location": {"https://{http.request.host}" + port + "{http.request.uri}"},
+			},
+		}},
+		"terminal": true,
+	}
+}
+
+func caddyErrorRouteID(domain string) string {
+	return caddyIDPrefix + domain + ":error"
+}
+
+// setCaddyErrorRoute replaces the error route of hosts, which is in the
+// server's errors routes rather than its routes, removing it for static
+// domains.
+func setCaddyErrorRoute(caddyAdmin string, hosts []string, port int, opts *RouteOptions) error {
+	route := buildErrorRoute(hosts, port, opts)
+	if route == nil {
+		err := caddyRequest(caddyAdmin, http.MethodDelete, "/id/"+caddyErrorRouteID(hosts[0]), nil, nil)
+		if err == errCaddyNotFound {
+			return nil
+		}
+		return err
+	}
+	err := caddyRequest(caddyAdmin, http.MethodPatch, "/id/"+caddyID(route), route, nil)
+	if err == errCaddyNotFound {
+		err = caddyRequest(caddyAdmin, http.MethodPost, "/id/"+caddyRouteServer(opts)+"/errors/routes", route, nil)
+	}
+	return err
+}
+
+// errorPage is shown instead of Caddy's empty 502 when a domain's upstream
+// isn't running. It is a Caddy placeholder template, so it avoids braces.
+const errorPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>%[1]s is not running</title></head>
+<body style="font-family: system-ui, sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #222">
+<h1 style="font-size: 1.4em">%[1]s is registered but nothing is listening on %[2]s</h1>
+<p>Start your app, or remove the domain with <code>localbase remove %[3]s</code>.</p>
+<p style="color: #888; font-size: 0.9em">localbase &middot; {http.error.status_code} {http.error.status_text}</p>
+</body>
+</html>
+`
+
+// buildErrorRoute returns the error route that shows errorPage for hosts
+// when their upstream can't be reached, or nil for static domains.
+func buildErrorRoute(hosts []string, port int, opts *RouteOptions) map[string]interface{} {
+	if opts.Dir != "" {
+		return nil
+	}
+	return map[string]interface{}{
+		"@id": caddyErrorRouteID(hosts[0]),
+		"match": []map[string]interface{}{{
+			"host":       hosts,
+			"expression": "{http.error.status_code} in [502, 503, 504]",
+		}},
+		"handle": []map[string]interface{}{{
+			"handler":     "static_response",
+			"status_code": "{http.error.status_code}",
+			"headers":     map[string][]string{"Content-Type": {"text/html; charset=utf-8"}},
+			"body":        errorPageBody(hosts[0], port, opts),
+		}},
+	}
+}
 
-		server["routes"] = routes
-		servers[serverName] = server
-	} else {
-		newRoutes := []interface{}{}
-		for _, domain := range domains {
-			newRoutes = append(newRoutes, map[string]interface{}{
-				"match": []map[string]interface{}{
-					{"host": []string{domain}},
+// errorPageBody returns errorPage for domain, naming the ports it proxies
+// to.
+func errorPageBody(domain string, port int, opts *RouteOptions) string {
+	ports := append([]int{port}, opts.ExtraPorts...)
+	for _, pr := range opts.Routes {
+		ports = append(ports, pr.Port)
+	}
+	where := "port " + strconv.Itoa(port)
+	if len(ports) > 1 {
+		where = "ports " + joinPorts(ports)
+	}
+	return fmt.Sprintf(errorPage, html.EscapeString(domain), where, html.EscapeString(domainLabel(domain)))
+}
+
+// rewriteHandler returns a handler applying the first of rewrites whose
+// From matches the request path. Only the path changes; the query is kept.
+func rewriteHandler(rewrites []Rewrite) map[string]interface{} {
+	routes := make([]map[string]interface{}, len(rewrites))
+	for i, rw := range rewrites {
+		rewrite := map[string]interface{}{"handler": "rewrite", "uri": rw.To}
+		if strings.HasSuffix(rw.From, "*") {
+			from := strings.TrimSuffix(rw.From, "*")
+			rewrite = map[string]interface{}{
+				"handler": "rewrite",
+				"path_regexp": []map[string]interface{}{
+					{"find": "^" + regexp.QuoteMeta(from), "replace": strings.TrimSuffix(rw.To, "*")},
 				},
+			}
+		}
+		routes[i] = map[string]interface{}{
+			"match":    []map[string]interface{}{{"path": []string{rw.From}}},
+			"handle":   []map[string]interface{}{rewrite},
+			"terminal": true,
+		}
+	}
+	return map[string]interface{}{"handler": "subroute", "routes": routes}
+}
+
+// corsHandler returns a handler that adds CORS headers to responses to
+// requests from origins, and answers preflight requests. Caddy's header
+// matcher treats "*" as any value. A specific origin is echoed back, and
+// allowed to send credentials.
+func corsHandler(origins []string) map[string]interface{} {
+	allow := map[string][]string{"Access-Control-Allow-Origin": {"*"}}
+	if origins[0] != "*" {
+		allow = map[string][]string{
+			"Access-Control-Allow-Origin":      {"{http.request.header.Origin}"},
+			"Access-Control-Allow-Credentials": {"true"},
+			"Vary":                             {"Origin"},
+		}
+	}
+
+	return map[string]interface{}{
+		"handler": "subroute",
+		"routes": []map[string]interface{}{
+			{
+				// Deferred so the upstream's own CORS headers are
+				// replaced rather than duplicated.
+				"match": []map[string]interface{}{{"header": map[string][]string{"Origin": origins}}},
+				"handle": []map[string]interface{}{{
+					"handler":  "headers",
+					"response": map[string]interface{}{"set": allow, "deferred": true},
+				}},
+			},
+			{
+				"match": []map[string]interface{}{{
+					"method": []string{http.MethodOptions},
+					"header": map[string][]string{"Origin": origins, "Access-Control-Request-Method": {"*"}},
+				}},
 				"handle": []map[string]interface{}{
 					{
-						"handler": "reverse_proxy",
-						"upstreams": []map[string]interface{}{
-							{"dial": fmt.Sprintf("localhost:%d", port)},
-						},
+						"handler": "headers",
+						"response": map[string]interface{}{"set": map[string][]string{
+							"Access-Control-Allow-Methods": {"GET, POST, PUT, PATCH, DELETE, OPTIONS"},
+							"Access-Control-Allow-Headers": {"{http.request.header.Access-Control-Request-Headers}"},
+							"Access-Control-Max-Age":       {"86400"},
+						}},
 					},
+					{"handler": "static_response", "status_code": http.StatusNoContent},
 				},
-			})
+			},
+		},
+	}
+}
+
+// mergeCaddyRoute merges user-provided route JSON into a generated route.
+// The snippet has been checked by validateRouteOptions.
+func mergeCaddyRoute(route, snippet map[string]interface{}) {
+	for key, value := range snippet {
+		switch key {
+		case "match":
+			for _, m := range route["match"].([]map[string]interface{}) {
+				for k, v := range value.(map[string]interface{}) {
+					m[k] = v
+				}
+			}
+		case "handle":
+			handle := append([]interface{}{}, value.([]interface{})...)
+			for _, h := range route["handle"].([]map[string]interface{}) {
+				handle = append(handle, h)
+			}
+			route["handle"] = handle
+		default:
+			route[key] = value
+		}
+	}
+}
+
+// mainHandler returns the handler for requests not matched by a path
+// route: a file server for static domains, otherwise a proxy to port.
+func mainHandler(port int, opts *RouteOptions) map[string]interface{} {
+	if opts.Dir != "" {
+		return map[string]interface{}{
+			"handler": "file_server",
+			"root":    opts.Dir,
+		}
+	}
+	handler := reverseProxyHandler(append([]int{port}, opts.ExtraPorts...), opts)
+	if hc := opts.HealthCheck; hc != nil {
+		active := map[string]interface{}{"uri": hc.Path}
+		if hc.Interval != "" {
+			active["interval"] = hc.Interval
+		}
+		if hc.Status != 0 {
+			active["expect_status"] = hc.Status
+		}
+		handler["health_checks"] = map[string]interface{}{
+			"active": active,
+			// Passive checks count failed requests, which Caddy reports
+			// per upstream.
+			"passive": map[string]interface{}{"fail_duration": "30s"},
 		}
+	}
+	return handler
+}
 
-		servers[serverName] = map[string]interface{}{
-			"listen": []string{":80", ":443"},
-			"routes": newRoutes,
+func reverseProxyHandler(ports []int, opts *RouteOptions) map[string]interface{} {
+	upstreams := make([]map[string]interface{}, len(ports))
+	for i, port := range ports {
+		upstreams[i] = map[string]interface{}{"dial": fmt.Sprintf("localhost:%d", port)}
+	}
+	handler := map[string]interface{}{
+		"handler":   "reverse_proxy",
+		"upstreams": upstreams,
+	}
+	if len(ports) > 1 && opts.LBPolicy != "" {
+		handler["load_balancing"] = map[string]interface{}{
+			"selection_policy": map[string]interface{}{"policy": opts.LBPolicy},
 		}
 	}
 
-	jsonData, err := json.Marshal(config)
-	if err != nil {
-		return err
+	transport := map[string]interface{}{"protocol": "http"}
+	if opts.GRPC || opts.UpstreamScheme == "https" {
+		if opts.UpstreamScheme == "https" {
+			tls := map[string]interface{}{}
+			if opts.InsecureUpstream {
+				tls["insecure_skip_verify"] = true
+			}
+			transport["tls"] = tls
+			if opts.GRPC {
+				transport["versions"] = []string{"2"}
+			}
+		} else {
+			transport["versions"] = []string{"h2c", "2"}
+		}
+	}
+	if t := opts.Timeouts; t != nil {
+		for key, value := range map[string]string{"dial_timeout": t.Dial, "read_timeout": t.Read, "write_timeout": t.Write} {
+			if value != "" {
+				transport[key] = value
+			}
+		}
+	}
+	if len(transport) > 1 {
+		handler["transport"] = transport
 	}
 
-	url := fmt.Sprintf("%s/config/", caddyAdmin)
-	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
+	if ops := caddyHeaderOps(opts.RequestHeaders); ops != nil {
+		handler["headers"] = map[string]interface{}{"request": ops}
+	}
+
+	if opts.WebSocket {
+		// Flush immediately, and keep upgraded connections open across
+		// config reloads, which happen every time a domain is added.
+		handler["flush_interval"] = -1
+		handler["stream_close_delay"] = "5m"
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	return handler
+}
+
+// caddyHeaderOps converts ops to Caddy's header ops, or nil if there are
+// none.
+func caddyHeaderOps(ops *HeaderOps) map[string]interface{} {
+	if ops == nil || (len(ops.Set) == 0 && len(ops.Remove) == 0) {
+		return nil
+	}
+	caddyOps := map[string]interface{}{}
+	if len(ops.Set) > 0 {
+		set := make(map[string][]string, len(ops.Set))
+		for name, value := range ops.Set {
+			set[name] = []string{value}
+		}
+		caddyOps["set"] = set
+	}
+	if len(ops.Remove) > 0 {
+		caddyOps["delete"] = ops.Remove
+	}
+	return caddyOps
+}
+
+// getCaddyUpstreams returns Caddy's request and failure counts for every
+// upstream it proxies to, by dial address.
+func getCaddyUpstreams(caddyAdmin string) (map[string]UpstreamStatus, error) {
+	resp, err := caddyGet(caddyAdmin, "/reverse_proxy/upstreams")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to add Caddy server block: %s", body)
+		return nil, fmt.Errorf("failed to get Caddy upstreams: %s", body)
 	}
 
-	return nil
+	var upstreams []struct {
+		Address     string `json:"address"`
+		NumRequests int    `json:"num_requests"`
+		Fails       int    `json:"fails"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&upstreams); err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]UpstreamStatus, len(upstreams))
+	for _, u := range upstreams {
+		statuses[u.Address] = UpstreamStatus{Address: u.Address, Requests: u.NumRequests, Fails: u.Fails}
+	}
+	return statuses, nil
 }
 
 func isCaddyRunning(caddyAdmin string) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/config/", caddyAdmin), nil)
+	req, err := newCaddyRequest(ctx, caddyAdmin, http.MethodGet, "/config/", nil)
 	if err != nil {
 		return false, err
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := caddyDo(req)
+	if errors.Is(err, errCaddyOrigin) {
+		return false, err
+	}
 	if err != nil {
 		return false, nil
 	}
@@ -148,10 +1088,57 @@ func isCaddyRunning(caddyAdmin string) (bool, error) {
 	return resp.StatusCode == http.StatusOK, nil
 }
 
-func ensureCaddyRunning(caddyAdmin string) error {
-	running, err := isCaddyRunning(caddyAdmin)
-	if err == nil && running {
-		return nil
+// ensureCaddyRunning waits up to timeout for Caddy to come up, for Caddy
+// instances started alongside localbase.
+func ensureCaddyRunning(caddyAdmin string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		running, err := isCaddyRunning(caddyAdmin)
+		if err == nil && running {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("ensure caddy is installed and running")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// caddyConfigStats reports the serialized size of the current Caddy config
+// and how many routes in it localbase created.
+func caddyConfigStats(caddyAdmin string) (size int, routes int, err error) {
+	config, err := getCaddyConfig(caddyAdmin)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, r := range caddyServerRoutes(config) {
+		if strings.HasPrefix(caddyID(r), caddyIDPrefix) {
+			routes++
+		}
+	}
+
+	return len(data), routes, nil
+}
+
+// caddyServerRoutes returns the routes of the servers localbase manages.
+func caddyServerRoutes(config map[string]interface{}) []interface{} {
+	apps, _ := config["apps"].(map[string]interface{})
+	httpApp, _ := apps["http"].(map[string]interface{})
+	servers, _ := httpApp["servers"].(map[string]interface{})
+	var routes []interface{}
+	for _, key := range []string{caddyServerKey, caddyHTTPServerKey} {
+		server, _ := servers[key].(map[string]interface{})
+		r, _ := server["routes"].([]interface{})
+		routes = append(routes, r...)
 	}
-	return fmt.Errorf("ensure caddy is installed and running")
+	return routes
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// summarizeRoute describes a route built by buildRoutes as its ID without
+// the localbase prefix, its path matcher, "local" if it is limited to this
+// machine, and its handlers, with the dials of proxies and the root of
+// file servers.
+func summarizeRoute(r interface{}) string {
+	route := r.(map[string]interface{})
+	parts := []string{strings.TrimPrefix(caddyID(route), caddyIDPrefix)}
+	match := route["match"].([]map[string]interface{})[0]
+	if paths, ok := match["path"].([]string); ok {
+		parts = append(parts, strings.Join(paths, ","))
+	}
+	if _, ok := match["remote_ip"]; ok {
+		parts = append(parts, "local")
+	}
+	for _, h := range route["handle"].([]map[string]interface{}) {
+		handler := h["handler"].(string)
+		switch handler {
+		case "reverse_proxy":
+			var dials []string
+			for _, u := range h["upstreams"].([]map[string]interface{}) {
+				dials = append(dials, u["dial"].(string))
+			}
+			handler += "(" + strings.Join(dials, ",") + ")"
+		case "file_server":
+			handler += "(" + h["root"].(string) + ")"
+		case "static_response":
+			handler += fmt.Sprintf("(%d)", h["status_code"])
+		}
+		parts = append(parts, handler)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestBuildRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		opts RouteOptions
+		want []string
+	}{
+		{
+			name: "proxy",
+			want: []string{"a.local:0 reverse_proxy(localhost:3000)"},
+		},
+		{
+			name: "load balanced",
+			opts: RouteOptions{ExtraPorts: []int{3001}},
+			want: []string{"a.local:0 reverse_proxy(localhost:3000,localhost:3001)"},
+		},
+		{
+			name: "path routes first",
+			opts: RouteOptions{Routes: []PathRoute{{Path: "/api", Port: 4000}, {Path: "/ws", Port: 5000, KeepPrefix: true}}},
+			want: []string{
+				"a.local:0 /api,/api/* rewrite reverse_proxy(localhost:4000)",
+				"a.local:1 /ws,/ws/* reverse_proxy(localhost:5000)",
+				"a.local:2 reverse_proxy(localhost:3000)",
+			},
+		},
+		{
+			name: "static",
+			opts: RouteOptions{Dir: "/srv/site"},
+			want: []string{"a.local:0 file_server(/srv/site)"},
+		},
+		{
+			name: "compress",
+			opts: RouteOptions{Compress: true},
+			want: []string{"a.local:0 encode reverse_proxy(localhost:3000)"},
+		},
+		{
+			name: "basic auth",
+			opts: RouteOptions{BasicAuth: []BasicAuthAccount{{Username: "admin", Password: "hash"}}},
+			want: []string{"a.local:0 authentication reverse_proxy(localhost:3000)"},
+		},
+		{
+			name: "cors",
+			opts: RouteOptions{CORS: []string{"*"}},
+			want: []string{"a.local:0 subroute reverse_proxy(localhost:3000)"},
+		},
+		{
+			name: "handlers before the proxy",
+			opts: RouteOptions{
+				CORS:      []string{"*"},
+				BasicAuth: []BasicAuthAccount{{Username: "admin", Password: "hash"}},
+				Rewrites:  []Rewrite{{From: "/old", To: "/new"}},
+				Compress:  true,
+			},
+			want: []string{"a.local:0 subroute authentication subroute encode reverse_proxy(localhost:3000)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Exposed, so the routes aren't limited to this machine, which
+			// TestBuildRoutesLocalOnly covers.
+			tt.opts.ExposeLAN = true
+			checkRoutes(t, &tt.opts, tt.want)
+		})
+	}
+}
+
+func TestBuildRoutesLocalOnly(t *testing.T) {
+	checkRoutes(t, &RouteOptions{Routes: []PathRoute{{Path: "/api", Port: 4000}}}, []string{
+		"a.local:0 /api,/api/* local rewrite reverse_proxy(localhost:4000)",
+		"a.local:1 local reverse_proxy(localhost:3000)",
+		"a.local:2 static_response(403)",
+	})
+}
+
+// checkRoutes checks the routes buildRoutes builds for a.local and b.local
+// on port 3000 with opts against want, as summarized by summarizeRoute.
+func checkRoutes(t *testing.T, opts *RouteOptions, want []string) {
+	t.Helper()
+	routes := buildRoutes([]string{"a.local", "b.local"}, 3000, opts)
+	var got []string
+	for _, r := range routes {
+		got = append(got, summarizeRoute(r))
+		hosts := r.(map[string]interface{})["match"].([]map[string]interface{})[0]["host"].([]string)
+		if strings.Join(hosts, " ") != "a.local b.local" {
+			t.Errorf("route %s matches hosts %v", caddyID(r), hosts)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got routes\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestBuildRedirectRoute(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsPort int
+		opts      RouteOptions
+		want      string
+	}{
+		{name: "default port", httpsPort: 443, want: "https://{http.request.host}{http.request.uri}"},
+		{name: "custom port", httpsPort: 8443, want: "https://{http.request.host}:8443{http.request.uri}"},
+		{name: "no tls", httpsPort: 443, opts: RouteOptions{NoTLS: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := buildRedirectRoute([]string{"a.local"}, tt.httpsPort, &tt.opts)
+			if route == nil {
+				if tt.want != "" {
+					t.Fatalf("got no route, want a redirect to %s", tt.want)
+				}
+				return
+			}
+			headers := route["handle"].([]map[string]interface{})[0]["headers"].(map[string][]string)
+			if got := headers["Location"][0]; got != tt.want {
+				t.Errorf("got redirect to %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaddyServers(t *testing.T) {
+	servers := caddyServers(&Config{HTTPPort: 8080, HTTPSPort: 8443})
+	got := make(map[string]string)
+	for _, s := range servers {
+		got[s.id] = strings.Join(s.listen, ",")
+	}
+	if got[caddyServerID] != ":8443" || got[caddyHTTPServerID] != ":8080" {
+		t.Errorf("got listeners %v, want :8443 for %s and :8080 for %s", got, caddyServerID, caddyHTTPServerID)
+	}
+	if caddyRouteServer(&RouteOptions{NoTLS: true}) != caddyHTTPServerID || caddyRouteServer(&RouteOptions{}) != caddyServerID {
+		t.Error("--no-tls routes must go in the HTTP server, and the others in the HTTPS server")
+	}
+}
+
+func TestCaddyDoOrigin(t *testing.T) {
+	tests := []struct {
+		body   string
+		origin bool
+	}{
+		{body: `{"error":"host not allowed: example.com"}`, origin: true},
+		{body: `{"error":"client is not allowed to access from origin 'http://localhost:2019'"}`, origin: true},
+		{body: `{"error":"required Origin header is missing or invalid"}`, origin: true},
+		{body: `{"error":"loading config: the host matcher is forbidden here"}`},
+		{body: `origin and host are fine, this is a proxy`},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, tt.body)
+		}))
+		_, err := caddyGet(srv.URL, "/config/")
+		srv.Close()
+		if err == nil || errors.Is(err, errCaddyOrigin) != tt.origin {
+			t.Errorf("%s: got %v, want an origin error: %v", tt.body, err, tt.origin)
+		}
+	}
+}
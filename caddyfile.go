@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// writeCaddyfile renders the routes localbase generates for domains as a
+// Caddyfile, one site block per domain, for running Caddy without
+// localbase or reading what it configures. Raw Caddy JSON given with
+// --caddy has no Caddyfile form and is left out with a comment.
+func writeCaddyfile(w io.Writer, domains []Domain, cfg *Config) error {
+	b := &caddyfileWriter{}
+	b.line("# Generated by localbase export --format caddyfile")
+
+	var global []string
+	if cfg.httpPort() != 80 {
+		global = append(global, fmt.Sprintf("http_port %d", cfg.httpPort()))
+	}
+	if cfg.httpsPort() != 443 {
+		global = append(global, fmt.Sprintf("https_port %d", cfg.httpsPort()))
+	}
+	if len(global) > 0 || cfg.DisableHTTP3 {
+		b.line("")
+		b.open("")
+		for _, g := range global {
+			b.line(g)
+		}
+		if cfg.DisableHTTP3 {
+			b.open("servers")
+			b.line("protocols h1 h2")
+			b.close()
+		}
+		b.close()
+	}
+
+	for i := range domains {
+		b.line("")
+		writeCaddyfileSite(b, &domains[i], cfg)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeCaddyfileSite writes the site block of d, following buildRoutes.
+func writeCaddyfileSite(b *caddyfileWriter, d *Domain, cfg *Config) {
+	opts := &d.RouteOptions
+	hosts := caddyHosts(append([]string{d.Domain}, d.Aliases...), cfg)
+	addrs := make([]string, len(hosts))
+	for i, h := range hosts {
+		addrs[i] = h
+		if opts.NoTLS {
+			addrs[i] = "http://" + h
+		}
+	}
+
+	b.open(strings.Join(addrs, ", "))
+	if opts.Caddy != nil {
+		b.line("# The raw Caddy JSON of this domain has no Caddyfile form and is left out.")
+	}
+	if !opts.NoTLS {
+		b.line("tls internal")
+	}
+	if opts.AccessLog {
+		if path, err := getAccessLogFile(hosts[0]); err == nil {
+			b.open("log")
+			b.line("output file " + caddyfileQuote(path))
+			b.line("format json")
+			b.close()
+		}
+	}
+
+	// A route block keeps the handlers in localbase's order rather than
+	// the Caddyfile's directive order.
+	b.open("route")
+	if !opts.ExposeLAN {
+		b.line("@outside not remote_ip " + strings.Join(localRanges(), " "))
+		b.line("respond @outside " + caddyfileQuote(localOnlyMessage(hosts[0])) + " 403")
+	}
+	if len(opts.CORS) > 0 {
+		writeCaddyfileCORS(b, opts.CORS)
+	}
+	if len(opts.BasicAuth) > 0 {
+		b.open("basic_auth bcrypt localbase")
+		for _, acct := range opts.BasicAuth {
+			b.line(caddyfileQuote(acct.Username) + " " + caddyfileQuote(acct.Password))
+		}
+		b.close()
+	}
+	if ops := opts.ResponseHeaders; ops != nil && (len(ops.Set) > 0 || len(ops.Remove) > 0) {
+		b.open("header")
+		for _, line := range caddyfileHeaderOps("", ops) {
+			b.line(line)
+		}
+		b.line("defer")
+		b.close()
+	}
+	if len(opts.Rewrites) > 0 {
+		// Handle blocks are mutually exclusive, so the first matching
+		// rewrite wins.
+		b.open("route")
+		for i, rw := range opts.Rewrites {
+			b.line(fmt.Sprintf("@rewrite%d path %s", i, caddyfileQuote(rw.From)))
+			b.open(fmt.Sprintf("handle @rewrite%d", i))
+			if from, ok := strings.CutSuffix(rw.From, "*"); ok {
+				b.line(fmt.Sprintf("uri path_regexp %s %s", caddyfileQuote("^"+regexp.QuoteMeta(from)), caddyfileQuote(strings.TrimSuffix(rw.To, "*"))))
+			} else {
+				b.line("rewrite " + caddyfileQuote(rw.To))
+			}
+			b.close()
+		}
+		b.close()
+	}
+	if opts.Compress {
+		b.line("encode zstd gzip")
+	}
+
+	for i, pr := range opts.Routes {
+		b.line(fmt.Sprintf("@route%d path %s %s", i, caddyfileQuote(pr.Path), caddyfileQuote(pr.Path+"/*")))
+		b.open(fmt.Sprintf("handle @route%d", i))
+		if !pr.KeepPrefix {
+			b.line("uri strip_prefix " + caddyfileQuote(pr.Path))
+		}
+		writeCaddyfileProxy(b, []int{pr.Port}, opts, false)
+		b.close()
+	}
+	b.open("handle")
+	if opts.Dir != "" {
+		b.open("file_server")
+		b.line("root " + caddyfileQuote(opts.Dir))
+		b.close()
+	} else {
+		writeCaddyfileProxy(b, append([]int{d.Port}, opts.ExtraPorts...), opts, true)
+	}
+	b.close()
+	b.close()
+
+	if opts.Dir == "" {
+		b.open("handle_errors 502 503 504")
+		b.line(`header Content-Type "text/html; charset=utf-8"`)
+		b.line("respond <<HTML")
+		for _, line := range strings.Split(strings.TrimSuffix(errorPageBody(hosts[0], d.Port, opts), "\n"), "\n") {
+			b.line(line)
+		}
+		b.line("HTML {http.error.status_code}")
+		b.close()
+	}
+	b.close()
+}
+
+// writeCaddyfileCORS follows corsHandler.
+func writeCaddyfileCORS(b *caddyfileWriter, origins []string) {
+	quoted := make([]string, len(origins))
+	for i, o := range origins {
+		quoted[i] = caddyfileQuote(o)
+	}
+	b.line("@cors header Origin " + strings.Join(quoted, " "))
+	b.open("header @cors")
+	if origins[0] == "*" {
+		b.line(`Access-Control-Allow-Origin "*"`)
+	} else {
+		b.line("Access-Control-Allow-Origin {http.request.header.Origin}")
+		b.line("Access-Control-Allow-Credentials true")
+		b.line("Vary Origin")
+	}
+	b.line("defer")
+	b.close()
+
+	b.open("@preflight")
+	b.line("method OPTIONS")
+	b.line("header Origin " + strings.Join(quoted, " "))
+	b.line("header Access-Control-Request-Method *")
+	b.close()
+	b.open("header @preflight")
+	b.line(`Access-Control-Allow-Methods "GET, POST, PUT, PATCH, DELETE, OPTIONS"`)
+	b.line("Access-Control-Allow-Headers {http.request.header.Access-Control-Request-Headers}")
+	b.line("Access-Control-Max-Age 86400")
+	b.close()
+	b.line("respond @preflight 204")
+}
+
+// writeCaddyfileProxy follows reverseProxyHandler, and mainHandler when
+// main is set.
+func writeCaddyfileProxy(b *caddyfileWriter, ports []int, opts *RouteOptions, main bool) {
+	upstreams := make([]string, len(ports))
+	for i, port := range ports {
+		upstreams[i] = fmt.Sprintf("localhost:%d", port)
+	}
+
+	var body []string
+	if len(ports) > 1 && opts.LBPolicy != "" {
+		body = append(body, "lb_policy "+opts.LBPolicy)
+	}
+	if hc := opts.HealthCheck; main && hc != nil {
+		body = append(body, "health_uri "+caddyfileQuote(hc.Path))
+		if hc.Interval != "" {
+			body = append(body, "health_interval "+hc.Interval)
+		}
+		if hc.Status != 0 {
+			body = append(body, fmt.Sprintf("health_status %d", hc.Status))
+		}
+		body = append(body, "fail_duration 30s")
+	}
+	body = append(body, caddyfileHeaderOps("header_up ", opts.RequestHeaders)...)
+	if opts.WebSocket {
+		body = append(body, "flush_interval -1", "stream_close_delay 5m")
+	}
+
+	var transport []string
+	switch {
+	case opts.UpstreamScheme == "https":
+		transport = append(transport, "tls")
+		if opts.InsecureUpstream {
+			transport = append(transport, "tls_insecure_skip_verify")
+		}
+		if opts.GRPC {
+			transport = append(transport, "versions 2")
+		}
+	case opts.GRPC:
+		transport = append(transport, "versions h2c 2")
+	}
+	if t := opts.Timeouts; t != nil {
+		for _, timeout := range [][2]string{{"dial_timeout", t.Dial}, {"read_timeout", t.Read}, {"write_timeout", t.Write}} {
+			if timeout[1] != "" {
+				transport = append(transport, timeout[0]+" "+timeout[1])
+			}
+		}
+	}
+
+	directive := "reverse_proxy " + strings.Join(upstreams, " ")
+	if len(body) == 0 && len(transport) == 0 {
+		b.line(directive)
+		return
+	}
+	b.open(directive)
+	for _, line := range body {
+		b.line(line)
+	}
+	if len(transport) > 0 {
+		b.open("transport http")
+		for _, line := range transport {
+			b.line(line)
+		}
+		b.close()
+	}
+	b.close()
+}
+
+// caddyfileHeaderOps returns ops as header fields, each prefixed with
+// prefix.
+func caddyfileHeaderOps(prefix string, ops *HeaderOps) []string {
+	if ops == nil {
+		return nil
+	}
+	names := make([]string, 0, len(ops.Set))
+	for name := range ops.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		lines = append(lines, prefix+caddyfileQuote(name)+" "+caddyfileQuote(ops.Set[name]))
+	}
+	for _, name := range ops.Remove {
+		lines = append(lines, prefix+"-"+caddyfileQuote(name))
+	}
+	return lines
+}
+
+// caddyfileQuote quotes s as a single Caddyfile token if it needs it.
+func caddyfileQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n\"'`{}#\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// caddyfileWriter writes tab-indented Caddyfile lines.
+type caddyfileWriter struct {
+	strings.Builder
+	depth int
+}
+
+func (b *caddyfileWriter) line(s string) {
+	if s != "" {
+		b.WriteString(strings.Repeat("\t", b.depth))
+		b.WriteString(s)
+	}
+	b.WriteString("\n")
+}
+
+// open starts a block, after a directive unless it is empty.
+func (b *caddyfileWriter) open(directive string) {
+	if directive == "" {
+		b.line("{")
+	} else {
+		b.line(directive + " {")
+	}
+	b.depth++
+}
+
+func (b *caddyfileWriter) close() {
+	b.depth--
+	b.line("}")
+}
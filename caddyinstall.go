@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// caddyReleases is where Caddy's release archives and checksums live.
+const caddyReleases = "https://github.com/caddyserver/caddy/releases"
+
+// caddyDownloadTimeout bounds each download made by caddy install.
+const caddyDownloadTimeout = 5 * time.Minute
+
+// caddyInstallInfo is the result of caddy install.
+type caddyInstallInfo struct {
+	Version string `json:"version"`
+	Path    string `json:"path"`
+}
+
+func caddyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "caddy",
+		Short: "Manage the Caddy binary localbase runs",
+	}
+
+	install := &cobra.Command{
+		Use:   "install",
+		Args:  noArgs,
+		Short: "Download Caddy into the localbase config dir",
+		Long: `Download the Caddy release for this OS and architecture, verify it against the
+release's SHA-512 checksums and install it into the bin dir of the localbase
+config dir. When Caddy isn't running, localbase start runs this binary.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			version, _ := cmd.Flags().GetString("version")
+			force, _ := cmd.Flags().GetBool("force")
+
+			path, err := getManagedCaddyPath()
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(path); err == nil && !force {
+				return usageErrorf("caddy is already installed at %s, use --force to replace it", path)
+			}
+
+			if version == "" {
+				if version, err = latestCaddyVersion(); err != nil {
+					return err
+				}
+			}
+			version = strings.TrimPrefix(version, "v")
+
+			fmt.Fprintf(os.Stderr, "Downloading caddy %s for %s/%s...\n", version, runtime.GOOS, runtime.GOARCH)
+			if err := installCaddy(version, path); err != nil {
+				return err
+			}
+
+			info := caddyInstallInfo{Version: version, Path: path}
+			return printResult(cmd, &info, func() {
+				fmt.Printf("Installed caddy %s to %s\n", info.Version, info.Path)
+			})
+		},
+	}
+	install.Flags().String("version", "", "caddy version to install, e.g. 2.8.4 (defaults to the latest release)")
+	install.Flags().Bool("force", false, "replace a caddy binary installed earlier")
+	cmd.AddCommand(install)
+	return cmd
+}
+
+// getManagedCaddyPath returns where caddy install puts the Caddy binary.
+func getManagedCaddyPath() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	name := "caddy"
+	if runtime.GOOS == "windows" {
+		name = "caddy.exe"
+	}
+	return filepath.Join(configDir, "bin", name), nil
+}
+
+func latestCaddyVersion() (string, error) {
+	body, err := download("https://api.github.com/repos/caddyserver/caddy/releases/latest")
+	if err != nil {
+		return "", fmt.Errorf("failed to find the latest caddy release: %v", err)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.Unmarshal(body, &release); err != nil || release.TagName == "" {
+		return "", fmt.Errorf("failed to find the latest caddy release, pass --version")
+	}
+	return release.TagName, nil
+}
+
+// caddyArchiveName returns the name of the release archive of version for
+// this OS and architecture.
+func caddyArchiveName(version string) (string, error) {
+	goos := runtime.GOOS
+	switch goos {
+	case "linux", "windows", "freebsd":
+	case "darwin":
+		goos = "mac"
+	default:
+		return "", fmt.Errorf("caddy doesn't publish releases for %s, install it manually", goos)
+	}
+
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64", "arm64", "ppc64le", "s390x", "riscv64":
+	case "arm":
+		arch = "armv7"
+	default:
+		return "", fmt.Errorf("caddy doesn't publish releases for %s, install it manually", arch)
+	}
+
+	ext := "tar.gz"
+	if goos == "windows" {
+		ext = "zip"
+	}
+	return fmt.Sprintf("caddy_%s_%s_%s.%s", version, goos, arch, ext), nil
+}
+
+// installCaddy downloads the version release archive, checks it against
+// the release's checksums and extracts the binary to path.
+func installCaddy(version, path string) error {
+	archive, err := caddyArchiveName(version)
+	if err != nil {
+		return err
+	}
+	base := fmt.Sprintf("%s/download/v%s/", caddyReleases, version)
+
+	sums, err := download(base + fmt.Sprintf("caddy_%s_checksums.txt", version))
+	if err != nil {
+		return fmt.Errorf("failed to download caddy %s checksums: %v", version, err)
+	}
+	want := findChecksum(sums, archive)
+	if want == "" {
+		return fmt.Errorf("caddy %s has no checksum for %s", version, archive)
+	}
+
+	data, err := download(base + archive)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", archive, err)
+	}
+	sum := sha512.Sum512(data)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", archive, got, want)
+	}
+
+	name := filepath.Base(path)
+	var bin []byte
+	if strings.HasSuffix(archive, ".zip") {
+		bin, err = extractZip(data, name)
+	} else {
+		bin, err = extractTarGz(data, name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %v", archive, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write next to the destination and rename, so a running caddy is
+	// never left half written.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bin, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func download(rawURL string) ([]byte, error) {
+	client := &http.Client{Timeout: caddyDownloadTimeout}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// findChecksum returns the hex checksum of name in a checksums file of
+// "<checksum>  <name>" lines.
+func findChecksum(sums []byte, name string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0])
+		}
+	}
+	return ""
+}
+
+func extractTarGz(data []byte, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %s in archive", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && filepath.Base(hdr.Name) == name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+func extractZip(data []byte, name string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if filepath.Base(f.Name) != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("no %s in archive", name)
+}
+
+// startManagedCaddy runs the Caddy installed by caddy install when Caddy
+// isn't already running, with its admin API at caddyAdmin. It returns nil
+// if Caddy is running or there is no installed binary.
+func startManagedCaddy(caddyAdmin string) (*exec.Cmd, error) {
+	if running, err := isCaddyRunning(caddyAdmin); err != nil || running {
+		return nil, err
+	}
+
+	path, err := getManagedCaddyPath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if _, err := exec.LookPath("caddy"); err != nil {
+			return nil, fmt.Errorf("caddy is not running and no caddy executable was found, install it with: localbase caddy install")
+		}
+		return nil, nil
+	}
+
+	// Caddy reads its default admin address from CADDY_ADMIN.
+	admin := caddyAdmin
+	if _, ok := caddySocket(caddyAdmin); !ok {
+		u, err := url.Parse(caddyAdmin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid caddy admin address %s: %v", caddyAdmin, err)
+		}
+		admin = u.Host
+	}
+
+	configDir, err := getConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(filepath.Join(configDir, "caddy.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(path, "run")
+	cmd.Env = append(os.Environ(), "CADDY_ADMIN="+admin)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", path, err)
+	}
+	log.Printf("Started caddy from %s (pid %d), logging to %s", path, cmd.Process.Pid, logFile.Name())
+	return cmd, nil
+}
+
+// stopManagedCaddy stops a Caddy started by startManagedCaddy.
+func stopManagedCaddy(cmd *exec.Cmd) {
+	if runtime.GOOS == "windows" {
+		cmd.Process.Kill()
+	} else {
+		cmd.Process.Signal(os.Interrupt)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		<-done
+	}
+	log.Println("Stopped caddy")
+}
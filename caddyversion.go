@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// caddyVersion is a Caddy release version, major, minor and patch.
+type caddyVersion [3]int
+
+func (v caddyVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+func (v caddyVersion) less(o caddyVersion) bool {
+	for i := range v {
+		if v[i] != o[i] {
+			return v[i] < o[i]
+		}
+	}
+	return false
+}
+
+// minCaddyVersion is the oldest Caddy that understands the config localbase
+// generates, which sets the server's protocols.
+var minCaddyVersion = caddyVersion{2, 6, 0}
+
+// caddyFeatures are route options that need a newer Caddy than
+// minCaddyVersion.
+var caddyFeatures = []struct {
+	name string
+	min  caddyVersion
+	used func(o *RouteOptions) bool
+}{
+	{"--websocket", caddyVersion{2, 7, 0}, func(o *RouteOptions) bool { return o.WebSocket }},
+	{"the client_ip_hash lb policy", caddyVersion{2, 7, 0}, func(o *RouteOptions) bool { return o.LBPolicy == "client_ip_hash" }},
+}
+
+// parseCaddyVersion parses the output of caddy version, such as
+// "v2.8.4 h1:...". Pre-release suffixes are ignored.
+func parseCaddyVersion(s string) (caddyVersion, bool) {
+	var v caddyVersion
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return v, false
+	}
+	s = strings.TrimPrefix(fields[0], "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// detectCaddyVersion runs caddy version on the binary localbase would run:
+// the one caddy install put in the config dir, or else caddy on the PATH.
+// The admin API doesn't report Caddy's version.
+func detectCaddyVersion() (caddyVersion, error) {
+	path, err := getManagedCaddyPath()
+	if err != nil {
+		return caddyVersion{}, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if path, err = exec.LookPath("caddy"); err != nil {
+			return caddyVersion{}, fmt.Errorf("no caddy executable found")
+		}
+	}
+
+	out, err := exec.Command(path, "version").Output()
+	if err != nil {
+		return caddyVersion{}, fmt.Errorf("%s version: %v", path, err)
+	}
+	v, ok := parseCaddyVersion(string(out))
+	if !ok {
+		return caddyVersion{}, fmt.Errorf("unrecognized caddy version %q", strings.TrimSpace(string(out)))
+	}
+	return v, nil
+}
+
+// checkCaddySupport returns an error naming the first option in o that the
+// detected Caddy is too old for. It allows everything if the version is
+// unknown.
+func (lb *LocalBase) checkCaddySupport(o *RouteOptions) error {
+	if lb.caddyVersion == (caddyVersion{}) {
+		return nil
+	}
+	for _, f := range caddyFeatures {
+		if f.used(o) && lb.caddyVersion.less(f.min) {
+			return errorf(CodeInvalidRequest, "%s needs caddy %s or later, but caddy is %s; upgrade caddy, e.g. with localbase caddy install --force",
+				f.name, f.min, lb.caddyVersion)
+		}
+	}
+	return nil
+}
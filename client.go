@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/noelukwa/localbase/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+// call sends a single request to the daemon and decodes its result into
+// result, which may be nil if the caller doesn't need it.
+func call(method string, params interface{}, result interface{}) error {
+	return callTimeout(clientTimeout(), method, params, result)
+}
+
+// clientTimeout returns the timeout for a call to the daemon, from
+// --request-timeout or else the config.
+func clientTimeout() time.Duration {
+	if f := rootCmd.PersistentFlags().Lookup("request-timeout"); f != nil && f.Changed {
+		d, _ := rootCmd.PersistentFlags().GetDuration("request-timeout")
+		return d
+	}
+	cfg, err := readConfig()
+	if err != nil {
+		return defaultClientTimeout
+	}
+	return cfg.ClientTimeout.orDefault(defaultClientTimeout)
+}
+
+// timeoutContext returns a context that expires after timeout, or never
+// if timeout is zero.
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// callTimeout is like call, but gives up once timeout has elapsed. A zero
+// timeout waits indefinitely.
+func callTimeout(timeout time.Duration, method string, params interface{}, result interface{}) error {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Call(ctx, method, params, result)
+}
+
+// batchCall is one request in a batch sent by callBatch.
+type batchCall = client.BatchCall
+
+// callBatch sends calls to the daemon in a single round trip, or one call
+// at a time if the daemon doesn't support batches. The returned error only
+// reports failure to talk to the daemon; per-call errors are stored in each
+// call's Err.
+func callBatch(calls []*batchCall) error {
+	ctx, cancel := timeoutContext(clientTimeout())
+	defer cancel()
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Batch(ctx, calls)
+}
+
+// newClient returns a client for the daemon in the config, or the one in
+// LOCALBASE_ADDR.
+func newClient() (*client.Client, error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if addr := os.Getenv(addrEnv); addr != "" {
+		cfg.AdminAddress = addr
+		cfg.Socket = ""
+		cfg.Pipe = ""
+		cfg.TLS = true
+	}
+
+	return client.New(func(ctx context.Context) (net.Conn, error) {
+		return dialDaemon(ctx, cfg)
+	}, &client.Options{Token: os.Getenv(tokenEnv)}), nil
+}
+
+// dialDaemon connects to the daemon, giving up when ctx expires.
+func dialDaemon(ctx context.Context, cfg *Config) (net.Conn, error) {
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	conn, err := dialAdmin(cfg, timeout)
+	var ce *certError
+	if errors.As(err, &ce) {
+		return nil, ce
+	}
+	if err != nil {
+		return nil, &exitError{code: ExitDaemonNotRunning, err: fmt.Errorf("failed to connect to daemon: %v", err)}
+	}
+	return conn, nil
+}
+
+// listDomains fetches every registered domain a page at a time, so large
+// lists stay under the daemon's message size limit.
+func listDomains(timeout time.Duration) ([]Domain, error) {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+
+	c, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	return c.List(ctx)
+}
+
+// completeDomains completes registered domain names for shell completion.
+// It uses a short timeout so a missing daemon doesn't stall the shell.
+func completeDomains(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	domains, err := listDomains(time.Second)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var names []string
+	for _, d := range domains {
+		name := domainLabel(d.Domain)
+		if strings.HasPrefix(name, toComplete) {
+			names = append(names, name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// subscribe streams daemon events of the given types, or all events if
+// types is empty, to fn until the connection closes or fn returns an error.
+func subscribe(types []string, fn func(*Event) error) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Subscribe(context.Background(), types, fn)
+}
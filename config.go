@@ -0,0 +1,802 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are the config files looked for in the config dir, in
+// order. The keys are the same in each format.
+var configFileNames = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+
+// getConfigFile returns the config file in the config dir, or where
+// config.json would be if there is none.
+func getConfigFile() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range configFileNames {
+		path := filepath.Join(configDir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return filepath.Join(configDir, configFileNames[0]), nil
+}
+
+// loadConfigFile reads the config file at path. Besides the config, it
+// returns the keys the file sets and its problems: unknown keys and values
+// of the wrong type, which are left out of the config.
+func loadConfigFile(path string) (*Config, map[string]bool, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	values, err := decodeConfig(path, data)
+	if err == nil {
+		_, err = migrate(path, values, configMigrations, configVersion)
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	cfg := &Config{}
+	keys := make(map[string]bool, len(values))
+	fields := configFields()
+	var problems []string
+	for key, value := range values {
+		field, ok := fields[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown key %q", key))
+			continue
+		}
+		// Each value is set on its own, so every bad value is reported
+		// rather than the first.
+		if err := setConfigValue(cfg, field, value); err != nil {
+			problems = append(problems, configValueProblem(key, field.Type, err))
+			continue
+		}
+		keys[key] = true
+	}
+	sort.Strings(problems)
+	return cfg, keys, problems, nil
+}
+
+// setConfigValue sets field of cfg to value, going through JSON.
+func setConfigValue(cfg *Config, field reflect.StructField, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(cfg).Elem().FieldByIndex(field.Index)
+	v.Set(reflect.Zero(field.Type))
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v.Addr().Interface())
+}
+
+// parseConfigValue parses s, from the command line or environment, as a
+// value of field. Lists are comma separated, and other values that aren't
+// strings are YAML or JSON.
+func parseConfigValue(field reflect.StructField, s string) (interface{}, error) {
+	switch {
+	case field.Type.Kind() == reflect.String || field.Type == reflect.TypeOf(Duration(0)):
+		return s, nil
+	case field.Type == reflect.TypeOf([]string(nil)):
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	}
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(s), &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// configEnvPrefix prefixes the environment variables that set config keys,
+// e.g. LOCALBASE_CADDY_ADMIN for caddy_admin.
+const configEnvPrefix = "LOCALBASE_"
+
+// configEnvAliases are shorter environment variables for some keys.
+var configEnvAliases = map[string]string{
+	"admin_address": "LOCALBASE_ADMIN_ADDR",
+}
+
+func configEnvName(key string) string {
+	return configEnvPrefix + strings.ToUpper(key)
+}
+
+// applyConfigEnv sets the config keys given in the environment on cfg,
+// adding them to keys, and returns the variables it couldn't use.
+func applyConfigEnv(cfg *Config, keys map[string]bool) []string {
+	var problems []string
+	transport := false
+	env := make(map[string]bool)
+	for key, field := range configFields() {
+		if key == "version" {
+			continue
+		}
+		name := configEnvName(key)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			if alias := configEnvAliases[key]; alias != "" {
+				name = alias
+				s, ok = os.LookupEnv(alias)
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		value, err := parseConfigValue(field, s)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if err := setConfigValue(cfg, field, value); err != nil {
+			problems = append(problems, configValueProblem(name, field.Type, err))
+			continue
+		}
+		keys[key] = true
+		env[key] = true
+		if key == "admin_address" || key == "socket" || key == "pipe" {
+			transport = true
+		}
+	}
+
+	// A transport from the environment replaces the config file's.
+	if transport {
+		if !env["admin_address"] {
+			cfg.AdminAddress = ""
+		}
+		if !env["socket"] {
+			cfg.Socket = ""
+		}
+		if !env["pipe"] {
+			cfg.Pipe = ""
+		}
+		keys["admin_address"], keys["socket"], keys["pipe"] = true, true, true
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// configFlags are the start flags that set each config key.
+var configFlags = map[string][]string{
+	"caddy_admin":            {"caddy"},
+	"caddy_origin":           {"caddy-origin"},
+	"admin_address":          {"addr", "socket"},
+	"socket":                 {"addr", "socket"},
+	"pipe":                   {"addr", "socket"},
+	"tls":                    {"tls"},
+	"allow_lan":              {"allow-lan"},
+	"disable_http3":          {"http3"},
+	"http_port":              {"http-port"},
+	"https_port":             {"https-port"},
+	"caddy_config_warn_size": {"config-warn-size"},
+	"api_address":            {"api"},
+	"cors_origins":           {"cors-origin"},
+	"suffix":                 {"suffix"},
+	"interfaces":             {"interface"},
+	"exclude_interfaces":     {"exclude-interface"},
+	"networks":               {"private-network", "public-network"},
+	"default_network_policy": {"network-default"},
+	"mdns":                   {"mdns"},
+	"mdns_reflect":           {"mdns-reflect"},
+	"llmnr":                  {"llmnr"},
+	"mdns_refresh_interval":  {"mdns-refresh"},
+	"mdns_ttl":               {"mdns-ttl"},
+	"dns_address":            {"dns"},
+	"dns_tlds":               {"dns-tld"},
+	"disable_dns_forward":    {"dns-forward"},
+	"dns_upstreams":          {"dns-upstream"},
+	"disable_resolver":       {"resolver"},
+	"hosts_file":             {"hosts"},
+	"static_roots":           {"static-root"},
+	"docker_discovery":       {"docker"},
+	"log_format":             {"log-format"},
+	"log_level":              {"log-level"},
+	"log_file":               {"log-file"},
+	"rate_limit":             {"rate-limit"},
+	"max_client_conns":       {"max-conns"},
+	"require_auth":           {"require-auth"},
+	"client_timeout":         {"client-timeout"},
+	"read_timeout":           {"read-timeout"},
+	"caddy_timeout":          {"caddy-timeout"},
+	"drain_timeout":          {"drain-timeout"},
+	"max_message_size":       {"max-message-size"},
+}
+
+// mergeConfig sets the keys of the config file and the environment that
+// none of start's given flags set on cfg, which holds the flags. The
+// environment wins over the config file. It returns the config to save,
+// the flags merged with the config file only, so the environment of one
+// start isn't written into the home dir.
+func mergeConfig(cfg *Config, cmd *cobra.Command) (*Config, error) {
+	path, err := getConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	upgradeConfigFile(path)
+	file, keys, problems, err := loadConfigFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		file, keys = &Config{}, map[string]bool{}
+	case err != nil:
+		return nil, err
+	case len(problems) > 0:
+		return nil, fmt.Errorf("invalid config file %s: %s, check it with localbase config validate", path, problems[0])
+	}
+	env, envKeys := &Config{}, map[string]bool{}
+	if problems := applyConfigEnv(env, envKeys); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid environment variable %s", problems[0])
+	}
+
+	mergeConfigKeys(cfg, file, keys, cmd)
+	saved := *cfg
+	mergeConfigKeys(cfg, env, envKeys, cmd)
+	return &saved, nil
+}
+
+// mergeConfigKeys sets the keys of src on dst, except those start's given
+// flags set.
+func mergeConfigKeys(dst, src *Config, keys map[string]bool, cmd *cobra.Command) {
+	// The transport keys go together, so a socket in the file replaces
+	// the default pipe or socket of the flags.
+	if keys["admin_address"] || keys["socket"] || keys["pipe"] {
+		keys["admin_address"], keys["socket"], keys["pipe"] = true, true, true
+	}
+	d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for key, field := range configFields() {
+		if !keys[key] || configFlagsChanged(cmd, configFlags[key]) {
+			continue
+		}
+		d.FieldByIndex(field.Index).Set(s.FieldByIndex(field.Index))
+	}
+}
+
+func configFlagsChanged(cmd *cobra.Command, names []string) bool {
+	for _, name := range names {
+		if cmd.Flags().Changed(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeConfig decodes a JSON, YAML or TOML config file into its values,
+// picking the format by the file's extension.
+func decodeConfig(path string, data []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+	default:
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// encodeConfig encodes cfg in the format of the config file at path.
+func encodeConfig(path string, cfg *Config) ([]byte, error) {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil || filepath.Ext(path) == ".json" {
+		return data, err
+	}
+	values, err := decodeConfigJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return encodeConfigValues(path, values)
+}
+
+// encodeConfigValues encodes the values of a config file in the format of
+// the one at path.
+func encodeConfigValues(path string, values map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		err = enc.Encode(values)
+	case ".toml":
+		err = toml.NewEncoder(&buf).Encode(values)
+	default:
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(values)
+	}
+	return buf.Bytes(), err
+}
+
+// decodeConfigJSON decodes JSON config values with plain numbers, which
+// YAML and TOML write as numbers rather than strings.
+func decodeConfigJSON(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var values map[string]interface{}
+	if err := dec.Decode(&values); err != nil {
+		return nil, err
+	}
+	return plainNumbers(values).(map[string]interface{}), nil
+}
+
+// writeFileAtomic writes data to path through a temporary file, so a
+// crash never leaves it half written.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// plainNumbers replaces the JSON numbers in v with ints, or floats where
+// they have a fraction, which YAML and TOML write as numbers.
+func plainNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = plainNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = plainNumbers(item)
+		}
+	}
+	return v
+}
+
+// configFields returns the fields of Config by key.
+func configFields() map[string]reflect.StructField {
+	t := reflect.TypeOf(Config{})
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if key != "" && key != "-" {
+			fields[key] = f
+		}
+	}
+	return fields
+}
+
+// configValueProblem describes why the value of key didn't decode into a
+// field of type t.
+func configValueProblem(key string, t reflect.Type, err error) string {
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			key += "." + typeErr.Field
+		}
+		return fmt.Sprintf("%s: want %s, got %s", key, configTypeName(typeErr.Type), typeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Sprintf("%s: unknown key %s", key, strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return fmt.Sprintf("%s: %v", key, err)
+}
+
+func configTypeName(t reflect.Type) string {
+	if t == reflect.TypeOf(Duration(0)) {
+		return "a duration like 10s"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		return "a list"
+	}
+	return "an object"
+}
+
+// validate checks the values of c, returning its problems. Unset values
+// are left to their defaults.
+func (c *Config) validate() []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.CaddyOrigin != "" {
+		if u, err := url.Parse(c.CaddyOrigin); err != nil || u.Scheme == "" || u.Host == "" {
+			add("invalid caddy_origin %q, want e.g. http://caddy.internal:2019", c.CaddyOrigin)
+		}
+	}
+	for _, port := range []int{c.HTTPPort, c.HTTPSPort} {
+		if port < 0 || port > 65535 {
+			add("invalid listen port: %d", port)
+		}
+	}
+	if c.httpPort() == c.httpsPort() {
+		add("http_port and https_port must differ")
+	}
+	if c.Suffix != "" {
+		if err := validateSuffix(c.Suffix); err != nil {
+			add("%v", err)
+		}
+	}
+	for _, root := range c.StaticRoots {
+		if !filepath.IsAbs(root) {
+			add("static root %q must be an absolute path", root)
+		}
+	}
+	for _, patterns := range [][]string{c.Interfaces, c.ExcludeInterfaces, c.MDNSReflect} {
+		if err := validateInterfacePatterns(patterns); err != nil {
+			add("%v", err)
+		}
+	}
+	for _, n := range c.Networks {
+		set := 0
+		for _, s := range []string{n.Interface, n.Subnet, n.SSID} {
+			if s != "" {
+				set++
+			}
+		}
+		switch {
+		case set != 1:
+			add("invalid network, set one of interface, subnet or ssid")
+		case n.Policy != networkPrivate && n.Policy != networkPublic:
+			add("invalid network policy %q, want private or public", n.Policy)
+		case n.Subnet != "":
+			if _, _, err := net.ParseCIDR(n.Subnet); err != nil {
+				add("invalid subnet %q, want e.g. 192.168.1.0/24", n.Subnet)
+			}
+		case n.Interface != "":
+			if err := validateInterfacePatterns([]string{n.Interface}); err != nil {
+				add("%v", err)
+			}
+		}
+	}
+	if p := c.DefaultNetworkPolicy; p != "" && p != networkPrivate && p != networkPublic {
+		add("invalid default_network_policy %q, want private or public", p)
+	}
+
+	switch c.MDNS {
+	case "", "auto", "builtin", "off":
+	case "native":
+		if runtime.GOOS != "windows" {
+			add("mdns native is only supported on windows")
+		}
+	case "avahi":
+		if runtime.GOOS != "linux" {
+			add("mdns avahi is only supported on linux")
+		}
+	default:
+		add("invalid mdns %q, want auto, builtin, avahi, native or off", c.MDNS)
+	}
+	if c.MDNS == "native" || c.MDNS == "avahi" {
+		if len(c.Networks) > 0 || c.DefaultNetworkPolicy == networkPublic {
+			add("network policies only apply to mdns builtin")
+		}
+		if len(c.MDNSReflect) > 0 {
+			add("mdns_reflect only applies to mdns builtin, avahi has its own enable-reflector setting")
+		}
+	}
+	if c.MDNSRefreshInterval < 0 {
+		add("mdns_refresh_interval must be positive")
+	}
+	if c.MDNSTTL != 0 && time.Duration(c.MDNSTTL) < time.Second {
+		add("mdns_ttl must be at least 1s")
+	}
+	for _, u := range c.DNSUpstreams {
+		if _, err := parseDNSUpstream(u); err != nil {
+			add("%v", err)
+		}
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		add("invalid log_format %q, want text or json", c.LogFormat)
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		add("invalid log_level %q, want info, warn or error", c.LogLevel)
+	}
+	if c.RateLimit < 0 || c.MaxClientConns < 0 || c.MaxMessageSize < 0 {
+		add("rate_limit, max_client_conns and max_message_size can't be negative")
+	}
+
+	network, _ := c.adminAddr()
+	if c.TLS && network != "tcp" {
+		add("tls only applies to the TCP transport, set admin_address")
+	}
+	if c.AllowLAN && network != "tcp" {
+		add("allow_lan only applies to the TCP transport, set admin_address")
+	}
+	if len(c.CORSOrigins) > 0 && c.APIAddress == "" {
+		add("cors_origins only applies to the REST API, set api_address")
+	}
+	if c.APIAddress != "" {
+		host, _, err := net.SplitHostPort(c.APIAddress)
+		switch {
+		case err != nil:
+			add("invalid api_address %q: %v", c.APIAddress, err)
+		case !loopbackHost(host) && !c.RequireAuth:
+			add("api_address %s is reachable from the network and requires token auth, use --require-auth", c.APIAddress)
+		}
+	}
+	if network == "tcp" && c.AdminAddress != "" {
+		if err := validateAdminAddr(c); err != nil {
+			add("%v", err)
+		}
+	}
+	return problems
+}
+
+// configValidation is the result of config validate.
+type configValidation struct {
+	File     string   `json:"file"`
+	Valid    bool     `json:"valid"`
+	Problems []string `json:"problems"`
+}
+
+func configCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage the daemon config",
+		Long: `Manage the daemon config, config.json, config.yaml or config.toml in the
+config dir. The keys are the same in each format. localbase start reads the
+config file and saves the flags it's given into it.
+
+Each key can also be set with an environment variable, LOCALBASE_ and the
+key in upper case, e.g. LOCALBASE_CADDY_ADMIN or LOCALBASE_ADMIN_ADDR for
+admin_address. The environment wins over the config file, and start's
+flags over both. start saves its flags into the config file, but not the
+environment. Lists are comma separated.`,
+	}
+
+	cmd.AddCommand(configGetCmd(), configSetCmd(), configValidateCmd())
+	return cmd
+}
+
+func configGetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get [key]",
+		Args:  rangeArgs(0, 1, "usage: localbase config get [key]"),
+		Short: "Show the config, or one key of it",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := readConfig()
+			if err != nil {
+				return fmt.Errorf("failed to read config: %v", err)
+			}
+			fields := configFields()
+			v := reflect.ValueOf(cfg).Elem()
+
+			if len(args) == 0 {
+				keys := make([]string, 0, len(fields))
+				for key := range fields {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				return printResult(cmd, cfg, func() {
+					for _, key := range keys {
+						if value := v.FieldByIndex(fields[key].Index); !value.IsZero() {
+							fmt.Printf("%s = %s\n", key, configValueText(value))
+						}
+					}
+				})
+			}
+
+			field, ok := fields[args[0]]
+			if !ok {
+				return usageErrorf("unknown config key %q, see localbase config get", args[0])
+			}
+			value := v.FieldByIndex(field.Index)
+			return printResult(cmd, map[string]interface{}{"key": args[0], "value": value.Interface()}, func() {
+				fmt.Println(configValueText(value))
+			})
+		},
+	}
+}
+
+func configSetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set <key> <value>",
+		Args:  rangeArgs(2, 2, "usage: localbase config set <key> <value>"),
+		Short: "Change one key of the config",
+		Long: `Change one key of the config file, checking the value first. Lists are comma
+separated, and networks is YAML or JSON. The file is replaced atomically and
+keeps its format. A running daemon picks up most changes when it restarts.`,
+		Example: `  localbase config set caddy_admin http://localhost:2020
+  localbase config set dns_tlds test,dev
+  localbase config set mdns_ttl 5m`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key := args[0]
+			fields := configFields()
+			field, ok := fields[key]
+			if !ok {
+				return usageErrorf("unknown config key %q, see localbase config get", key)
+			}
+			if key == "version" {
+				return usageErrorf("version is the format of the config file and can't be set")
+			}
+			path, err := getConfigFile()
+			if err != nil {
+				return err
+			}
+			upgradeConfigFile(path)
+
+			// Only the keys the file already sets are written back, so
+			// setting one key doesn't pin the others to their defaults.
+			cfg, values := &Config{}, map[string]interface{}{"version": configVersion}
+			data, err := os.ReadFile(path)
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+			case err != nil:
+				return err
+			default:
+				var problems []string
+				cfg, _, problems, err = loadConfigFile(path)
+				if err != nil {
+					return err
+				}
+				if len(problems) > 0 {
+					return fmt.Errorf("%s has problems, fix them first: %s, check it with localbase config validate", path, problems[0])
+				}
+				if values, err = decodeConfig(path, data); err != nil {
+					return err
+				}
+				if _, err := migrate(path, values, configMigrations, configVersion); err != nil {
+					return err
+				}
+			}
+
+			value, err := parseConfigValue(field, args[1])
+			if err == nil {
+				err = setConfigValue(cfg, field, value)
+			}
+			if err != nil {
+				return usageErrorf("%s", configValueProblem(key, field.Type, err))
+			}
+			v := reflect.ValueOf(cfg).Elem()
+			// One transport replaces another.
+			if key == "admin_address" || key == "socket" || key == "pipe" {
+				for _, k := range []string{"admin_address", "socket", "pipe"} {
+					if k != key {
+						delete(values, k)
+						v.FieldByIndex(fields[k].Index).SetString("")
+					}
+				}
+			}
+			if problems := cfg.validate(); len(problems) > 0 {
+				return usageErrorf("%s", problems[0])
+			}
+
+			// The value goes through the field, so it is written the way
+			// start writes it.
+			raw, err := json.Marshal(map[string]interface{}{key: v.FieldByIndex(field.Index).Interface()})
+			if err != nil {
+				return err
+			}
+			set, err := decodeConfigJSON(raw)
+			if err != nil {
+				return err
+			}
+			values[key] = set[key]
+			if data, err = encodeConfigValues(path, values); err != nil {
+				return err
+			}
+			if err := writeFileAtomic(path, data, 0644); err != nil {
+				return err
+			}
+			fmt.Printf("Set %s in %s\n", key, path)
+			return nil
+		},
+	}
+}
+
+func configValidateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate [file]",
+		Args:  rangeArgs(0, 1, "usage: localbase config validate [file]"),
+		Short: "Check the config file for mistakes",
+		Long: `Check a config file, the daemon's unless one is given, reporting unknown keys,
+values of the wrong type and invalid values. The daemon's config is checked
+with the LOCALBASE_ environment variables that override it. It exits 1 if
+there are any problems.`,
+		// An invalid config file is not a usage error.
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path, err := getConfigFile()
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				path = args[0]
+			}
+
+			result := configValidation{File: path, Problems: []string{}}
+			cfg, keys, problems, err := loadConfigFile(path)
+			switch {
+			case errors.Is(err, fs.ErrNotExist) && len(args) == 0:
+				// No config file is a valid config, all defaults.
+				cfg, keys = &Config{}, map[string]bool{}
+			case err != nil:
+				return err
+			}
+			if len(args) == 0 {
+				problems = append(problems, applyConfigEnv(cfg, keys)...)
+			}
+			result.Problems = append(result.Problems, problems...)
+			result.Problems = append(result.Problems, cfg.validate()...)
+			result.Valid = len(result.Problems) == 0
+
+			if err := printResult(cmd, &result, func() {
+				if result.Valid {
+					fmt.Printf("%s is valid\n", result.File)
+					return
+				}
+				fmt.Printf("%s is invalid:\n", result.File)
+				for _, p := range result.Problems {
+					fmt.Printf("  %s\n", p)
+				}
+			}); err != nil {
+				return err
+			}
+			if !result.Valid {
+				return fmt.Errorf("invalid config file %s", result.File)
+			}
+			return nil
+		},
+	}
+}
+
+// configValueText formats a config value for config get.
+func configValueText(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case string:
+		return value
+	case Duration:
+		return time.Duration(value).String()
+	case []string:
+		return strings.Join(value, ",")
+	}
+	data, _ := json.Marshal(v.Interface())
+	return string(data)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// discoveredDomain is a localbase domain advertised on the LAN.
+type discoveredDomain struct {
+	Domain    string   `json:"domain"`
+	URL       string   `json:"url,omitempty"`
+	Port      int      `json:"port,omitempty"`
+	Owner     string   `json:"owner,omitempty"`
+	Aliases   []string `json:"aliases,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// discoverResult is the result of discover.
+type discoverResult struct {
+	Domains []discoveredDomain `json:"domains"`
+}
+
+func discoverCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "discover",
+		Args:  noArgs,
+		Short: "List localbase domains advertised on the LAN",
+		Long: `Browse the LAN over mDNS for domains that localbase daemons, yours and your
+teammates', advertise, listing each with its url, owner and addresses. It
+doesn't need the daemon running.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			if timeout <= 0 {
+				return usageErrorf("--timeout must be positive")
+			}
+
+			domains, err := discover(timeout)
+			if err != nil {
+				return err
+			}
+			result := discoverResult{Domains: domains}
+			return printResult(cmd, &result, func() {
+				if len(result.Domains) == 0 {
+					fmt.Println("No domains found")
+					return
+				}
+				for _, d := range result.Domains {
+					fmt.Printf("- %s %s", d.Domain, d.URL)
+					if d.Owner != "" {
+						fmt.Printf(" (%s)", d.Owner)
+					}
+					fmt.Println()
+					if d.Port != 0 {
+						fmt.Printf("  port: %d\n", d.Port)
+					}
+					if len(d.Aliases) > 0 {
+						fmt.Printf("  aliases: %s\n", strings.Join(d.Aliases, ", "))
+					}
+					if len(d.Addresses) > 0 {
+						fmt.Printf("  addresses: %s\n", strings.Join(d.Addresses, ", "))
+					}
+				}
+			})
+		},
+	}
+	cmd.Flags().Duration("timeout", 2*time.Second, "how long to wait for answers")
+	return cmd
+}
+
+// discover asks for every instance of the localbase service on each
+// multicast interface and collects the answers until timeout.
+func discover(timeout time.Duration) ([]discoveredDomain, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(mdnsLocalbaseService, dns.TypePTR)
+	query.Id = 0
+	query.RecursionDesired = false
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	// Answers to queries from a port other than 5353 come back unicast, so
+	// ephemeral sockets don't compete with the system's responder.
+	var conns []net.PacketConn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	if c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero}); err == nil {
+		conns = append(conns, c)
+		p := ipv4.NewPacketConn(c)
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+				p.WriteTo(packet, &ipv4.ControlMessage{IfIndex: iface.Index}, mdnsGroupIPv4)
+			}
+		}
+	}
+	if c, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified}); err == nil {
+		conns = append(conns, c)
+		p := ipv6.NewPacketConn(c)
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+				p.WriteTo(packet, &ipv6.ControlMessage{IfIndex: iface.Index}, mdnsGroupIPv6)
+			}
+		}
+	}
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("failed to open a socket for mdns")
+	}
+
+	answers := make(chan []dns.RR)
+	deadline := time.Now().Add(timeout)
+	for _, c := range conns {
+		c.SetReadDeadline(deadline)
+		go func(c net.PacketConn) {
+			buf := make([]byte, 9000)
+			for {
+				n, _, err := c.ReadFrom(buf)
+				if err != nil {
+					answers <- nil
+					return
+				}
+				var msg dns.Msg
+				if msg.Unpack(buf[:n]) == nil && msg.Response && len(msg.Answer) > 0 {
+					answers <- append(msg.Answer, msg.Extra...)
+				}
+			}
+		}(c)
+	}
+
+	var rrs []dns.RR
+	for open := len(conns); open > 0; {
+		batch := <-answers
+		if batch == nil {
+			open--
+		}
+		rrs = append(rrs, batch...)
+	}
+	return discoveredDomains(rrs), nil
+}
+
+// discoveredDomains puts together the domains described by rrs.
+func discoveredDomains(rrs []dns.RR) []discoveredDomain {
+	instances := make(map[string]bool)
+	srvs := make(map[string]*dns.SRV)
+	txts := make(map[string][]string)
+	addrs := make(map[string][]string)
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			if strings.EqualFold(name, mdnsLocalbaseService) {
+				instances[strings.ToLower(rr.Ptr)] = true
+			}
+		case *dns.SRV:
+			srvs[name] = rr
+		case *dns.TXT:
+			txts[name] = rr.Txt
+		case *dns.A:
+			addrs[name] = appendUnique(addrs[name], rr.A.String())
+		case *dns.AAAA:
+			addrs[name] = appendUnique(addrs[name], rr.AAAA.String())
+		}
+	}
+
+	domains := make([]discoveredDomain, 0, len(instances))
+	for instance := range instances {
+		d := discoveredDomain{}
+		for _, kv := range txts[instance] {
+			key, value, _ := strings.Cut(kv, "=")
+			switch key {
+			case "domain":
+				d.Domain = value
+			case "url":
+				d.URL = value
+			case "owner":
+				d.Owner = value
+			case "port":
+				d.Port, _ = strconv.Atoi(value)
+			case "aliases":
+				d.Aliases = strings.Split(value, ",")
+			}
+		}
+		if srv := srvs[instance]; srv != nil {
+			target := strings.ToLower(srv.Target)
+			if d.Domain == "" {
+				d.Domain = strings.TrimSuffix(target, ".")
+			}
+			d.Addresses = addrs[target]
+		}
+		if d.Domain == "" {
+			continue
+		}
+		domains = append(domains, d)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].Domain != domains[j].Domain {
+			return domains[i].Domain < domains[j].Domain
+		}
+		return domains[i].Owner < domains[j].Owner
+	})
+	return domains
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
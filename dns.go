@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const dnsTTL = 60
+
+// dnsServer answers A and AAAA queries for registered domains under custom TLDs,
+// so hello.local is also reachable as hello.test where mDNS is blocked, and
+// for domains registered with a suffix other than .local. Queries for other
+// names are forwarded upstream if forwarder is set.
+type dnsServer struct {
+	lb        *LocalBase
+	tlds      []string
+	forwarder *dnsForwarder
+	servers   []*dns.Server
+}
+
+func newDNSServer(lb *LocalBase, addr string, tlds []string, forwarder *dnsForwarder) *dnsServer {
+	s := &dnsServer{lb: lb, forwarder: forwarder}
+	for _, tld := range tlds {
+		s.tlds = append(s.tlds, dns.Fqdn(strings.Trim(tld, ".")))
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		s.servers = append(s.servers, &dns.Server{
+			Addr:    addr,
+			Net:     network,
+			Handler: s,
+		})
+	}
+	return s
+}
+
+func (s *dnsServer) Start() {
+	for _, srv := range s.servers {
+		go func(srv *dns.Server) {
+			if err := srv.ListenAndServe(); err != nil {
+				log.Printf("dns server (%s) error: %v", srv.Net, err)
+			}
+		}(srv)
+	}
+}
+
+func (s *dnsServer) Shutdown() {
+	for _, srv := range s.servers {
+		srv.Shutdown()
+	}
+}
+
+func (s *dnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = s.forwarder != nil
+
+	if len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+		w.WriteMsg(resp)
+		return
+	}
+
+	// Names registered under a suffix other than .local are answered as
+	// they are, .local names under each managed TLD. Names outside them
+	// are forwarded, except under .local or the default suffix, which
+	// only localbase answers for.
+	q := req.Question[0]
+	name := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+	if !s.lb.Registered(name) {
+		label, ok := s.label(q.Name)
+		if !ok && s.forwarder != nil && !s.local(name) {
+			s.forwarder.forward(w, req)
+			return
+		}
+		if !ok {
+			resp.Rcode = dns.RcodeRefused
+			w.WriteMsg(resp)
+			return
+		}
+		if !s.lb.Registered(fmt.Sprintf("%s.local", label)) {
+			resp.Rcode = dns.RcodeNameError
+			w.WriteMsg(resp)
+			return
+		}
+	}
+
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		localIP, err := getLocalIP()
+		if err != nil {
+			log.Printf("dns: error getting local IP: %v", err)
+			resp.Rcode = dns.RcodeServerFailure
+			w.WriteMsg(resp)
+			return
+		}
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: dnsTTL},
+			A:   net.ParseIP(localIP),
+		})
+	}
+	if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+		localIP, err := getLocalIP()
+		if err == nil {
+			if ip6 := getLocalIPv6(localIP); ip6 != "" {
+				resp.Answer = append(resp.Answer, &dns.AAAA{
+					Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: dnsTTL},
+					AAAA: net.ParseIP(ip6),
+				})
+			}
+		}
+	}
+
+	w.WriteMsg(resp)
+}
+
+// label strips a managed TLD from name, returning false if name is not
+// under one.
+func (s *dnsServer) label(name string) (string, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, tld := range s.tlds {
+		if label, ok := strings.CutSuffix(name, "."+tld); ok && label != "" {
+			return label, true
+		}
+	}
+	return "", false
+}
+
+// local reports whether name is under .local or the default suffix.
+func (s *dnsServer) local(name string) bool {
+	for _, suffix := range []string{"local", s.lb.suffix} {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolverHint describes how to point the system resolver at the DNS
+// server for tld on the current platform.
+func resolverHint(addr, tld string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "53"
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		return fmt.Sprintf("create /etc/resolver/%s containing \"nameserver %s\" and \"port %s\"", tld, host, port)
+	case "linux":
+		return fmt.Sprintf("run \"resolvectl dns lo %s:%s\" and \"resolvectl domain lo ~%s\" (systemd-resolved), or add a dnsmasq rule server=/%s/%s#%s", host, port, tld, tld, host, port)
+	case "windows":
+		return fmt.Sprintf("run \"Add-DnsClientNrptRule -Namespace .%s -NameServers %s\" (port 53 only)", tld, host)
+	default:
+		return fmt.Sprintf("configure your resolver to send .%s queries to %s:%s", tld, host, port)
+	}
+}
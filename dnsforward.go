@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnsForwardTimeout bounds each query to an upstream resolver.
+	dnsForwardTimeout = 2 * time.Second
+	// systemResolverRefresh is how often the system's resolvers are read
+	// again, as they change with the network.
+	systemResolverRefresh = 30 * time.Second
+	// dnsCacheSize caps the answers cached, and dnsCacheMaxTTL how long
+	// each is kept.
+	dnsCacheSize   = 4096
+	dnsCacheMaxTTL = time.Hour
+)
+
+// dnsForwarder forwards queries for names localbase doesn't manage to
+// upstream resolvers, caching the answers for their TTL.
+type dnsForwarder struct {
+	// upstreams are the resolvers to forward to. Empty means the system's.
+	upstreams []string
+	// self is the DNS server's address, never forwarded to so a system
+	// resolver pointed at localbase doesn't loop.
+	self string
+
+	mu       sync.Mutex
+	system   []string
+	loadedAt time.Time
+	cache    map[dnsCacheKey]*dnsCacheEntry
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	dnssec bool
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+func newDNSForwarder(self string, upstreams []string) *dnsForwarder {
+	return &dnsForwarder{
+		upstreams: upstreams,
+		self:      self,
+		cache:     make(map[dnsCacheKey]*dnsCacheEntry),
+	}
+}
+
+// forward answers req from the cache, or else from the first upstream
+// resolver that responds, with SERVFAIL if none does.
+func (f *dnsForwarder) forward(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	key := dnsCacheKey{strings.ToLower(q.Name), q.Qtype, q.Qclass, false}
+	if opt := req.IsEdns0(); opt != nil {
+		key.dnssec = opt.Do()
+	}
+	network := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+
+	resp := f.cached(key)
+	if resp == nil {
+		var err error
+		if resp, err = f.exchange(req, network); err != nil {
+			log.Printf("dns: failed to forward %s %s: %v", q.Name, dns.TypeToString[q.Qtype], err)
+			resp = new(dns.Msg)
+			resp.SetRcode(req, dns.RcodeServerFailure)
+			resp.RecursionAvailable = true
+			w.WriteMsg(resp)
+			return
+		}
+		f.store(key, resp)
+	}
+
+	resp.Id = req.Id
+	if network == "udp" {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	w.WriteMsg(resp)
+}
+
+// exchange sends req to each upstream resolver in turn until one
+// responds.
+func (f *dnsForwarder) exchange(req *dns.Msg, network string) (*dns.Msg, error) {
+	upstreams := f.resolvers()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream resolvers, pass --dns-upstream")
+	}
+	client := &dns.Client{Net: network, Timeout: dnsForwardTimeout}
+	msg := req.Copy()
+	msg.Id = dns.Id()
+
+	var err error
+	for _, upstream := range upstreams {
+		var resp *dns.Msg
+		if resp, _, err = client.Exchange(msg, upstream); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// resolvers returns the upstream resolvers, reading the system's again if
+// they are old.
+func (f *dnsForwarder) resolvers() []string {
+	if len(f.upstreams) > 0 {
+		return f.upstreams
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.loadedAt) < systemResolverRefresh {
+		return f.system
+	}
+	system, err := systemResolvers()
+	if err != nil {
+		log.Printf("dns: failed to read the system's resolvers: %v", err)
+	}
+	f.system = f.system[:0]
+	for _, addr := range system {
+		if !f.isSelf(addr) {
+			f.system = append(f.system, addr)
+		}
+	}
+	f.loadedAt = time.Now()
+	return f.system
+}
+
+// isSelf reports whether addr is the DNS server's own address.
+func (f *dnsForwarder) isSelf(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	selfHost, selfPort, selfErr := net.SplitHostPort(f.self)
+	if err != nil || selfErr != nil || port != selfPort {
+		return false
+	}
+	ip, self := net.ParseIP(host), net.ParseIP(selfHost)
+	if ip == nil {
+		return false
+	}
+	if selfHost != "" && !self.IsUnspecified() {
+		return ip.Equal(self)
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// cached returns a copy of the cached response for key, its TTLs counted
+// down by the time it has been cached, or nil.
+func (f *dnsForwarder) cached(key dnsCacheKey) *dns.Msg {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := f.cache[key]
+	if entry == nil {
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		delete(f.cache, key)
+		return nil
+	}
+	resp := entry.msg.Copy()
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				if h.Ttl > age {
+					h.Ttl -= age
+				} else {
+					h.Ttl = 0
+				}
+			}
+		}
+	}
+	return resp
+}
+
+// store caches resp for the lowest TTL of its records, or for negative
+// answers the SOA's minimum. Truncated responses and failures aren't
+// cached.
+func (f *dnsForwarder) store(key dnsCacheKey, resp *dns.Msg) {
+	if resp.Truncated || resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return
+	}
+	ttl, ok := uint32(0), false
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			t := h.Ttl
+			if soa, isSOA := rr.(*dns.SOA); isSOA && len(resp.Answer) == 0 && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if !ok || t < ttl {
+				ttl, ok = t, true
+			}
+		}
+	}
+	if !ok || ttl == 0 {
+		return
+	}
+	lifetime := time.Duration(ttl) * time.Second
+	if lifetime > dnsCacheMaxTTL {
+		lifetime = dnsCacheMaxTTL
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if len(f.cache) >= dnsCacheSize {
+		for k, entry := range f.cache {
+			if !now.Before(entry.expires) {
+				delete(f.cache, k)
+			}
+		}
+	}
+	// Still full, so make room by dropping any entry.
+	for k := range f.cache {
+		if len(f.cache) < dnsCacheSize {
+			break
+		}
+		delete(f.cache, k)
+	}
+	f.cache[key] = &dnsCacheEntry{msg: resp.Copy(), stored: now, expires: now.Add(lifetime)}
+}
+
+// systemResolvers returns the addresses of the resolvers the system is
+// configured with. On Linux, systemd-resolved's upstream servers are used
+// rather than its local stub.
+func systemResolvers() ([]string, error) {
+	if runtime.GOOS == "windows" {
+		out, err := exec.Command("powershell", "-NoProfile", "-Command",
+			"Get-DnsClientServerAddress | ForEach-Object { $_.ServerAddresses }").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list dns servers: %v", err)
+		}
+		var servers []string
+		for _, line := range strings.Fields(string(out)) {
+			if ip := net.ParseIP(line); ip != nil && !ip.IsLinkLocalUnicast() {
+				servers = appendUnique(servers, net.JoinHostPort(line, "53"))
+			}
+		}
+		return servers, nil
+	}
+
+	path := "/etc/resolv.conf"
+	if _, err := os.Stat("/run/systemd/resolve/resolv.conf"); err == nil {
+		path = "/run/systemd/resolve/resolv.conf"
+	}
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]string, len(conf.Servers))
+	for i, server := range conf.Servers {
+		servers[i] = net.JoinHostPort(server, conf.Port)
+	}
+	return servers, nil
+}
+
+// parseDNSUpstream parses a resolver given to --dns-upstream, an IP
+// address with an optional port.
+func parseDNSUpstream(s string) (string, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return net.JoinHostPort(s, "53"), nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || net.ParseIP(host) == nil || port == "" {
+		return "", fmt.Errorf("invalid dns upstream %q, want an ip address with an optional port, e.g. 1.1.1.1 or [::1]:5353", s)
+	}
+	return s, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dockerDomainLabel = "localbase.domain"
+	dockerPortLabel   = "localbase.port"
+)
+
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		PrivatePort int `json:"PrivatePort"`
+		PublicPort  int `json:"PublicPort"`
+	} `json:"Ports"`
+}
+
+// dockerWatcher registers domains for running containers labeled with
+// localbase.domain and localbase.port, and removes them once the
+// containers stop.
+type dockerWatcher struct {
+	lb     *LocalBase
+	client *http.Client
+	// owned maps container IDs to the domains registered for them.
+	owned map[string]string
+	// skipped holds containers whose labels couldn't be registered, so the
+	// error is only logged once.
+	skipped map[string]bool
+}
+
+func newDockerWatcher(lb *LocalBase) *dockerWatcher {
+	socket := "/var/run/docker.sock"
+	if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+		socket = strings.TrimPrefix(host, "unix://")
+	}
+
+	return &dockerWatcher{
+		lb: lb,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		owned:   make(map[string]string),
+		skipped: make(map[string]bool),
+	}
+}
+
+func (w *dockerWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := w.sync(ctx); err != nil {
+			log.Printf("docker discovery: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *dockerWatcher) sync(ctx context.Context) error {
+	containers, err := w.containers(ctx)
+	if err != nil {
+		return err
+	}
+
+	running := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		running[c.ID] = true
+		if _, ok := w.owned[c.ID]; ok || w.skipped[c.ID] {
+			continue
+		}
+
+		name := c.Labels[dockerDomainLabel]
+		port, err := containerPort(c)
+		if err != nil {
+			log.Printf("docker discovery: container %.12s: %v", c.ID, err)
+			w.skipped[c.ID] = true
+			continue
+		}
+
+		domain, err := w.lb.Add(&AddParams{Domain: name, Port: port})
+		if err != nil {
+			log.Printf("docker discovery: container %.12s: %v", c.ID, err)
+			w.skipped[c.ID] = true
+			continue
+		}
+		w.owned[c.ID] = domain.Domain
+		log.Printf("docker discovery: added %s for container %.12s on port %d", domain.Domain, c.ID, port)
+	}
+
+	for id, domain := range w.owned {
+		if running[id] {
+			continue
+		}
+		if _, err := w.lb.Remove(domain); err != nil {
+			log.Printf("docker discovery: %v", err)
+		}
+		delete(w.owned, id)
+	}
+	for id := range w.skipped {
+		if !running[id] {
+			delete(w.skipped, id)
+		}
+	}
+
+	return nil
+}
+
+func (w *dockerWatcher) containers(ctx context.Context) ([]dockerContainer, error) {
+	filters := fmt.Sprintf(`{"label":[%q]}`, dockerDomainLabel)
+	u := "http://docker/containers/json?filters=" + url.QueryEscape(filters)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query docker: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list containers: %s", resp.Status)
+	}
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// containerPort returns the host port to proxy to. If the labeled port is
+// a published container port, the host side of the mapping is used.
+func containerPort(c dockerContainer) (int, error) {
+	label, ok := c.Labels[dockerPortLabel]
+	if !ok {
+		return 0, fmt.Errorf("missing %s label", dockerPortLabel)
+	}
+
+	port, err := strconv.Atoi(label)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid %s label %q", dockerPortLabel, label)
+	}
+
+	for _, p := range c.Ports {
+		if p.PrivatePort == port && p.PublicPort != 0 {
+			return p.PublicPort, nil
+		}
+	}
+	return port, nil
+}
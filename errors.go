@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/noelukwa/localbase/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+// ErrorCode identifies a category of failure reported by the daemon.
+type ErrorCode = client.ErrorCode
+
+const (
+	CodeInternal       = client.CodeInternal
+	CodeInvalidRequest = client.CodeInvalidRequest
+	CodeDomainNotFound = client.CodeDomainNotFound
+	CodeDomainExists   = client.CodeDomainExists
+	CodeRateLimited    = client.CodeRateLimited
+	CodeUnauthorized   = client.CodeUnauthorized
+)
+
+// Error is an error carrying a protocol error code. The daemon returns it
+// to clients in the error field of a Response.
+type Error = client.Error
+
+func errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// rpcParseError is the JSON-RPC code for a request that isn't valid JSON.
+const rpcParseError = client.RPCParseError
+
+// RPCError is an Error as sent in a JSON-RPC response.
+type RPCError = client.RPCError
+
+func newRPCError(err error) *RPCError {
+	return client.NewRPCError(toError(err))
+}
+
+// Exit codes returned by the localbase CLI.
+const (
+	ExitOK               = 0
+	ExitError            = 1
+	ExitUsage            = 2
+	ExitDaemonNotRunning = 3
+	ExitDomainNotFound   = 4
+	ExitDomainExists     = 5
+)
+
+const exitCodesHelp = `
+Exit Codes:
+  0  success
+  1  generic error
+  2  usage error
+  3  daemon not running
+  4  domain not found
+  5  domain already exists
+`
+
+// exitError attaches a process exit code to an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &exitError{code: ExitUsage, err: fmt.Errorf(format, args...)}
+}
+
+// noArgs is the Args of commands that take no arguments, like cobra.NoArgs
+// but failing with a usage error. Flag errors are usage errors too, through
+// the root's flag error func.
+func noArgs(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("unknown command %q for %q", args[0], cmd.CommandPath())
+	// Cobra defaults the distance like this when it suggests commands.
+	if cmd.SuggestionsMinimumDistance <= 0 {
+		cmd.SuggestionsMinimumDistance = 2
+	}
+	if suggestions := cmd.SuggestionsFor(args[0]); len(suggestions) > 0 {
+		msg += "\n\nDid you mean this?\n\t" + strings.Join(suggestions, "\n\t")
+	}
+	return usageErrorf("%s", msg)
+}
+
+// rangeArgs returns the Args of commands that take min to max arguments,
+// failing with usage as a usage error otherwise.
+func rangeArgs(min, max int, usage string) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) < min || len(args) > max {
+			return usageErrorf("%s", usage)
+		}
+		return nil
+	}
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+
+	var pe *Error
+	if errors.As(err, &pe) {
+		switch pe.Code {
+		case CodeInvalidRequest:
+			return ExitUsage
+		case CodeDomainNotFound:
+			return ExitDomainNotFound
+		case CodeDomainExists:
+			return ExitDomainExists
+		}
+	}
+	return ExitError
+}
+
+// toError converts err into a protocol Error, treating errors without a
+// code as internal.
+func toError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: CodeInternal, Message: err.Error()}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestArgsValidators(t *testing.T) {
+	cmd := &cobra.Command{Use: "list"}
+	cmd.Flags().String("group", "", "")
+	grouped := &cobra.Command{Use: "pause"}
+	grouped.Flags().String("group", "", "")
+	grouped.Flags().Set("group", "shop")
+
+	tests := []struct {
+		name string
+		cmd  *cobra.Command
+		args cobra.PositionalArgs
+		in   []string
+		want int
+	}{
+		{name: "no args", cmd: cmd, args: noArgs, want: ExitOK},
+		{name: "unexpected arg", cmd: cmd, args: noArgs, in: []string{"x"}, want: ExitUsage},
+		{name: "in range", cmd: cmd, args: rangeArgs(1, 2, "usage"), in: []string{"x"}, want: ExitOK},
+		{name: "too few args", cmd: cmd, args: rangeArgs(1, 2, "usage"), want: ExitUsage},
+		{name: "too many args", cmd: cmd, args: rangeArgs(1, 2, "usage"), in: []string{"x", "y", "z"}, want: ExitUsage},
+		{name: "domain", cmd: cmd, args: domainOrGroupArgs, in: []string{"x"}, want: ExitOK},
+		{name: "no domain", cmd: cmd, args: domainOrGroupArgs, want: ExitUsage},
+		{name: "group", cmd: grouped, args: domainOrGroupArgs, want: ExitOK},
+		{name: "domain and group", cmd: grouped, args: domainOrGroupArgs, in: []string{"x"}, want: ExitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.args(tt.cmd, tt.in)); got != tt.want {
+				t.Errorf("%v: got exit code %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCommandsValidateArgs checks that every command validates its args,
+// as cobra's own errors for them aren't usage errors.
+func TestCommandsValidateArgs(t *testing.T) {
+	var walk func(cmd *cobra.Command)
+	walk = func(cmd *cobra.Command) {
+		if cmd.Args == nil {
+			t.Errorf("%s has no Args", cmd.CommandPath())
+		}
+		for _, sub := range cmd.Commands() {
+			walk(sub)
+		}
+	}
+	walk(rootCmd)
+
+	err := rootCmd.Args(rootCmd, []string{"lsit"})
+	if exitCode(err) != ExitUsage || !strings.Contains(err.Error(), "list") {
+		t.Errorf("got %v for an unknown command, want a usage error suggesting list", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/noelukwa/localbase/pkg/client"
+)
+
+// Event types published to subscribers.
+const (
+	EventDomainAdded    = client.EventDomainAdded
+	EventDomainUpdated  = client.EventDomainUpdated
+	EventDomainRemoved  = client.EventDomainRemoved
+	EventIPChanged      = client.EventIPChanged
+	EventCaddyRestarted = client.EventCaddyRestarted
+	EventUpstreamDown   = client.EventUpstreamDown
+	EventUpstreamUp     = client.EventUpstreamUp
+	EventNameConflict   = client.EventNameConflict
+	EventDomainPaused   = client.EventDomainPaused
+	EventDomainResumed  = client.EventDomainResumed
+)
+
+// eventBuffer is how many events a slow subscriber may fall behind before
+// events are dropped for it.
+const eventBuffer = 64
+
+// Event is a change in daemon state, streamed to subscribers.
+type Event = client.Event
+
+// SubscribeParams optionally limits a subscription to some event types.
+type SubscribeParams = client.SubscribeParams
+
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]map[string]bool
+}
+
+// subscribe returns a channel receiving events of the given types, or all
+// events if types is empty. The channel is closed by unsubscribe or when
+// the bus is closed.
+func (b *eventBus) subscribe(types []string) chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var filter map[string]bool
+	if len(types) > 0 {
+		filter = make(map[string]bool, len(types))
+		for _, t := range types {
+			filter[t] = true
+		}
+	}
+
+	ch := make(chan Event, eventBuffer)
+	if b.subs == nil {
+		b.subs = make(map[chan Event]map[string]bool)
+	}
+	b.subs[ch] = filter
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends ev to every interested subscriber without blocking.
+func (b *eventBus) publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, filter := range b.subs {
+		if filter != nil && !filter[ev.Type] {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("Warning: dropping %s event for slow subscriber", ev.Type)
+		}
+	}
+}
+
+// close ends every subscription.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		close(ch)
+	}
+	b.subs = nil
+}
+
+// watchCaddy publishes caddy_restarted when Caddy becomes reachable again
+// after being down.
+func (lb *LocalBase) watchCaddy(ctx context.Context, caddyAdmin string) {
+	ticker := time.NewTicker(upstreamProbeInterval)
+	defer ticker.Stop()
+
+	reachable := true
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		running, _ := isCaddyRunning(caddyAdmin)
+		if running && !reachable {
+			log.Println("Caddy is reachable again")
+			lb.events.publish(Event{Type: EventCaddyRestarted})
+		} else if !running && reachable {
+			log.Printf("Warning: Caddy is unreachable at %s", caddyAdmin)
+		}
+		reachable = running
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func exportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Args:  noArgs,
+		Short: "Export registered domains as JSON or a Caddyfile",
+		Long: `Print all registered domains, with their options, as JSON suitable for
+localbase import. With --format caddyfile, print the routes localbase
+configures in Caddy as an equivalent Caddyfile instead, to inspect them or
+to run Caddy without localbase.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			if format != "json" && format != "caddyfile" {
+				return usageErrorf("invalid --format %q, want json or caddyfile", format)
+			}
+			domains, err := listDomains(clientTimeout())
+			if err != nil {
+				return err
+			}
+
+			if format == "caddyfile" {
+				cfg, err := readConfig()
+				if err != nil {
+					return fmt.Errorf("failed to read config: %v", err)
+				}
+				// Local-only domains are served to the reflected
+				// bridges too.
+				reflectInterfaces = cfg.MDNSReflect
+				return writeCaddyfile(os.Stdout, domains, cfg)
+			}
+
+			list := ListResult{Domains: domains}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(&list)
+		},
+	}
+	cmd.Flags().String("format", "json", "output format: json or caddyfile")
+	return cmd
+}
+
+func importCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "import <file>",
+		Args:  rangeArgs(1, 1, "usage: localbase import <file>"),
+		Short: "Register domains from an export",
+		Long: `Register every domain in a file written by localbase export. Use - to read
+from stdin. Domains that are already registered are skipped, so importing the
+same file twice is safe.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+
+			var list ListResult
+			if err := json.NewDecoder(r).Decode(&list); err != nil {
+				return fmt.Errorf("invalid export file: %v", err)
+			}
+			return importDomains(list.Domains)
+		},
+	}
+}
+
+// importDomains registers domains in one batch, skipping those already
+// registered, and prints the outcome of each.
+func importDomains(domains []Domain) error {
+	calls := make([]*batchCall, len(domains))
+	for i, d := range domains {
+		params := &AddParams{Domain: d.Domain, Port: d.Port, Aliases: d.Aliases, DomainInfo: d.DomainInfo, RouteOptions: d.RouteOptions}
+		calls[i] = &batchCall{Method: "add", Params: params}
+	}
+	if err := callBatch(calls); err != nil {
+		return err
+	}
+
+	var failed int
+	for i, d := range domains {
+		err := calls[i].Err
+		switch {
+		case err == nil:
+			fmt.Printf("%s: added\n", d.Domain)
+		case exitCode(err) == ExitDomainExists:
+			fmt.Printf("%s: already registered\n", d.Domain)
+		default:
+			fmt.Printf("%s: %v\n", d.Domain, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d domains failed to import", failed, len(domains))
+	}
+	return nil
+}
@@ -5,18 +5,23 @@ go 1.21.0
 toolchain go1.22.3
 
 require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/Microsoft/go-winio v0.6.2
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/miekg/dns v1.1.59
 	github.com/mitchellh/go-homedir v1.1.0
-	github.com/oleksandr/bonjour v0.0.0-20210301155756-30f43c61b915
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/spf13/cobra v1.8.1
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/crypto v0.23.0
+	golang.org/x/net v0.25.0
+	golang.org/x/sys v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/miekg/dns v1.1.59 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
 	golang.org/x/tools v0.21.0 // indirect
 )
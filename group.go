@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func pauseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pause <domain>",
+		Args:  domainOrGroupArgs,
+		Short: "Stop routing a domain without removing it",
+		Long: `Pause a domain, or with --group every domain in a group. A paused domain
+stays registered, keeping its port, aliases and options, but its Caddy routes,
+mDNS records and hosts file entries are removed until it is resumed.`,
+		ValidArgsFunction: completeDomains,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pauseOrResume(cmd, args, "pause", "Paused")
+		},
+	}
+	cmd.Flags().String("group", "", "pause every domain in this group")
+	return cmd
+}
+
+func resumeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "resume <domain>",
+		Args:              domainOrGroupArgs,
+		Short:             "Route a paused domain again",
+		Long:              `Resume a paused domain, or with --group every domain in a group.`,
+		ValidArgsFunction: completeDomains,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pauseOrResume(cmd, args, "resume", "Resumed")
+		},
+	}
+	cmd.Flags().String("group", "", "resume every domain in this group")
+	return cmd
+}
+
+func pauseOrResume(cmd *cobra.Command, args []string, method, done string) error {
+	if group, _ := cmd.Flags().GetString("group"); group != "" {
+		return groupCall(method, group, done)
+	}
+	var domain Domain
+	if err := call(method, &PauseParams{Domain: args[0]}, &domain); err != nil {
+		return err
+	}
+	return printResult(cmd, &domain, func() {
+		fmt.Printf("%s domain: %s\n", done, domain.Domain)
+	})
+}
+
+// domainOrGroupArgs is the Args of remove, pause and resume, which take
+// either a domain or --group.
+func domainOrGroupArgs(cmd *cobra.Command, args []string) error {
+	group, _ := cmd.Flags().GetString("group")
+	if group == "" && len(args) == 1 || group != "" && len(args) == 0 {
+		return nil
+	}
+	return usageErrorf("usage: localbase %s <domain> | --group <group>", cmd.Name())
+}
+
+// groupCall calls method, remove, pause or resume, for every domain in
+// group in one batch, printing each outcome like down does.
+func groupCall(method, group, done string) error {
+	if err := validateGroup(group); err != nil {
+		return usageErrorf("%v", err)
+	}
+	domains, err := listDomains(clientTimeout())
+	if err != nil {
+		return err
+	}
+	var names []string
+	var calls []*batchCall
+	for _, d := range domains {
+		if d.Group != group {
+			continue
+		}
+		var params interface{} = &PauseParams{Domain: d.Domain}
+		if method == "remove" {
+			params = &RemoveParams{Domain: d.Domain}
+		}
+		names = append(names, d.Domain)
+		calls = append(calls, &batchCall{Method: method, Params: params, Result: &Domain{}})
+	}
+	if len(calls) == 0 {
+		return &exitError{code: ExitDomainNotFound, err: fmt.Errorf("no domains in group %s", group)}
+	}
+	if err := callBatch(calls); err != nil {
+		return err
+	}
+
+	var failed int
+	for i, c := range calls {
+		domain := c.Result.(*Domain)
+		switch {
+		case c.Err != nil:
+			fmt.Printf("%s: %v\n", names[i], c.Err)
+			failed++
+		default:
+			fmt.Printf("%s domain: %s\n", done, domain.Domain)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d domains in group %s failed", failed, len(calls), group)
+	}
+	return nil
+}
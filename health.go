@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/noelukwa/localbase/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+// Health types shared with the client package.
+type (
+	HealthCheck = client.HealthCheck
+	Health      = client.Health
+)
+
+// Health runs every health check.
+func (lb *LocalBase) Health() (*Health, error) {
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	checks := []HealthCheck{
+		checkCaddy(config.CaddyAdmin),
+		lb.checkMDNS(config.MDNS),
+		checkStateWritable(),
+		checkIP(),
+		lb.checkDomainsSynced(config.CaddyAdmin),
+	}
+
+	health := &Health{Healthy: true, Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			health.Healthy = false
+		}
+	}
+	return health, nil
+}
+
+func checkCaddy(caddyAdmin string) HealthCheck {
+	check := HealthCheck{Name: "caddy_admin_reachable", Detail: caddyAdmin}
+	ok, err := isCaddyRunning(caddyAdmin)
+	check.OK = ok
+	if err != nil {
+		check.Detail = fmt.Sprintf("%s: %v", caddyAdmin, err)
+	}
+	return check
+}
+
+func (lb *LocalBase) checkMDNS(mode string) HealthCheck {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if mode == "off" {
+		return HealthCheck{Name: "mdns_ok", OK: true, Detail: "mdns is off"}
+	}
+	if lb.mdns == nil {
+		return HealthCheck{Name: "mdns_ok", Detail: "the mdns responder isn't running, see the daemon log"}
+	}
+	return HealthCheck{Name: "mdns_ok", OK: true, Detail: fmt.Sprintf("%d names advertised", lb.mdns.count())}
+}
+
+// checkStateWritable checks that the config dir, which holds the pid file,
+// audit log and tokens, can be written.
+func checkStateWritable() HealthCheck {
+	check := HealthCheck{Name: "state_file_writable"}
+	configDir, err := getConfigDir()
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.Detail = configDir
+
+	f, err := os.CreateTemp(configDir, ".health-*")
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	check.OK = true
+	return check
+}
+
+func checkIP() HealthCheck {
+	ip, err := getLocalIP()
+	if err != nil {
+		return HealthCheck{Name: "ip_detected", Detail: err.Error()}
+	}
+	if ip6 := getLocalIPv6(ip); ip6 != "" {
+		ip += " " + ip6
+	}
+	return HealthCheck{Name: "ip_detected", OK: true, Detail: ip}
+}
+
+// checkDomainsSynced checks that Caddy has a route for every registered
+// domain.
+func (lb *LocalBase) checkDomainsSynced(caddyAdmin string) HealthCheck {
+	check := HealthCheck{Name: "domains_synced"}
+
+	config, err := getCaddyConfig(caddyAdmin)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	routes := caddyServerRoutes(config)
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	var missing []string
+	routed := 0
+	for domain, rec := range lb.records {
+		if rec.paused {
+			continue
+		}
+		routed++
+		found := false
+		for _, r := range routes {
+			if routeOwnedBy(r, domain) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, domain)
+		}
+	}
+
+	if len(missing) > 0 {
+		check.Detail = "missing Caddy routes for " + strings.Join(missing, ", ")
+		return check
+	}
+	check.OK = true
+	check.Detail = fmt.Sprintf("%d domains routed", routed)
+	return check
+}
+
+func healthCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "health",
+		Args:  noArgs,
+		Short: "Check daemon health",
+		Long: `Run the daemon's health checks: whether Caddy is reachable, mDNS adverts are
+registered, the config dir is writable, a local IP was found and every domain
+has a Caddy route. Exits non-zero if any check fails.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var health Health
+			if err := call("health", nil, &health); err != nil {
+				return err
+			}
+			if err := printResult(cmd, &health, func() {
+				for _, c := range health.Checks {
+					status := "ok"
+					if !c.OK {
+						status = "FAIL"
+					}
+					fmt.Printf("%-22s %-4s %s\n", c.Name, status, c.Detail)
+				}
+			}); err != nil {
+				return err
+			}
+			if !health.Healthy {
+				return fmt.Errorf("daemon is unhealthy")
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hooks are executables in the hooks dir named after the point they run
+// at, like git hooks. A failing pre- hook aborts the operation; post- hook
+// failures are only logged.
+const (
+	HookPreAdd       = "pre-add"
+	HookPostAdd      = "post-add"
+	HookPreRemove    = "pre-remove"
+	HookPostRemove   = "post-remove"
+	HookPreShutdown  = "pre-shutdown"
+	HookPostShutdown = "post-shutdown"
+)
+
+// hookTimeout bounds how long a hook may run.
+const hookTimeout = 30 * time.Second
+
+// hookInput is written to a hook's stdin as JSON.
+type hookInput struct {
+	Hook   string  `json:"hook"`
+	Domain *Domain `json:"domain,omitempty"`
+}
+
+func getHooksDir() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "hooks"), nil
+}
+
+// hookPath returns the executable for hook, or "" if there is none.
+func hookPath(hook string) string {
+	dir, err := getHooksDir()
+	if err != nil {
+		return ""
+	}
+	names := []string{hook}
+	if runtime.GOOS == "windows" {
+		names = []string{hook + ".exe", hook + ".cmd", hook + ".bat"}
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// runHook runs hook, if installed, for d, which is nil for daemon-wide
+// hooks. The domain is passed as LOCALBASE_DOMAIN, LOCALBASE_PORT and
+// LOCALBASE_ALIASES, and as JSON on stdin.
+func runHook(hook string, d *Domain) error {
+	path := hookPath(hook)
+	if path == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	input, err := json.Marshal(&hookInput{Hook: hook, Domain: d})
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), "LOCALBASE_HOOK="+hook)
+	if d != nil {
+		cmd.Env = append(cmd.Env,
+			"LOCALBASE_DOMAIN="+d.Domain,
+			"LOCALBASE_PORT="+strconv.Itoa(d.Port),
+			"LOCALBASE_ALIASES="+strings.Join(d.Aliases, ","),
+		)
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err = cmd.Run()
+	out := strings.TrimSpace(output.String())
+	if out != "" {
+		log.Printf("%s hook: %s", hook, out)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s hook timed out after %s", hook, hookTimeout)
+	}
+	if err != nil && out != "" {
+		return fmt.Errorf("%s hook failed: %v: %s", hook, err, out)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %v", hook, err)
+	}
+	return nil
+}
+
+// runPostHook runs a post- hook, logging rather than returning failures
+// since the operation has already happened.
+func runPostHook(hook string, d *Domain) {
+	if err := runHook(hook, d); err != nil {
+		log.Printf("Error: %v", err)
+	}
+}
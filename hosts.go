@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// hostsBlockBegin and hostsBlockEnd mark the block localbase manages in
+// the hosts file. Each profile has its own block.
+func hostsBlockBegin() string {
+	return "# BEGIN " + profileName("localbase") + " managed block, do not edit"
+}
+
+func hostsBlockEnd() string {
+	return "# END " + profileName("localbase") + " managed block"
+}
+
+func defaultHostsFile() string {
+	if runtime.GOOS == "windows" {
+		return `C:\Windows\System32\drivers\etc\hosts`
+	}
+	return "/etc/hosts"
+}
+
+// writeHostsBlock replaces the localbase block in the hosts file at path
+// with one entry per host, leaving the rest of the file untouched. An
+// empty hosts list removes the block.
+func writeHostsBlock(path string, hosts []string, ip string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return hostsError(path, err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(stripHostsBlock(string(data)))
+
+	if len(hosts) > 0 {
+		sorted := append([]string(nil), hosts...)
+		sort.Strings(sorted)
+
+		if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(hostsBlockBegin() + "\n")
+		for _, host := range sorted {
+			fmt.Fprintf(&buf, "%s\t%s\n", ip, host)
+		}
+		buf.WriteString(hostsBlockEnd() + "\n")
+	}
+
+	// Write in place rather than renaming, /etc/hosts is often a bind mount.
+	if err := os.WriteFile(path, buf.Bytes(), info.Mode().Perm()); err != nil {
+		return hostsError(path, err)
+	}
+	return nil
+}
+
+func stripHostsBlock(content string) string {
+	var out []string
+	inBlock := false
+	begin, end := hostsBlockBegin(), hostsBlockEnd()
+	for _, line := range strings.SplitAfter(content, "\n") {
+		switch strings.TrimSpace(line) {
+		case begin:
+			inBlock = true
+			continue
+		case end:
+			inBlock = false
+			continue
+		}
+		if !inBlock {
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "")
+}
+
+func hostsError(path string, err error) error {
+	if os.IsPermission(err) {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("writing %s requires administrator rights, start localbase from an elevated prompt or pass --hosts=false", path)
+		}
+		return fmt.Errorf("writing %s requires root, start localbase with sudo", path)
+	}
+	return err
+}
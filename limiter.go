@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientLimiter enforces per-client request rates and connection counts on
+// the admin listener. Clients are keyed by remote IP, or by user for unix
+// sockets. Zero limits are disabled.
+type clientLimiter struct {
+	rate     float64
+	burst    float64
+	maxConns int
+
+	mu      sync.Mutex
+	clients map[string]*clientState
+}
+
+type clientState struct {
+	tokens float64
+	last   time.Time
+	conns  int
+}
+
+// idleClientTTL is how long state for a disconnected client is kept. By
+// then its bucket has refilled, so forgetting it changes nothing.
+const idleClientTTL = time.Minute
+
+func newClientLimiter(rate float64, maxConns int) *clientLimiter {
+	return &clientLimiter{
+		rate:     rate,
+		burst:    2 * rate,
+		maxConns: maxConns,
+		clients:  make(map[string]*clientState),
+	}
+}
+
+// state returns the state for key, creating it with a full bucket. l.mu
+// must be held.
+func (l *clientLimiter) state(key string, now time.Time) *clientState {
+	s, ok := l.clients[key]
+	if !ok {
+		s = &clientState{tokens: l.burst, last: now}
+		l.clients[key] = s
+	}
+	return s
+}
+
+// connect registers a new connection from key, reporting false if the
+// client already has too many open.
+func (l *clientLimiter) connect(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.state(key, time.Now())
+	if l.maxConns > 0 && s.conns >= l.maxConns {
+		return false
+	}
+	s.conns++
+	return true
+}
+
+func (l *clientLimiter) disconnect(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s, ok := l.clients[key]; ok {
+		s.conns--
+	}
+
+	now := time.Now()
+	for k, s := range l.clients {
+		if s.conns == 0 && now.Sub(s.last) > idleClientTTL {
+			delete(l.clients, k)
+		}
+	}
+}
+
+// allow takes a token from key's bucket, reporting false if it is empty.
+func (l *clientLimiter) allow(key string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	s := l.state(key, now)
+	s.tokens += now.Sub(s.last).Seconds() * l.rate
+	if s.tokens > l.burst {
+		s.tokens = l.burst
+	}
+	s.last = now
+
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// clientKey identifies the client behind conn for rate limiting.
+func clientKey(conn net.Conn) string {
+	if uc, ok := conn.(*net.UnixConn); ok {
+		// Limit by user rather than by process.
+		cred := peerCredentials(uc)
+		uid, _, _ := strings.Cut(cred, " ")
+		return "unix " + uid
+	}
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// LLMNR multicast groups (RFC 4795).
+var (
+	llmnrGroupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 252), Port: 5355}
+	llmnrGroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::1:3"), Port: 5355}
+)
+
+// llmnrTTL is the TTL of answers, the default RFC 4795 recommends.
+const llmnrTTL = 30
+
+// llmnrResponder answers LLMNR queries for the single-label names of
+// registered domains, hello for hello.local, which Windows resolves over
+// LLMNR rather than mDNS. Like mDNS, names resolve to the addresses of the
+// interface a query came in on, and only interfaces on private networks
+// are answered on. Answers are a few addresses, so they are only sent over
+// UDP.
+type llmnrResponder struct {
+	lb *LocalBase
+
+	mu     sync.Mutex
+	ifaces []net.Interface
+	closed bool
+
+	conn4 *ipv4.PacketConn
+	conn6 *ipv6.PacketConn
+}
+
+// newLLMNRResponder joins the LLMNR groups on the interfaces mDNS would
+// answer on. It fails only if neither IPv4 nor IPv6 could be set up.
+func newLLMNRResponder(lb *LocalBase) (*llmnrResponder, error) {
+	r := &llmnrResponder{lb: lb}
+	ifaces, _, err := mdnsInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	r.ifaces = ifaces
+
+	// As with mDNS, binding the group addresses lets the system's own
+	// responder keep the port.
+	if c, err := net.ListenUDP("udp4", llmnrGroupIPv4); err != nil {
+		log.Printf("llmnr: failed to listen on %s: %v", llmnrGroupIPv4, err)
+	} else {
+		p := ipv4.NewPacketConn(c)
+		for i := range r.ifaces {
+			p.JoinGroup(&r.ifaces[i], llmnrGroupIPv4)
+		}
+		p.SetControlMessage(ipv4.FlagInterface, true)
+		r.conn4 = p
+	}
+	if c, err := net.ListenUDP("udp6", llmnrGroupIPv6); err != nil {
+		log.Printf("llmnr: failed to listen on %s: %v", llmnrGroupIPv6, err)
+	} else {
+		p := ipv6.NewPacketConn(c)
+		for i := range r.ifaces {
+			p.JoinGroup(&r.ifaces[i], llmnrGroupIPv6)
+		}
+		p.SetControlMessage(ipv6.FlagInterface, true)
+		r.conn6 = p
+	}
+
+	if r.conn4 == nil && r.conn6 == nil {
+		return nil, fmt.Errorf("couldn't listen on the LLMNR port")
+	}
+	return r, nil
+}
+
+// updateInterfaces joins the groups on interfaces that came up or moved to
+// a private network, and leaves them on those that moved to a public one.
+func (r *llmnrResponder) updateInterfaces() {
+	if r == nil {
+		return
+	}
+	ifaces, _, err := mdnsInterfaces()
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	allowed := make(map[int]bool, len(ifaces))
+	for _, iface := range ifaces {
+		allowed[iface.Index] = true
+	}
+	known := make(map[int]bool, len(r.ifaces))
+	var kept []net.Interface
+	for i := range r.ifaces {
+		if allowed[r.ifaces[i].Index] {
+			kept = append(kept, r.ifaces[i])
+			known[r.ifaces[i].Index] = true
+			continue
+		}
+		if r.conn4 != nil {
+			r.conn4.LeaveGroup(&r.ifaces[i], llmnrGroupIPv4)
+		}
+		if r.conn6 != nil {
+			r.conn6.LeaveGroup(&r.ifaces[i], llmnrGroupIPv6)
+		}
+	}
+	r.ifaces = kept
+	for i := range ifaces {
+		if known[ifaces[i].Index] {
+			continue
+		}
+		if r.conn4 != nil {
+			r.conn4.JoinGroup(&ifaces[i], llmnrGroupIPv4)
+		}
+		if r.conn6 != nil {
+			r.conn6.JoinGroup(&ifaces[i], llmnrGroupIPv6)
+		}
+		r.ifaces = append(r.ifaces, ifaces[i])
+		log.Printf("llmnr: answering on %s", ifaces[i].Name)
+	}
+}
+
+// serve answers queries until close is called.
+func (r *llmnrResponder) serve() {
+	if r.conn4 != nil {
+		go func() {
+			buf := make([]byte, 9000)
+			for {
+				n, cm, src, err := r.conn4.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				ifIndex := 0
+				if cm != nil {
+					ifIndex = cm.IfIndex
+				}
+				r.handle(buf[:n], src, ifIndex)
+			}
+		}()
+	}
+	if r.conn6 != nil {
+		go func() {
+			buf := make([]byte, 9000)
+			for {
+				n, cm, src, err := r.conn6.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				ifIndex := 0
+				if cm != nil {
+					ifIndex = cm.IfIndex
+				}
+				r.handle(buf[:n], src, ifIndex)
+			}
+		}()
+	}
+}
+
+func (r *llmnrResponder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	if r.conn4 != nil {
+		r.conn4.Close()
+	}
+	if r.conn6 != nil {
+		r.conn6.Close()
+	}
+}
+
+// interfaceNames lists the interfaces the groups were joined on.
+func (r *llmnrResponder) interfaceNames() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, len(r.ifaces))
+	for i, iface := range r.ifaces {
+		names[i] = iface.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// handle answers the query in packet, received from src on the interface
+// ifIndex, with a unicast reply. Queries for names that aren't registered
+// go unanswered, as RFC 4795 asks, and so do those from off the link.
+func (r *llmnrResponder) handle(packet []byte, src net.Addr, ifIndex int) {
+	var query dns.Msg
+	if err := query.Unpack(packet); err != nil || query.Response || query.Opcode != dns.OpcodeQuery || len(query.Question) != 1 {
+		return
+	}
+	addr, ok := src.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	iface := r.iface(ifIndex, addr.IP)
+	if iface == nil || !onLink(iface, addr.IP) {
+		return
+	}
+	q := query.Question[0]
+	if q.Qclass != dns.ClassINET || !r.registered(q.Name) {
+		return
+	}
+	ips := interfaceAddrs([]net.Interface{*iface})[iface.Index]
+
+	// The LLMNR header has the C and T bits where DNS has AA and RD, so
+	// the reply is built by hand rather than with SetReply.
+	resp := new(dns.Msg)
+	resp.Id = query.Id
+	resp.Response = true
+	resp.Question = query.Question
+	for _, rr := range addrRecords(q.Name, llmnrTTL, ips) {
+		rr.Header().Class = dns.ClassINET
+		switch rr.(type) {
+		case *dns.A:
+			if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		case *dns.AAAA:
+			if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+	}
+	r.send(resp, addr, iface.Index)
+}
+
+// registered reports whether name, a single label, is the name of a
+// registered .local domain.
+func (r *llmnrResponder) registered(name string) bool {
+	label := strings.TrimSuffix(strings.ToLower(name), ".")
+	if label == "" || strings.Contains(label, ".") {
+		return false
+	}
+	return r.lb.Registered(label + ".local")
+}
+
+// iface returns the interface ifIndex if the groups were joined on it. If
+// the interface is unknown, it is the one src is on.
+func (r *llmnrResponder) iface(ifIndex int, src net.IP) *net.Interface {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.ifaces {
+		iface := r.ifaces[i]
+		if iface.Index == ifIndex || ifIndex == 0 && !src.IsLinkLocalUnicast() && onLink(&iface, src) {
+			return &iface
+		}
+	}
+	return nil
+}
+
+// onLink reports whether ip is on a subnet of iface. IPv6 link-local
+// addresses always are.
+func onLink(iface *net.Interface, ip net.IP) bool {
+	if ip.IsLinkLocalUnicast() {
+		return true
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *llmnrResponder) send(msg *dns.Msg, dst *net.UDPAddr, ifIndex int) {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return
+	}
+
+	packet, err := msg.Pack()
+	if err != nil {
+		log.Printf("llmnr: failed to pack response: %v", err)
+		return
+	}
+	if dst.IP.To4() != nil {
+		if r.conn4 != nil {
+			_, err = r.conn4.WriteTo(packet, &ipv4.ControlMessage{IfIndex: ifIndex}, dst)
+		}
+	} else if r.conn6 != nil {
+		_, err = r.conn6.WriteTo(packet, &ipv6.ControlMessage{IfIndex: ifIndex}, dst)
+	}
+	if err != nil {
+		log.Printf("llmnr: failed to send to %s: %v", dst, err)
+	}
+}
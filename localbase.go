@@ -4,163 +4,824 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/oleksandr/bonjour"
+	"github.com/noelukwa/localbase/pkg/client"
 )
 
 type Record struct {
-	service string
-	host    string
-	server  *bonjour.Server
+	aliases []string
+	hosts   []string
+	port    int
+	info    DomainInfo
+	opts    RouteOptions
+	// adverts are the record's .local names as the mDNS responder
+	// answers for them.
+	adverts []*mdnsHost
+	// upstream is the last probed state of port, empty until probed.
+	upstream string
+	// paused records keep their names but have no Caddy routes, mDNS
+	// adverts or hosts file entries.
+	paused bool
+	// httpPort and httpsPort are the ports Caddy serves the record's names
+	// on.
+	httpPort, httpsPort int
 }
 
 type LocalBase struct {
-	records map[string]*Record
-	mu      sync.Mutex
+	records   map[string]*Record
+	mu        sync.Mutex
+	startedAt time.Time
+	hostsFile string
+	// ip and ip6 are the addresses names resolve to. ip6 is empty if there
+	// is no IPv6 address.
+	ip  string
+	ip6 string
+	// ranges are the addresses requests from this machine come from, which
+	// the routes of domains not exposed to the LAN are limited to. rangesChanged is signalled when
+	// they change so the routes are rebuilt.
+	ranges        []string
+	rangesChanged chan struct{}
+	events        eventBus
+	audit         *auditLog
+	// requireAuth rejects requests that don't carry a token.
+	requireAuth bool
+	// caddyVersion is the detected Caddy version, zero if unknown.
+	caddyVersion caddyVersion
+	// suffix is the suffix of domains added without one.
+	suffix string
+	// mdns advertises the .local names, nil if it is off or couldn't be
+	// started.
+	mdns mdnsAdvertiser
+	// llmnr answers for the names over LLMNR, nil if it is off.
+	llmnr *llmnrResponder
+	// journal is the changes undo can revert, oldest first. journalMu is
+	// held throughout an undo, so it is taken before mu.
+	journal   []Change
+	journalMu sync.Mutex
 }
 
 func NewLocalBase() *LocalBase {
 	return &LocalBase{
-		records: make(map[string]*Record),
+		records:       make(map[string]*Record),
+		startedAt:     time.Now(),
+		suffix:        "local",
+		rangesChanged: make(chan struct{}, 1),
 	}
 }
 
-func (lb *LocalBase) List() []string {
+// domainLabel strips surrounding whitespace and the .local suffix from name.
+func domainLabel(name string) string {
+	return strings.TrimSuffix(strings.TrimSpace(name), ".local")
+}
+
+// qualifyDomain adds suffix to name unless it already ends in suffix or
+// .local. It returns "" for an empty name.
+func qualifyDomain(name, suffix string) string {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" || strings.HasSuffix(name, ".local") || strings.HasSuffix(name, "."+suffix) {
+		return name
+	}
+	return name + "." + suffix
+}
+
+// caddyHosts returns the hosts Caddy serves a domain's names on: each name,
+// and for .local names the bare label when LLMNR answers for it and the
+// label under each DNS TLD.
+func caddyHosts(names []string, cfg *Config) []string {
+	var hosts []string
+	for _, name := range names {
+		hosts = append(hosts, name)
+		label, ok := strings.CutSuffix(name, ".local")
+		if !ok {
+			continue
+		}
+		if cfg.LLMNR && !strings.Contains(label, ".") {
+			hosts = append(hosts, label)
+		}
+		if cfg.DNSAddress != "" {
+			for _, tld := range cfg.DNSTLDs {
+				hosts = append(hosts, fmt.Sprintf("%s.%s", label, strings.Trim(tld, ".")))
+			}
+		}
+	}
+	return hosts
+}
+
+// validateSuffix checks that suffix is one or more DNS labels.
+func validateSuffix(suffix string) error {
+	if !validDomainName(suffix) {
+		return fmt.Errorf("invalid domain suffix %q, want e.g. test or dev.localhost", suffix)
+	}
+	return nil
+}
+
+// validDomainName reports whether name is a lowercase host name of any
+// number of labels, such as auth.api.myapp.local.
+func validDomainName(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") ||
+			strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// qualify returns the name a domain given by a client is registered under:
+// the name itself if it's registered as is, or else the name with the
+// default suffix. lb.mu must be held.
+func (lb *LocalBase) qualify(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if _, rec := lb.lookup(name); rec != nil {
+		return name
+	}
+	return qualifyDomain(name, lb.suffix)
+}
+
+func (lb *LocalBase) List() []Domain {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
-	domains := make([]string, 0, len(lb.records))
-	for domain := range lb.records {
-		domains = append(domains, domain)
+	domains := make([]Domain, 0, len(lb.records))
+	for domain, rec := range lb.records {
+		domains = append(domains, rec.domain(domain))
 	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Domain < domains[j].Domain
+	})
 	return domains
 }
 
-func (lb *LocalBase) Add(domain string, port int) error {
+// Registered reports whether domain is currently registered, either as a
+// domain or as an alias, and not paused, so its names should resolve.
+func (lb *LocalBase) Registered(domain string) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	_, rec := lb.lookup(domain)
+	return rec != nil && !rec.paused
+}
+
+// lookup finds the record serving domain and the domain it is registered
+// under. lb.mu must be held.
+func (lb *LocalBase) lookup(domain string) (string, *Record) {
+	if rec, ok := lb.records[domain]; ok {
+		return domain, rec
+	}
+	for primary, rec := range lb.records {
+		for _, alias := range rec.aliases {
+			if alias == domain {
+				return primary, rec
+			}
+		}
+	}
+	return "", nil
+}
+
+// recordNames returns the domain and aliases of the record name refers to,
+// resolved as Remove and Get resolve it, or nil if there is none.
+func (lb *LocalBase) recordNames(name string) []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	primary, rec := lb.lookup(lb.qualify(name))
+	if rec == nil {
+		primary, rec, _ = lb.find(name)
+	}
+	if rec == nil {
+		return nil
+	}
+	return append([]string{primary}, rec.aliases...)
+}
+
+// serves reports whether a registered domain serves name, including its
+// names under the DNS TLDs. lb.mu must be held.
+func (lb *LocalBase) serves(name string) bool {
+	for _, rec := range lb.records {
+		for _, host := range rec.hosts {
+			if host == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Get returns the domain serving hostname, which may be a registered
+// domain, an alias or one of their names under a DNS TLD. A name that
+// isn't served as is is looked up under the default suffix.
+func (lb *LocalBase) Get(hostname string) (*Domain, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	primary, rec, err := lb.find(hostname)
+	if err != nil {
+		return nil, err
+	}
+	d := rec.domain(primary)
+	return &d, nil
+}
+
+// find returns the domain serving hostname and its record, looking the
+// name up under the default suffix if it isn't served as is. lb.mu must be
+// held.
+func (lb *LocalBase) find(hostname string) (string, *Record, error) {
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+	if !lb.serves(name) {
+		name = qualifyDomain(name, lb.suffix)
+	}
+
+	if primary, rec := lb.lookup(name); rec != nil {
+		return primary, rec, nil
+	}
+	for primary, rec := range lb.records {
+		for _, host := range rec.hosts {
+			if host == name {
+				return primary, rec, nil
+			}
+		}
+	}
+	return "", nil, errorf(CodeDomainNotFound, "domain %s not registered", name)
+}
+
+func (lb *LocalBase) Add(params *AddParams) (*Domain, error) {
+	names, err := lb.addNames(params)
+	if err != nil {
+		return nil, err
+	}
+	// Probing and hooks take a while, so they run without the lock.
+	if err := lb.claimNames(names, params.Rename); err != nil {
+		return nil, err
+	}
+	if err := runHook(HookPreAdd, &Domain{Domain: names[0], Port: params.Port, Aliases: names[1:], DomainInfo: params.DomainInfo, RouteOptions: params.RouteOptions}); err != nil {
+		return nil, err
+	}
+
+	domain, err := lb.addRecord(names, params)
+	if err != nil {
+		return nil, err
+	}
+	if domain.ExposeLAN {
+		lb.warnLANListener(domain)
+	}
+	runPostHook(HookPostAdd, domain)
+	return domain, nil
+}
+
+// addRecord registers the record for names, the domain and aliases params
+// asks for, and adds its Caddy routes and mDNS adverts.
+func (lb *LocalBase) addRecord(names []string, params *AddParams) (*Domain, error) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
+	// Another add may have claimed a name since addNames checked it.
+	for _, name := range names {
+		if lb.serves(name) {
+			return nil, errorf(CodeDomainExists, "domain %s already registered", name)
+		}
+	}
 	config, err := readConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	localIP, err := getLocalIP()
 	if err != nil {
-		log.Fatalln("Error getting local IP:", err.Error())
+		return nil, fmt.Errorf("failed to get local IP: %v", err)
 	}
-	log.Println("Local IP:", localIP)
+	localIP6 := getLocalIPv6(localIP)
+	log.Println("Local IP:", localIP, localIP6)
+	lb.setIP(localIP, localIP6)
 
-	clean := strings.TrimSpace(domain)
-	fullDomain := fmt.Sprintf("%s.local", clean)
-	if _, exists := lb.records[fullDomain]; exists {
-		return fmt.Errorf("domain %s already registered", fullDomain)
+	record := &Record{
+		aliases:   names[1:],
+		port:      params.Port,
+		info:      params.DomainInfo,
+		opts:      params.RouteOptions,
+		httpPort:  config.httpPort(),
+		httpsPort: config.httpsPort(),
 	}
-	fullHost := fmt.Sprintf("%s.", fullDomain)
 
-	service := fmt.Sprintf("_%s._tcp", clean)
-	// Register nodecrane service
-	s1, err := bonjour.RegisterProxy(
-		"localbase",
-		service,
-		"",
-		80,
-		fullHost,
-		localIP,
-		[]string{},
-		nil)
+	// Only .local names are advertised over mDNS, the rest resolve through
+	// the hosts file or the DNS server.
+	record.hosts = caddyHosts(names, config)
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".local") {
+			if !strings.HasSuffix(name, ".localhost") && lb.hostsFile == "" && config.DNSAddress == "" {
+				log.Printf("Warning: %s won't resolve without --hosts or --dns", name)
+			}
+			continue
+		}
+		record.adverts = append(record.adverts, &mdnsHost{name: name + "."})
+	}
 
-	if err != nil {
-		log.Fatalln("Error registering frontend service:", err.Error())
+	record.setAdverts(names[0])
+	lb.records[names[0]] = record
+
+	if err := addCaddyServerBlock(record.hosts, record.port, &record.opts, config); err != nil {
+		delete(lb.records, names[0])
+		return nil, fmt.Errorf("failed to add Caddy server block: %v", err)
+	}
+	if lb.mdns != nil {
+		lb.mdns.add(record.adverts...)
 	}
 
-	lb.records[fullDomain] = &Record{
-		service: service,
-		host:    fullHost,
-		server:  s1,
+	if err := lb.syncHostsFile(); err != nil {
+		log.Printf("Error updating hosts file: %v", err)
 	}
+	domain := record.domain(names[0])
+	lb.events.publish(Event{Type: EventDomainAdded, Domain: domain.Domain, Port: domain.Port})
+	return &domain, nil
+}
 
-	if err := addCaddyServerBlock([]string{fullDomain}, port, config.CaddyAdmin); err != nil {
-		s1.Shutdown()
-		delete(lb.records, domain)
-		return fmt.Errorf("failed to add Caddy server block: %v", err)
+// addNames returns the qualified domain and aliases params asks for,
+// checking that they are valid and not already registered.
+func (lb *LocalBase) addNames(params *AddParams) ([]string, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	suffix := lb.suffix
+	if params.Suffix != "" {
+		if err := validateSuffix(params.Suffix); err != nil {
+			return nil, errorf(CodeInvalidRequest, "%v", err)
+		}
+		suffix = params.Suffix
+	}
+
+	given := append([]string{params.Domain}, params.Aliases...)
+	seen := make(map[string]bool, len(given))
+	names := make([]string, 0, len(given))
+	for _, g := range given {
+		name := qualifyDomain(g, suffix)
+		if name == "" {
+			return nil, errorf(CodeInvalidRequest, "domain names must not be empty")
+		}
+		if !validDomainName(name) {
+			return nil, errorf(CodeInvalidRequest, "invalid domain name %q, labels may only have letters, digits and hyphens", g)
+		}
+		if seen[name] {
+			return nil, errorf(CodeInvalidRequest, "%s is listed more than once", name)
+		}
+		seen[name] = true
+		if lb.serves(name) {
+			return nil, errorf(CodeDomainExists, "domain %s already registered", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// claimNames probes the LAN for the .local names among names, so a name
+// another host already answers for isn't fought over. With rename, such a
+// name is replaced in names by the first free one of name-2.local through
+// name-9.local. lb.mu must not be held, as probing takes a while.
+func (lb *LocalBase) claimNames(names []string, rename bool) error {
+	if lb.mdns == nil {
+		return nil
+	}
+	var local []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".local") {
+			local = append(local, name)
+		}
+	}
+	taken := make(map[string]bool)
+	for _, name := range lb.mdns.probe(local...) {
+		taken[name] = true
+	}
+	for i, name := range names {
+		if !taken[name] {
+			continue
+		}
+		if !rename {
+			return errorf(CodeDomainExists, "%s is already in use by another host on the network, pick another name or pass --rename", name)
+		}
+		label := strings.TrimSuffix(name, ".local")
+		renamed := ""
+		for n := 2; n <= 9 && renamed == ""; n++ {
+			candidate := fmt.Sprintf("%s-%d.local", label, n)
+			lb.mu.Lock()
+			served := lb.serves(candidate)
+			lb.mu.Unlock()
+			if !validDomainName(candidate) || served || containsString(names, candidate) {
+				continue
+			}
+			if len(lb.mdns.probe(candidate)) == 0 {
+				renamed = candidate
+			}
+		}
+		if renamed == "" {
+			return errorf(CodeDomainExists, "%s and the names tried instead are already in use by other hosts on the network", name)
+		}
+		log.Printf("%s is already in use by another host on the network, using %s", name, renamed)
+		names[i] = renamed
 	}
 	return nil
 }
 
-func (lb *LocalBase) Remove(domain string) error {
+func (r *Record) domain(name string) Domain {
+	return Domain{
+		Domain:       name,
+		Port:         r.port,
+		Aliases:      r.aliases,
+		DomainInfo:   r.info,
+		RouteOptions: r.opts,
+		Paused:       r.paused,
+		Upstream:     r.upstream,
+		URL:          r.url(name),
+	}
+}
+
+// setAdverts fills in how the record's .local names are advertised: as
+// web servers at Caddy's port, with TXT keys describing the domain, and
+// the primary name of a domain exposed to the LAN also as a localbase
+// domain for discover.
+func (r *Record) setAdverts(primary string) {
+	owner := localOwner()
+	host := owner[strings.LastIndex(owner, "@")+1:]
+	service, port := "_https._tcp.local.", r.httpsPort
+	if r.opts.NoTLS {
+		service, port = "_http._tcp.local.", r.httpPort
+	}
+
+	for _, ad := range r.adverts {
+		name := strings.TrimSuffix(ad.name, ".")
+		ad.service, ad.port = service, port
+		ad.instance = strings.ReplaceAll(domainLabel(name), ".", `\.`) + "@" + host
+		ad.discover = name == primary
+		ad.txt = []string{"path=/", "managed-by=localbase", "domain=" + primary, "url=" + r.url(name), "owner=" + owner}
+		if r.port != 0 {
+			ad.txt = append(ad.txt, fmt.Sprintf("port=%d", r.port))
+		}
+		if len(r.aliases) > 0 {
+			ad.txt = append(ad.txt, "aliases="+strings.Join(r.aliases, ","))
+		}
+	}
+}
+
+// url returns the URL name is served at, with the port unless it's the
+// default for the scheme.
+func (r *Record) url(name string) string {
+	scheme, port, def := "https", r.httpsPort, 443
+	if r.opts.NoTLS {
+		scheme, port, def = "http", r.httpPort, 80
+	}
+	if port == def || port == 0 {
+		return scheme + "://" + name
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, name, port)
+}
+
+// Remove unregisters a domain along with its aliases. domain may be the
+// registered domain or any of its aliases.
+func (lb *LocalBase) Remove(domain string) (*Domain, error) {
+	lb.mu.Lock()
+	domain = lb.qualify(domain)
+	primary, record := lb.lookup(domain)
+	var d Domain
+	if record != nil {
+		d = record.domain(primary)
+	}
+	lb.mu.Unlock()
+	if record == nil {
+		return nil, errorf(CodeDomainNotFound, "domain %s not registered", domain)
+	}
+
+	// Hooks take a while, so they run without the lock.
+	if err := runHook(HookPreRemove, &d); err != nil {
+		return nil, err
+	}
+	removed, err := lb.removeRecord(primary, record)
+	if err != nil {
+		return nil, err
+	}
+	runPostHook(HookPostRemove, removed)
+	return removed, nil
+}
+
+// removeRecord removes record, registered as primary, along with its Caddy
+// routes and mDNS adverts, unless it was removed since it was looked up.
+func (lb *LocalBase) removeRecord(primary string, record *Record) (*Domain, error) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
-	record, exists := lb.records[domain]
-	if !exists {
-		return fmt.Errorf("domain %s not registered", domain)
+	if lb.records[primary] != record {
+		return nil, errorf(CodeDomainNotFound, "domain %s not registered", primary)
 	}
+	removed := record.domain(primary)
 
-	record.server.Shutdown()
-	delete(lb.records, domain)
-	log.Printf("Removed domain: %s", domain)
-	return nil
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := removeCaddyRoutes(record.hosts, &record.opts, config.CaddyAdmin); err != nil {
+		log.Printf("Error removing Caddy routes for %s: %v", primary, err)
+	}
+
+	if lb.mdns != nil {
+		lb.mdns.remove(append([]string{primary}, record.aliases...)...)
+	}
+	delete(lb.records, primary)
+	if err := lb.syncHostsFile(); err != nil {
+		log.Printf("Error updating hosts file: %v", err)
+	}
+	log.Printf("Removed domain: %s", primary)
+	lb.events.publish(Event{Type: EventDomainRemoved, Domain: primary, Port: removed.Port})
+	return &removed, nil
 }
 
-func (lb *LocalBase) Shutdown() {
+// Update points an existing domain at a new port. The Caddy routes are
+// patched in place and the mDNS adverts only have their TXT keys updated,
+// so the domain keeps resolving throughout.
+func (lb *LocalBase) Update(params *UpdateParams) (*Domain, error) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	domain := lb.qualify(params.Domain)
+	primary, record := lb.lookup(domain)
+	if record == nil {
+		return nil, errorf(CodeDomainNotFound, "domain %s not registered", domain)
+	}
+	if record.opts.Dir != "" {
+		return nil, errorf(CodeInvalidRequest, "%s serves %s, not a port", primary, record.opts.Dir)
+	}
+
+	// A paused domain gets the new port when it is resumed.
+	if !record.paused {
+		if err := replaceCaddyRoutes(record.hosts, params.Port, &record.opts, config.CaddyAdmin); err != nil {
+			return nil, fmt.Errorf("failed to update Caddy routes: %v", err)
+		}
+	}
+
+	log.Printf("Updated domain: %s (port %d -> %d)", primary, record.port, params.Port)
+	record.port = params.Port
+	record.upstream = ""
+	record.setAdverts(primary)
+	if lb.mdns != nil && !record.paused {
+		lb.mdns.add(record.adverts...)
+	}
+	updated := record.domain(primary)
+	lb.events.publish(Event{Type: EventDomainUpdated, Domain: primary, Port: params.Port})
+	return &updated, nil
+}
+
+// Pause stops routing and resolving a domain without unregistering it:
+// its Caddy routes and hosts file entries are removed and its .local names
+// said goodbye to, until Resume brings them back.
+func (lb *LocalBase) Pause(domain string) (*Domain, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	domain = lb.qualify(domain)
+	primary, record := lb.lookup(domain)
+	if record == nil {
+		return nil, errorf(CodeDomainNotFound, "domain %s not registered", domain)
+	}
+	if !record.paused {
+		if err := removeCaddyRoutes(record.hosts, &record.opts, config.CaddyAdmin); err != nil {
+			return nil, fmt.Errorf("failed to remove Caddy routes: %v", err)
+		}
+		if lb.mdns != nil {
+			lb.mdns.remove(append([]string{primary}, record.aliases...)...)
+		}
+		record.paused = true
+		record.upstream = ""
+		if err := lb.syncHostsFile(); err != nil {
+			log.Printf("Error updating hosts file: %v", err)
+		}
+		log.Printf("Paused domain: %s", primary)
+		lb.events.publish(Event{Type: EventDomainPaused, Domain: primary, Port: record.port})
+	}
+	paused := record.domain(primary)
+	return &paused, nil
+}
+
+// Resume routes and resolves a paused domain again.
+func (lb *LocalBase) Resume(domain string) (*Domain, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	domain = lb.qualify(domain)
+	primary, record := lb.lookup(domain)
+	if record == nil {
+		return nil, errorf(CodeDomainNotFound, "domain %s not registered", domain)
+	}
+	if record.paused {
+		if err := addCaddyServerBlock(record.hosts, record.port, &record.opts, config); err != nil {
+			return nil, fmt.Errorf("failed to add Caddy server block: %v", err)
+		}
+		record.paused = false
+		record.setAdverts(primary)
+		if lb.mdns != nil {
+			lb.mdns.add(record.adverts...)
+		}
+		if err := lb.syncHostsFile(); err != nil {
+			log.Printf("Error updating hosts file: %v", err)
+		}
+		log.Printf("Resumed domain: %s", primary)
+		lb.events.publish(Event{Type: EventDomainResumed, Domain: primary, Port: record.port})
+	}
+	resumed := record.domain(primary)
+	return &resumed, nil
+}
+
+// Shutdown unregisters every domain, removing its Caddy routes. Shutdown
+// hooks can't stop it, so a failing pre-shutdown hook is only logged.
+func (lb *LocalBase) Shutdown() {
+	runPostHook(HookPreShutdown, nil)
+
+	lb.mu.Lock()
+
+	config, err := readConfig()
+	if err != nil {
+		log.Printf("Error reading config, leaving Caddy routes in place: %v", err)
+	}
 	for domain, rec := range lb.records {
-		rec.server.Shutdown()
 		log.Printf("Shutting down domain: %s", domain)
+		if config == nil || rec.paused {
+			continue
+		}
+		if err := removeCaddyRoutes(rec.hosts, &rec.opts, config.CaddyAdmin); err != nil {
+			log.Printf("Error removing Caddy routes for %s: %v", domain, err)
+		}
+	}
+	// Says goodbye for every name.
+	if lb.mdns != nil {
+		lb.mdns.close()
+	}
+
+	if lb.hostsFile != "" {
+		if err := writeHostsBlock(lb.hostsFile, nil, ""); err != nil {
+			log.Printf("Error cleaning up hosts file: %v", err)
+		}
+	}
+
+	lb.events.close()
+	lb.mu.Unlock()
+
+	runPostHook(HookPostShutdown, nil)
+}
+
+// UseHostsFile enables the hosts file backend, failing early if the file
+// can't be written.
+func (lb *LocalBase) UseHostsFile(path string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.hostsFile = path
+	return lb.syncHostsFile()
+}
+
+// syncHostsFile rewrites the managed hosts file block. lb.mu must be held.
+func (lb *LocalBase) syncHostsFile() error {
+	if lb.hostsFile == "" {
+		return nil
+	}
+
+	var hosts []string
+	for _, rec := range lb.records {
+		if !rec.paused {
+			hosts = append(hosts, rec.hosts...)
+		}
 	}
+	return writeHostsBlock(lb.hostsFile, hosts, "127.0.0.1")
 }
 
-func (lb *LocalBase) startBroadcast(ctx context.Context) {
-	ticker := time.NewTicker(15 * time.Second)
+// addrSettleDelay is how long after an address change the daemon waits for
+// more, since switching networks changes several at once.
+const addrSettleDelay = 500 * time.Millisecond
+
+// watchIP re-announces the names as soon as the OS reports an address
+// change, and checks the local addresses every interval in case a change
+// went unreported.
+func (lb *LocalBase) watchIP(ctx context.Context, interval time.Duration) {
+	changes, err := watchAddrChanges(ctx)
+	if err != nil {
+		log.Printf("Not watching for address changes, checking every %s instead: %v", interval, err)
+	}
+
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	var settle <-chan time.Time
 	for {
 		select {
+		case <-changes:
+			if settle == nil {
+				settle = time.After(addrSettleDelay)
+			}
+			continue
+		case <-settle:
+			settle = nil
 		case <-ticker.C:
-			lb.broadcastAll()
 		case <-ctx.Done():
 			return
 		}
+		// Interfaces are checked on the ticker too, as joining another
+		// Wi-Fi network may leave the addresses as they were.
+		if lb.mdns != nil {
+			lb.mdns.updateInterfaces()
+		}
+		lb.llmnr.updateInterfaces()
+		lb.refreshIP()
 	}
 }
 
-func (lb *LocalBase) broadcastAll() {
+func (lb *LocalBase) refreshIP() {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
 	localIP, err := getLocalIP()
 	if err != nil {
-		log.Fatalln("Error getting local IP:", err.Error())
+		log.Printf("Error getting local IP: %v", err)
+		return
+	}
+	lb.setIP(localIP, getLocalIPv6(localIP))
+
+	ranges := localRanges()
+	if lb.ranges != nil && strings.Join(ranges, " ") != strings.Join(lb.ranges, " ") {
+		select {
+		case lb.rangesChanged <- struct{}{}:
+		default:
+		}
+	}
+	lb.ranges = ranges
+}
+
+// setIP records the addresses names resolve to, publishing
+// ip_changed when they differ from the last ones. lb.mu must be held.
+func (lb *LocalBase) setIP(ip, ip6 string) {
+	if lb.ip != "" && (ip != lb.ip || ip6 != lb.ip6) {
+		log.Printf("Local IP changed from %s %s to %s %s", lb.ip, lb.ip6, ip, ip6)
+		lb.events.publish(Event{Type: EventIPChanged, IP: ip, IPv6: ip6})
+	}
+	lb.ip, lb.ip6 = ip, ip6
+	if lb.mdns != nil {
+		lb.mdns.setAddrs(net.ParseIP(ip), net.ParseIP(ip6))
 	}
+}
 
-	for domain, info := range lb.records {
-		info.server.Shutdown()
+// Status is the daemon's state, see the client package.
+type Status = client.Status
 
-		server, err := bonjour.RegisterProxy(
-			"localbase",
-			info.service,
-			"",
-			80,
-			info.host,
-			localIP,
-			[]string{},
-			nil)
+// Status reports daemon health along with on-demand statistics about the
+// Caddy config localbase manages. The Caddy config is only fetched when
+// status is requested.
+func (lb *LocalBase) Status() (*Status, error) {
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			log.Fatalln("Error registering frontend service:", err.Error())
-		}
+	_, address := config.adminAddr()
+	domains := lb.List()
+	status := &Status{
+		PID:                 os.Getpid(),
+		StartedAt:           lb.startedAt,
+		Address:             address,
+		Domains:             len(domains),
+		CaddyAdmin:          config.CaddyAdmin,
+		CaddyConfigWarnSize: config.CaddyConfigWarnSize,
+	}
 
-		if err != nil {
-			log.Printf("Error re-registering service for %s: %v", domain, err)
-			continue
-		}
+	if lb.caddyVersion != (caddyVersion{}) {
+		status.CaddyVersion = lb.caddyVersion.String()
+	}
+	status.CaddyReachable, _ = isCaddyRunning(config.CaddyAdmin)
+	if !status.CaddyReachable {
+		return status, nil
+	}
 
-		info.server = server
+	size, routes, err := caddyConfigStats(config.CaddyAdmin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Caddy config: %v", err)
 	}
+	status.CaddyConfigSize = size
+	status.Routes = routes
+
+	return status, nil
 }
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestQualifyDomain(t *testing.T) {
+	tests := []struct {
+		name, suffix, want string
+	}{
+		{"hello", "local", "hello.local"},
+		{"hello.local", "local", "hello.local"},
+		{"hello", "test", "hello.test"},
+		{"hello.test", "test", "hello.test"},
+		{"hello.local", "test", "hello.local"},
+		{"api.hello", "test", "api.hello.test"},
+		{" Hello.Local. ", "local", "hello.local"},
+		{"HELLO", "test", "hello.test"},
+		{"", "local", ""},
+		{"  ", "local", ""},
+	}
+	for _, tt := range tests {
+		if got := qualifyDomain(tt.name, tt.suffix); got != tt.want {
+			t.Errorf("qualifyDomain(%q, %q) = %q, want %q", tt.name, tt.suffix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// setupLogging configures the daemon's log output. In json mode every line
+// logged through the log package becomes a JSON object with level, ts and
+// msg fields. Lines below level are dropped in either mode.
+func setupLogging(w io.Writer, format, level string) error {
+	min, err := parseLogLevel(level)
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+
+	switch format {
+	case "", "text":
+		log.SetOutput(levelWriter{w: w, min: min})
+		return nil
+	case "json":
+		handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) > 0 {
+					return a
+				}
+				switch a.Key {
+				case slog.TimeKey:
+					a.Key = "ts"
+				case slog.LevelKey:
+					a.Value = slog.StringValue(strings.ToLower(a.Value.String()))
+				}
+				return a
+			},
+		})
+		slog.SetDefault(slog.New(levelHandler{Handler: handler, min: min}))
+		return nil
+	default:
+		return usageErrorf("unknown log format %q, expected text or json", format)
+	}
+}
+
+// parseLogLevel parses a log_level, where empty means info.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch s {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected info, warn or error", s)
+}
+
+// lineLevel infers the level of msg, a line written through the log
+// package, which has no levels.
+func lineLevel(msg string) slog.Level {
+	msg = strings.ToLower(msg)
+	switch {
+	case strings.HasPrefix(msg, "error"), strings.HasPrefix(msg, "failed"),
+		strings.HasPrefix(msg, "[err]"), strings.Contains(msg, " error: "):
+		return slog.LevelError
+	case strings.HasPrefix(msg, "warning"):
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// logTimePrefix is the date and time the log package starts text lines
+// with.
+const logTimePrefix = "2006/01/02 15:04:05 "
+
+// levelWriter writes the text lines of the log package, which writes one
+// line at a time, dropping those below min.
+type levelWriter struct {
+	w   io.Writer
+	min slog.Level
+}
+
+func (lw levelWriter) Write(p []byte) (int, error) {
+	msg := string(p)
+	if len(msg) > len(logTimePrefix) {
+		msg = msg[len(logTimePrefix):]
+	}
+	if lineLevel(msg) < lw.min {
+		return len(p), nil
+	}
+	return lw.w.Write(p)
+}
+
+// levelHandler infers a level for lines written through the log package,
+// which slog otherwise records at info, dropping those below min.
+type levelHandler struct {
+	slog.Handler
+	min slog.Level
+}
+
+// Enabled reports every level as enabled, as lines from the log package
+// only get their level in Handle.
+func (h levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level == slog.LevelInfo {
+		r.Level = lineLevel(r.Message)
+	}
+	if r.Level < h.min {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs), h.min}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name), h.min}
+}
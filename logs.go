@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	logMaxSize    = 10 << 20
+	logMaxBackups = 3
+)
+
+func getLogFile() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "localbase.log"), nil
+}
+
+// getAccessLogFile returns the file Caddy writes domain's access log to.
+func getAccessLogFile(domain string) (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "access", domain+".log"), nil
+}
+
+// rotatingWriter appends to a log file, renaming it to path.1, path.2, ...
+// once it grows past maxSize.
+type rotatingWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingWriter(path string) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: logMaxSize, maxBackups: logMaxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size+int64(len(p)) > w.maxSize && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	for i := w.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+func logsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "logs [domain]",
+		Args:  rangeArgs(0, 1, "usage: localbase logs [domain] [-f] [--since duration]"),
+		Short: "Show daemon logs, or a domain's access log",
+		Long: `Show the logs written by the daemon when started with --detached or
+--log-file. Given a domain added with --access-log, show the requests Caddy
+proxied for it instead.`,
+		ValidArgsFunction: completeDomains,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			follow, _ := cmd.Flags().GetBool("follow")
+			since, _ := cmd.Flags().GetDuration("since")
+
+			var cutoff time.Time
+			if since > 0 {
+				cutoff = time.Now().Add(-since)
+			}
+
+			if len(args) == 1 {
+				config, err := readConfig()
+				if err != nil {
+					return err
+				}
+				domain := qualifyDomain(args[0], config.suffix())
+				path, err := getAccessLogFile(domain)
+				if err != nil {
+					return err
+				}
+				if _, err := os.Stat(path); os.IsNotExist(err) {
+					return fmt.Errorf("no access log for %s, requests are only logged for domains added with --access-log", domain)
+				}
+				return printLogs(path, cutoff, follow)
+			}
+
+			path, err := getLogFile()
+			if err != nil {
+				return err
+			}
+			cfg, err := readConfig()
+			if err != nil {
+				return err
+			}
+			if cfg.LogFile != "" {
+				path = cfg.LogFile
+			}
+			return printLogs(path, cutoff, follow)
+		},
+	}
+	cmd.Flags().BoolP("follow", "f", false, "keep printing new log lines")
+	cmd.Flags().Duration("since", 0, "only show lines newer than this, e.g. 10m")
+	return cmd
+}
+
+func printLogs(path string, cutoff time.Time, follow bool) error {
+	// Older rotated files first so output is chronological.
+	for i := logMaxBackups; i > 0; i-- {
+		f, err := os.Open(fmt.Sprintf("%s.%d", path, i))
+		if err != nil {
+			continue
+		}
+		copyLogLines(os.Stdout, f, cutoff)
+		f.Close()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no log file at %s, logs are only written when started with --detached or --log-file", path)
+		}
+		return err
+	}
+	defer f.Close()
+
+	offset := copyLogLines(os.Stdout, f, cutoff)
+	if !follow {
+		return nil
+	}
+
+	for {
+		time.Sleep(500 * time.Millisecond)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.Size() < offset || !sameFile(f, info) {
+			// The file was rotated, start over on the new one.
+			f.Close()
+			if f, err = os.Open(path); err != nil {
+				return err
+			}
+			offset = 0
+		}
+		if info.Size() > offset {
+			n, _ := io.Copy(os.Stdout, f)
+			offset += n
+		}
+	}
+}
+
+func sameFile(f *os.File, info os.FileInfo) bool {
+	current, err := f.Stat()
+	return err == nil && os.SameFile(current, info)
+}
+
+// copyLogLines copies lines logged at or after cutoff from r to w and
+// returns the number of bytes read. Lines without a timestamp, such as
+// wrapped output, follow the line before them.
+func copyLogLines(w io.Writer, r io.Reader, cutoff time.Time) int64 {
+	var read int64
+	include := cutoff.IsZero()
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		read += int64(len(line))
+		if len(line) > 0 {
+			if ts, ok := logLineTime(line); ok && !cutoff.IsZero() {
+				include = !ts.Before(cutoff)
+			}
+			if include {
+				io.WriteString(w, line)
+			}
+		}
+		if err != nil {
+			return read
+		}
+	}
+}
+
+// logLineTime parses the timestamp of a text or json log line. Caddy's
+// json logs have ts in seconds since the epoch rather than RFC 3339.
+func logLineTime(line string) (time.Time, bool) {
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			TS json.RawMessage `json:"ts"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || len(entry.TS) == 0 {
+			return time.Time{}, false
+		}
+		var ts time.Time
+		if err := json.Unmarshal(entry.TS, &ts); err == nil {
+			return ts, true
+		}
+		var secs float64
+		if err := json.Unmarshal(entry.TS, &secs); err == nil && secs > 0 {
+			return time.Unix(0, int64(secs*float64(time.Second))), true
+		}
+		return time.Time{}, false
+	}
+
+	const layout = "2006/01/02 15:04:05"
+	if len(line) < len(layout) {
+		return time.Time{}, false
+	}
+	ts, err := time.ParseInLocation(layout, line[:len(layout)], time.Local)
+	return ts, err == nil
+}
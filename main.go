@@ -1,169 +1,28 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/noelukwa/localbase/pkg/client"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
-func run(cfg *Config) {
-
-	if err := ensureCaddyRunning(cfg.CaddyAdmin); err != nil {
-		log.Fatalf("failed to ensure Caddy is running: %v", err)
-	}
-
-	lb := NewLocalBase()
-
-	listener, err := net.Listen("tcp", cfg.AdminAddress)
-	if err != nil {
-		log.Fatalf("failed to start localbase server: %v", err)
-	}
-	defer listener.Close()
-
-	log.Println("localBase server started. listening on", cfg.AdminAddress)
-
-	ctx, cancel := context.WithCancel(context.Background())
-
-	go lb.startBroadcast(ctx)
-
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		<-c
-		cancel()
-	}()
-
-	doneChan := make(chan struct{})
-	connections := make(chan net.Conn)
-
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					log.Printf("error accepting connection: %v\n", err)
-					continue
-				}
-			}
-
-			select {
-			case connections <- conn:
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-
-	for {
-		select {
-		case conn := <-connections:
-			go handleConnection(doneChan, conn, lb)
-		case <-doneChan:
-			cancel()
-		case <-ctx.Done():
-			log.Println("shutting down localbase")
-			lb.Shutdown()
-			return
-		}
-	}
-}
-
-func handleConnection(ch chan struct{}, conn net.Conn, lb *LocalBase) {
-	defer conn.Close()
-	scanner := bufio.NewScanner(conn)
-	if scanner.Scan() {
-		parts := strings.Fields(scanner.Text())
-		cmd := parts[0]
-		switch cmd {
-		case "add":
-			if len(parts) != 4 || parts[2] != "--port" {
-				fmt.Fprintln(conn, "Invalid command. Usage: add <domain> --port <port>")
-				return
-			}
-			domain := parts[1]
-			port, err := strconv.Atoi(parts[3])
-			if err != nil {
-				fmt.Fprintf(conn, "Invalid port number: %v\n", err)
-				return
-			}
-			err = lb.Add(domain, port)
-			if err != nil {
-				fmt.Fprintf(conn, "Error: %v\n", err)
-			} else {
-				fmt.Fprintf(conn, "Added domain: %s with port: %d\n", domain, port)
-			}
-		case "remove":
-			if len(parts) != 2 {
-				fmt.Fprintln(conn, "Invalid command. Usage: remove <domain>")
-				return
-			}
-			domain := parts[1]
-			err := lb.Remove(domain)
-			if err != nil {
-				fmt.Fprintf(conn, "Error: %v\n", err)
-			} else {
-				fmt.Fprintf(conn, "Removed domain: %s\n", domain)
-			}
-
-		case "list":
-			domains := lb.List()
-			if len(domains) == 0 {
-				fmt.Fprintln(conn, "No domains registered")
-			} else {
-				fmt.Fprintln(conn, "Registered domains:")
-				for _, domain := range domains {
-					fmt.Fprintf(conn, "- %s\n", domain)
-				}
-			}
-		case "stop":
-			close(ch)
-		default:
-			fmt.Fprintln(conn, "Unknown command")
-		}
-	}
-}
-
-func sendCommand(command string) error {
-	cfg, err := readConfig()
-	if err != nil {
-		return err
-	}
-
-	conn, err := net.Dial("tcp", cfg.AdminAddress)
-	if err != nil {
-		return fmt.Errorf("failed to connect to daemon: %v", err)
-	}
-	defer conn.Close()
-
-	_, err = fmt.Fprintln(conn, command)
-	if err != nil {
-		return fmt.Errorf("failed to send command: %v", err)
-	}
-
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		fmt.Println(scanner.Text())
-	}
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading response: %v", err)
-	}
-
-	return nil
-}
-
 var rootCmd = &cobra.Command{
 	Use:   "localbase",
 	Short: "localBase is a local domain management tool",
@@ -172,45 +31,296 @@ It integrates with Caddy server to provide local domain resolution and routing.`
 }
 
 var addCmd = &cobra.Command{
-	Use:   "add <domain> --port <port>",
+	Use:   "add <domain> --port <port> [--alias <alias>...]",
+	Args:  rangeArgs(1, 1, "usage: localbase add <domain> --port <port>"),
 	Short: "add a new domain",
-	Long:  `add a new domain to LocalBase with the specified port.`,
+	Long: `add a new domain to LocalBase with the specified port. Aliases are extra
+names routed to the same port, and are removed along with the domain. Names
+without a suffix get the daemon's default suffix (.local unless start was
+given --suffix), or the one set by --suffix. A .local name another host on
+the network already answers for is refused, or renamed with --rename.
+Repeating --port load balances requests between the ports, picked by --lb.
+With --dir instead of --port, the domain serves static files from a directory.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if len(args) != 1 {
-			return fmt.Errorf("usage: localbase add <domain> --port <port>")
+		ports, _ := cmd.Flags().GetIntSlice("port")
+		dir, _ := cmd.Flags().GetString("dir")
+		switch {
+		case len(ports) > 0 && dir != "":
+			return usageErrorf("--port and --dir can't be used together")
+		case len(ports) == 0 && dir == "":
+			return usageErrorf("port is required")
+		}
+		var port int
+		if len(ports) > 0 {
+			port = ports[0]
+		}
+		aliases, _ := cmd.Flags().GetStringArray("alias")
+		suffix, _ := cmd.Flags().GetString("suffix")
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if suffix != "" {
+			if err := validateSuffix(suffix); err != nil {
+				return usageErrorf("%v", err)
+			}
+		}
+		opts, err := routeOptionsFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+		opts.LBPolicy, _ = cmd.Flags().GetString("lb")
+		if len(ports) > 1 {
+			opts.ExtraPorts = ports[1:]
+		} else if opts.LBPolicy != "" {
+			return usageErrorf("--lb needs more than one --port")
+		}
+		if dir != "" {
+			// The daemon has its own working directory.
+			if opts.Dir, err = filepath.Abs(dir); err != nil {
+				return err
+			}
 		}
-		port, _ := cmd.Flags().GetInt("port")
-		if port == 0 {
-			return fmt.Errorf("port is required")
+
+		labelFlags, _ := cmd.Flags().GetStringArray("label")
+		labels, err := parseLabels(labelFlags)
+		if err != nil {
+			return usageErrorf("%v", err)
+		}
+		desc, _ := cmd.Flags().GetString("desc")
+		group, _ := cmd.Flags().GetString("group")
+		if err := validateGroup(group); err != nil {
+			return usageErrorf("%v", err)
 		}
-		return sendCommand(fmt.Sprintf("add %s --port %d", args[0], port))
+
+		rename, _ := cmd.Flags().GetBool("rename")
+		params := &AddParams{Domain: args[0], Port: port, Aliases: aliases, Suffix: suffix, Rename: rename,
+			DomainInfo: DomainInfo{Labels: labels, Description: desc, Group: group}, RouteOptions: *opts}
+		var domain Domain
+		if err := call("add", params, &domain); err != nil {
+			return err
+		}
+		return printResult(cmd, &domain, func() {
+			fmt.Printf("Added domain: %s with %s\n", domain.Domain, domainTarget(&domain))
+			printDomainDetails(&domain)
+		})
 	},
 }
 
 var startCmd = &cobra.Command{
 	Use:   "start",
+	Args:  noArgs,
 	Short: "start the localbase",
 	Long:  `start the localbase,either in the foreground or as a detached process.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		caddyAdmin, _ := cmd.Flags().GetString("caddy")
+		caddyOrigin, _ := cmd.Flags().GetString("caddy-origin")
 		adminAddr, _ := cmd.Flags().GetInt("addr")
+		socket, _ := cmd.Flags().GetString("socket")
 		detached, _ := cmd.Flags().GetBool("detached")
+		warnSize, _ := cmd.Flags().GetInt("config-warn-size")
+		apiAddr, _ := cmd.Flags().GetString("api")
+		corsOrigins, _ := cmd.Flags().GetStringSlice("cors-origin")
+		dnsAddr, _ := cmd.Flags().GetString("dns")
+		dnsTLDs, _ := cmd.Flags().GetStringSlice("dns-tld")
+		dnsForward, _ := cmd.Flags().GetBool("dns-forward")
+		dnsUpstreams, _ := cmd.Flags().GetStringSlice("dns-upstream")
+		resolver, _ := cmd.Flags().GetBool("resolver")
+		suffix, _ := cmd.Flags().GetString("suffix")
+		interfaces, _ := cmd.Flags().GetStringSlice("interface")
+		excludeIfaces, _ := cmd.Flags().GetStringSlice("exclude-interface")
+		reflect, _ := cmd.Flags().GetStringSlice("mdns-reflect")
+		staticRoots, _ := cmd.Flags().GetStringArray("static-root")
+		for i, root := range staticRoots {
+			abs, err := filepath.Abs(root)
+			if err != nil {
+				return fmt.Errorf("invalid static root %s: %v", root, err)
+			}
+			staticRoots[i] = abs
+		}
+		privateNetworks, _ := cmd.Flags().GetStringArray("private-network")
+		publicNetworks, _ := cmd.Flags().GetStringArray("public-network")
+		networkDefault, _ := cmd.Flags().GetString("network-default")
+		mdnsRefresh, _ := cmd.Flags().GetDuration("mdns-refresh")
+		mdnsTTL, _ := cmd.Flags().GetDuration("mdns-ttl")
+		mdnsMode, _ := cmd.Flags().GetString("mdns")
+		llmnr, _ := cmd.Flags().GetBool("llmnr")
+		useHosts, _ := cmd.Flags().GetBool("hosts")
+		docker, _ := cmd.Flags().GetBool("docker")
+		logFormat, _ := cmd.Flags().GetString("log-format")
+		logLevel, _ := cmd.Flags().GetString("log-level")
+		logFile, _ := cmd.Flags().GetString("log-file")
+		rateLimit, _ := cmd.Flags().GetFloat64("rate-limit")
+		maxConns, _ := cmd.Flags().GetInt("max-conns")
+		requireAuth, _ := cmd.Flags().GetBool("require-auth")
+		http3, _ := cmd.Flags().GetBool("http3")
+		httpPort, _ := cmd.Flags().GetInt("http-port")
+		httpsPort, _ := cmd.Flags().GetInt("https-port")
+		useTLS, _ := cmd.Flags().GetBool("tls")
+		allowLAN, _ := cmd.Flags().GetBool("allow-lan")
+		clientTimeout, _ := cmd.Flags().GetDuration("client-timeout")
+		readTimeout, _ := cmd.Flags().GetDuration("read-timeout")
+		caddyTimeout, _ := cmd.Flags().GetDuration("caddy-timeout")
+		drainTimeout, _ := cmd.Flags().GetDuration("drain-timeout")
+		maxMessageSize, _ := cmd.Flags().GetInt("max-message-size")
+
+		if cmd.Flags().Changed("addr") && cmd.Flags().Changed("socket") {
+			return usageErrorf("--addr and --socket can't be used together")
+		}
+		if useTLS && !cmd.Flags().Changed("addr") {
+			return usageErrorf("--tls only applies to the TCP transport, set --addr")
+		}
+		if allowLAN && !cmd.Flags().Changed("addr") {
+			return usageErrorf("--allow-lan only applies to the TCP transport, set --addr")
+		}
+		if mdnsRefresh <= 0 {
+			return usageErrorf("--mdns-refresh must be positive")
+		}
+		if mdnsTTL < time.Second {
+			return usageErrorf("--mdns-ttl must be at least 1s")
+		}
+		var networks []NetworkPolicy
+		for i, list := range [][]string{privateNetworks, publicNetworks} {
+			policy := networkPrivate
+			if i == 1 {
+				policy = networkPublic
+			}
+			for _, s := range list {
+				network, err := parseNetworkPolicy(s, policy)
+				if err != nil {
+					return usageErrorf("%v", err)
+				}
+				networks = append(networks, network)
+			}
+		}
 
 		cfg := &Config{
-			AdminAddress: fmt.Sprintf(":%d", adminAddr),
-			CaddyAdmin:   caddyAdmin,
+			CaddyAdmin:           caddyAdmin,
+			CaddyOrigin:          caddyOrigin,
+			DisableHTTP3:         !http3,
+			HTTPPort:             httpPort,
+			HTTPSPort:            httpsPort,
+			CaddyConfigWarnSize:  warnSize,
+			APIAddress:           apiAddr,
+			CORSOrigins:          corsOrigins,
+			Suffix:               suffix,
+			Interfaces:           interfaces,
+			ExcludeInterfaces:    excludeIfaces,
+			Networks:             networks,
+			DefaultNetworkPolicy: networkDefault,
+			MDNS:                 mdnsMode,
+			MDNSReflect:          reflect,
+			LLMNR:                llmnr,
+			MDNSRefreshInterval:  Duration(mdnsRefresh),
+			MDNSTTL:              Duration(mdnsTTL),
+			DNSAddress:           dnsAddr,
+			DNSTLDs:              dnsTLDs,
+			DisableDNSForward:    !dnsForward,
+			DNSUpstreams:         dnsUpstreams,
+			DisableResolver:      !resolver,
+			StaticRoots:          staticRoots,
+			DockerDiscovery:      docker,
+			LogFormat:            logFormat,
+			LogLevel:             logLevel,
+			LogFile:              logFile,
+			RateLimit:            rateLimit,
+			MaxClientConns:       maxConns,
+			RequireAuth:          requireAuth,
+			TLS:                  useTLS,
+			AllowLAN:             allowLAN,
+			ClientTimeout:        Duration(clientTimeout),
+			ReadTimeout:          Duration(readTimeout),
+			CaddyTimeout:         Duration(caddyTimeout),
+			DrainTimeout:         Duration(drainTimeout),
+			MaxMessageSize:       maxMessageSize,
+		}
+		if useHosts {
+			cfg.HostsFile = defaultHostsFile()
+		}
+
+		// A named pipe on Windows and a unix socket elsewhere are the
+		// default transports; TCP is opt-in with --addr.
+		switch {
+		case cmd.Flags().Changed("addr"):
+			cfg.AdminAddress = fmt.Sprintf("localhost:%d", adminAddr)
+			if allowLAN {
+				cfg.AdminAddress = fmt.Sprintf(":%d", adminAddr)
+			}
+		case socket != "":
+			cfg.Socket = socket
+		case defaultPipe() != "":
+			cfg.Pipe = defaultPipe()
+		default:
+			path, err := defaultSocketPath()
+			if err != nil {
+				return err
+			}
+			cfg.Socket = path
+		}
+
+		// The config file and environment set what isn't given as a flag.
+		saved, err := mergeConfig(cfg, cmd)
+		if err != nil {
+			return err
+		}
+		cfg.normalize()
+		if problems := cfg.validate(); len(problems) > 0 {
+			return usageErrorf("%s", problems[0])
+		}
+		saved.normalize()
+		if cfg.AllowLAN {
+			if tokens, err := loadTokens(); err == nil && len(tokens) == 0 {
+				fmt.Fprintln(os.Stderr, "warning: no API tokens exist, create one with: localbase token create <name>")
+			}
+		}
+
+		if detached && cfg.LogFile == "" {
+			path, err := getLogFile()
+			if err != nil {
+				return err
+			}
+			cfg.LogFile = path
+			saved.LogFile = path
+		}
+
+		var logOutput io.Writer = os.Stderr
+		if cfg.LogFile != "" && !detached {
+			w, err := newRotatingWriter(cfg.LogFile)
+			if err != nil {
+				return fmt.Errorf("failed to open log file: %v", err)
+			}
+			defer w.Close()
+			logOutput = w
 		}
 
-		if err := saveConfig(cfg); err != nil {
+		if err := setupLogging(logOutput, cfg.LogFormat, cfg.LogLevel); err != nil {
+			return err
+		}
+
+		if err := saveConfig(saved); err != nil {
 			return fmt.Errorf("failed to save config: %v", err)
 		}
+		runningConfig = cfg
 
 		if detached {
-			cmd := exec.Command(os.Args[0], "start")
+			// Pass the flags on so the child saves the same config.
+			childArgs := []string{"start", "--log-file=" + cfg.LogFile}
+			cmd.Flags().Visit(func(f *pflag.Flag) {
+				if f.Name == "detached" || f.Name == "log-file" {
+					return
+				}
+				// Slices print as [a,b], which they don't parse back from.
+				if v, ok := f.Value.(pflag.SliceValue); ok {
+					for _, item := range v.GetSlice() {
+						childArgs = append(childArgs, fmt.Sprintf("--%s=%s", f.Name, item))
+					}
+					return
+				}
+				childArgs = append(childArgs, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+			})
+
+			cmd := exec.Command(os.Args[0], childArgs...)
 			cmd.Stdout = nil
 			cmd.Stderr = nil
 			cmd.Stdin = nil
-			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+			cmd.SysProcAttr = detachedProcAttr()
 			if err := cmd.Start(); err != nil {
 				return fmt.Errorf("failed to start in detached mode: %v", err)
 			}
@@ -224,55 +334,800 @@ var startCmd = &cobra.Command{
 }
 
 func stopCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "stop",
+		Args:  noArgs,
 		Short: "Stop localbase daemon",
-		Long:  `Stop the running localbase daemon.`,
+		Long: `Stop the running localbase daemon.
+
+stop waits for the daemon to exit. If it does not exit within --timeout,
+--force sends SIGTERM and then SIGKILL to the pid recorded in the pid file,
+after checking that it still runs localbase.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return sendCommand("stop")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			force, _ := cmd.Flags().GetBool("force")
+			return stopDaemon(timeout, force)
 		},
 	}
+	cmd.Flags().Duration("timeout", 10*time.Second, "how long to wait for the daemon to exit")
+	cmd.Flags().Bool("force", false, "terminate the daemon process if it does not exit")
+	return cmd
+}
+
+func stopDaemon(timeout time.Duration, force bool) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pid, err := readPIDFile()
+	if err != nil {
+		return err
+	}
+
+	if err := call("stop", nil, nil); err != nil {
+		if pid == 0 || !force {
+			return err
+		}
+		fmt.Printf("daemon did not accept stop command: %v\n", err)
+	} else {
+		fmt.Println("stop requested")
+	}
+
+	if pid == 0 {
+		return nil
+	}
+
+	if waitForExit(ctx, pid, timeout) {
+		fmt.Println("localbase stopped")
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted while waiting for pid %d to exit", pid)
+	}
+	if !force {
+		return fmt.Errorf("daemon (pid %d) did not exit within %s, rerun with --force to terminate it", pid, timeout)
+	}
+
+	if err := checkLocalbaseProcess(pid); err != nil {
+		return fmt.Errorf("not signalling pid %d from the pid file: %v", pid, err)
+	}
+	fmt.Printf("daemon (pid %d) did not exit within %s, sending SIGTERM\n", pid, timeout)
+	if err := signalProcess(pid, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to send SIGTERM to pid %d: %v", pid, err)
+	}
+	if waitForExit(ctx, pid, timeout) {
+		fmt.Println("localbase terminated")
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted while waiting for pid %d to exit", pid)
+	}
+
+	if err := checkLocalbaseProcess(pid); err != nil {
+		return fmt.Errorf("not signalling pid %d from the pid file: %v", pid, err)
+	}
+	fmt.Printf("daemon (pid %d) ignored SIGTERM, sending SIGKILL\n", pid)
+	if err := signalProcess(pid, syscall.SIGKILL); err != nil {
+		return fmt.Errorf("failed to send SIGKILL to pid %d: %v", pid, err)
+	}
+	if !waitForExit(ctx, pid, timeout) {
+		return fmt.Errorf("daemon (pid %d) is still running after SIGKILL", pid)
+	}
+
+	// A killed daemon cannot clean up after itself.
+	if err := removePIDFile(); err != nil {
+		return fmt.Errorf("failed to remove stale pid file: %v", err)
+	}
+	fmt.Println("localbase killed")
+	return nil
 }
 
 func removeCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "remove <domain>",
-		Short: "Remove a domain",
-		Long:  `Remove a domain from LocalBase.`,
+	cmd := &cobra.Command{
+		Use:               "remove <domain>",
+		Args:              domainOrGroupArgs,
+		Short:             "Remove a domain",
+		Long:              `Remove a domain from LocalBase, or with --group every domain in a group.`,
+		ValidArgsFunction: completeDomains,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if group, _ := cmd.Flags().GetString("group"); group != "" {
+				return groupCall("remove", group, "Removed")
+			}
+			var domain Domain
+			if err := call("remove", &RemoveParams{Domain: args[0]}, &domain); err != nil {
+				return err
+			}
+			return printResult(cmd, &domain, func() {
+				fmt.Printf("Removed domain: %s\n", domain.Domain)
+			})
+		},
+	}
+	cmd.Flags().String("group", "", "remove every domain in this group")
+	return cmd
+}
+
+func updateCmd() *cobra.Command {
+	var port int
+	cmd := &cobra.Command{
+		Use:               "update <domain>",
+		Args:              rangeArgs(1, 1, "usage: localbase update <domain> --port <port>"),
+		Short:             "Change the port of a domain",
+		Long:              `Point a registered domain at a new port without re-registering it.`,
+		ValidArgsFunction: completeDomains,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if len(args) != 1 {
-				return fmt.Errorf("usage: localbase remove <domain>")
+			if port == 0 {
+				return usageErrorf("port is required")
+			}
+			var domain Domain
+			if err := call("update", &UpdateParams{Domain: args[0], Port: port}, &domain); err != nil {
+				return err
 			}
-			return sendCommand(fmt.Sprintf("remove %s", args[0]))
+			return printResult(cmd, &domain, func() {
+				fmt.Printf("Updated domain: %s (port %d)\n", domain.Domain, domain.Port)
+			})
 		},
 	}
+	cmd.Flags().IntVarP(&port, "port", "p", 0, "New port to proxy to")
+	return cmd
 }
 
 func listCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "list",
+		Args:  noArgs,
 		Short: "List all domains",
-		Long:  `List all domains registered in LocalBase.`,
+		Long: `List all domains registered in LocalBase. --label limits the list to domains
+with a label, key=value for a label with that value or key for any value, and
+--group to the domains in a group.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return sendCommand("list")
+			selectors, _ := cmd.Flags().GetStringArray("label")
+			group, _ := cmd.Flags().GetString("group")
+			domains, err := listDomains(clientTimeout())
+			if err != nil {
+				return err
+			}
+			list := ListResult{Domains: []Domain{}}
+			for _, d := range domains {
+				if matchLabels(d.Labels, selectors) && (group == "" || d.Group == group) {
+					list.Domains = append(list.Domains, d)
+				}
+			}
+			return printResult(cmd, &list, func() {
+				switch {
+				case len(list.Domains) == 0 && group != "":
+					fmt.Printf("No domains in group %s\n", group)
+					return
+				case len(list.Domains) == 0 && len(selectors) > 0:
+					fmt.Println("No domains with those labels")
+					return
+				case len(list.Domains) == 0:
+					fmt.Println("No domains registered")
+					return
+				}
+				fmt.Println("Registered domains:")
+				for _, d := range list.Domains {
+					if d.Dir != "" {
+						paused := ""
+						if d.Paused {
+							paused = ", paused"
+						}
+						fmt.Printf("- %s (dir %s%s)\n", d.Domain, d.Dir, paused)
+						printDomainDetails(&d)
+						continue
+					}
+					upstream := d.Upstream
+					switch {
+					case d.Paused:
+						upstream = "paused"
+					case upstream == "":
+						upstream = "unknown"
+					}
+					fmt.Printf("- %s (port %d, %s)\n", d.Domain, d.Port, upstream)
+					printDomainDetails(&d)
+				}
+			})
 		},
 	}
+	cmd.Flags().StringArray("label", nil, "only list domains with this label, key=value or key (repeatable, all must match)")
+	cmd.Flags().String("group", "", "only list domains in this group")
+	return cmd
+}
+
+func statusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Args:  noArgs,
+		Short: "Show localbase status",
+		Long: `Show whether the daemon is running, its pid, uptime and address, the number
+of registered domains, and whether Caddy is reachable along with the size of
+its config and the number of routes managed by LocalBase.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var status Status
+			err := call("status", nil, &status)
+			if exitCode(err) == ExitDaemonNotRunning {
+				fmt.Println("Daemon: not running")
+			}
+			if err != nil {
+				return err
+			}
+			return printResult(cmd, &status, func() { printStatus(&status) })
+		},
+	}
+}
+
+func schemaCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "schema",
+		Args:  noArgs,
+		Short: "Print the JSON Schema of the admin protocol",
+		Long: `Print a JSON Schema describing every protocol method, its params and result,
+and the error codes, for generating clients in other languages. The daemon's
+REST API serves the same schema at GET /v1/schema.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, err := os.Stdout.Write(append(client.Schema(), '\n'))
+			return err
+		},
+	}
+}
+
+func runCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run <domain> --port <port> -- <command> [args...]",
+		Short: "Run a command with a domain registered",
+		Long: `Register a domain, run the given command, and remove the domain when the
+command exits or is interrupted. The command's exit code is passed through.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if cmd.ArgsLenAtDash() != 1 || len(args) < 2 {
+				return usageErrorf("usage: localbase run <domain> --port <port> -- <command> [args...]")
+			}
+			return nil
+		},
+		// A failing child is not a usage error.
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			port, _ := cmd.Flags().GetInt("port")
+			if port == 0 {
+				return usageErrorf("port is required")
+			}
+			opts, err := routeOptionsFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+			return runWithDomain(&AddParams{Domain: args[0], Port: port, RouteOptions: *opts}, args[1:])
+		},
+	}
+	cmd.Flags().IntP("port", "p", 0, "port for the .local domain")
+	addRouteFlags(cmd)
+	return cmd
+}
+
+func runWithDomain(params *AddParams, command []string) error {
+	var domain Domain
+	if err := call("add", params, &domain); err != nil {
+		return err
+	}
+	fmt.Printf("Added domain: %s with port: %d\n", domain.Domain, domain.Port)
+
+	defer func() {
+		if err := call("remove", &RemoveParams{Domain: domain.Domain}, nil); err != nil {
+			log.Printf("failed to remove domain %s: %v", domain.Domain, err)
+			return
+		}
+		fmt.Printf("Removed domain: %s\n", domain.Domain)
+	}()
+
+	child := exec.Command(command[0], command[1:]...)
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+
+	// Forward signals to the child and let it decide when to exit, so the
+	// domain is only removed after it has shut down.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if err := child.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", command[0], err)
+	}
+
+	go func() {
+		for sig := range signals {
+			child.Process.Signal(sig)
+		}
+	}()
+
+	err := child.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		if code < 0 {
+			code = ExitError
+		}
+		return &exitError{code: code, err: fmt.Errorf("%s exited: %v", command[0], err)}
+	}
+	return err
+}
+
+func upCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "up",
+		Args:  noArgs,
+		Short: "Register all domains in the project file",
+		Long: `Register every domain declared in .localbase.yml. Domains that are already
+registered are left as they are.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, _ := cmd.Flags().GetString("file")
+			project, err := loadProject(file)
+			if err != nil {
+				return err
+			}
+
+			calls := make([]*batchCall, len(project.Domains))
+			for i, d := range project.Domains {
+				params := &AddParams{Domain: d.Name, Port: d.Port, Aliases: d.Aliases, DomainInfo: d.DomainInfo, RouteOptions: d.RouteOptions}
+				calls[i] = &batchCall{Method: "add", Params: params, Result: &Domain{}}
+			}
+			if err := callBatch(calls); err != nil {
+				return err
+			}
+
+			var failed int
+			for i, d := range project.Domains {
+				domain := calls[i].Result.(*Domain)
+				err := calls[i].Err
+				switch {
+				case exitCode(err) == ExitDomainExists:
+					fmt.Printf("%s: already registered\n", d.Name)
+				case err != nil:
+					fmt.Printf("%s: %v\n", d.Name, err)
+					failed++
+				default:
+					fmt.Printf("Added domain: %s with %s\n", domain.Domain, domainTarget(domain))
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d domains failed", failed, len(project.Domains))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringP("file", "f", projectFile, "project file")
+	return cmd
+}
+
+func downCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "down",
+		Args:  noArgs,
+		Short: "Remove all domains in the project file",
+		Long:  `Remove every domain declared in .localbase.yml.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, _ := cmd.Flags().GetString("file")
+			project, err := loadProject(file)
+			if err != nil {
+				return err
+			}
+
+			calls := make([]*batchCall, len(project.Domains))
+			for i, d := range project.Domains {
+				calls[i] = &batchCall{Method: "remove", Params: &RemoveParams{Domain: d.Name}, Result: &Domain{}}
+			}
+			if err := callBatch(calls); err != nil {
+				return err
+			}
+
+			var failed int
+			for i, d := range project.Domains {
+				domain := calls[i].Result.(*Domain)
+				err := calls[i].Err
+				switch {
+				case exitCode(err) == ExitDomainNotFound:
+					fmt.Printf("%s: not registered\n", d.Name)
+				case err != nil:
+					fmt.Printf("%s: %v\n", d.Name, err)
+					failed++
+				default:
+					fmt.Printf("Removed domain: %s\n", domain.Domain)
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d domains failed", failed, len(project.Domains))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringP("file", "f", projectFile, "project file")
+	return cmd
+}
+
+// routeOptionsFromFlags reads the route options shared by add and run.
+func routeOptionsFromFlags(cmd *cobra.Command) (*RouteOptions, error) {
+	var opts RouteOptions
+
+	routes, _ := cmd.Flags().GetStringArray("route")
+	rewrites, _ := cmd.Flags().GetStringArray("rewrite")
+	for _, r := range rewrites {
+		rw, err := parseRewrite(r)
+		if err != nil {
+			return nil, usageErrorf("%v", err)
+		}
+		opts.Rewrites = append(opts.Rewrites, rw)
+	}
+	keepPrefix, _ := cmd.Flags().GetBool("keep-prefix")
+	for _, r := range routes {
+		pr, err := parsePathRoute(r)
+		if err != nil {
+			return nil, usageErrorf("%v", err)
+		}
+		pr.KeepPrefix = keepPrefix
+		opts.Routes = append(opts.Routes, pr)
+	}
+
+	opts.GRPC, _ = cmd.Flags().GetBool("grpc")
+	opts.WebSocket, _ = cmd.Flags().GetBool("websocket")
+	opts.Compress, _ = cmd.Flags().GetBool("compress")
+	opts.AccessLog, _ = cmd.Flags().GetBool("access-log")
+	opts.NoTLS, _ = cmd.Flags().GetBool("no-tls")
+	opts.ExposeLAN, _ = cmd.Flags().GetBool("expose-lan")
+	opts.CORS, _ = cmd.Flags().GetStringArray("cors")
+	credentials, _ := cmd.Flags().GetStringArray("basic-auth")
+	for _, c := range credentials {
+		user, pass, ok := strings.Cut(c, ":")
+		if !ok {
+			return nil, usageErrorf("invalid --basic-auth %q, expected user:password", c)
+		}
+		opts.BasicAuth = append(opts.BasicAuth, BasicAuthAccount{Username: user, Password: pass})
+	}
+	for _, h := range []struct {
+		set, remove string
+		ops         **HeaderOps
+	}{
+		{"set-request-header", "remove-request-header", &opts.RequestHeaders},
+		{"set-header", "remove-header", &opts.ResponseHeaders},
+	} {
+		values, _ := cmd.Flags().GetStringArray(h.set)
+		set, err := parseHeaders(values)
+		if err != nil {
+			return nil, usageErrorf("%v", err)
+		}
+		remove, _ := cmd.Flags().GetStringArray(h.remove)
+		if len(set) > 0 || len(remove) > 0 {
+			*h.ops = &HeaderOps{Set: set, Remove: remove}
+		}
+	}
+
+	if path, _ := cmd.Flags().GetString("health-path"); path != "" {
+		interval, _ := cmd.Flags().GetDuration("health-interval")
+		status, _ := cmd.Flags().GetInt("health-status")
+		opts.HealthCheck = &UpstreamCheck{Path: path, Status: status}
+		if interval > 0 {
+			opts.HealthCheck.Interval = interval.String()
+		}
+	} else if cmd.Flags().Changed("health-interval") || cmd.Flags().Changed("health-status") {
+		return nil, usageErrorf("--health-interval and --health-status need --health-path")
+	}
+
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	dialTimeout, _ := cmd.Flags().GetDuration("dial-timeout")
+	if timeout > 0 || dialTimeout > 0 {
+		opts.Timeouts = &ProxyTimeouts{}
+		if timeout > 0 {
+			opts.Timeouts.Read = timeout.String()
+			opts.Timeouts.Write = timeout.String()
+		}
+		if dialTimeout > 0 {
+			opts.Timeouts.Dial = dialTimeout.String()
+		}
+	}
+
+	opts.UpstreamScheme, _ = cmd.Flags().GetString("upstream-scheme")
+	opts.InsecureUpstream, _ = cmd.Flags().GetBool("insecure-upstream")
+
+	if path, _ := cmd.Flags().GetString("caddy-json"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, usageErrorf("failed to read --caddy-json: %v", err)
+		}
+		if err := json.Unmarshal(data, &opts.Caddy); err != nil {
+			return nil, usageErrorf("invalid --caddy-json %s: %v", path, err)
+		}
+	}
+
+	return &opts, nil
+}
+
+func addRouteFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("route", nil, "send a path to another port, e.g. /api=4000 (repeatable)")
+	cmd.Flags().StringArray("rewrite", nil, "rewrite request paths, e.g. /api/*=/v1/* or /old=/new (repeatable, first match wins)")
+	cmd.Flags().Bool("keep-prefix", false, "pass the --route path prefix through to the upstream instead of stripping it")
+	cmd.Flags().Bool("grpc", false, "proxy to the upstream over h2c for grpc backends")
+	cmd.Flags().Bool("websocket", false, "tune the proxy for long-lived websocket connections, e.g. dev server HMR")
+	cmd.Flags().Bool("compress", false, "compress responses with zstd or gzip")
+	cmd.Flags().StringArray("set-header", nil, "set a response header, e.g. X-Env=local (repeatable)")
+	cmd.Flags().StringArray("remove-header", nil, "remove a response header, e.g. Server (repeatable)")
+	cmd.Flags().StringArray("set-request-header", nil, "set a header on requests to the upstream (repeatable)")
+	cmd.Flags().StringArray("remove-request-header", nil, "remove a header from requests to the upstream (repeatable)")
+	cmd.Flags().String("health-path", "", "have caddy check upstreams by requesting this path, e.g. /healthz")
+	cmd.Flags().Duration("health-interval", 0, "how often caddy checks upstreams (default 30s)")
+	cmd.Flags().Int("health-status", 0, "status a healthy upstream responds with (default any 2xx)")
+	cmd.Flags().Duration("timeout", 0, "read and write timeout for the upstream, e.g. 5m for uploads or streaming (default caddy's)")
+	cmd.Flags().Duration("dial-timeout", 0, "how long to wait to connect to the upstream (default caddy's)")
+	cmd.Flags().String("upstream-scheme", "http", "scheme the upstream serves: http or https")
+	cmd.Flags().Bool("insecure-upstream", false, "don't verify the https upstream's certificate, for self-signed dev certs")
+	cmd.Flags().StringArray("cors", nil, "allow browser requests from this origin, or * for any, answering preflights (repeatable)")
+	cmd.Flags().StringArray("basic-auth", nil, "require http basic auth as user:password (repeatable)")
+	cmd.Flags().Bool("no-tls", false, "serve over plain http only, without a certificate or https redirect")
+	cmd.Flags().Bool("access-log", false, "log proxied requests, view them with localbase logs <domain>")
+	cmd.Flags().Bool("expose-lan", false, "serve the domain to other devices on the LAN, not just this machine")
+	cmd.Flags().String("caddy-json", "", "file of Caddy route JSON to merge into the generated routes")
+}
+
+func joinPorts(ports []int) string {
+	s := make([]string, len(ports))
+	for i, port := range ports {
+		s[i] = strconv.Itoa(port)
+	}
+	return strings.Join(s, ", ")
+}
+
+// domainTarget describes where a domain sends requests.
+func domainTarget(d *Domain) string {
+	if d.Dir != "" {
+		return "dir: " + d.Dir
+	}
+	return fmt.Sprintf("port: %d", d.Port)
+}
+
+func printHeaderOps(kind string, ops *HeaderOps) {
+	if ops == nil {
+		return
+	}
+	names := make([]string, 0, len(ops.Set))
+	for name := range ops.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %s: %s=%s\n", kind, name, ops.Set[name])
+	}
+	for _, name := range ops.Remove {
+		fmt.Printf("  %s: -%s\n", kind, name)
+	}
+}
+
+func printDomainDetails(d *Domain) {
+	if d.Description != "" {
+		fmt.Printf("  description: %s\n", d.Description)
+	}
+	if d.Group != "" {
+		fmt.Printf("  group: %s\n", d.Group)
+	}
+	if len(d.Labels) > 0 {
+		labels := make([]string, 0, len(d.Labels))
+		for key, value := range d.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		fmt.Printf("  labels: %s\n", strings.Join(labels, ", "))
+	}
+	if d.URL != "" {
+		fmt.Printf("  url: %s\n", d.URL)
+	}
+	for _, alias := range d.Aliases {
+		fmt.Printf("  alias: %s\n", alias)
+	}
+	if len(d.ExtraPorts) > 0 {
+		policy := d.LBPolicy
+		if policy == "" {
+			policy = "random"
+		}
+		fmt.Printf("  load balanced: ports %s (%s)\n", joinPorts(append([]int{d.Port}, d.ExtraPorts...)), policy)
+	}
+	if hc := d.HealthCheck; hc != nil {
+		interval := hc.Interval
+		if interval == "" {
+			interval = "30s"
+		}
+		fmt.Printf("  health check: %s every %s\n", hc.Path, interval)
+	}
+	if t := d.Timeouts; t != nil {
+		for _, v := range []struct{ name, value string }{{"dial", t.Dial}, {"read", t.Read}, {"write", t.Write}} {
+			if v.value != "" {
+				fmt.Printf("  %s timeout: %s\n", v.name, v.value)
+			}
+		}
+	}
+	for _, u := range d.Upstreams {
+		fmt.Printf("  upstream %s: %d requests, %d fails\n", u.Address, u.Requests, u.Fails)
+	}
+	for _, rw := range d.Rewrites {
+		fmt.Printf("  rewrite: %s -> %s\n", rw.From, rw.To)
+	}
+	for _, r := range d.Routes {
+		fmt.Printf("  route: %s -> port %d\n", r.Path, r.Port)
+	}
+	if d.GRPC {
+		fmt.Println("  grpc: h2c")
+	}
+	if d.WebSocket {
+		fmt.Println("  websocket: enabled")
+	}
+	if len(d.CORS) > 0 {
+		fmt.Printf("  cors: %s\n", strings.Join(d.CORS, ", "))
+	}
+	for _, acct := range d.BasicAuth {
+		fmt.Printf("  basic auth: %s\n", acct.Username)
+	}
+	if d.Compress {
+		fmt.Println("  compression: zstd, gzip")
+	}
+	if d.NoTLS {
+		fmt.Println("  tls: off (http only)")
+	}
+	if d.ExposeLAN {
+		fmt.Println("  lan: exposed")
+	}
+	printHeaderOps("request header", d.RequestHeaders)
+	printHeaderOps("response header", d.ResponseHeaders)
+	if d.UpstreamScheme == "https" {
+		if d.InsecureUpstream {
+			fmt.Println("  upstream: https (certificate not verified)")
+		} else {
+			fmt.Println("  upstream: https")
+		}
+	}
+	if d.AccessLog {
+		if path, err := getAccessLogFile(d.Domain); err == nil {
+			fmt.Printf("  access log: %s\n", path)
+		}
+	}
+	if d.Caddy != nil {
+		fmt.Println("  caddy: custom route json")
+	}
+}
+
+func printStatus(status *Status) {
+	fmt.Printf("Daemon: running (pid %d)\n", status.PID)
+	fmt.Printf("Uptime: %s\n", time.Since(status.StartedAt).Round(time.Second))
+	fmt.Printf("Listening on: %s\n", status.Address)
+	fmt.Printf("Domains: %d\n", status.Domains)
+	if !status.CaddyReachable {
+		fmt.Printf("Caddy: unreachable (%s)\n", status.CaddyAdmin)
+		return
+	}
+	if status.CaddyVersion != "" {
+		fmt.Printf("Caddy: reachable (%s, v%s)\n", status.CaddyAdmin, status.CaddyVersion)
+	} else {
+		fmt.Printf("Caddy: reachable (%s)\n", status.CaddyAdmin)
+	}
+	fmt.Printf("Caddy config size: %d bytes\n", status.CaddyConfigSize)
+	fmt.Printf("Localbase routes: %d\n", status.Routes)
+	if status.CaddyConfigWarnSize > 0 && status.CaddyConfigSize > status.CaddyConfigWarnSize {
+		fmt.Printf("Warning: Caddy config exceeds %d bytes, consider removing unused domains\n", status.CaddyConfigWarnSize)
+	}
 }
 
 func init() {
+	rootCmd.SetUsageTemplate(rootCmd.UsageTemplate() + exitCodesHelp)
+	rootCmd.PersistentFlags().StringP("output", "o", "text", "output format: text, json or yaml")
+	rootCmd.PersistentFlags().Duration("request-timeout", defaultClientTimeout, "how long to wait for the daemon to respond (0 waits forever, defaults to the config)")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "use this profile's config and domains, kept apart from other profiles (default $"+profileEnv+")")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if !cmd.Flags().Changed("profile") {
+			profile = os.Getenv(profileEnv)
+		}
+		if err := validateProfile(profile); err != nil {
+			return &exitError{code: ExitUsage, err: err}
+		}
+		return nil
+	}
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return &exitError{code: ExitUsage, err: err}
+	})
 	rootCmd.AddCommand(addCmd)
-	addCmd.Flags().IntP("port", "p", 0, "port for the .local domain")
+	addCmd.Flags().IntSliceP("port", "p", nil, "port for the .local domain (repeatable to load balance)")
+	addCmd.Flags().String("lb", "", "policy for picking between ports: random, round_robin, least_conn, first, ip_hash, client_ip_hash or uri_hash")
+	addCmd.Flags().String("dir", "", "serve static files from this directory instead of proxying to a port")
+	addCmd.Flags().StringArray("alias", nil, "additional name routed to the same port (repeatable)")
+	addCmd.Flags().String("suffix", "", "suffix for names given without one, e.g. test (defaults to the daemon's --suffix)")
+	addCmd.Flags().StringArray("label", nil, "key=value label for organizing domains, e.g. team=payments (repeatable)")
+	addCmd.Flags().String("desc", "", "description of the domain, e.g. \"checkout API\"")
+	addCmd.Flags().String("group", "", "group the domain belongs to, e.g. shop, for remove, pause and resume --group")
+	addCmd.Flags().Bool("rename", false, "if another host already answers for a .local name, use name-2.local, name-3.local and so on instead of failing")
+	addRouteFlags(addCmd)
 	rootCmd.AddCommand(startCmd)
-	startCmd.Flags().IntP("addr", "a", 2025, "localbase process address")
-	startCmd.Flags().StringP("caddy", "c", "http://localhost:2019", "local caddy admin address")
+	startCmd.Flags().IntP("addr", "a", 2025, "listen on this localhost TCP port instead of the unix socket")
+	startCmd.Flags().String("socket", "", "unix socket to listen on (default $XDG_RUNTIME_DIR/localbase.sock, or the localbase named pipe on Windows)")
+	startCmd.Flags().StringP("caddy", "c", "http://localhost:2019", "local caddy admin address, a url or a unix socket as unix//path/to/admin.sock")
+	startCmd.Flags().String("caddy-origin", "", "origin sent to the caddy admin api when its admin config sets origins (defaults to the admin address)")
 	startCmd.Flags().BoolP("detached", "d", false, "run localbase in background")
+	startCmd.Flags().Bool("http3", true, "serve HTTP/3 (QUIC) on the caddy listeners, --http3=false to turn it off")
+	startCmd.Flags().Int("http-port", 80, "port the caddy server listens on for http")
+	startCmd.Flags().Int("https-port", 443, "port the caddy server listens on for https")
+	startCmd.Flags().Int("config-warn-size", 0, "warn when the caddy config exceeds this many bytes (0 disables)")
+	startCmd.Flags().String("api", "", "address for the REST admin API, e.g. localhost:2026 (disabled if empty)")
+	startCmd.Flags().StringSlice("cors-origin", nil, "browser origin allowed to call the REST API, e.g. chrome-extension://<id> (repeatable)")
+	startCmd.Flags().StringSlice("interface", nil, "only take the local address from and answer mdns on interfaces matching this pattern, e.g. en0 or eth* (repeatable)")
+	startCmd.Flags().StringSlice("exclude-interface", nil, "never use interfaces matching this pattern, e.g. utun* (repeatable; vpn and container interfaces are skipped unless --interface is set)")
+	startCmd.Flags().StringArray("private-network", nil, "network to answer mdns on: an interface pattern, a subnet like 192.168.1.0/24 or ssid:<wi-fi name> (repeatable)")
+	startCmd.Flags().StringArray("public-network", nil, "network never to answer mdns on, e.g. ssid:CoffeeShop (repeatable, wins over --private-network)")
+	startCmd.Flags().String("network-default", networkPrivate, "policy of networks matching neither --private-network nor --public-network: private or public")
+	startCmd.Flags().String("mdns", "auto", "how .local names are advertised: builtin, avahi (through avahi-daemon on linux), native (the windows dns client's responder), off, or auto for avahi where it runs and builtin elsewhere")
+	startCmd.Flags().Bool("llmnr", false, "also answer llmnr queries for domain names without .local, e.g. hello, for windows machines")
+	startCmd.Flags().StringArray("static-root", nil, "directory static domains may serve, with its subdirectories (repeatable, defaults to the directory localbase starts in)")
+	startCmd.Flags().StringSlice("mdns-reflect", nil, "also answer and announce mdns on these container or vm bridges, e.g. docker0 or virbr* (repeatable)")
+	startCmd.Flags().Duration("mdns-refresh", defaultMDNSRefreshInterval, "how often to check for a new local address, in case the os doesn't report the change")
+	startCmd.Flags().Duration("mdns-ttl", defaultMDNSTTL, "how long other machines cache the .local names' addresses")
+	startCmd.Flags().String("dns", "", "address for the built-in DNS server, e.g. 127.0.0.1:5353 (disabled if empty)")
+	startCmd.Flags().StringSlice("dns-tld", []string{"test"}, "TLDs answered by the built-in DNS server")
+	startCmd.Flags().Bool("dns-forward", true, "forward dns queries for other names to upstream resolvers, caching the answers")
+	startCmd.Flags().StringSlice("dns-upstream", nil, "resolvers the dns server forwards to, e.g. 1.1.1.1 (defaults to the system's)")
+	startCmd.Flags().Bool("resolver", true, "point the system resolver at the dns server for its tlds while running (requires root), --resolver=false to configure it yourself")
+	startCmd.Flags().String("suffix", "local", "default suffix for names added without one, e.g. test or dev.localhost (names outside .local resolve via --hosts or --dns)")
+	// mDNS is unreliable on Windows, so names go in the hosts file there
+	// unless turned off.
+	startCmd.Flags().Bool("hosts", runtime.GOOS == "windows", "also write registered domains to the system hosts file (requires root or an elevated prompt)")
+	startCmd.Flags().String("log-format", "text", "daemon log format: text or json")
+	startCmd.Flags().String("log-level", "info", "least severe daemon log lines to write: info, warn or error")
+	startCmd.Flags().String("log-file", "", "write daemon logs to this file, rotated as it grows (defaults to the config dir when detached)")
+	startCmd.Flags().Float64("rate-limit", defaultRateLimit, "admin requests per second allowed from each client (0 disables)")
+	startCmd.Flags().Int("max-conns", defaultMaxClientConns, "admin connections allowed open at once from each client (0 disables)")
+	startCmd.Flags().Duration("client-timeout", defaultClientTimeout, "how long the cli waits for the daemon to respond")
+	startCmd.Flags().Duration("read-timeout", defaultReadTimeout, "how long an idle admin connection is kept open")
+	startCmd.Flags().Duration("caddy-timeout", defaultCaddyTimeout, "timeout for Caddy admin API requests, and for Caddy to come up at start")
+	startCmd.Flags().Int("max-message-size", defaultMaxMessageSize, "largest admin request or line response, in bytes")
+	startCmd.Flags().Duration("drain-timeout", defaultDrainTimeout, "how long shutdown waits for in-flight requests to finish")
+	startCmd.Flags().Bool("tls", false, "serve the TCP admin protocol over TLS with a self-signed certificate")
+	startCmd.Flags().Bool("allow-lan", false, "listen on every interface for --addr, so other machines can manage the daemon (implies --tls and --require-auth)")
+	startCmd.Flags().Bool("require-auth", false, "reject admin and API requests without a token")
+	startCmd.Flags().Bool("docker", false, "register domains for docker containers labeled localbase.domain and localbase.port")
 	rootCmd.AddCommand(stopCmd())
 	rootCmd.AddCommand(removeCmd())
+	rootCmd.AddCommand(updateCmd())
+	rootCmd.AddCommand(pauseCmd())
+	rootCmd.AddCommand(resumeCmd())
+	rootCmd.AddCommand(undoCmd())
 	rootCmd.AddCommand(listCmd())
+	rootCmd.AddCommand(statusCmd())
+	rootCmd.AddCommand(healthCmd())
+	rootCmd.AddCommand(discoverCmd())
+	rootCmd.AddCommand(resolveCmd())
+	rootCmd.AddCommand(shareCmd())
+	rootCmd.AddCommand(schemaCmd())
+	rootCmd.AddCommand(runCmd())
+	rootCmd.AddCommand(upCmd())
+	rootCmd.AddCommand(downCmd())
+	rootCmd.AddCommand(serviceCmd())
+	rootCmd.AddCommand(trustCmd())
+	rootCmd.AddCommand(caddyCmd())
+	rootCmd.AddCommand(logsCmd())
+	rootCmd.AddCommand(watchCmd())
+	rootCmd.AddCommand(auditCmd())
+	rootCmd.AddCommand(tokenCmd())
+	rootCmd.AddCommand(webhookCmd())
+	rootCmd.AddCommand(exportCmd())
+	rootCmd.AddCommand(importCmd())
+	rootCmd.AddCommand(backupCmd())
+	rootCmd.AddCommand(restoreCmd())
+	rootCmd.AddCommand(configCmd())
+
+	// Cobra shows a group's help for an unknown subcommand, like token frob,
+	// and exits 0, and its error for an unknown command is a plain one.
+	// Refuse their args as usage errors instead, leaving the bare root and
+	// groups to show help.
+	for _, cmd := range append(rootCmd.Commands(), rootCmd) {
+		if cmd.HasSubCommands() && !cmd.Runnable() {
+			cmd.Args = noArgs
+			cmd.RunE = func(cmd *cobra.Command, args []string) error {
+				return cmd.Help()
+			}
+		}
+	}
 }
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatalf("[localbase]: %v", err)
+		log.Printf("[localbase]: %v", err)
+		os.Exit(exitCode(err))
 	}
 }
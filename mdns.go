@@ -0,0 +1,958 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// mDNS multicast groups (RFC 6762).
+var (
+	mdnsGroupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsGroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+const (
+	// mdnsOtherTTL is the TTL of records not tied to a host name, PTR and
+	// TXT, as RFC 6762 recommends.
+	mdnsOtherTTL = 4500
+	// mdnsLegacyTTL caps the TTL of answers to one-shot queriers, which
+	// don't see the updates sent to the multicast group.
+	mdnsLegacyTTL = 10
+	// mdnsCacheFlush is the class bit telling queriers to replace what they
+	// have cached for a name.
+	mdnsCacheFlush = 1 << 15
+	// mdnsUnicastResponse is the question class bit asking for a unicast
+	// reply.
+	mdnsUnicastResponse = 1 << 15
+	// mdnsServices is the name DNS-SD browsers enumerate service types at.
+	mdnsServices = "_services._dns-sd._udp.local."
+	// mdnsLocalbaseService is the service type every localbase domain is
+	// also advertised as, which discover browses.
+	mdnsLocalbaseService = "_localbase._tcp.local."
+	// mdnsProbes is how many probe queries are sent before claiming a name,
+	// mdnsProbeInterval apart (RFC 6762 section 8.1).
+	mdnsProbes        = 3
+	mdnsProbeInterval = 250 * time.Millisecond
+	// mdnsConflictInterval limits how often a conflict over the same name
+	// is reported.
+	mdnsConflictInterval = time.Minute
+)
+
+// mdnsAdvertiser advertises .local names on the LAN, with localbase's own
+// responder or the OS's.
+type mdnsAdvertiser interface {
+	add(hosts ...*mdnsHost)
+	remove(names ...string)
+	setAddrs(ip4, ip6 net.IP)
+	// updateInterfaces starts advertising on interfaces that came up or
+	// moved to a private network since, and stops on those that moved to a
+	// public one.
+	updateInterfaces()
+	// probe asks the LAN whether another host already answers for any of
+	// names, returning those that are taken.
+	probe(names ...string) []string
+	count() int
+	close()
+}
+
+// mdnsHost is a .local name the responder answers for, along with the
+// DNS-SD service it is advertised as.
+type mdnsHost struct {
+	// name and service are fully qualified, e.g. hello.local. and
+	// _https._tcp.local.
+	name    string
+	service string
+	// instance is advertised at port with txt, and must have its dots
+	// escaped.
+	instance string
+	port     int
+	txt      []string
+	// discover also advertises the instance as a localbase domain, for
+	// discover. It is set for a domain's primary name only.
+	discover bool
+}
+
+// mdnsResponder answers queries for the registered .local names over both
+// the IPv4 and IPv6 multicast groups, announcing names when they are added
+// or their addresses change and sending goodbyes when they are removed.
+// Names resolve to the addresses of the interface a query comes in on, so
+// a machine on several networks is reachable from each.
+type mdnsResponder struct {
+	mu    sync.Mutex
+	hosts map[string]*mdnsHost
+	// ip4 and ip6 are the preferred addresses, answered with when the
+	// interface a query came in on is unknown or has no address.
+	ip4 net.IP
+	ip6 net.IP
+	// addrs are the addresses of each interface the groups were joined on,
+	// by index.
+	addrs  map[int][]net.IP
+	closed bool
+	// ttl is the TTL of the records tied to a host name, A, AAAA and SRV.
+	ttl uint32
+
+	// probing receives the names being probed for as other hosts answer
+	// for them, by name.
+	probing map[string]chan<- string
+	// conflicts is when a conflict over each registered name was last
+	// reported.
+	conflicts map[string]time.Time
+	// onConflict, if set, is called when another host answers for a
+	// registered name, with the name and the host's address.
+	onConflict func(name, from string)
+
+	conn4 *ipv4.PacketConn
+	conn6 *ipv6.PacketConn
+	// ifaces are the interfaces the groups were joined on, guarded by mu.
+	ifaces []net.Interface
+	// public are the names of the interfaces left out for being on public
+	// networks, guarded by mu.
+	public []string
+}
+
+// newMDNSResponder joins the mDNS groups on every allowed multicast
+// interface, answering with host records that live for ttl. It fails only
+// if neither IPv4 nor IPv6 could be set up.
+func newMDNSResponder(ttl time.Duration) (*mdnsResponder, error) {
+	r := &mdnsResponder{
+		hosts:     make(map[string]*mdnsHost),
+		probing:   make(map[string]chan<- string),
+		conflicts: make(map[string]time.Time),
+		ttl:       uint32(ttl / time.Second),
+	}
+
+	ifaces, public, err := mdnsInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	r.ifaces, r.public = ifaces, public
+	r.addrs = interfaceAddrs(ifaces)
+	for _, name := range public {
+		log.Printf("mdns: not answering on %s, it is on a public network", name)
+	}
+
+	// Binding the group addresses rather than the wildcard makes Go set
+	// SO_REUSEADDR, so the system's own responder can keep port 5353. With
+	// no interface to join yet, e.g. when all are on public networks, the
+	// sockets are kept for updateInterfaces to join them later.
+	if c, err := net.ListenUDP("udp4", mdnsGroupIPv4); err != nil {
+		log.Printf("mdns: failed to listen on %s: %v", mdnsGroupIPv4, err)
+	} else {
+		p := ipv4.NewPacketConn(c)
+		joined := 0
+		for i := range r.ifaces {
+			if p.JoinGroup(&r.ifaces[i], mdnsGroupIPv4) == nil {
+				joined++
+			}
+		}
+		p.SetControlMessage(ipv4.FlagInterface, true)
+		p.SetMulticastTTL(255)
+		if joined > 0 || len(r.ifaces) == 0 {
+			r.conn4 = p
+		} else {
+			c.Close()
+		}
+	}
+
+	if c, err := net.ListenUDP("udp6", mdnsGroupIPv6); err != nil {
+		log.Printf("mdns: failed to listen on %s: %v", mdnsGroupIPv6, err)
+	} else {
+		p := ipv6.NewPacketConn(c)
+		joined := 0
+		for i := range r.ifaces {
+			if p.JoinGroup(&r.ifaces[i], mdnsGroupIPv6) == nil {
+				joined++
+			}
+		}
+		p.SetControlMessage(ipv6.FlagInterface, true)
+		p.SetMulticastHopLimit(255)
+		if joined > 0 || len(r.ifaces) == 0 {
+			r.conn6 = p
+		} else {
+			c.Close()
+		}
+	}
+
+	if r.conn4 == nil && r.conn6 == nil {
+		return nil, fmt.Errorf("no interface joined the mDNS groups")
+	}
+	return r, nil
+}
+
+// mdnsInterfaces returns the allowed interfaces that are up and support
+// multicast, except those on public networks, whose names are returned
+// apart, and the bridges mDNS is reflected onto.
+func mdnsInterfaces() (allowed []net.Interface, public []string, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if matchInterface(reflectInterfaces, iface.Name) {
+			allowed = append(allowed, iface)
+			continue
+		}
+		if !interfaceAllowed(iface.Name) {
+			continue
+		}
+		if networkPolicy(iface) == networkPublic {
+			public = append(public, iface.Name)
+			continue
+		}
+		allowed = append(allowed, iface)
+	}
+	return allowed, public, nil
+}
+
+// interfaceAddrs returns the unicast addresses of each of ifaces, by index.
+func interfaceAddrs(ifaces []net.Interface) map[int][]net.IP {
+	addrs := make(map[int][]net.IP, len(ifaces))
+	for _, iface := range ifaces {
+		list, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range list {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsMulticast() || ipnet.IP.IsUnspecified() {
+				continue
+			}
+			addrs[iface.Index] = append(addrs[iface.Index], ipnet.IP)
+		}
+	}
+	return addrs
+}
+
+// updateInterfaces joins the groups on interfaces that came up or moved
+// to a private network since the responder started, such as a new network
+// adapter, and announces the names there. It leaves the groups on
+// interfaces that moved to a public network, without goodbyes, which would
+// advertise the names there.
+func (r *mdnsResponder) updateInterfaces() {
+	if r == nil {
+		return
+	}
+	ifaces, public, err := mdnsInterfaces()
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	for _, name := range public {
+		if !containsString(r.public, name) {
+			log.Printf("mdns: not answering on %s, it is on a public network", name)
+		}
+	}
+	r.public = public
+	var kept []net.Interface
+	for i := range r.ifaces {
+		if !containsString(public, r.ifaces[i].Name) {
+			kept = append(kept, r.ifaces[i])
+			continue
+		}
+		if r.conn4 != nil {
+			r.conn4.LeaveGroup(&r.ifaces[i], mdnsGroupIPv4)
+		}
+		if r.conn6 != nil {
+			r.conn6.LeaveGroup(&r.ifaces[i], mdnsGroupIPv6)
+		}
+		delete(r.addrs, r.ifaces[i].Index)
+	}
+	r.ifaces = kept
+
+	rrs := make(map[int][]dns.RR)
+	known := make(map[int]bool, len(r.ifaces))
+	for _, iface := range r.ifaces {
+		known[iface.Index] = true
+	}
+	for i := range ifaces {
+		if known[ifaces[i].Index] {
+			continue
+		}
+		if r.conn4 != nil {
+			r.conn4.JoinGroup(&ifaces[i], mdnsGroupIPv4)
+		}
+		if r.conn6 != nil {
+			r.conn6.JoinGroup(&ifaces[i], mdnsGroupIPv6)
+		}
+		r.ifaces = append(r.ifaces, ifaces[i])
+		r.addrs[ifaces[i].Index] = interfaceAddrs(ifaces[i : i+1])[ifaces[i].Index]
+		for _, h := range r.hosts {
+			rrs[ifaces[i].Index] = append(rrs[ifaces[i].Index], r.hostRecords(h, false, ifaces[i].Index)...)
+		}
+		log.Printf("mdns: answering on %s", ifaces[i].Name)
+	}
+	r.mu.Unlock()
+	r.announce(rrs)
+}
+
+// serve answers queries until close is called.
+func (r *mdnsResponder) serve() {
+	if r.conn4 != nil {
+		go func() {
+			buf := make([]byte, 9000)
+			for {
+				n, cm, src, err := r.conn4.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				ifIndex := 0
+				if cm != nil {
+					ifIndex = cm.IfIndex
+				}
+				r.handle(buf[:n], src, ifIndex)
+			}
+		}()
+	}
+	if r.conn6 != nil {
+		go func() {
+			buf := make([]byte, 9000)
+			for {
+				n, cm, src, err := r.conn6.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				ifIndex := 0
+				if cm != nil {
+					ifIndex = cm.IfIndex
+				}
+				r.handle(buf[:n], src, ifIndex)
+			}
+		}()
+	}
+}
+
+// close says goodbye for every name and stops answering.
+func (r *mdnsResponder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	var names []string
+	for name := range r.hosts {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	r.remove(names...)
+
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	if r.conn4 != nil {
+		r.conn4.Close()
+	}
+	if r.conn6 != nil {
+		r.conn6.Close()
+	}
+}
+
+// interfaceNames lists the interfaces the groups were joined on.
+func (r *mdnsResponder) interfaceNames() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, len(r.ifaces))
+	for i, iface := range r.ifaces {
+		names[i] = iface.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// count returns the number of names the responder answers for.
+func (r *mdnsResponder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.hosts)
+}
+
+// setAddrs sets the preferred addresses, and looks up the addresses of
+// each interface again, announcing the address records of interfaces whose
+// addresses changed and sending goodbyes for addresses that are gone. ip6
+// may be nil if there is no IPv6 address.
+func (r *mdnsResponder) setAddrs(ip4, ip6 net.IP) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.ip4, r.ip6 = ip4, ip6
+	addrs := interfaceAddrs(r.ifaces)
+	rrs := make(map[int][]dns.RR)
+	for _, iface := range r.ifaces {
+		old, current := r.addrs[iface.Index], addrs[iface.Index]
+		var gone []net.IP
+		for _, ip := range old {
+			if !containsIP(current, ip) {
+				gone = append(gone, ip)
+			}
+		}
+		if len(gone) == 0 && len(old) == len(current) {
+			continue
+		}
+		for _, h := range r.hosts {
+			rrs[iface.Index] = append(rrs[iface.Index], addrRecords(h.name, 0, gone)...)
+			rrs[iface.Index] = append(rrs[iface.Index], addrRecords(h.name, r.ttl, current)...)
+		}
+	}
+	r.addrs = addrs
+	r.mu.Unlock()
+
+	r.announce(rrs)
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, have := range ips {
+		if have.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// add starts answering for hosts and announces them.
+func (r *mdnsResponder) add(hosts ...*mdnsHost) {
+	if r == nil {
+		return
+	}
+	rrs := make(map[int][]dns.RR)
+	r.mu.Lock()
+	for _, h := range hosts {
+		r.hosts[strings.ToLower(h.name)] = h
+		for _, iface := range r.ifaces {
+			for _, rr := range r.hostRecords(h, false, iface.Index) {
+				rrs[iface.Index] = appendRR(rrs[iface.Index], rr)
+			}
+		}
+	}
+	r.mu.Unlock()
+	r.announce(rrs)
+}
+
+// probe sends probe queries for names on every interface, proposing the
+// address records it would answer with, and returns the names another host
+// answered for. It takes a little under a second.
+func (r *mdnsResponder) probe(names ...string) []string {
+	if r == nil || len(names) == 0 {
+		return nil
+	}
+	taken := make(chan string, len(names)*mdnsProbes)
+	msgs := make(map[int]*dns.Msg)
+	r.mu.Lock()
+	for _, name := range names {
+		r.probing[strings.ToLower(dns.Fqdn(name))] = taken
+	}
+	for _, iface := range r.ifaces {
+		msg := new(dns.Msg)
+		for _, name := range names {
+			name = dns.Fqdn(name)
+			msg.Question = append(msg.Question, dns.Question{Name: name, Qtype: dns.TypeANY, Qclass: dns.ClassINET})
+			msg.Ns = append(msg.Ns, addrRecords(name, r.ttl, r.ifaceAddrs(iface.Index))...)
+		}
+		msgs[iface.Index] = msg
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		for _, name := range names {
+			delete(r.probing, strings.ToLower(dns.Fqdn(name)))
+		}
+		r.mu.Unlock()
+	}()
+
+	// The probes ask for multicast replies, as the socket bound to the
+	// group address doesn't receive unicast ones.
+	for i := 0; i < mdnsProbes; i++ {
+		if i > 0 {
+			time.Sleep(mdnsProbeInterval)
+		}
+		for ifIndex, msg := range msgs {
+			if r.conn4 != nil {
+				r.send(msg, mdnsGroupIPv4, ifIndex)
+			}
+			if r.conn6 != nil {
+				r.send(msg, mdnsGroupIPv6, ifIndex)
+			}
+		}
+	}
+	time.Sleep(mdnsProbeInterval)
+
+	var result []string
+	for {
+		select {
+		case name := <-taken:
+			for _, n := range names {
+				if strings.EqualFold(dns.Fqdn(n), name) {
+					result = appendUnique(result, n)
+				}
+			}
+		default:
+			return result
+		}
+	}
+}
+
+// remove stops answering for the hosts named and sends their records with
+// a zero TTL, so queriers drop them from their caches right away.
+func (r *mdnsResponder) remove(names ...string) {
+	if r == nil {
+		return
+	}
+	var removed []*mdnsHost
+	r.mu.Lock()
+	for _, name := range names {
+		name = strings.ToLower(dns.Fqdn(name))
+		if h := r.hosts[name]; h != nil {
+			removed = append(removed, h)
+			delete(r.hosts, name)
+			delete(r.conflicts, name)
+		}
+	}
+	// Service types other names are still advertised as stay listed.
+	inUse := make(map[string]bool)
+	for _, h := range r.hosts {
+		inUse[h.service] = true
+		if h.discover {
+			inUse[mdnsLocalbaseService] = true
+		}
+	}
+	rrs := make(map[int][]dns.RR)
+	for _, iface := range r.ifaces {
+		for _, h := range removed {
+			for _, rr := range r.hostRecords(h, true, iface.Index) {
+				if ptr, ok := rr.(*dns.PTR); ok && ptr.Hdr.Name == mdnsServices && inUse[ptr.Ptr] {
+					continue
+				}
+				rrs[iface.Index] = appendRR(rrs[iface.Index], rr)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	r.sendEach(rrs)
+}
+
+// ifaceAddrs returns the addresses names resolve to on the interface
+// ifIndex, the preferred ones if it is unknown. r.mu must be held.
+func (r *mdnsResponder) ifaceAddrs(ifIndex int) []net.IP {
+	if ips := r.addrs[ifIndex]; len(ips) > 0 {
+		return ips
+	}
+	var ips []net.IP
+	for _, ip := range []net.IP{r.ip4, r.ip6} {
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// addrRecords returns the A and AAAA records of name for ips.
+func addrRecords(name string, ttl uint32, ips []net.IP) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET | mdnsCacheFlush, Ttl: ttl},
+				A:   ip4,
+			})
+		} else {
+			rrs = append(rrs, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET | mdnsCacheFlush, Ttl: ttl},
+				AAAA: ip,
+			})
+		}
+	}
+	return rrs
+}
+
+// hostRecords returns every record of h on the interface ifIndex, or its
+// goodbyes with a zero TTL. Shared records, the PTRs, don't set the
+// cache-flush bit. r.mu must be held.
+func (r *mdnsResponder) hostRecords(h *mdnsHost, goodbye bool, ifIndex int) []dns.RR {
+	hostTTL, otherTTL := r.ttl, uint32(mdnsOtherTTL)
+	if goodbye {
+		hostTTL, otherTTL = 0, 0
+	}
+
+	rrs := addrRecords(h.name, hostTTL, r.ifaceAddrs(ifIndex))
+	if h.discover {
+		rrs = append(rrs, serviceRecords(mdnsLocalbaseService, h.instance, h.name, h.port, h.txt, hostTTL, otherTTL)...)
+	}
+	return append(rrs, serviceRecords(h.service, h.instance, h.name, h.port, h.txt, hostTTL, otherTTL)...)
+}
+
+// serviceRecords returns the DNS-SD records advertising the instance of
+// service at target and port.
+func serviceRecords(service, instance, target string, port int, txt []string, hostTTL, otherTTL uint32) []dns.RR {
+	instance += "." + service
+	if len(txt) == 0 {
+		txt = []string{""}
+	}
+	return []dns.RR{
+		&dns.PTR{
+			Hdr: dns.RR_Header{Name: service, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: otherTTL},
+			Ptr: instance,
+		},
+		&dns.SRV{
+			Hdr:    dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET | mdnsCacheFlush, Ttl: hostTTL},
+			Port:   uint16(port),
+			Target: target,
+		},
+		&dns.TXT{
+			Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET | mdnsCacheFlush, Ttl: otherTTL},
+			Txt: txt,
+		},
+		&dns.PTR{
+			Hdr: dns.RR_Header{Name: mdnsServices, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: otherTTL},
+			Ptr: service,
+		},
+	}
+}
+
+// records returns the records answering q on the interface ifIndex, and
+// the additional records a querier would likely ask for next.
+func (r *mdnsResponder) records(q dns.Question, ifIndex int) (answers, extra []dns.RR) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Names advertised as the same service share its PTR records.
+	var all []dns.RR
+	seen := make(map[string]bool)
+	for _, h := range r.hosts {
+		for _, rr := range r.hostRecords(h, false, ifIndex) {
+			if key := rr.String(); !seen[key] {
+				seen[key] = true
+				all = append(all, rr)
+			}
+		}
+	}
+
+	for _, rr := range all {
+		hdr := rr.Header()
+		if strings.EqualFold(hdr.Name, q.Name) && (q.Qtype == dns.TypeANY || q.Qtype == hdr.Rrtype) {
+			answers = append(answers, rr)
+		}
+	}
+	for _, rr := range answers {
+		for _, add := range additionalRecords(rr, all) {
+			if !containsRR(answers, add) {
+				extra = appendRR(extra, add)
+			}
+		}
+	}
+	return answers, append(extra, r.nsecRecords(append(answers, extra...))...)
+}
+
+// additionalRecords returns the records of all that RFC 6763 section 12
+// has sent along with rr: the SRV and TXT records of the instance a service
+// PTR points to, the addresses of an SRV's target, and a host's other
+// addresses for an address record. Service type enumeration gets none.
+func additionalRecords(rr dns.RR, all []dns.RR) []dns.RR {
+	var extra []dns.RR
+	switch rr := rr.(type) {
+	case *dns.PTR:
+		if strings.EqualFold(rr.Hdr.Name, mdnsServices) {
+			return nil
+		}
+		for _, have := range all {
+			if !strings.EqualFold(have.Header().Name, rr.Ptr) {
+				continue
+			}
+			switch have := have.(type) {
+			case *dns.SRV:
+				extra = append(extra, have)
+				extra = append(extra, additionalRecords(have, all)...)
+			case *dns.TXT:
+				extra = append(extra, have)
+			}
+		}
+	case *dns.SRV:
+		extra = hostAddrRecords(rr.Target, all)
+	case *dns.A, *dns.AAAA:
+		extra = hostAddrRecords(rr.Header().Name, all)
+	}
+	return extra
+}
+
+// hostAddrRecords returns the A and AAAA records of all for name.
+func hostAddrRecords(name string, all []dns.RR) []dns.RR {
+	var addrs []dns.RR
+	for _, rr := range all {
+		if t := rr.Header().Rrtype; (t == dns.TypeA || t == dns.TypeAAAA) && strings.EqualFold(rr.Header().Name, name) {
+			addrs = append(addrs, rr)
+		}
+	}
+	return addrs
+}
+
+// nsecRecords returns an NSEC record for each host whose addresses are in
+// rrs but that has only IPv4 or only IPv6 addresses, telling queriers the
+// other kind doesn't exist so they needn't wait for it (RFC 6762 section
+// 6.1). r.mu must be held.
+func (r *mdnsResponder) nsecRecords(rrs []dns.RR) []dns.RR {
+	types := make(map[string]map[uint16]bool)
+	var names []string
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype != dns.TypeA && hdr.Rrtype != dns.TypeAAAA {
+			continue
+		}
+		name := strings.ToLower(hdr.Name)
+		if types[name] == nil {
+			types[name] = make(map[uint16]bool)
+			names = append(names, hdr.Name)
+		}
+		types[name][hdr.Rrtype] = true
+	}
+
+	var nsecs []dns.RR
+	for _, name := range names {
+		has := types[strings.ToLower(name)]
+		if has[dns.TypeA] && has[dns.TypeAAAA] {
+			continue
+		}
+		bitmap := []uint16{dns.TypeA}
+		if has[dns.TypeAAAA] {
+			bitmap = []uint16{dns.TypeAAAA}
+		}
+		nsecs = append(nsecs, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET | mdnsCacheFlush, Ttl: r.ttl},
+			NextDomain: name,
+			TypeBitMap: bitmap,
+		})
+	}
+	return nsecs
+}
+
+// appendRR appends rr to rrs unless it is already there, as names
+// advertised as the same service share its PTR records.
+func appendRR(rrs []dns.RR, rr dns.RR) []dns.RR {
+	if containsRR(rrs, rr) {
+		return rrs
+	}
+	return append(rrs, rr)
+}
+
+func containsRR(rrs []dns.RR, rr dns.RR) bool {
+	for _, have := range rrs {
+		if dns.IsDuplicate(have, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle answers the query in packet, received from src on the interface
+// ifIndex. Queries from a port other than 5353 come from one-shot
+// resolvers and get a unicast reply echoing the query, as do questions
+// with the unicast-response bit set; the rest are answered on the group.
+func (r *mdnsResponder) handle(packet []byte, src net.Addr, ifIndex int) {
+	var query dns.Msg
+	if err := query.Unpack(packet); err != nil || query.Opcode != dns.OpcodeQuery {
+		return
+	}
+	addr, ok := src.(*net.UDPAddr)
+	if !ok || !r.joined(ifIndex) {
+		return
+	}
+	if query.Response {
+		r.handleResponse(&query, addr)
+		return
+	}
+	legacy := addr.Port != mdnsGroupIPv4.Port
+
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	if legacy {
+		resp.Id = query.Id
+		resp.Question = query.Question
+	}
+
+	unicast := legacy
+	for _, q := range query.Question {
+		answers, extra := r.records(q, ifIndex)
+		for _, rr := range answers {
+			if !knownAnswer(&query, rr) {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+		for _, rr := range extra {
+			if !containsRR(resp.Answer, rr) {
+				resp.Extra = appendRR(resp.Extra, rr)
+			}
+		}
+		if len(answers) > 0 && q.Qclass&mdnsUnicastResponse != 0 {
+			unicast = true
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return
+	}
+	if legacy {
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			hdr := rr.Header()
+			hdr.Class &^= mdnsCacheFlush
+			if hdr.Ttl > mdnsLegacyTTL {
+				hdr.Ttl = mdnsLegacyTTL
+			}
+		}
+	}
+
+	dst := addr
+	if !unicast {
+		dst = mdnsGroupIPv4
+		if addr.IP.To4() == nil {
+			dst = mdnsGroupIPv6
+		}
+	}
+	r.send(resp, dst, ifIndex)
+}
+
+// handleResponse looks through a response another host sent for address
+// records of names being probed for or already registered. Records with
+// one of our own addresses are ours, looped back or sent by another
+// responder on this machine, and are no conflict.
+func (r *mdnsResponder) handleResponse(resp *dns.Msg, src *net.UDPAddr) {
+	r.mu.Lock()
+	var own []net.IP
+	for _, ips := range r.addrs {
+		own = append(own, ips...)
+	}
+	own = append(own, r.ip4, r.ip6)
+	if containsIP(own, src.IP) {
+		r.mu.Unlock()
+		return
+	}
+
+	var conflicts []string
+	for _, rr := range append(resp.Answer, resp.Extra...) {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		name := strings.ToLower(rr.Header().Name)
+		if rr.Header().Ttl == 0 || containsIP(own, ip) {
+			continue
+		}
+		if taken := r.probing[name]; taken != nil {
+			select {
+			case taken <- name:
+			default:
+			}
+		} else if r.hosts[name] != nil && time.Since(r.conflicts[name]) > mdnsConflictInterval {
+			r.conflicts[name] = time.Now()
+			conflicts = append(conflicts, name)
+		}
+	}
+	onConflict := r.onConflict
+	r.mu.Unlock()
+
+	for _, name := range conflicts {
+		name = strings.TrimSuffix(name, ".")
+		log.Printf("mdns: another host (%s) also answers for %s, remove or rename the domain on one of them", src.IP, name)
+		if onConflict != nil {
+			onConflict(name, src.IP.String())
+		}
+	}
+}
+
+// joined reports whether the groups were joined on the interface ifIndex.
+// The socket also receives queries from interfaces other programs joined
+// the groups on, which are ignored.
+func (r *mdnsResponder) joined(ifIndex int) bool {
+	if ifIndex == 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, iface := range r.ifaces {
+		if iface.Index == ifIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// knownAnswer reports whether query lists rr as already known with at least
+// half of its TTL left, so it needn't be sent again.
+func knownAnswer(query *dns.Msg, rr dns.RR) bool {
+	want := dns.Copy(rr)
+	want.Header().Class &^= mdnsCacheFlush
+	for _, known := range query.Answer {
+		got := dns.Copy(known)
+		got.Header().Class &^= mdnsCacheFlush
+		if dns.IsDuplicate(got, want) && known.Header().Ttl >= rr.Header().Ttl/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// announce sends the records for each interface to the groups on it, and
+// again a second later in case the first was lost, as RFC 6762 asks.
+func (r *mdnsResponder) announce(rrs map[int][]dns.RR) {
+	if len(rrs) == 0 {
+		return
+	}
+	r.sendEach(rrs)
+	time.AfterFunc(time.Second, func() { r.sendEach(rrs) })
+}
+
+// sendEach sends the records for each interface to the groups on it.
+func (r *mdnsResponder) sendEach(rrs map[int][]dns.RR) {
+	for ifIndex, answers := range rrs {
+		if len(answers) == 0 {
+			continue
+		}
+		msg := new(dns.Msg)
+		msg.Response = true
+		msg.Authoritative = true
+		msg.Answer = answers
+		if r.conn4 != nil {
+			r.send(msg, mdnsGroupIPv4, ifIndex)
+		}
+		if r.conn6 != nil {
+			r.send(msg, mdnsGroupIPv6, ifIndex)
+		}
+	}
+}
+
+func (r *mdnsResponder) send(msg *dns.Msg, dst *net.UDPAddr, ifIndex int) {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return
+	}
+
+	packet, err := msg.Pack()
+	if err != nil {
+		log.Printf("mdns: failed to pack response: %v", err)
+		return
+	}
+	if dst.IP.To4() != nil {
+		if r.conn4 != nil {
+			_, err = r.conn4.WriteTo(packet, &ipv4.ControlMessage{IfIndex: ifIndex}, dst)
+		}
+	} else if r.conn6 != nil {
+		_, err = r.conn6.WriteTo(packet, &ipv6.ControlMessage{IfIndex: ifIndex}, dst)
+	}
+	if err != nil {
+		log.Printf("mdns: failed to send to %s: %v", dst, err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/miekg/dns"
+)
+
+// Avahi's D-Bus names and constants, from avahi-common/defs.h.
+const (
+	avahiService    = "org.freedesktop.Avahi"
+	avahiServer     = "org.freedesktop.Avahi.Server"
+	avahiEntryGroup = "org.freedesktop.Avahi.EntryGroup"
+
+	avahiIfUnspec    = int32(-1)
+	avahiProtoUnspec = int32(-1)
+	// avahiPublishNoReverse leaves out the reverse lookup record of an
+	// address, which the machine's own host name already has.
+	avahiPublishNoReverse = uint32(16)
+
+	avahiServerRunning  = int32(2)
+	avahiGroupCollision = int32(3)
+	avahiGroupFailure   = int32(4)
+)
+
+// avahiMDNS advertises names through avahi-daemon's D-Bus API, for Linux
+// machines where avahi-daemon already owns the mDNS port. Each name is an
+// entry group holding its addresses and services. Avahi answers with the
+// same addresses on every interface, and probes for each name itself.
+type avahiMDNS struct {
+	conn *dbus.Conn
+
+	mu    sync.Mutex
+	ip4   net.IP
+	ip6   net.IP
+	hosts map[string]*mdnsHost
+	// groups are the entry group of each registered name.
+	groups map[string]dbus.ObjectPath
+}
+
+// avahiRunning reports whether avahi-daemon is up on the system bus.
+func avahiRunning() bool {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	return avahiState(conn) == nil
+}
+
+// avahiState checks that avahi-daemon is running.
+func avahiState(conn *dbus.Conn) error {
+	var state int32
+	if err := conn.Object(avahiService, "/").Call(avahiServer+".GetState", 0).Store(&state); err != nil {
+		return fmt.Errorf("avahi-daemon isn't running: %v", err)
+	}
+	if state != avahiServerRunning {
+		return fmt.Errorf("avahi-daemon isn't running yet, its state is %d", state)
+	}
+	return nil
+}
+
+func newAvahiMDNS() (mdnsAdvertiser, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the system bus: %v", err)
+	}
+	if err := avahiState(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	a := &avahiMDNS{
+		conn:   conn,
+		hosts:  make(map[string]*mdnsHost),
+		groups: make(map[string]dbus.ObjectPath),
+	}
+	// Entry groups report collisions with other hosts, and avahi-daemon
+	// forgets every group when it restarts.
+	err = conn.AddMatchSignal(dbus.WithMatchInterface(avahiEntryGroup), dbus.WithMatchMember("StateChanged"))
+	if err == nil {
+		err = conn.AddMatchSignal(dbus.WithMatchInterface("org.freedesktop.DBus"), dbus.WithMatchMember("NameOwnerChanged"), dbus.WithMatchArg(0, avahiService))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to watch avahi-daemon: %v", err)
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	go a.watch(signals)
+	return a, nil
+}
+
+// watch logs names avahi-daemon withdrew, and registers every name again
+// when avahi-daemon restarts.
+func (a *avahiMDNS) watch(signals <-chan *dbus.Signal) {
+	for sig := range signals {
+		switch sig.Name {
+		case avahiEntryGroup + ".StateChanged":
+			var state int32
+			var reason string
+			if dbus.Store(sig.Body, &state, &reason) != nil {
+				continue
+			}
+			name := a.groupName(sig.Path)
+			switch {
+			case name == "":
+			case state == avahiGroupCollision:
+				log.Printf("mdns: another host on the network already uses %s, avahi withdrew it", strings.TrimSuffix(name, "."))
+			case state == avahiGroupFailure:
+				log.Printf("mdns: avahi failed to advertise %s: %s", strings.TrimSuffix(name, "."), reason)
+			}
+		case "org.freedesktop.DBus.NameOwnerChanged":
+			var service, oldOwner, newOwner string
+			if dbus.Store(sig.Body, &service, &oldOwner, &newOwner) != nil || service != avahiService || newOwner == "" {
+				continue
+			}
+			log.Println("mdns: avahi-daemon restarted, advertising the names again")
+			a.mu.Lock()
+			a.groups = make(map[string]dbus.ObjectPath)
+			for name := range a.hosts {
+				a.register(name)
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// groupName returns the name the entry group at path was created for.
+func (a *avahiMDNS) groupName(path dbus.ObjectPath) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, p := range a.groups {
+		if p == path {
+			return name
+		}
+	}
+	return ""
+}
+
+func (a *avahiMDNS) add(hosts ...*mdnsHost) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, h := range hosts {
+		name := strings.ToLower(h.name)
+		a.deregister(name)
+		a.hosts[name] = h
+		a.register(name)
+	}
+}
+
+func (a *avahiMDNS) remove(names ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, name := range names {
+		name = strings.ToLower(dns.Fqdn(name))
+		a.deregister(name)
+		delete(a.hosts, name)
+	}
+}
+
+// setAddrs registers every name again when the addresses change, since
+// the addresses are part of each entry group.
+func (a *avahiMDNS) setAddrs(ip4, ip6 net.IP) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ip4.Equal(ip4) && a.ip6.Equal(ip6) {
+		return
+	}
+	a.ip4, a.ip6 = ip4, ip6
+	for name := range a.hosts {
+		a.deregister(name)
+		a.register(name)
+	}
+}
+
+// updateInterfaces does nothing, avahi-daemon follows interfaces itself.
+// Network policies don't apply to it; its allow-interfaces setting does.
+func (a *avahiMDNS) updateInterfaces() {}
+
+// probe finds nothing taken, avahi-daemon probes for each name itself as
+// it registers it, and a collision is logged.
+func (a *avahiMDNS) probe(names ...string) []string { return nil }
+
+func (a *avahiMDNS) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.hosts)
+}
+
+func (a *avahiMDNS) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name := range a.groups {
+		a.deregister(name)
+	}
+	a.conn.Close()
+}
+
+// register creates the entry group of the host called name, once there is
+// an address to register it with. a.mu must be held.
+func (a *avahiMDNS) register(name string) {
+	h := a.hosts[name]
+	if h == nil || a.ip4 == nil && a.ip6 == nil {
+		return
+	}
+	var path dbus.ObjectPath
+	if err := a.conn.Object(avahiService, "/").Call(avahiServer+".EntryGroupNew", 0).Store(&path); err != nil {
+		log.Printf("mdns: failed to register %s with avahi: %v", name, err)
+		return
+	}
+	a.groups[name] = path
+	if err := a.fill(a.conn.Object(avahiService, path), h); err != nil {
+		log.Printf("mdns: failed to register %s with avahi: %v", name, err)
+		a.deregister(name)
+	}
+}
+
+// fill adds the addresses and services of h to group, and commits it.
+func (a *avahiMDNS) fill(group dbus.BusObject, h *mdnsHost) error {
+	host := strings.TrimSuffix(h.name, ".")
+	for _, ip := range []net.IP{a.ip4, a.ip6} {
+		if ip == nil {
+			continue
+		}
+		call := group.Call(avahiEntryGroup+".AddAddress", 0, avahiIfUnspec, avahiProtoUnspec, avahiPublishNoReverse, host, ip.String())
+		if call.Err != nil {
+			return call.Err
+		}
+	}
+
+	// Avahi takes the instance name unescaped, and the service type and
+	// domain apart.
+	instance := strings.ReplaceAll(h.instance, `\.`, ".")
+	services := []string{h.service}
+	if h.discover {
+		services = append(services, mdnsLocalbaseService)
+	}
+	txt := make([][]byte, len(h.txt))
+	for i, kv := range h.txt {
+		txt[i] = []byte(kv)
+	}
+	for _, service := range services {
+		serviceType := strings.TrimSuffix(strings.TrimSuffix(service, "."), ".local")
+		call := group.Call(avahiEntryGroup+".AddService", 0, avahiIfUnspec, avahiProtoUnspec, uint32(0),
+			instance, serviceType, "local", host, uint16(h.port), txt)
+		if call.Err != nil {
+			return call.Err
+		}
+	}
+	return group.Call(avahiEntryGroup+".Commit", 0).Err
+}
+
+// deregister frees the entry group of the host called name, withdrawing
+// its records. a.mu must be held.
+func (a *avahiMDNS) deregister(name string) {
+	path, ok := a.groups[name]
+	if !ok {
+		return
+	}
+	delete(a.groups, name)
+	if err := a.conn.Object(avahiService, path).Call(avahiEntryGroup+".Free", 0).Err; err != nil {
+		log.Printf("mdns: failed to withdraw %s from avahi: %v", name, err)
+	}
+}
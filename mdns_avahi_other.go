@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// avahiRunning reports false, avahi is only used on Linux.
+func avahiRunning() bool { return false }
+
+func newAvahiMDNS() (mdnsAdvertiser, error) {
+	return nil, fmt.Errorf("avahi is not supported on %s", runtime.GOOS)
+}
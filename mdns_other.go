@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func newNativeMDNS() (mdnsAdvertiser, error) {
+	return nil, fmt.Errorf("native mdns is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	dnsapi                          = syscall.NewLazyDLL("dnsapi.dll")
+	procDnsServiceConstructInstance = dnsapi.NewProc("DnsServiceConstructInstance")
+	procDnsServiceFreeInstance      = dnsapi.NewProc("DnsServiceFreeInstance")
+	procDnsServiceRegister          = dnsapi.NewProc("DnsServiceRegister")
+	procDnsServiceDeRegister        = dnsapi.NewProc("DnsServiceDeRegister")
+)
+
+// dnsRequestPending is what DnsServiceRegister and DnsServiceDeRegister
+// return once the request is under way.
+const dnsRequestPending = 9506
+
+// dnsServiceRegisterRequest is DNS_SERVICE_REGISTER_REQUEST.
+type dnsServiceRegisterRequest struct {
+	version         uint32
+	interfaceIndex  uint32
+	serviceInstance uintptr
+	callback        uintptr
+	context         uintptr
+	credentials     uintptr
+	unicastEnabled  int32
+}
+
+// dnsServiceCallback is shared by every request, since Go can only create
+// a limited number of callbacks.
+var dnsServiceCallback = syscall.NewCallback(func(status, context, instance uintptr) uintptr {
+	if status != 0 {
+		log.Printf("mdns: the system responder failed a request: %v", syscall.Errno(status))
+	}
+	return 0
+})
+
+// nativeMDNS advertises names through the DNS-SD API of the Windows DNS
+// client, whose responder answers for them. Windows 10 1809 or later has
+// it.
+type nativeMDNS struct {
+	mu    sync.Mutex
+	ip4   net.IP
+	ip6   net.IP
+	hosts map[string]*mdnsHost
+	// instances are the registered service instances of each host. They
+	// are never freed, as Windows may still use one after
+	// DnsServiceDeRegister returns.
+	instances map[string][]uintptr
+}
+
+func newNativeMDNS() (mdnsAdvertiser, error) {
+	if err := procDnsServiceRegister.Find(); err != nil {
+		return nil, fmt.Errorf("the dns client has no DNS-SD support, it needs windows 10 1809 or later: %v", err)
+	}
+	return &nativeMDNS{
+		hosts:     make(map[string]*mdnsHost),
+		instances: make(map[string][]uintptr),
+	}, nil
+}
+
+func (n *nativeMDNS) add(hosts ...*mdnsHost) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, h := range hosts {
+		name := strings.ToLower(h.name)
+		n.deregister(name)
+		n.hosts[name] = h
+		n.register(name)
+	}
+}
+
+func (n *nativeMDNS) remove(names ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, name := range names {
+		name = strings.ToLower(dns.Fqdn(name))
+		n.deregister(name)
+		delete(n.hosts, name)
+	}
+}
+
+// setAddrs registers every name again when the addresses change, since
+// the addresses are part of each registration.
+func (n *nativeMDNS) setAddrs(ip4, ip6 net.IP) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ip4.Equal(ip4) && n.ip6.Equal(ip6) {
+		return
+	}
+	n.ip4, n.ip6 = ip4, ip6
+	for name := range n.hosts {
+		n.deregister(name)
+		n.register(name)
+	}
+}
+
+// updateInterfaces does nothing, the system responder follows interfaces
+// itself. Network policies don't apply to it.
+func (n *nativeMDNS) updateInterfaces() {}
+
+// probe finds nothing taken, the system responder probes for each name
+// itself as it registers it.
+func (n *nativeMDNS) probe(names ...string) []string { return nil }
+
+func (n *nativeMDNS) count() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.hosts)
+}
+
+func (n *nativeMDNS) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for name := range n.instances {
+		n.deregister(name)
+	}
+}
+
+// register registers the services of the host called name, once there is
+// an address to register them with. n.mu must be held.
+func (n *nativeMDNS) register(name string) {
+	h := n.hosts[name]
+	if h == nil || n.ip4 == nil && n.ip6 == nil {
+		return
+	}
+	host := strings.TrimSuffix(h.name, ".")
+	// The API takes the instance name unescaped, so its dots go.
+	instance := strings.ReplaceAll(h.instance, `\.`, "-")
+	services := []string{instance + "." + h.service}
+	if h.discover {
+		services = append(services, instance+"."+mdnsLocalbaseService)
+	}
+
+	for _, service := range services {
+		instance, err := n.registerService(strings.TrimSuffix(service, "."), host, h.port, h.txt)
+		if err != nil {
+			log.Printf("mdns: failed to register %s: %v", service, err)
+			continue
+		}
+		n.instances[name] = append(n.instances[name], instance)
+	}
+}
+
+func (n *nativeMDNS) registerService(service, host string, port int, txt []string) (uintptr, error) {
+	servicePtr, err := syscall.UTF16PtrFromString(service)
+	if err != nil {
+		return 0, err
+	}
+	hostPtr, err := syscall.UTF16PtrFromString(host)
+	if err != nil {
+		return 0, err
+	}
+	// IP4_ADDRESS and IP6_ADDRESS hold the address in network order.
+	var ip4 *[4]byte
+	if v4 := n.ip4.To4(); v4 != nil {
+		ip4 = (*[4]byte)(v4)
+	}
+	var ip6 *[16]byte
+	if v6 := n.ip6.To16(); v6 != nil && n.ip6.To4() == nil {
+		ip6 = (*[16]byte)(v6)
+	}
+
+	var keys, values []*uint16
+	for _, kv := range txt {
+		k, v, _ := strings.Cut(kv, "=")
+		kp, err := syscall.UTF16PtrFromString(k)
+		if err != nil {
+			return 0, err
+		}
+		vp, err := syscall.UTF16PtrFromString(v)
+		if err != nil {
+			return 0, err
+		}
+		keys, values = append(keys, kp), append(values, vp)
+	}
+	var keysPtr, valuesPtr unsafe.Pointer
+	if len(keys) > 0 {
+		keysPtr, valuesPtr = unsafe.Pointer(&keys[0]), unsafe.Pointer(&values[0])
+	}
+
+	instance, _, err := procDnsServiceConstructInstance.Call(
+		uintptr(unsafe.Pointer(servicePtr)), uintptr(unsafe.Pointer(hostPtr)),
+		uintptr(unsafe.Pointer(ip4)), uintptr(unsafe.Pointer(ip6)),
+		uintptr(port), 0, 0, uintptr(len(keys)),
+		uintptr(keysPtr), uintptr(valuesPtr))
+	if instance == 0 {
+		return 0, err
+	}
+
+	req := dnsServiceRegisterRequest{version: 1, serviceInstance: instance, callback: dnsServiceCallback}
+	if ret, _, _ := procDnsServiceRegister.Call(uintptr(unsafe.Pointer(&req)), 0); ret != dnsRequestPending {
+		procDnsServiceFreeInstance.Call(instance)
+		return 0, syscall.Errno(ret)
+	}
+	return instance, nil
+}
+
+// deregister withdraws the services of the host called name. n.mu must be
+// held.
+func (n *nativeMDNS) deregister(name string) {
+	for _, instance := range n.instances[name] {
+		req := dnsServiceRegisterRequest{version: 1, serviceInstance: instance, callback: dnsServiceCallback}
+		if ret, _, _ := procDnsServiceDeRegister.Call(uintptr(unsafe.Pointer(&req)), 0); ret != dnsRequestPending {
+			log.Printf("mdns: failed to deregister %s: %v", name, syscall.Errno(ret))
+		}
+	}
+	delete(n.instances, name)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// The config and state files carry a version, so their format can change
+// without breaking existing installs. Files of an older version are
+// upgraded when they are loaded, keeping the original next to them as
+// <file>.v<version>.bak.
+const (
+	configVersion = 2
+	stateVersion  = 2
+)
+
+// A migration upgrades the decoded values of the file at path by one
+// version.
+type migration func(path string, values map[string]interface{}) error
+
+// configMigrations upgrade the config file, by the version they upgrade
+// from.
+var configMigrations = map[int]migration{
+	// Version 1 files have no rate_limit or max_client_conns, which meant
+	// start's defaults. Version 2 writes them even when zero, which
+	// disables the limits, so a missing key gets the default.
+	1: func(path string, values map[string]interface{}) error {
+		defaults := map[string]interface{}{"rate_limit": defaultRateLimit, "max_client_conns": defaultMaxClientConns}
+		for key, value := range defaults {
+			if _, ok := values[key]; !ok {
+				values[key] = value
+			}
+		}
+		return nil
+	},
+}
+
+// stateMigrations upgrade tokens.json and webhooks.json. There are none
+// yet: version 1 files are a bare list, which decodeStateFile puts under
+// the file's key, and otherwise match version 2.
+var stateMigrations = map[int]migration{}
+
+// migrate upgrades values, decoded from the file at path, to version
+// current, returning the version the file was.
+func migrate(path string, values map[string]interface{}, migrations map[int]migration, current int) (int, error) {
+	version := 1
+	if v, ok := values["version"]; ok {
+		switch n := v.(type) {
+		case int:
+			version = n
+		case int64:
+			version = int(n)
+		case float64:
+			version = int(n)
+		default:
+			return 0, fmt.Errorf("invalid version %v", v)
+		}
+		if version < 1 {
+			return 0, fmt.Errorf("invalid version %v", v)
+		}
+	}
+	if version > current {
+		return version, fmt.Errorf("version %d is newer than this localbase understands (%d), upgrade localbase", version, current)
+	}
+	for v := version; v < current; v++ {
+		if m := migrations[v]; m != nil {
+			if err := m(path, values); err != nil {
+				return version, fmt.Errorf("failed to upgrade from version %d: %v", v, err)
+			}
+		}
+	}
+	values["version"] = current
+	return version, nil
+}
+
+// backupFile copies the file at path, of the given version, to
+// <path>.v<version>.bak, unless an earlier upgrade already did.
+func backupFile(path string, version int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fmt.Sprintf("%s.v%d.bak", path, version), os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// upgradeConfigFile upgrades the config file at path in place if it is of
+// an older version. Files that don't decode or migrate are left for
+// loadConfigFile to report.
+func upgradeConfigFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	values, err := decodeConfig(path, data)
+	if err != nil {
+		return
+	}
+	from, err := migrate(path, values, configMigrations, configVersion)
+	if err != nil || from == configVersion {
+		return
+	}
+	if data, err = encodeConfigValues(path, values); err == nil {
+		if err = backupFile(path, from); err == nil {
+			err = writeFileAtomic(path, data, 0644)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to upgrade %s from version %d: %v", path, from, err)
+	}
+}
+
+// decodeStateFile decodes the list under key in data, read from the state
+// file at path, into v, upgrading the file in place if it is of an older
+// version.
+func decodeStateFile(path string, data []byte, key string, v interface{}) error {
+	values := map[string]interface{}{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var list []interface{}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		values = map[string]interface{}{"version": 1, key: list}
+	} else if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	from, err := migrate(path, values, stateMigrations, stateVersion)
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(values[key])
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return err
+	}
+	if from < stateVersion {
+		err := backupFile(path, from)
+		if err == nil {
+			err = writeStateFile(path, key, v)
+		}
+		if err != nil {
+			log.Printf("Failed to upgrade %s from version %d: %v", path, from, err)
+		}
+	}
+	return nil
+}
+
+// writeStateFile writes v under key to the state file at path. State files
+// hold secrets, so only the owner can read them.
+func writeStateFile(path, key string, v interface{}) error {
+	data, err := json.MarshalIndent(map[string]interface{}{"version": stateVersion, key: v}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	// Each migration records that it ran, so the order can be checked.
+	migrations := map[int]migration{
+		1: func(path string, values map[string]interface{}) error {
+			values["ran"] = fmt.Sprint(values["ran"], "1")
+			return nil
+		},
+		3: func(path string, values map[string]interface{}) error {
+			values["ran"] = fmt.Sprint(values["ran"], "3")
+			return nil
+		},
+	}
+	tests := []struct {
+		name    string
+		values  map[string]interface{}
+		from    int
+		ran     string
+		wantErr string
+	}{
+		{name: "no version is version 1", values: map[string]interface{}{}, from: 1, ran: "<nil>13"},
+		{name: "json number", values: map[string]interface{}{"version": float64(2)}, from: 2, ran: "<nil>3"},
+		{name: "yaml int", values: map[string]interface{}{"version": 3}, from: 3, ran: "<nil>3"},
+		{name: "toml int64", values: map[string]interface{}{"version": int64(2)}, from: 2, ran: "<nil>3"},
+		{name: "current", values: map[string]interface{}{"version": 4}, from: 4},
+		{name: "newer", values: map[string]interface{}{"version": 5}, from: 5, wantErr: "upgrade localbase"},
+		{name: "zero", values: map[string]interface{}{"version": 0}, wantErr: "invalid version"},
+		{name: "not a number", values: map[string]interface{}{"version": "2"}, wantErr: "invalid version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, err := migrate("test.json", tt.values, migrations, 4)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from != tt.from {
+				t.Errorf("got from %d, want %d", from, tt.from)
+			}
+			if tt.values["version"] != 4 {
+				t.Errorf("got version %v, want 4", tt.values["version"])
+			}
+			if ran, _ := tt.values["ran"].(string); ran != tt.ran {
+				t.Errorf("ran migrations %q, want %q", ran, tt.ran)
+			}
+		})
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	migrations := map[int]migration{
+		1: func(path string, values map[string]interface{}) error {
+			return fmt.Errorf("bad %s", path)
+		},
+	}
+	_, err := migrate("test.json", map[string]interface{}{}, migrations, 2)
+	if err == nil || !strings.Contains(err.Error(), "failed to upgrade from version 1: bad test.json") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestConfigMigrations(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		rate   interface{}
+		conns  interface{}
+	}{
+		{name: "missing limits get the defaults", values: map[string]interface{}{}, rate: defaultRateLimit, conns: defaultMaxClientConns},
+		{name: "set limits are kept", values: map[string]interface{}{"rate_limit": float64(5), "max_client_conns": float64(0)}, rate: float64(5), conns: float64(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := migrate("config.json", tt.values, configMigrations, configVersion); err != nil {
+				t.Fatal(err)
+			}
+			if tt.values["rate_limit"] != tt.rate || tt.values["max_client_conns"] != tt.conns {
+				t.Errorf("got rate_limit %v and max_client_conns %v, want %v and %v",
+					tt.values["rate_limit"], tt.values["max_client_conns"], tt.rate, tt.conns)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// Network policies.
+const (
+	networkPrivate = "private"
+	networkPublic  = "public"
+)
+
+// NetworkPolicy marks the networks matching Interface, Subnet or SSID as
+// private or public. mDNS is only answered on private networks.
+type NetworkPolicy struct {
+	// Interface is an interface name pattern, e.g. en0 or eth*.
+	Interface string `json:"interface,omitempty"`
+	// Subnet matches interfaces with an address in it, e.g. 192.168.1.0/24.
+	Subnet string `json:"subnet,omitempty"`
+	// SSID matches interfaces joined to the Wi-Fi network of that name.
+	SSID   string `json:"ssid,omitempty"`
+	Policy string `json:"policy"`
+}
+
+// networkPolicies and defaultNetworkPolicy are the daemon's Networks and
+// DefaultNetworkPolicy, set at start.
+var (
+	networkPolicies      []NetworkPolicy
+	defaultNetworkPolicy = networkPrivate
+)
+
+// parseNetworkPolicy parses a network given to --private-network or
+// --public-network: ssid:<name>, a subnet, or an interface pattern.
+func parseNetworkPolicy(s, policy string) (NetworkPolicy, error) {
+	p := NetworkPolicy{Policy: policy}
+	switch {
+	case strings.HasPrefix(s, "ssid:"):
+		p.SSID = strings.TrimPrefix(s, "ssid:")
+		if p.SSID == "" {
+			return p, fmt.Errorf("invalid network %q, the ssid is empty", s)
+		}
+	case strings.Contains(s, "/"):
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return p, fmt.Errorf("invalid subnet %q, want e.g. 192.168.1.0/24", s)
+		}
+		p.Subnet = s
+	default:
+		if err := validateInterfacePatterns([]string{s}); err != nil {
+			return p, err
+		}
+		p.Interface = s
+	}
+	return p, nil
+}
+
+// networkPolicy returns the policy of the network iface is on. Public
+// entries win over private ones, so a network marked both isn't advertised
+// on. The interface's addresses and SSID are only looked up if an entry
+// needs them.
+func networkPolicy(iface net.Interface) string {
+	var addrs []net.IP
+	var ssid string
+	addrsLoaded, ssidLoaded := false, false
+
+	private := false
+	for _, p := range networkPolicies {
+		match := false
+		switch {
+		case p.Interface != "":
+			match, _ = path.Match(p.Interface, iface.Name)
+		case p.Subnet != "":
+			if !addrsLoaded {
+				addrs, addrsLoaded = interfaceAddrs([]net.Interface{iface})[iface.Index], true
+			}
+			_, subnet, err := net.ParseCIDR(p.Subnet)
+			for _, ip := range addrs {
+				if err == nil && subnet.Contains(ip) {
+					match = true
+				}
+			}
+		case p.SSID != "":
+			if !ssidLoaded {
+				ssid, ssidLoaded = interfaceSSID(iface.Name), true
+			}
+			match = ssid != "" && ssid == p.SSID
+		}
+		if !match {
+			continue
+		}
+		if p.Policy == networkPublic {
+			return networkPublic
+		}
+		private = true
+	}
+	if private {
+		return networkPrivate
+	}
+	return defaultNetworkPolicy
+}
+
+// interfaceSSID returns the SSID of the Wi-Fi network the interface name
+// is joined to, or "" if it isn't a Wi-Fi interface or the SSID can't be
+// found out.
+func interfaceSSID(name string) string {
+	switch runtime.GOOS {
+	case "linux":
+		if out, err := exec.Command("iwgetid", name, "--raw").Output(); err == nil {
+			return strings.TrimSpace(string(out))
+		}
+		out, _ := exec.Command("iw", "dev", name, "link").Output()
+		return fieldValue(string(out), "SSID")
+	case "darwin":
+		out, _ := exec.Command("ipconfig", "getsummary", name).Output()
+		if ssid := fieldValue(string(out), "SSID"); ssid != "" {
+			return ssid
+		}
+		out, _ = exec.Command("networksetup", "-getairportnetwork", name).Output()
+		return fieldValue(string(out), "Current Wi-Fi Network")
+	case "windows":
+		// netsh lists each wireless interface as a block starting with
+		// its name.
+		out, _ := exec.Command("netsh", "wlan", "show", "interfaces").Output()
+		current := ""
+		for _, line := range strings.Split(string(out), "\n") {
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "Name":
+				current = strings.TrimSpace(value)
+			case "SSID":
+				if current == name {
+					return strings.TrimSpace(value)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// fieldValue returns the value of the first "key: value" line of out.
+func fieldValue(out, key string) string {
+	for _, line := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
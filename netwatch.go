@@ -0,0 +1,10 @@
+package main
+
+// notify signals on ch without blocking, coalescing with a signal that
+// hasn't been received yet.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,50 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"context"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchAddrChanges signals on the returned channel whenever an address or
+// interface changes, as reported by a routing socket. This is what the
+// SystemConfiguration framework watches on macOS.
+func watchAddrChanges(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	// Wakes the read up every second to check ctx.
+	tv := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 2048)
+		for ctx.Err() == nil {
+			n, err := unix.Read(fd, buf)
+			if err != nil {
+				if err == unix.EAGAIN || err == unix.EINTR {
+					continue
+				}
+				return
+			}
+			// Every routing message starts with its length, version and
+			// type.
+			if n < 4 {
+				continue
+			}
+			switch int(buf[3]) {
+			case unix.RTM_NEWADDR, unix.RTM_DELADDR, unix.RTM_IFINFO:
+				notify(changes)
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !windows && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// watchAddrChanges isn't implemented here, so address changes are only
+// noticed by polling.
+func watchAddrChanges(ctx context.Context) (<-chan struct{}, error) {
+	return nil, fmt.Errorf("not supported on %s", runtime.GOOS)
+}
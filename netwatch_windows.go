@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"syscall"
+)
+
+var procNotifyAddrChange = syscall.NewLazyDLL("iphlpapi.dll").NewProc("NotifyAddrChange")
+
+// watchAddrChanges signals on the returned channel whenever an IPv4
+// address changes. NotifyAddrChange blocks until the next change when
+// called without an overlapped handle.
+func watchAddrChanges(ctx context.Context) (<-chan struct{}, error) {
+	if err := procNotifyAddrChange.Find(); err != nil {
+		return nil, err
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		for ctx.Err() == nil {
+			if ret, _, _ := procNotifyAddrChange.Call(0, 0); ret != 0 {
+				return
+			}
+			notify(changes)
+		}
+	}()
+	return changes, nil
+}
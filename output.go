@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// printResult writes v to stdout in the format selected by --output. text
+// renders the human readable form.
+func printResult(cmd *cobra.Command, v interface{}, text func()) error {
+	format, _ := cmd.Flags().GetString("output")
+	switch format {
+	case "", "text":
+		text()
+		return nil
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		return printYAML(v)
+	default:
+		return usageErrorf("unknown output format %q, expected text, json or yaml", format)
+	}
+}
+
+// printYAML renders v through its JSON encoding so the YAML output uses the
+// same field names and ordering as --output json.
+func printYAML(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// blockStyle clears the flow and quoting styles inherited from JSON.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials describes the process on the other end of a unix socket.
+func peerCredentials(conn *net.UnixConn) string {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return ""
+	}
+
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ""
+	}
+	return fmt.Sprintf("uid=%d pid=%d", cred.Uid, cred.Pid)
+}
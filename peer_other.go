@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// peerCredentials is only implemented on Linux.
+func peerCredentials(conn *net.UnixConn) string {
+	return ""
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// defaultPipeName is empty where named pipes aren't supported.
+const defaultPipeName = ""
+
+var errNoPipes = errors.New("named pipes are only supported on Windows")
+
+func listenPipe(name string) (net.Listener, error) {
+	return nil, errNoPipes
+}
+
+func dialPipe(name string, timeout time.Duration) (net.Conn, error) {
+	return nil, errNoPipes
+}
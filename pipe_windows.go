@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// defaultPipeName is the named pipe the daemon listens on by default on
+// Windows.
+const defaultPipeName = `\\.\pipe\localbase`
+
+// pipeSecurity restricts the pipe to its owner, SYSTEM and administrators.
+const pipeSecurity = "D:P(A;;GA;;;OW)(A;;GA;;;SY)(A;;GA;;;BA)"
+
+func listenPipe(name string) (net.Listener, error) {
+	return winio.ListenPipe(name, &winio.PipeConfig{SecurityDescriptor: pipeSecurity})
+}
+
+func dialPipe(name string, timeout time.Duration) (net.Conn, error) {
+	if timeout == 0 {
+		return winio.DialPipe(name, nil)
+	}
+	return winio.DialPipe(name, &timeout)
+}
@@ -0,0 +1,748 @@
+// Package client talks to the localbase daemon over its JSON-RPC admin
+// protocol, for Go programs and tests that drive localbase without
+// shelling out to the CLI.
+//
+//	c, err := client.Dial(ctx, "unix", "/run/user/1000/localbase.sock", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	domain, err := c.Add(ctx, "hello", 3000)
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DialFunc opens a connection to the daemon.
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// Options configures a Client.
+type Options struct {
+	// Token is the API token sent with every request, required when the
+	// daemon runs with --require-auth.
+	Token string
+}
+
+// Client is a connection to the daemon that carries many concurrent calls.
+// It connects on first use and reconnects after the connection fails.
+// Subscriptions get a connection of their own.
+type Client struct {
+	dial  DialFunc
+	token string
+
+	mu     sync.Mutex
+	conn   *conn
+	nextID int
+}
+
+// New returns a client that connects to the daemon with dial.
+func New(dial DialFunc, opts *Options) *Client {
+	c := &Client{dial: dial}
+	if opts != nil {
+		c.token = opts.Token
+	}
+	return c
+}
+
+// Dial connects to the daemon listening on address, a unix socket path or
+// a TCP host:port depending on network.
+func Dial(ctx context.Context, network, address string, opts *Options) (*Client, error) {
+	var d net.Dialer
+	c := New(func(ctx context.Context) (net.Conn, error) {
+		return d.DialContext(ctx, network, address)
+	}, opts)
+	if _, err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the client's connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// connect returns the current connection, dialing a new one if there is
+// none or the last one failed.
+func (c *Client) connect(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil && c.conn.failed() == nil {
+		return c.conn, nil
+	}
+	nc, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = newConn(nc)
+	return c.conn, nil
+}
+
+func (c *Client) newRequest(method string, params interface{}) (*request, error) {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	c.mu.Unlock()
+
+	req := &request{
+		JSONRPC: JSONRPCVersion,
+		ID:      id,
+		Method:  method,
+		Auth:    c.token,
+	}
+	if params != nil {
+		var err error
+		req.Params, err = json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// Call sends a request and waits for its response, decoding the result
+// into result, which may be nil if the caller doesn't need it. Errors
+// returned by the daemon are *Error.
+func (c *Client) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	cn, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return c.call(ctx, cn, method, params, result)
+}
+
+// call is Call on cn.
+func (c *Client) call(ctx context.Context, cn *conn, method string, params interface{}, result interface{}) error {
+	req, err := c.newRequest(method, params)
+	if err != nil {
+		return err
+	}
+
+	done, err := cn.send(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-done:
+		if resp == nil {
+			return cn.failed()
+		}
+		return decodeResult(resp, result)
+	case <-ctx.Done():
+		cn.cancel(req.ID)
+		return fmt.Errorf("error reading response: %w", ctx.Err())
+	}
+}
+
+func decodeResult(resp *Response, result interface{}) error {
+	if resp.Error != nil {
+		return resp.Error.Err()
+	}
+
+	if result != nil && len(resp.Result) > 0 {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("invalid response: %v", err)
+		}
+	}
+	return nil
+}
+
+// conn is a single connection multiplexing calls and batches, with
+// responses matched to them by request ID.
+type conn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	pending map[int]chan *Response
+	batches map[int]*batch
+	// hello is what the daemon negotiated on this connection, once hello
+	// was sent on it.
+	hello *HelloResult
+	// framed is set once the daemon is known to read framed messages.
+	framed bool
+	err    error
+}
+
+// batch is a batch of requests waiting for its array of responses. It is
+// in conn.batches under the ID of each of its requests.
+type batch struct {
+	ids  []int
+	done chan []Response
+}
+
+func newConn(nc net.Conn) *conn {
+	cn := &conn{
+		Conn:    nc,
+		pending: make(map[int]chan *Response),
+		batches: make(map[int]*batch),
+	}
+	go cn.readLoop()
+	return cn
+}
+
+// send writes req and returns the channel its response is delivered on.
+// The channel is closed without a response if the connection fails.
+func (cn *conn) send(ctx context.Context, req *request) (chan *Response, error) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	if cn.err != nil {
+		return nil, cn.err
+	}
+	done := make(chan *Response, 1)
+	cn.pending[req.ID] = done
+
+	if err := cn.write(ctx, req); err != nil {
+		delete(cn.pending, req.ID)
+		return nil, err
+	}
+	return done, nil
+}
+
+// write sends v as a message. cn.mu must be held.
+func (cn *conn) write(ctx context.Context, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	cn.SetWriteDeadline(deadline)
+	if err := WriteMessage(cn.Conn, data, cn.framed); err != nil {
+		return fmt.Errorf("failed to send command: %v", err)
+	}
+	return nil
+}
+
+// sendBatch writes reqs as a batch and returns the channel its responses
+// are delivered on. The channel is closed without responses if the
+// connection fails.
+func (cn *conn) sendBatch(ctx context.Context, reqs []*request) (chan []Response, error) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	if cn.err != nil {
+		return nil, cn.err
+	}
+	b := &batch{done: make(chan []Response, 1)}
+	for _, req := range reqs {
+		b.ids = append(b.ids, req.ID)
+		cn.batches[req.ID] = b
+	}
+
+	if err := cn.write(ctx, reqs); err != nil {
+		cn.dropBatch(b)
+		return nil, err
+	}
+	return b.done, nil
+}
+
+// cancel stops waiting for the response to request id.
+func (cn *conn) cancel(id int) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	delete(cn.pending, id)
+}
+
+// cancelBatch stops waiting for the responses to the batch with request
+// id.
+func (cn *conn) cancelBatch(id int) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if b, ok := cn.batches[id]; ok {
+		cn.dropBatch(b)
+	}
+}
+
+// dropBatch forgets b. cn.mu must be held.
+func (cn *conn) dropBatch(b *batch) {
+	for _, id := range b.ids {
+		delete(cn.batches, id)
+	}
+}
+
+func (cn *conn) failed() error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return cn.err
+}
+
+// readLoop hands each response to the call waiting for it, and each array
+// of responses to the batch with their IDs. Once the connection fails,
+// every pending and future call fails with that error. An error without an
+// ID, such as a rejected connection or an oversized request, fails the
+// connection with that error.
+func (cn *conn) readLoop() {
+	r := bufio.NewReader(cn.Conn)
+	var err error
+	for {
+		var raw []byte
+		if raw, _, err = ReadMessage(r, 0); err != nil {
+			break
+		}
+		if len(raw) == 0 {
+			continue
+		}
+		if raw[0] == '[' {
+			var resps []Response
+			if err := json.Unmarshal(raw, &resps); err != nil {
+				cn.fail(fmt.Errorf("invalid response: %v", err))
+				return
+			}
+			cn.deliverBatch(resps)
+			continue
+		}
+
+		resp := new(Response)
+		if err = json.Unmarshal(raw, resp); err != nil {
+			break
+		}
+		// A null ID decodes into the pointer as nil rather than failing.
+		var id *int
+		if json.Unmarshal(resp.ID, &id) != nil || id == nil {
+			if resp.Error != nil {
+				cn.fail(resp.Error.Err())
+				return
+			}
+			continue
+		}
+		cn.mu.Lock()
+		done, ok := cn.pending[*id]
+		delete(cn.pending, *id)
+		cn.mu.Unlock()
+		if ok {
+			done <- resp
+		}
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	cn.fail(fmt.Errorf("error reading response: %v", err))
+}
+
+// deliverBatch hands resps to the batch with any of their IDs. The batch
+// checks that they answer each of its requests.
+func (cn *conn) deliverBatch(resps []Response) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	for _, resp := range resps {
+		var id int
+		if json.Unmarshal(resp.ID, &id) != nil {
+			continue
+		}
+		if b, ok := cn.batches[id]; ok {
+			cn.dropBatch(b)
+			b.done <- resps
+			return
+		}
+	}
+}
+
+// fail closes the connection, failing every pending and future call with
+// err.
+func (cn *conn) fail(err error) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	cn.Close()
+	cn.err = err
+	for id, done := range cn.pending {
+		delete(cn.pending, id)
+		close(done)
+	}
+	// Dropping a batch removes its other IDs before the loop reaches them.
+	for _, b := range cn.batches {
+		cn.dropBatch(b)
+		close(b.done)
+	}
+}
+
+// Hello negotiates the protocol version and features with the daemon.
+// Daemons that predate negotiation are treated as version 1 without any
+// optional features.
+func (c *Client) Hello(ctx context.Context) (*HelloResult, error) {
+	cn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.hello(ctx, cn)
+}
+
+// hello is Hello on cn. The result is kept on cn, as it holds for as long
+// as the connection does.
+func (c *Client) hello(ctx context.Context, cn *conn) (*HelloResult, error) {
+	params := &HelloParams{Features: Features()}
+	for v := MaxProtocolVersion; v >= MinProtocolVersion; v-- {
+		params.Versions = append(params.Versions, v)
+	}
+
+	result := new(HelloResult)
+	err := c.call(ctx, cn, "hello", params, result)
+	var e *Error
+	if errors.As(err, &e) && e.Code == CodeInvalidRequest && strings.HasPrefix(e.Message, "unknown method") {
+		result, err = &HelloResult{Version: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cn.mu.Lock()
+	cn.hello = result
+	cn.framed = result.Has(FeatureFraming)
+	cn.mu.Unlock()
+	return result, nil
+}
+
+// BatchCall is one request in a batch sent by Batch. Err is set to the
+// error the daemon returned for this request, if any.
+type BatchCall struct {
+	Method string
+	Params interface{}
+	Result interface{}
+	Err    error
+}
+
+// Batch sends calls to the daemon in a single round trip on the client's
+// connection, or one call at a time if the daemon doesn't support batches.
+// Features are negotiated once per connection. The returned error only
+// reports failure to talk to the daemon; per-call errors are stored in each
+// call's Err.
+func (c *Client) Batch(ctx context.Context, calls []*BatchCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+
+	cn, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	cn.mu.Lock()
+	server := cn.hello
+	cn.mu.Unlock()
+	if server == nil {
+		if server, err = c.hello(ctx, cn); err != nil {
+			return err
+		}
+	}
+	if !server.Has(FeatureBatch) {
+		for _, call := range calls {
+			call.Err = c.call(ctx, cn, call.Method, call.Params, call.Result)
+			var e *Error
+			if call.Err != nil && !errors.As(call.Err, &e) {
+				return call.Err
+			}
+		}
+		return nil
+	}
+
+	reqs := make([]*request, len(calls))
+	index := make(map[int]int, len(calls))
+	for i, call := range calls {
+		reqs[i], err = c.newRequest(call.Method, call.Params)
+		if err != nil {
+			return err
+		}
+		index[reqs[i].ID] = i
+	}
+
+	done, err := cn.sendBatch(ctx, reqs)
+	if err != nil {
+		return err
+	}
+	var resps []Response
+	select {
+	case resps = <-done:
+		if resps == nil {
+			return cn.failed()
+		}
+	case <-ctx.Done():
+		cn.cancelBatch(reqs[0].ID)
+		return fmt.Errorf("error reading response: %w", ctx.Err())
+	}
+	if len(resps) != len(calls) {
+		return fmt.Errorf("invalid response: got %d results for %d requests", len(resps), len(calls))
+	}
+
+	for _, resp := range resps {
+		var id int
+		err := json.Unmarshal(resp.ID, &id)
+		i, ok := index[id]
+		if err != nil || !ok {
+			return fmt.Errorf("invalid response id %s", resp.ID)
+		}
+		calls[i].Err = decodeResult(&resp, calls[i].Result)
+	}
+	return nil
+}
+
+// Add registers domain, proxying it to port on localhost.
+func (c *Client) Add(ctx context.Context, domain string, port int) (*Domain, error) {
+	return c.AddDomain(ctx, &AddParams{Domain: domain, Port: port})
+}
+
+// AddDomain registers a domain with aliases and route options.
+func (c *Client) AddDomain(ctx context.Context, params *AddParams) (*Domain, error) {
+	var d Domain
+	if err := c.Call(ctx, "add", params, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Update points a registered domain or alias at a new port.
+func (c *Client) Update(ctx context.Context, domain string, port int) (*Domain, error) {
+	var d Domain
+	if err := c.Call(ctx, "update", &UpdateParams{Domain: domain, Port: port}, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Remove unregisters a domain, or the domain an alias belongs to.
+func (c *Client) Remove(ctx context.Context, domain string) (*Domain, error) {
+	var d Domain
+	if err := c.Call(ctx, "remove", &RemoveParams{Domain: domain}, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Pause stops routing and resolving a domain, keeping it registered.
+func (c *Client) Pause(ctx context.Context, domain string) (*Domain, error) {
+	var d Domain
+	if err := c.Call(ctx, "pause", &PauseParams{Domain: domain}, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Resume routes and resolves a paused domain again.
+func (c *Client) Resume(ctx context.Context, domain string) (*Domain, error) {
+	var d Domain
+	if err := c.Call(ctx, "resume", &PauseParams{Domain: domain}, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Undo reverts the most recent add, remove, update, pause or resume.
+func (c *Client) Undo(ctx context.Context) (*UndoResult, error) {
+	var result UndoResult
+	if err := c.Call(ctx, "undo", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// History lists the changes Undo can revert, most recent first.
+func (c *Client) History(ctx context.Context) ([]Change, error) {
+	var result HistoryResult
+	if err := c.Call(ctx, "history", nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Changes, nil
+}
+
+// Get looks up the domain serving hostname.
+func (c *Client) Get(ctx context.Context, hostname string) (*Domain, error) {
+	var d Domain
+	if err := c.Call(ctx, "get", &GetParams{Domain: hostname}, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Share makes the domain serving hostname reachable from other devices on
+// the LAN, reporting where they reach it.
+func (c *Client) Share(ctx context.Context, hostname string) (*ShareResult, error) {
+	var result ShareResult
+	if err := c.Call(ctx, "share", &ShareParams{Domain: hostname}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListPage returns one page of registered domains.
+func (c *Client) ListPage(ctx context.Context, params *ListParams) (*ListResult, error) {
+	var page ListResult
+	if err := c.Call(ctx, "list", params, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// List returns every registered domain, fetched a page at a time so large
+// lists stay under the daemon's message size limit.
+func (c *Client) List(ctx context.Context) ([]Domain, error) {
+	domains := []Domain{}
+	params := &ListParams{Limit: ListPageSize}
+	for {
+		page, err := c.ListPage(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, page.Domains...)
+		if page.Next == "" {
+			return domains, nil
+		}
+		params.Cursor = page.Next
+	}
+}
+
+// Status returns the daemon's status.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var status Status
+	if err := c.Call(ctx, "status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Health runs the daemon's health checks.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var health Health
+	if err := c.Call(ctx, "health", nil, &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// Stop asks the daemon to shut down.
+func (c *Client) Stop(ctx context.Context) error {
+	return c.Call(ctx, "stop", nil, nil)
+}
+
+// Subscribe streams daemon events of the given types, or all events if
+// types is empty, to fn until ctx is done, the connection closes or fn
+// returns an error. It returns nil when the daemon closes the stream.
+func (c *Client) Subscribe(ctx context.Context, types []string, fn func(*Event) error) error {
+	nc, dec, err := c.subscribe(ctx, types)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	stop := context.AfterFunc(ctx, func() { nc.Close() })
+	defer stop()
+
+	for {
+		var n struct {
+			Method string `json:"method"`
+			Params Event  `json:"params"`
+		}
+		if err := dec.Decode(&n); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("error reading event: %v", err)
+		}
+		if n.Method != "event" {
+			continue
+		}
+		if err := fn(&n.Params); err != nil {
+			return err
+		}
+	}
+}
+
+// Events is like Subscribe, but delivers events on a channel that is
+// closed when ctx is done or the stream ends.
+func (c *Client) Events(ctx context.Context, types ...string) (<-chan Event, error) {
+	nc, dec, err := c.subscribe(ctx, types)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer nc.Close()
+		stop := context.AfterFunc(ctx, func() { nc.Close() })
+		defer stop()
+
+		for {
+			var n struct {
+				Method string `json:"method"`
+				Params Event  `json:"params"`
+			}
+			if err := dec.Decode(&n); err != nil {
+				return
+			}
+			if n.Method != "event" {
+				continue
+			}
+			select {
+			case events <- n.Params:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// subscribe opens a connection for a subscription and waits for the
+// daemon to accept it.
+func (c *Client) subscribe(ctx context.Context, types []string) (net.Conn, *json.Decoder, error) {
+	nc, err := c.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var params interface{}
+	if len(types) > 0 {
+		params = &SubscribeParams{Events: types}
+	}
+	req, err := c.newRequest("subscribe", params)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	if err := json.NewEncoder(nc).Encode(req); err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("failed to send command: %v", err)
+	}
+
+	dec := json.NewDecoder(nc)
+	var resp Response
+	if err := dec.Decode(&resp); err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("error reading response: %v", err)
+	}
+	if err := decodeResult(&resp, nil); err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	// The stream stays open until ctx is done.
+	nc.SetDeadline(time.Time{})
+	return nc, dec, nil
+}
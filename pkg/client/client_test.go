@@ -0,0 +1,420 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDaemon returns a DialFunc whose connections answer each request line
+// with the lines serve returns for it, and hang up when it returns nil.
+// hello is answered on its own, advertising every feature.
+func fakeDaemon(t *testing.T, serve func(line string) []string) DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+		go func() {
+			defer server.Close()
+			scanner := bufio.NewScanner(server)
+			for scanner.Scan() {
+				line := scanner.Text()
+				var req request
+				var replies []string
+				if json.Unmarshal([]byte(line), &req) == nil && req.Method == "hello" {
+					replies = []string{fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":{"version":%d,"features":["batch"]}}`, req.ID, MaxProtocolVersion)}
+				} else if replies = serve(line); replies == nil {
+					return
+				}
+				for _, reply := range replies {
+					if _, err := io.WriteString(server, reply+"\n"); err != nil {
+						return
+					}
+				}
+			}
+		}()
+		return client, nil
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestCall(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []string
+		want    string
+		code    ErrorCode
+		wantErr string
+	}{
+		{
+			name:    "result",
+			replies: []string{`{"jsonrpc":"2.0","id":1,"result":{"domain":"a.local"}}`},
+			want:    "a.local",
+		},
+		{
+			name: "unknown id skipped",
+			replies: []string{
+				`{"jsonrpc":"2.0","id":99,"result":{"domain":"other.local"}}`,
+				`{"jsonrpc":"2.0","id":1,"result":{"domain":"a.local"}}`,
+			},
+			want: "a.local",
+		},
+		{
+			name: "notification skipped",
+			replies: []string{
+				`{"jsonrpc":"2.0","method":"event","params":{"type":"domain_added"}}`,
+				`{"jsonrpc":"2.0","id":1,"result":{"domain":"a.local"}}`,
+			},
+			want: "a.local",
+		},
+		{
+			name:    "error",
+			replies: []string{`{"jsonrpc":"2.0","id":1,"error":{"code":-32001,"message":"domain a.local not found","data":"domain_not_found"}}`},
+			code:    CodeDomainNotFound,
+		},
+		{
+			name:    "error without data",
+			replies: []string{`{"jsonrpc":"2.0","id":1,"error":{"code":-32003,"message":"slow down"}}`},
+			code:    CodeRateLimited,
+		},
+		{
+			name:    "error without id",
+			replies: []string{`{"jsonrpc":"2.0","id":null,"error":{"code":-32003,"message":"too many open connections","data":"rate_limited"}}`},
+			code:    CodeRateLimited,
+		},
+		{
+			name:    "hang up",
+			wantErr: "unexpected EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(fakeDaemon(t, func(string) []string { return tt.replies }), nil)
+			defer c.Close()
+
+			var d Domain
+			err := c.Call(testContext(t), "get", &GetParams{Domain: "a"}, &d)
+			var e *Error
+			switch {
+			case tt.code != "":
+				if !errors.As(err, &e) || e.Code != tt.code {
+					t.Fatalf("got error %v, want code %s", err, tt.code)
+				}
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case d.Domain != tt.want:
+				t.Errorf("got domain %q, want %q", d.Domain, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallMatchesOutOfOrderResponses(t *testing.T) {
+	const n = 4
+	// The daemon answers once every request is in, last one first.
+	lines := make(chan string, n)
+	c := New(fakeDaemon(t, func(line string) []string {
+		lines <- line
+		if len(lines) < n {
+			return []string{}
+		}
+		var replies []string
+		for i := 0; i < n; i++ {
+			var req struct {
+				ID     int
+				Params GetParams
+			}
+			json.Unmarshal([]byte(<-lines), &req)
+			reply := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":{"domain":%q}}`, req.ID, req.Params.Domain)
+			replies = append([]string{reply}, replies...)
+		}
+		return replies
+	}), nil)
+	defer c.Close()
+
+	ctx := testContext(t)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("d%d.local", i)
+		go func() {
+			var d Domain
+			err := c.Call(ctx, "get", &GetParams{Domain: name}, &d)
+			if err == nil && d.Domain != name {
+				err = fmt.Errorf("asked for %s, got %s", name, d.Domain)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// batchIDs returns the request IDs of the batch in line as $1, $2, and so
+// on, for replies to refer to them.
+func batchIDs(t *testing.T, line string) *strings.Replacer {
+	var reqs []request
+	if err := json.Unmarshal([]byte(line), &reqs); err != nil {
+		t.Errorf("batch sent as %s", line)
+	}
+	var oldnew []string
+	// Backwards, so $1 doesn't replace the start of $10.
+	for i := len(reqs) - 1; i >= 0; i-- {
+		oldnew = append(oldnew, fmt.Sprintf("$%d", i+1), fmt.Sprint(reqs[i].ID))
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+func TestBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    []string
+		codes   []ErrorCode
+		wantErr string
+	}{
+		{
+			name:  "in order",
+			reply: `[{"jsonrpc":"2.0","id":$1,"result":{"domain":"a.local"}},{"jsonrpc":"2.0","id":$2,"result":{"domain":"b.local"}}]`,
+			want:  []string{"a.local", "b.local"},
+		},
+		{
+			name:  "out of order",
+			reply: `[{"jsonrpc":"2.0","id":$2,"result":{"domain":"b.local"}},{"jsonrpc":"2.0","id":$1,"result":{"domain":"a.local"}}]`,
+			want:  []string{"a.local", "b.local"},
+		},
+		{
+			name:  "per-call error",
+			reply: `[{"jsonrpc":"2.0","id":$1,"result":{"domain":"a.local"}},{"jsonrpc":"2.0","id":$2,"error":{"code":-32001,"message":"not found","data":"domain_not_found"}}]`,
+			want:  []string{"a.local", ""},
+			codes: []ErrorCode{"", CodeDomainNotFound},
+		},
+		{
+			name:    "error for the whole batch",
+			reply:   `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"request exceeds the 100 byte message limit","data":"invalid_request"}}`,
+			wantErr: "request exceeds",
+		},
+		{
+			name:    "missing response",
+			reply:   `[{"jsonrpc":"2.0","id":$1,"result":{"domain":"a.local"}}]`,
+			wantErr: "got 1 results for 2 requests",
+		},
+		{
+			name:    "unknown id",
+			reply:   `[{"jsonrpc":"2.0","id":$1,"result":{"domain":"a.local"}},{"jsonrpc":"2.0","id":7,"result":{"domain":"b.local"}}]`,
+			wantErr: "invalid response id 7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(fakeDaemon(t, func(line string) []string {
+				return []string{batchIDs(t, line).Replace(tt.reply)}
+			}), nil)
+			defer c.Close()
+
+			calls := []*BatchCall{
+				{Method: "get", Params: &GetParams{Domain: "a"}, Result: &Domain{}},
+				{Method: "get", Params: &GetParams{Domain: "b"}, Result: &Domain{}},
+			}
+			err := c.Batch(testContext(t), calls)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, call := range calls {
+				var code ErrorCode
+				if tt.codes != nil {
+					code = tt.codes[i]
+				}
+				var e *Error
+				if code != "" {
+					if !errors.As(call.Err, &e) || e.Code != code {
+						t.Errorf("call %d: got error %v, want code %s", i, call.Err, code)
+					}
+					continue
+				}
+				if call.Err != nil {
+					t.Errorf("call %d: %v", i, call.Err)
+				} else if got := call.Result.(*Domain).Domain; got != tt.want[i] {
+					t.Errorf("call %d: got domain %q, want %q", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchSharesConnection(t *testing.T) {
+	dials, gets := 0, 0
+	daemon := fakeDaemon(t, func(line string) []string {
+		if !strings.HasPrefix(line, "[") {
+			gets++
+			var req request
+			json.Unmarshal([]byte(line), &req)
+			return []string{fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":{"domain":"c.local"}}`, req.ID)}
+		}
+		return []string{batchIDs(t, line).Replace(`[{"jsonrpc":"2.0","id":$1,"result":{}},{"jsonrpc":"2.0","id":$2,"result":{}}]`)}
+	})
+	c := New(func(ctx context.Context) (net.Conn, error) {
+		dials++
+		return daemon(ctx)
+	}, nil)
+	defer c.Close()
+
+	ctx := testContext(t)
+	var ids []int
+	for i := 0; i < 2; i++ {
+		calls := []*BatchCall{{Method: "get"}, {Method: "get"}}
+		if err := c.Batch(ctx, calls); err != nil {
+			t.Fatal(err)
+		}
+		for _, call := range calls {
+			if call.Err != nil {
+				t.Fatal(call.Err)
+			}
+		}
+		ids = append(ids, c.nextID)
+	}
+	// Single calls still share the connection.
+	if _, err := c.Get(ctx, "c"); err != nil || gets != 1 {
+		t.Fatalf("got %v after %d gets, want one get", err, gets)
+	}
+	if dials != 1 {
+		t.Errorf("dialed %d connections, want 1", dials)
+	}
+	// Hello takes an ID only before the first batch.
+	if ids[1]-ids[0] != 2 {
+		t.Errorf("second batch used %d IDs, want 2, as hello isn't sent again", ids[1]-ids[0])
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		limit   int
+		want    []string
+		framed  bool
+		wantErr error
+	}{
+		{name: "lines", in: "{\"a\":1}\n\n  [1,2]\n{\"b\":2}", want: []string{`{"a":1}`, `[1,2]`, `{"b":2}`}},
+		{name: "framed", in: "7\n{\"id\":1\n10\n,\"x\":\"ab\"}\n0\n", want: []string{`{"id":1,"x":"ab"}`}, framed: true},
+		{name: "mixed", in: "{\"a\":1}\n3\n[1]\n0\n", want: []string{`{"a":1}`, `[1]`}},
+		{name: "line over the limit", in: "{\"a\":\"xxxxxxxxxx\"}\n", limit: 10, wantErr: ErrMessageTooLarge},
+		{name: "framed over the limit is skipped", in: "5\n[1,2]\n6\n,[3,4]\n0\n2\n[]\n0\n", limit: 8, want: []string{"too large", "[]"}, framed: true},
+		{name: "bad chunk length", in: "12x\n", wantErr: errors.New("invalid chunk length")},
+		{name: "chunk without newline", in: "2\n[]]\n0\n", wantErr: errors.New("not followed by a newline")},
+		{name: "truncated chunk", in: "9\n[1,2]", wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in))
+			var got []string
+			for {
+				msg, framed, err := ReadMessage(r, tt.limit)
+				if err == io.EOF {
+					break
+				}
+				// A framed message over the limit is skipped.
+				if errors.Is(err, ErrMessageTooLarge) && framed {
+					got = append(got, "too large")
+					continue
+				}
+				if err != nil {
+					if tt.wantErr == nil || !strings.Contains(err.Error(), tt.wantErr.Error()) {
+						t.Fatalf("got error %v, want %v", err, tt.wantErr)
+					}
+					return
+				}
+				if tt.framed && !framed {
+					t.Errorf("%s read as a line", msg)
+				}
+				got = append(got, string(msg))
+			}
+			if tt.wantErr != nil {
+				t.Fatalf("got %q, want error %v", got, tt.wantErr)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteMessageChunks(t *testing.T) {
+	data := []byte(`"` + strings.Repeat("x", 2*FrameChunkSize) + `"`)
+	var buf strings.Builder
+	if err := WriteMessage(&buf, data, true); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := strings.Count(buf.String(), "\n") / 2; chunks != 3 {
+		t.Errorf("wrote %d chunks, want 3", chunks)
+	}
+	msg, framed, err := ReadMessage(bufio.NewReader(strings.NewReader(buf.String())), 0)
+	if err != nil || !framed || string(msg) != string(data) {
+		t.Errorf("read back %d bytes, framed %v, error %v, want the %d bytes written", len(msg), framed, err, len(data))
+	}
+}
+
+// TestCallFramed checks that calls are framed once hello finds the daemon
+// reads framed messages.
+func TestCallFramed(t *testing.T) {
+	c := New(func(ctx context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+		go func() {
+			defer server.Close()
+			r := bufio.NewReader(server)
+			for {
+				msg, framed, err := ReadMessage(r, 0)
+				if err != nil {
+					return
+				}
+				var req request
+				json.Unmarshal(msg, &req)
+				result := `{"domain":"a.local"}`
+				if req.Method == "hello" {
+					result = fmt.Sprintf(`{"version":%d,"features":["framing"]}`, MaxProtocolVersion)
+				} else if !framed {
+					t.Errorf("%s sent as a line after hello", req.Method)
+				}
+				reply := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":%s}`, req.ID, result)
+				if WriteMessage(server, []byte(reply), framed) != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	}, nil)
+	defer c.Close()
+
+	ctx := testContext(t)
+	if _, err := c.Hello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	domain, err := c.Get(ctx, "a")
+	if err != nil || domain.Domain != "a.local" {
+		t.Fatalf("got %v, %v, want a.local", domain, err)
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+// ErrorCode identifies a category of failure reported by the daemon.
+type ErrorCode string
+
+const (
+	CodeInternal       ErrorCode = "internal"
+	CodeInvalidRequest ErrorCode = "invalid_request"
+	CodeDomainNotFound ErrorCode = "domain_not_found"
+	CodeDomainExists   ErrorCode = "domain_exists"
+	CodeRateLimited    ErrorCode = "rate_limited"
+	CodeUnauthorized   ErrorCode = "unauthorized"
+)
+
+// Error is an error carrying a protocol error code. Calls return it when
+// the daemon rejects a request; use errors.As to inspect the code.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// JSON-RPC error codes. Codes from -32000 to -32099 are reserved by the
+// spec for application errors.
+const (
+	RPCParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcInternalError  = -32603
+	rpcDomainNotFound = -32001
+	rpcDomainExists   = -32002
+	rpcRateLimited    = -32003
+	rpcUnauthorized   = -32004
+)
+
+var rpcCodes = map[ErrorCode]int{
+	CodeInternal:       rpcInternalError,
+	CodeInvalidRequest: rpcInvalidRequest,
+	CodeDomainNotFound: rpcDomainNotFound,
+	CodeDomainExists:   rpcDomainExists,
+	CodeRateLimited:    rpcRateLimited,
+	CodeUnauthorized:   rpcUnauthorized,
+}
+
+// RPCError is an Error as sent in a JSON-RPC response. Data carries the
+// typed error code so clients can recover the original Error.
+type RPCError struct {
+	Code    int       `json:"code"`
+	Message string    `json:"message"`
+	Data    ErrorCode `json:"data,omitempty"`
+}
+
+// NewRPCError converts e into its JSON-RPC form.
+func NewRPCError(e *Error) *RPCError {
+	code, ok := rpcCodes[e.Code]
+	if !ok {
+		code = rpcInternalError
+	}
+	return &RPCError{Code: code, Message: e.Message, Data: e.Code}
+}
+
+// Err converts e back into an Error.
+func (e *RPCError) Err() *Error {
+	code := e.Data
+	if code == "" {
+		code = CodeInternal
+		for c, rpc := range rpcCodes {
+			if rpc == e.Code {
+				code = c
+			}
+		}
+	}
+	return &Error{Code: code, Message: e.Message}
+}
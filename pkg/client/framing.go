@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// A message is either a line of JSON or framed in chunks. A framed message
+// is any number of chunks, each its length in decimal digits, a newline,
+// that many bytes and another newline, ended by a chunk of length zero:
+//
+//	7
+//	{"id":1
+//	10
+//	,"x":"ab"}
+//	0
+//
+// Framed messages start with a digit and lines with { or [, so the two can
+// be mixed on a connection. The daemon answers a framed request with a
+// framed response, streamed in chunks of at most FrameChunkSize bytes, and
+// advertises FeatureFraming.
+
+// FrameChunkSize is the largest chunk WriteMessage writes.
+const FrameChunkSize = 64 << 10
+
+// ErrMessageTooLarge is returned by ReadMessage for a message over its
+// limit. A framed message is skipped, so the next can be read.
+var ErrMessageTooLarge = errors.New("message exceeds the size limit")
+
+// maxChunkHeader bounds the length line of a chunk.
+const maxChunkHeader = 20
+
+// ReadMessage reads the next message from r, reporting whether it was
+// framed. Blank lines between messages are skipped. limit bounds the
+// message's size unless it is zero.
+func ReadMessage(r *bufio.Reader, limit int) ([]byte, bool, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, false, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		r.UnreadByte()
+		if b >= '0' && b <= '9' {
+			msg, err := readFramed(r, limit)
+			return msg, true, err
+		}
+		msg, err := readLine(r, limit)
+		return msg, false, err
+	}
+}
+
+// readLine reads a line of at most limit bytes, without its newline. The
+// last line may end at EOF instead.
+func readLine(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if limit > 0 && len(line) > limit {
+			return nil, ErrMessageTooLarge
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) > 0:
+			return bytes.TrimSpace(line), nil
+		case err != nil:
+			return nil, err
+		}
+		return bytes.TrimSpace(line), nil
+	}
+}
+
+// readFramed reads the chunks of a framed message. Chunks past limit are
+// read and dropped, so the connection stays in step.
+func readFramed(r *bufio.Reader, limit int) ([]byte, error) {
+	var msg []byte
+	tooLarge := false
+	for {
+		header, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull || len(header) > maxChunkHeader {
+			return nil, fmt.Errorf("invalid chunk length %.20q", header)
+		}
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		n, err := strconv.Atoi(string(bytes.TrimSpace(header)))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid chunk length %q", bytes.TrimSpace(header))
+		}
+		if n == 0 {
+			break
+		}
+
+		if tooLarge || limit > 0 && n > limit-len(msg) {
+			tooLarge, msg = true, nil
+			if _, err := r.Discard(n); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		} else {
+			start := len(msg)
+			msg = append(msg, make([]byte, n)...)
+			if _, err := io.ReadFull(r, msg[start:]); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		}
+		if b, err := r.ReadByte(); err != nil || b != '\n' {
+			return nil, fmt.Errorf("chunk of %d bytes not followed by a newline", n)
+		}
+	}
+	if tooLarge {
+		return nil, ErrMessageTooLarge
+	}
+	return msg, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WriteMessage writes data, a JSON message, to w as a line, or framed in
+// chunks of at most FrameChunkSize bytes if framed is set.
+func WriteMessage(w io.Writer, data []byte, framed bool) error {
+	if !framed {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for len(data) > 0 {
+		n := len(data)
+		if n > FrameChunkSize {
+			n = FrameChunkSize
+		}
+		fmt.Fprintf(bw, "%d\n", n)
+		bw.Write(data[:n])
+		bw.WriteByte('\n')
+		data = data[n:]
+		// Flush each chunk so the reader can start on it.
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("0\n")
+	return bw.Flush()
+}
@@ -0,0 +1,381 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// JSONRPCVersion is the JSON-RPC version spoken over the admin socket.
+const JSONRPCVersion = "2.0"
+
+// Versions of the localbase protocol this package speaks, negotiated with
+// the hello method. Bump MaxProtocolVersion for incompatible changes and
+// keep serving older versions for as long as possible.
+const (
+	MinProtocolVersion = 1
+	MaxProtocolVersion = 1
+)
+
+// Optional protocol features. Clients check for a feature in the hello
+// result before relying on it.
+const (
+	FeatureBatch     = "batch"
+	FeatureSubscribe = "subscribe"
+	FeatureUpdate    = "update"
+	// FeatureMultiplex means a connection can carry many requests, with
+	// responses matched to requests by ID.
+	FeatureMultiplex = "multiplex"
+	// FeaturePause means the daemon has the pause and resume methods.
+	FeaturePause = "pause"
+	// FeatureUndo means the daemon has the undo and history methods.
+	FeatureUndo = "undo"
+	// FeatureFraming means the daemon reads framed messages, see
+	// ReadMessage, and answers them framed.
+	FeatureFraming = "framing"
+)
+
+// Features returns every optional feature this package speaks.
+func Features() []string {
+	return []string{FeatureBatch, FeatureSubscribe, FeatureUpdate, FeatureMultiplex, FeaturePause, FeatureUndo, FeatureFraming}
+}
+
+// ListPageSize is how many domains List asks for per request.
+const ListPageSize = 200
+
+// request is a single JSON-RPC call to the daemon, sent as one message.
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      int             `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Auth    string          `json:"auth,omitempty"`
+}
+
+// Response is the daemon's reply to a request, sent as one message.
+// Exactly one of Result and Error is set.
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// HelloParams lists the protocol versions and features a client supports.
+type HelloParams struct {
+	Versions []int    `json:"versions"`
+	Features []string `json:"features,omitempty"`
+}
+
+// HelloResult is the version chosen by the daemon, the highest one both
+// sides support, and the features both sides support.
+type HelloResult struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+// Has reports whether the daemon supports feature.
+func (r *HelloResult) Has(feature string) bool {
+	for _, f := range r.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+type AddParams struct {
+	Domain  string   `json:"domain"`
+	Port    int      `json:"port"`
+	Aliases []string `json:"aliases,omitempty"`
+	// Suffix is added to names given without one, instead of the daemon's
+	// default suffix.
+	Suffix string `json:"suffix,omitempty"`
+	// Rename renames a .local name another host on the LAN already
+	// answers for to name-2.local, name-3.local and so on, instead of
+	// failing.
+	Rename bool `json:"rename,omitempty"`
+	DomainInfo
+	RouteOptions
+}
+
+// UpdateParams changes the port of a registered domain or alias.
+type UpdateParams struct {
+	Domain string `json:"domain"`
+	Port   int    `json:"port"`
+}
+
+type RemoveParams struct {
+	Domain string `json:"domain"`
+}
+
+// PauseParams pauses or resumes a registered domain.
+type PauseParams struct {
+	Domain string `json:"domain"`
+}
+
+// GetParams looks up the domain serving a hostname, which may be the
+// domain, an alias or one of their names under a DNS TLD.
+type GetParams struct {
+	Domain string `json:"domain"`
+}
+
+// ShareParams asks the daemon to make a domain reachable from other devices
+// on the LAN.
+type ShareParams struct {
+	Domain string `json:"domain"`
+}
+
+// ShareResult is where other devices on the LAN reach a shared domain.
+// Warnings are problems found that may keep them from reaching it.
+type ShareResult struct {
+	Domain string `json:"domain"`
+	// URL is at the domain's .local name, which other devices resolve
+	// over mDNS to IP and IPv6.
+	URL      string   `json:"url"`
+	IP       string   `json:"ip,omitempty"`
+	IPv6     string   `json:"ipv6,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Domain describes a registered domain, the port it proxies to, and any
+// aliases routed to the same port. Upstream is "up" or "down" once the
+// daemon has probed the port.
+type Domain struct {
+	Domain  string   `json:"domain"`
+	Port    int      `json:"port"`
+	Aliases []string `json:"aliases,omitempty"`
+	DomainInfo
+	RouteOptions
+	// Paused is set while the domain is paused: it stays registered, but
+	// Caddy doesn't route it and its names don't resolve.
+	Paused   bool   `json:"paused,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+	// URL is where the domain is served, including the port when Caddy
+	// doesn't listen on the default port for the scheme.
+	URL string `json:"url,omitempty"`
+	// Upstreams is Caddy's view of each upstream, set by get and list for
+	// domains with a health check.
+	Upstreams []UpstreamStatus `json:"upstreams,omitempty"`
+}
+
+// DomainInfo describes a domain for the people managing it. It doesn't
+// change how the domain is served.
+type DomainInfo struct {
+	// Group is the group the domain is managed with, such as the project
+	// it belongs to. remove, pause and resume take a whole group.
+	Group string `json:"group,omitempty" yaml:"group"`
+	// Labels are key=value pairs for organizing domains, such as
+	// team=payments. list filters on them.
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels"`
+	// Description says what the domain is, such as "checkout API".
+	Description string `json:"description,omitempty" yaml:"description"`
+}
+
+// RouteOptions configures the Caddy routes generated for a domain.
+type RouteOptions struct {
+	// Dir is an absolute path to serve static files from instead of
+	// proxying to a port. The domain's port is zero.
+	Dir    string      `json:"dir,omitempty" yaml:"dir"`
+	Routes []PathRoute `json:"routes,omitempty" yaml:"routes"`
+	// Rewrites change request paths before they are proxied or served, in
+	// order, the first matching rule winning.
+	Rewrites []Rewrite `json:"rewrites,omitempty" yaml:"rewrites"`
+	// ExtraPorts are upstreams load balanced with the domain's port.
+	ExtraPorts []int `json:"extra_ports,omitempty" yaml:"extra_ports"`
+	// HealthCheck has Caddy actively check each upstream, sending requests
+	// only to healthy ones.
+	HealthCheck *UpstreamCheck `json:"health_check,omitempty" yaml:"health_check"`
+	// LBPolicy is the Caddy selection policy used to pick between the
+	// port and ExtraPorts, such as round_robin. Empty means random.
+	LBPolicy string `json:"lb_policy,omitempty" yaml:"lb_policy"`
+	// GRPC proxies to the upstream over cleartext HTTP/2 (h2c).
+	GRPC bool `json:"grpc,omitempty" yaml:"grpc"`
+	// WebSocket tunes the proxy for long-lived upgraded connections such as
+	// dev server HMR sockets.
+	WebSocket bool `json:"websocket,omitempty" yaml:"websocket"`
+	// Compress encodes responses with zstd or gzip, as most production
+	// servers do.
+	Compress bool `json:"compress,omitempty" yaml:"compress"`
+	// UpstreamScheme is "https" for upstreams that only serve TLS, such as
+	// .NET or Vite with https enabled. Empty means http.
+	UpstreamScheme string `json:"upstream_scheme,omitempty" yaml:"upstream_scheme"`
+	// InsecureUpstream skips verifying the upstream's certificate, for
+	// self-signed dev certificates.
+	InsecureUpstream bool `json:"insecure_upstream,omitempty" yaml:"insecure_upstream"`
+	// Timeouts override Caddy's timeouts for talking to the upstream, for
+	// long uploads or streamed responses.
+	Timeouts *ProxyTimeouts `json:"timeouts,omitempty" yaml:"timeouts"`
+	// RequestHeaders changes headers on requests sent to the upstream.
+	RequestHeaders *HeaderOps `json:"request_headers,omitempty" yaml:"request_headers"`
+	// ResponseHeaders changes headers on responses from the upstream.
+	ResponseHeaders *HeaderOps `json:"response_headers,omitempty" yaml:"response_headers"`
+	// CORS lists the browser origins allowed to call the domain, or "*"
+	// for any. Caddy answers preflight requests itself.
+	CORS []string `json:"cors,omitempty" yaml:"cors"`
+	// BasicAuth requires requests to carry one of these HTTP basic auth
+	// credentials.
+	BasicAuth []BasicAuthAccount `json:"basic_auth,omitempty" yaml:"basic_auth"`
+	// NoTLS serves the domain over plain HTTP only: Caddy gets no
+	// certificate for it and doesn't redirect it to HTTPS.
+	NoTLS bool `json:"no_tls,omitempty" yaml:"no_tls"`
+	// AccessLog has Caddy log requests for the domain to a file in the
+	// localbase config dir.
+	AccessLog bool `json:"access_log,omitempty" yaml:"access_log"`
+	// ExposeLAN serves the domain to other devices on the LAN. Otherwise
+	// Caddy only serves it to this machine and answers others with a 403.
+	ExposeLAN bool `json:"expose_lan,omitempty" yaml:"expose_lan"`
+	// Caddy is raw Caddy route JSON merged into each generated route: its
+	// "match" fields are added to every matcher set, its "handle" handlers
+	// run before the proxy, and any other fields are set on the route.
+	Caddy map[string]interface{} `json:"caddy,omitempty" yaml:"caddy"`
+}
+
+// UpstreamCheck is an active health check Caddy runs against upstreams.
+// Interval is a duration such as 10s, and Status the expected response
+// status; Caddy defaults to 30s and any 2xx.
+type UpstreamCheck struct {
+	Path     string `json:"path" yaml:"path"`
+	Interval string `json:"interval,omitempty" yaml:"interval"`
+	Status   int    `json:"status,omitempty" yaml:"status"`
+}
+
+// ProxyTimeouts bound connecting to, writing requests to and reading
+// responses from the upstream. Each is a duration such as 5m; empty keeps
+// Caddy's default.
+type ProxyTimeouts struct {
+	Dial  string `json:"dial,omitempty" yaml:"dial"`
+	Read  string `json:"read,omitempty" yaml:"read"`
+	Write string `json:"write,omitempty" yaml:"write"`
+}
+
+// UpstreamStatus is Caddy's view of one of a domain's upstreams.
+type UpstreamStatus struct {
+	Address  string `json:"address"`
+	Requests int    `json:"requests"`
+	Fails    int    `json:"fails"`
+}
+
+// BasicAuthAccount is a user allowed through basic auth. Password may be
+// given in plain text; the daemon replaces it with a bcrypt hash.
+type BasicAuthAccount struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// HeaderOps sets and removes HTTP headers.
+type HeaderOps struct {
+	Set    map[string]string `json:"set,omitempty" yaml:"set"`
+	Remove []string          `json:"remove,omitempty" yaml:"remove"`
+}
+
+// Rewrite replaces the request path From with To. A From ending in "*"
+// matches every path with that prefix, which is replaced with To minus its
+// own trailing "*", so /api/*=/v1/* maps /api/users to /v1/users.
+type Rewrite struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+}
+
+// PathRoute sends requests under Path to a different port than the rest of
+// the domain. The path prefix is stripped unless KeepPrefix is set.
+type PathRoute struct {
+	Path       string `json:"path" yaml:"path"`
+	Port       int    `json:"port" yaml:"port"`
+	KeepPrefix bool   `json:"keep_prefix,omitempty" yaml:"keep_prefix"`
+}
+
+// ListParams pages through domains in name order. Cursor is the Next
+// value from the previous page; a zero Limit returns every domain.
+type ListParams struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// ListResult is a page of domains. Next is set when more domains follow.
+type ListResult struct {
+	Domains []Domain `json:"domains"`
+	Next    string   `json:"next,omitempty"`
+}
+
+// Change is an add, remove, update, pause or resume undo can revert.
+type Change struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Domain is the domain as the change left it, or as it was before a
+	// remove.
+	Domain Domain `json:"domain"`
+	// PrevPort is the port before an update.
+	PrevPort int `json:"prev_port,omitempty"`
+}
+
+// HistoryResult is the changes undo can revert, most recent first.
+type HistoryResult struct {
+	Changes []Change `json:"changes"`
+}
+
+// UndoResult is the change undo reverted and the domain as undo left it,
+// nil when undoing an add removed it.
+type UndoResult struct {
+	Undone Change  `json:"undone"`
+	Domain *Domain `json:"domain,omitempty"`
+}
+
+// Status is the daemon's state along with on-demand statistics about the
+// Caddy config it manages.
+type Status struct {
+	PID                 int       `json:"pid"`
+	StartedAt           time.Time `json:"started_at"`
+	Address             string    `json:"address"`
+	Domains             int       `json:"domains"`
+	CaddyAdmin          string    `json:"caddy_admin"`
+	CaddyReachable      bool      `json:"caddy_reachable"`
+	CaddyVersion        string    `json:"caddy_version,omitempty"`
+	CaddyConfigSize     int       `json:"caddy_config_size,omitempty"`
+	CaddyConfigWarnSize int       `json:"caddy_config_warn_size,omitempty"`
+	Routes              int       `json:"routes,omitempty"`
+}
+
+// HealthCheck is the outcome of a single health check.
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Health is the daemon's overall health. Healthy is set when every check
+// passes.
+type Health struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []HealthCheck `json:"checks"`
+}
+
+// Event types published to subscribers.
+const (
+	EventDomainAdded    = "domain_added"
+	EventDomainUpdated  = "domain_updated"
+	EventDomainRemoved  = "domain_removed"
+	EventIPChanged      = "ip_changed"
+	EventCaddyRestarted = "caddy_restarted"
+	EventUpstreamDown   = "upstream_down"
+	EventUpstreamUp     = "upstream_up"
+	// EventNameConflict is published when another host on the LAN answers
+	// for a registered .local name. IP is the other host's address.
+	EventNameConflict  = "name_conflict"
+	EventDomainPaused  = "domain_paused"
+	EventDomainResumed = "domain_resumed"
+)
+
+// Event is a change in daemon state, streamed to subscribers.
+type Event struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Domain string    `json:"domain,omitempty"`
+	Port   int       `json:"port,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	IPv6   string    `json:"ipv6,omitempty"`
+}
+
+// SubscribeParams optionally limits a subscription to some event types.
+type SubscribeParams struct {
+	Events []string `json:"events,omitempty"`
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// method describes the params and result of a protocol method. A nil type
+// means the method takes no params or returns no result.
+type method struct {
+	params reflect.Type
+	result reflect.Type
+	doc    string
+}
+
+func typeOf(v interface{}) reflect.Type {
+	return reflect.TypeOf(v).Elem()
+}
+
+// methods lists every protocol method, for the schema.
+var methods = map[string]method{
+	"hello":     {typeOf((*HelloParams)(nil)), typeOf((*HelloResult)(nil)), "Negotiate the protocol version and features."},
+	"add":       {typeOf((*AddParams)(nil)), typeOf((*Domain)(nil)), "Register a domain."},
+	"update":    {typeOf((*UpdateParams)(nil)), typeOf((*Domain)(nil)), "Point a registered domain at a new port."},
+	"remove":    {typeOf((*RemoveParams)(nil)), typeOf((*Domain)(nil)), "Unregister a domain."},
+	"pause":     {typeOf((*PauseParams)(nil)), typeOf((*Domain)(nil)), "Stop routing and resolving a domain, keeping it registered."},
+	"resume":    {typeOf((*PauseParams)(nil)), typeOf((*Domain)(nil)), "Route and resolve a paused domain again."},
+	"undo":      {nil, typeOf((*UndoResult)(nil)), "Revert the most recent add, remove, update, pause or resume."},
+	"history":   {nil, typeOf((*HistoryResult)(nil)), "List the changes undo can revert, most recent first."},
+	"get":       {typeOf((*GetParams)(nil)), typeOf((*Domain)(nil)), "Look up the domain serving a hostname."},
+	"list":      {typeOf((*ListParams)(nil)), typeOf((*ListResult)(nil)), "List registered domains a page at a time."},
+	"share":     {typeOf((*ShareParams)(nil)), typeOf((*ShareResult)(nil)), "Make a domain reachable from other devices on the LAN."},
+	"status":    {nil, typeOf((*Status)(nil)), "Report daemon status."},
+	"health":    {nil, typeOf((*Health)(nil)), "Run the daemon's health checks."},
+	"stop":      {nil, nil, "Shut the daemon down."},
+	"subscribe": {typeOf((*SubscribeParams)(nil)), nil, "Stream event notifications; must be the only request on its connection."},
+}
+
+// notifications lists the notifications the daemon sends, for the schema.
+var notifications = map[string]reflect.Type{
+	"event": typeOf((*Event)(nil)),
+}
+
+// Schema returns a JSON Schema describing the protocol: every params,
+// result and error type under $defs, and each method's params and result
+// under x-methods. It is generated from the Go types, so it always
+// matches this build.
+func Schema() json.RawMessage {
+	g := &schemaGen{defs: make(map[string]interface{})}
+
+	g.define("Request", typeOf((*request)(nil)))
+	// IDs are echoed back as sent, so any JSON-RPC id works.
+	g.defs["Request"].(map[string]interface{})["properties"].(map[string]interface{})["id"] = map[string]interface{}{
+		"type": []string{"integer", "string"},
+	}
+	g.define("Response", typeOf((*Response)(nil)))
+
+	methodDefs := make(map[string]interface{}, len(methods))
+	for name, m := range methods {
+		def := map[string]interface{}{"description": m.doc}
+		if m.params != nil {
+			def["params"] = g.ref(m.params)
+		}
+		if m.result != nil {
+			def["result"] = g.ref(m.result)
+		} else {
+			def["result"] = map[string]interface{}{"type": "null"}
+		}
+		methodDefs[name] = def
+	}
+
+	notificationDefs := make(map[string]interface{}, len(notifications))
+	for name, t := range notifications {
+		notificationDefs[name] = map[string]interface{}{"params": g.ref(t)}
+	}
+
+	codes := []string{}
+	for code := range rpcCodes {
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+	g.defs["ErrorCode"] = map[string]interface{}{"type": "string", "enum": codes}
+
+	data, _ := json.MarshalIndent(map[string]interface{}{
+		"$schema":         "https://json-schema.org/draft/2020-12/schema",
+		"$id":             "https://github.com/noelukwa/localbase/protocol.json",
+		"title":           "localbase admin protocol",
+		"description":     "JSON-RPC " + JSONRPCVersion + " over newline-delimited or chunk-framed JSON.",
+		"x-versions":      []int{MinProtocolVersion, MaxProtocolVersion},
+		"x-features":      Features(),
+		"x-methods":       methodDefs,
+		"x-notifications": notificationDefs,
+		"$defs":           g.defs,
+	}, "", "  ")
+	return data
+}
+
+type schemaGen struct {
+	defs map[string]interface{}
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	rawType       = reflect.TypeOf(json.RawMessage{})
+	errorCodeType = reflect.TypeOf(ErrorCode(""))
+)
+
+// ref returns a reference to the definition of t, defining it first.
+func (g *schemaGen) ref(t reflect.Type) map[string]interface{} {
+	name := t.Name()
+	if _, ok := g.defs[name]; !ok {
+		g.define(name, t)
+	}
+	return map[string]interface{}{"$ref": "#/$defs/" + name}
+}
+
+func (g *schemaGen) define(name string, t reflect.Type) {
+	// Placeholder so recursive types terminate.
+	g.defs[name] = nil
+	g.defs[name] = g.object(t)
+}
+
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	required := []string{}
+	g.fields(t, props, &required)
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+		"required":   required,
+	}
+}
+
+// fields adds the JSON fields of struct t, flattening embedded structs as
+// encoding/json does.
+func (g *schemaGen) fields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, props, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func (g *schemaGen) schema(t reflect.Type) interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]interface{}{}
+	case errorCodeType:
+		return map[string]interface{}{"$ref": "#/$defs/ErrorCode"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.ref(t)
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkLocalbaseProcess returns an error unless pid runs localbase, so a
+// stale PID file reused by another process never gets it signalled. The
+// daemon may run another copy of the binary than this one, so any
+// executable named like localbase counts.
+func checkLocalbaseProcess(pid int) error {
+	exe, err := processExecutable(pid)
+	if err != nil {
+		return fmt.Errorf("can't tell what pid %d runs: %v", pid, err)
+	}
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(exe)), ".exe")
+	if self, err := os.Executable(); err == nil {
+		if strings.TrimSuffix(strings.ToLower(filepath.Base(self)), ".exe") == name {
+			return nil
+		}
+	}
+	if strings.Contains(name, "localbase") {
+		return nil
+	}
+	return fmt.Errorf("pid %d runs %s, not localbase", pid, exe)
+}
+
+// waitForExit polls until the daemon has removed its PID file or the
+// process is gone. It returns false if the timeout elapses first.
+func waitForExit(ctx context.Context, pid int, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		current, err := readPIDFile()
+		if err == nil && current != pid {
+			return true
+		}
+		if !processAlive(pid) {
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const projectFile = ".localbase.yml"
+
+// projectFiles are the project files looked for when --file isn't given,
+// in order.
+var projectFiles = []string{projectFile, ".localbase.yaml", ".localbase.toml"}
+
+var projectLineNumber = regexp.MustCompile(`^line \d+: `)
+
+// Project is a per-project set of domains, read from .localbase.yml, or
+// .localbase.toml with the same keys:
+//
+//	domains:
+//	  - name: web
+//	    port: 3000
+//	  - name: api
+//	    port: 4000
+//	    aliases: [backend]
+//	    routes:
+//	      - path: /auth
+//	        port: 4001
+//	  - name: docs
+//	    dir: ./site
+type Project struct {
+	Domains []ProjectDomain `yaml:"domains"`
+}
+
+type ProjectDomain struct {
+	Name         string   `yaml:"name"`
+	Port         int      `yaml:"port"`
+	Aliases      []string `yaml:"aliases"`
+	DomainInfo   `yaml:",inline"`
+	RouteOptions `yaml:",inline"`
+}
+
+func loadProject(path string) (*Project, error) {
+	if path == projectFile {
+		for _, name := range projectFiles {
+			if _, err := os.Stat(name); err == nil {
+				path = name
+				break
+			}
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, usageErrorf("no %s found, create one or pass --file", path)
+		}
+		return nil, err
+	}
+	if filepath.Ext(path) == ".toml" {
+		// TOML goes through YAML so both are checked against the same
+		// keys.
+		var values map[string]interface{}
+		if err := toml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", path, err)
+		}
+		if data, err = yaml.Marshal(values); err != nil {
+			return nil, err
+		}
+	}
+
+	var project Project
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&project); err != nil {
+		var typeErr *yaml.TypeError
+		if filepath.Ext(path) == ".toml" && errors.As(err, &typeErr) {
+			// The YAML line numbers don't match the TOML file.
+			for i, e := range typeErr.Errors {
+				typeErr.Errors[i] = projectLineNumber.ReplaceAllString(e, "")
+			}
+		}
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for i, d := range project.Domains {
+		if d.Name == "" {
+			return nil, fmt.Errorf("invalid %s: domain %d has no name", path, i+1)
+		}
+		if d.Dir != "" {
+			// Directories are relative to the project file.
+			if !filepath.IsAbs(d.Dir) {
+				dir, err := filepath.Abs(filepath.Join(filepath.Dir(path), d.Dir))
+				if err != nil {
+					return nil, err
+				}
+				project.Domains[i].Dir = dir
+			}
+		} else if d.Port <= 0 || d.Port > 65535 {
+			return nil, fmt.Errorf("invalid %s: domain %s has invalid port %d", path, d.Name, d.Port)
+		}
+		if seen[d.Name] {
+			return nil, fmt.Errorf("invalid %s: domain %s is declared twice", path, d.Name)
+		}
+		seen[d.Name] = true
+	}
+
+	return &project, nil
+}
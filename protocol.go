@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noelukwa/localbase/pkg/client"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// protocolVersion is the JSON-RPC version spoken over the admin socket.
+const protocolVersion = client.JSONRPCVersion
+
+// Versions of the localbase protocol this build speaks. They are defined
+// by the client package so the daemon and its clients move together.
+const (
+	minProtocolVersion = client.MinProtocolVersion
+	maxProtocolVersion = client.MaxProtocolVersion
+)
+
+// Optional protocol features, see the client package.
+const (
+	FeatureBatch     = client.FeatureBatch
+	FeatureSubscribe = client.FeatureSubscribe
+	FeatureUpdate    = client.FeatureUpdate
+	FeatureMultiplex = client.FeatureMultiplex
+	FeaturePause     = client.FeaturePause
+	FeatureUndo      = client.FeatureUndo
+	FeatureFraming   = client.FeatureFraming
+)
+
+var protocolFeatures = client.Features()
+
+// Protocol types shared with the client package.
+type (
+	HelloParams      = client.HelloParams
+	HelloResult      = client.HelloResult
+	Response         = client.Response
+	AddParams        = client.AddParams
+	UpdateParams     = client.UpdateParams
+	RemoveParams     = client.RemoveParams
+	PauseParams      = client.PauseParams
+	GetParams        = client.GetParams
+	Domain           = client.Domain
+	DomainInfo       = client.DomainInfo
+	RouteOptions     = client.RouteOptions
+	BasicAuthAccount = client.BasicAuthAccount
+	UpstreamCheck    = client.UpstreamCheck
+	UpstreamStatus   = client.UpstreamStatus
+	ProxyTimeouts    = client.ProxyTimeouts
+	PathRoute        = client.PathRoute
+	Rewrite          = client.Rewrite
+	HeaderOps        = client.HeaderOps
+	ListParams       = client.ListParams
+	ListResult       = client.ListResult
+	Change           = client.Change
+	HistoryResult    = client.HistoryResult
+	UndoResult       = client.UndoResult
+)
+
+// defaultMaxMessageSize bounds a single request, and a response sent as a
+// line, batches included, unless the config sets another limit.
+const defaultMaxMessageSize = 4 << 20
+
+// maxInFlight bounds how many requests on one connection are served
+// concurrently.
+const maxInFlight = 16
+
+// Request is a single JSON-RPC call to the daemon, sent as one line of JSON.
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// Auth is an API token, required when the daemon runs with
+	// --require-auth.
+	Auth string `json:"auth,omitempty"`
+
+	// client identifies who sent the request, for the audit log.
+	client string
+	// prefix limits the request to domains starting with it, as set by
+	// authorize for a token with a prefix.
+	prefix string
+}
+
+// Notification is a message from the daemon that isn't a reply to a
+// request, such as a subscription event.
+type Notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// parsePathRoute parses a path route written as /path=port.
+func parsePathRoute(s string) (PathRoute, error) {
+	path, port, ok := strings.Cut(s, "=")
+	if !ok {
+		return PathRoute{}, fmt.Errorf("invalid route %q, expected /path=port", s)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return PathRoute{}, fmt.Errorf("invalid route %q: invalid port: %v", s, err)
+	}
+	return PathRoute{Path: path, Port: p}, nil
+}
+
+func parseRewrite(s string) (Rewrite, error) {
+	from, to, ok := strings.Cut(s, "=")
+	if !ok {
+		return Rewrite{}, fmt.Errorf("invalid rewrite %q, expected /from=/to", s)
+	}
+	return Rewrite{From: from, To: to}, nil
+}
+
+// staticRoots are the directories static domains may serve, the daemon's
+// StaticRoots or the directory it started in, set at start.
+var staticRoots []string
+
+// checkStaticDir refuses to serve dir unless it is in one of staticRoots.
+// The config dir, and any directory holding it, is always refused, as it
+// would serve the daemon's private key and tokens.
+func checkStaticDir(dir string) error {
+	dir = realPath(dir)
+	if configDir, err := getConfigDir(); err == nil {
+		configDir = realPath(configDir)
+		if pathWithin(dir, configDir) || pathWithin(configDir, dir) {
+			return errorf(CodeInvalidRequest, "%s holds the localbase config dir and can't be served", dir)
+		}
+	}
+	for _, root := range staticRoots {
+		if pathWithin(dir, realPath(root)) {
+			return nil
+		}
+	}
+	if len(staticRoots) == 0 {
+		return errorf(CodeInvalidRequest, "no directories may be served, start localbase with --static-root")
+	}
+	return errorf(CodeInvalidRequest, "%s is outside the directories localbase may serve (%s), start it with --static-root", dir, strings.Join(staticRoots, ", "))
+}
+
+// realPath returns path with its symlinks resolved, or as is if that
+// fails.
+func realPath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
+
+// pathWithin reports whether path is dir or under it.
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// validateRouteOptions checks o, normalizing it in place.
+func validateRouteOptions(o *RouteOptions) error {
+	if o.Dir != "" {
+		if !filepath.IsAbs(o.Dir) {
+			return errorf(CodeInvalidRequest, "dir %q must be an absolute path", o.Dir)
+		}
+		info, err := os.Stat(o.Dir)
+		if err != nil {
+			return errorf(CodeInvalidRequest, "invalid dir: %v", err)
+		}
+		if !info.IsDir() {
+			return errorf(CodeInvalidRequest, "%s is not a directory", o.Dir)
+		}
+		if err := checkStaticDir(o.Dir); err != nil {
+			return err
+		}
+		if o.GRPC || o.WebSocket || o.UpstreamScheme == "https" || len(o.ExtraPorts) > 0 || o.HealthCheck != nil || o.Timeouts != nil {
+			return errorf(CodeInvalidRequest, "ports, grpc, websocket, upstream scheme and timeouts don't apply to static domains")
+		}
+	}
+	seen := make(map[string]bool)
+	for i := range o.Routes {
+		pr := &o.Routes[i]
+		pr.Path = strings.TrimSuffix(pr.Path, "/")
+		if !strings.HasPrefix(pr.Path, "/") {
+			return errorf(CodeInvalidRequest, "route path %q must start with /", pr.Path)
+		}
+		if pr.Port <= 0 || pr.Port > 65535 {
+			return errorf(CodeInvalidRequest, "invalid port number for route %s: %d", pr.Path, pr.Port)
+		}
+		if seen[pr.Path] {
+			return errorf(CodeInvalidRequest, "route %s is listed more than once", pr.Path)
+		}
+		seen[pr.Path] = true
+	}
+	for _, rw := range o.Rewrites {
+		if !strings.HasPrefix(rw.From, "/") || !strings.HasPrefix(rw.To, "/") {
+			return errorf(CodeInvalidRequest, "rewrite %s=%s: paths must start with /", rw.From, rw.To)
+		}
+		if strings.Contains(strings.TrimSuffix(rw.From, "*"), "*") || strings.Contains(strings.TrimSuffix(rw.To, "*"), "*") {
+			return errorf(CodeInvalidRequest, "rewrite %s=%s: * is only allowed at the end", rw.From, rw.To)
+		}
+		if strings.HasSuffix(rw.From, "*") != strings.HasSuffix(rw.To, "*") {
+			return errorf(CodeInvalidRequest, "rewrite %s=%s: both paths or neither must end in *", rw.From, rw.To)
+		}
+	}
+	for _, port := range o.ExtraPorts {
+		if port <= 0 || port > 65535 {
+			return errorf(CodeInvalidRequest, "invalid port number: %d", port)
+		}
+	}
+	for _, origin := range o.CORS {
+		if origin == "*" {
+			if len(o.CORS) > 1 {
+				return errorf(CodeInvalidRequest, "cors origin * can't be combined with other origins")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return errorf(CodeInvalidRequest, "invalid cors origin %q, expected * or e.g. http://localhost:5173", origin)
+		}
+	}
+	for i := range o.BasicAuth {
+		acct := &o.BasicAuth[i]
+		if acct.Username == "" || strings.Contains(acct.Username, ":") {
+			return errorf(CodeInvalidRequest, "invalid basic auth username %q", acct.Username)
+		}
+		if acct.Password == "" {
+			return errorf(CodeInvalidRequest, "basic auth user %s has no password", acct.Username)
+		}
+		if _, err := bcrypt.Cost([]byte(acct.Password)); err == nil {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(acct.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return errorf(CodeInvalidRequest, "invalid basic auth password for %s: %v", acct.Username, err)
+		}
+		acct.Password = string(hash)
+	}
+	if hc := o.HealthCheck; hc != nil {
+		if !strings.HasPrefix(hc.Path, "/") {
+			return errorf(CodeInvalidRequest, "health check path %q must start with /", hc.Path)
+		}
+		if hc.Interval != "" {
+			if d, err := time.ParseDuration(hc.Interval); err != nil || d <= 0 {
+				return errorf(CodeInvalidRequest, "invalid health check interval %q", hc.Interval)
+			}
+		}
+		if hc.Status != 0 && (hc.Status < 100 || hc.Status > 599) {
+			return errorf(CodeInvalidRequest, "invalid health check status %d", hc.Status)
+		}
+	}
+	if t := o.Timeouts; t != nil {
+		for _, v := range []struct{ name, value string }{{"dial", t.Dial}, {"read", t.Read}, {"write", t.Write}} {
+			if v.value == "" {
+				continue
+			}
+			if d, err := time.ParseDuration(v.value); err != nil || d <= 0 {
+				return errorf(CodeInvalidRequest, "invalid %s timeout %q", v.name, v.value)
+			}
+		}
+	}
+	switch o.LBPolicy {
+	case "", "random", "round_robin", "least_conn", "first", "ip_hash", "client_ip_hash", "uri_hash":
+	default:
+		return errorf(CodeInvalidRequest, "invalid lb policy %q, expected random, round_robin, least_conn, first, ip_hash, client_ip_hash or uri_hash", o.LBPolicy)
+	}
+	if o.LBPolicy != "" && len(o.ExtraPorts) == 0 {
+		return errorf(CodeInvalidRequest, "lb policy needs more than one port")
+	}
+	switch o.UpstreamScheme {
+	case "", "http", "https":
+	default:
+		return errorf(CodeInvalidRequest, "invalid upstream scheme %q, expected http or https", o.UpstreamScheme)
+	}
+	if o.UpstreamScheme == "http" {
+		o.UpstreamScheme = ""
+	}
+	if o.InsecureUpstream && o.UpstreamScheme != "https" {
+		return errorf(CodeInvalidRequest, "insecure upstream only applies to https upstreams")
+	}
+	for _, ops := range []*HeaderOps{o.RequestHeaders, o.ResponseHeaders} {
+		if err := validateHeaderOps(ops); err != nil {
+			return err
+		}
+	}
+	return validateCaddyRoute(o.Caddy)
+}
+
+func validateHeaderOps(ops *HeaderOps) error {
+	if ops == nil {
+		return nil
+	}
+	names := append([]string{}, ops.Remove...)
+	for name := range ops.Set {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return errorf(CodeInvalidRequest, "invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// parseHeaders parses headers written as Name=value.
+func parseHeaders(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	headers := make(map[string]string, len(values))
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q, expected Name=value", v)
+		}
+		headers[strings.TrimSpace(name)] = value
+	}
+	return headers, nil
+}
+
+// parseLabels parses labels written as key=value.
+func parseLabels(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", v)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+// validateDomainInfo checks the group, labels and description of a
+// domain.
+func validateDomainInfo(info *DomainInfo) error {
+	if err := validateGroup(info.Group); err != nil {
+		return errorf(CodeInvalidRequest, "%v", err)
+	}
+	for key, value := range info.Labels {
+		if key == "" || len(key) > 63 || strings.Trim(key, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./") != "" {
+			return errorf(CodeInvalidRequest, "invalid label %q, keys are letters, digits, -, _, . and /", key)
+		}
+		if len(value) > 256 || strings.ContainsAny(value, "\r\n") {
+			return errorf(CodeInvalidRequest, "invalid value for label %s, values are one line of at most 256 bytes", key)
+		}
+	}
+	if len(info.Description) > 1024 {
+		return errorf(CodeInvalidRequest, "description is longer than 1024 bytes")
+	}
+	return nil
+}
+
+// validateGroup checks that group is empty or a name of letters, digits,
+// -, _ and ., so it is easy to type.
+func validateGroup(group string) error {
+	if len(group) > 63 || strings.Trim(group, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") != "" {
+		return fmt.Errorf("invalid group %q, groups are letters, digits, -, _ and .", group)
+	}
+	return nil
+}
+
+// matchLabels reports whether labels match every selector, key=value for
+// a label with that value or key for a label with any value.
+func matchLabels(labels map[string]string, selectors []string) bool {
+	for _, sel := range selectors {
+		key, want, hasValue := strings.Cut(sel, "=")
+		value, ok := labels[strings.TrimSpace(key)]
+		if !ok || hasValue && value != strings.TrimSpace(want) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateCaddyRoute checks that custom route JSON can be merged into the
+// generated routes without taking them over.
+func validateCaddyRoute(snippet map[string]interface{}) error {
+	if _, ok := snippet["@id"]; ok {
+		return errorf(CodeInvalidRequest, "caddy route must not set @id, localbase manages it")
+	}
+	if match, ok := snippet["match"]; ok {
+		m, ok := match.(map[string]interface{})
+		if !ok {
+			return errorf(CodeInvalidRequest, "caddy match must be an object of matchers")
+		}
+		if _, ok := m["host"]; ok {
+			return errorf(CodeInvalidRequest, "caddy match must not set host, localbase manages it")
+		}
+	}
+	if handle, ok := snippet["handle"]; ok {
+		handlers, ok := handle.([]interface{})
+		if !ok {
+			return errorf(CodeInvalidRequest, "caddy handle must be a list of handlers")
+		}
+		for i, h := range handlers {
+			handler, _ := h.(map[string]interface{})
+			if name, _ := handler["handler"].(string); name == "" {
+				return errorf(CodeInvalidRequest, "caddy handler %d has no handler name", i+1)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRewrite(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Rewrite
+		wantErr bool
+	}{
+		{in: "/old=/new", want: Rewrite{From: "/old", To: "/new"}},
+		{in: "/api/*=/v1/*", want: Rewrite{From: "/api/*", To: "/v1/*"}},
+		{in: "/a=/b=c", want: Rewrite{From: "/a", To: "/b=c"}},
+		{in: "/old", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRewrite(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRewrite(%q): got error %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRewrite(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRouteOptions(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index.html")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(roots []string) { staticRoots = roots }(staticRoots)
+	staticRoots = []string{dir}
+
+	tests := []struct {
+		name    string
+		opts    RouteOptions
+		wantErr string
+	}{
+		{name: "empty"},
+		{name: "static", opts: RouteOptions{Dir: dir}},
+		{name: "relative dir", opts: RouteOptions{Dir: "site"}, wantErr: "must be an absolute path"},
+		{name: "missing dir", opts: RouteOptions{Dir: filepath.Join(dir, "missing")}, wantErr: "invalid dir"},
+		{name: "dir is a file", opts: RouteOptions{Dir: file}, wantErr: "is not a directory"},
+		{name: "static with ports", opts: RouteOptions{Dir: dir, ExtraPorts: []int{3001}}, wantErr: "don't apply to static domains"},
+		{name: "route", opts: RouteOptions{Routes: []PathRoute{{Path: "/api/", Port: 4000}}}},
+		{name: "route without slash", opts: RouteOptions{Routes: []PathRoute{{Path: "api", Port: 4000}}}, wantErr: "must start with /"},
+		{name: "route port", opts: RouteOptions{Routes: []PathRoute{{Path: "/api", Port: 70000}}}, wantErr: "invalid port number for route"},
+		{name: "duplicate route", opts: RouteOptions{Routes: []PathRoute{{Path: "/api", Port: 4000}, {Path: "/api/", Port: 4001}}}, wantErr: "listed more than once"},
+		{name: "rewrite", opts: RouteOptions{Rewrites: []Rewrite{{From: "/api/*", To: "/v1/*"}}}},
+		{name: "rewrite without slash", opts: RouteOptions{Rewrites: []Rewrite{{From: "old", To: "/new"}}}, wantErr: "must start with /"},
+		{name: "rewrite wildcard in the middle", opts: RouteOptions{Rewrites: []Rewrite{{From: "/a/*/b", To: "/c"}}}, wantErr: "only allowed at the end"},
+		{name: "rewrite wildcard on one side", opts: RouteOptions{Rewrites: []Rewrite{{From: "/a/*", To: "/b"}}}, wantErr: "both paths or neither"},
+		{name: "extra port", opts: RouteOptions{ExtraPorts: []int{0}}, wantErr: "invalid port number"},
+		{name: "cors", opts: RouteOptions{CORS: []string{"http://localhost:5173"}}},
+		{name: "cors any with others", opts: RouteOptions{CORS: []string{"*", "http://localhost:5173"}}, wantErr: "can't be combined"},
+		{name: "cors without scheme", opts: RouteOptions{CORS: []string{"localhost:5173"}}, wantErr: "invalid cors origin"},
+		{name: "basic auth username", opts: RouteOptions{BasicAuth: []BasicAuthAccount{{Username: "a:b", Password: "x"}}}, wantErr: "invalid basic auth username"},
+		{name: "basic auth password", opts: RouteOptions{BasicAuth: []BasicAuthAccount{{Username: "admin"}}}, wantErr: "has no password"},
+		{name: "health check path", opts: RouteOptions{HealthCheck: &UpstreamCheck{Path: "healthz"}}, wantErr: "must start with /"},
+		{name: "health check interval", opts: RouteOptions{HealthCheck: &UpstreamCheck{Path: "/healthz", Interval: "soon"}}, wantErr: "invalid health check interval"},
+		{name: "timeout", opts: RouteOptions{Timeouts: &ProxyTimeouts{Read: "-1s"}}, wantErr: "invalid read timeout"},
+		{name: "lb policy", opts: RouteOptions{ExtraPorts: []int{3001}, LBPolicy: "least_conn"}},
+		{name: "unknown lb policy", opts: RouteOptions{ExtraPorts: []int{3001}, LBPolicy: "fastest"}, wantErr: "invalid lb policy"},
+		{name: "lb policy with one port", opts: RouteOptions{LBPolicy: "first"}, wantErr: "needs more than one port"},
+		{name: "upstream scheme", opts: RouteOptions{UpstreamScheme: "ftp"}, wantErr: "invalid upstream scheme"},
+		{name: "insecure http upstream", opts: RouteOptions{InsecureUpstream: true}, wantErr: "only applies to https"},
+		{name: "header name", opts: RouteOptions{ResponseHeaders: &HeaderOps{Remove: []string{"X Bad"}}}, wantErr: "invalid header name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRouteOptions(&tt.opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckStaticDir(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	for _, d := range []string{"root/site/dist", "root-other", "outside"} {
+		if err := os.MkdirAll(filepath.Join(base, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(root, "escape")
+	if err := os.Symlink(filepath.Join(base, "outside"), link); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	configDir, err := getConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		roots   []string
+		dir     string
+		wantErr string
+	}{
+		{name: "root", roots: []string{root}, dir: root},
+		{name: "under the root", roots: []string{root}, dir: filepath.Join(root, "site", "dist")},
+		{name: "second root", roots: []string{filepath.Join(base, "outside"), root}, dir: filepath.Join(root, "site")},
+		{name: "outside", roots: []string{root}, dir: filepath.Join(base, "outside"), wantErr: "outside the directories"},
+		{name: "sibling with the root's prefix", roots: []string{root}, dir: filepath.Join(base, "root-other"), wantErr: "outside the directories"},
+		{name: "symlink out of the root", roots: []string{root}, dir: link, wantErr: "outside the directories"},
+		{name: "no roots", dir: root, wantErr: "--static-root"},
+		{name: "config dir", roots: []string{"/"}, dir: configDir, wantErr: "holds the localbase config dir"},
+		{name: "in the config dir", roots: []string{"/"}, dir: filepath.Join(configDir, "hooks"), wantErr: "holds the localbase config dir"},
+		{name: "holding the config dir", roots: []string{"/"}, dir: filepath.Dir(configDir), wantErr: "holds the localbase config dir"},
+	}
+	defer func(roots []string) { staticRoots = roots }(staticRoots)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			staticRoots = tt.roots
+			err := checkStaticDir(tt.dir)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRouteOptionsNormalizes(t *testing.T) {
+	opts := RouteOptions{
+		Routes:         []PathRoute{{Path: "/api/", Port: 4000}},
+		UpstreamScheme: "http",
+		BasicAuth:      []BasicAuthAccount{{Username: "admin", Password: "s3cret"}},
+	}
+	if err := validateRouteOptions(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Routes[0].Path != "/api" {
+		t.Errorf("got route path %q, want /api", opts.Routes[0].Path)
+	}
+	if opts.UpstreamScheme != "" {
+		t.Errorf("got upstream scheme %q, want the http default", opts.UpstreamScheme)
+	}
+	if !strings.HasPrefix(opts.BasicAuth[0].Password, "$2") {
+		t.Errorf("password %q wasn't hashed", opts.BasicAuth[0].Password)
+	}
+}
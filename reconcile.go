@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// reconcileInterval is how often the daemon checks that Caddy still has
+// the routes it added, in case Caddy was restarted or reconfigured.
+const reconcileInterval = 30 * time.Second
+
+// watchReconcile reconciles Caddy's config with the registered domains
+// periodically, as soon as Caddy comes back after being down, and when
+// the machine's addresses change, as routes of domains not exposed to the
+// LAN are limited to them.
+func (lb *LocalBase) watchReconcile(ctx context.Context, cfg *Config) {
+	events := lb.events.subscribe([]string{EventCaddyRestarted, EventIPChanged})
+	defer lb.events.unsubscribe(events)
+
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-lb.rangesChanged:
+		case <-ctx.Done():
+			return
+		}
+		lb.reconcile(cfg)
+	}
+}
+
+// reconcile re-applies the routes of any domain whose Caddy routes are
+// missing or were changed out of band, and deletes routes localbase tagged
+// for domains that are no longer registered. Drift is logged.
+func (lb *LocalBase) reconcile(cfg *Config) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	// Routes by ID, and the server each is in, since a domain's routes
+	// move between servers when it is added again with or without TLS.
+	actual := make(map[string]interface{})
+	errorRoutes := make(map[string]interface{})
+	serverOf := make(map[string]string)
+	for _, serverID := range []string{caddyServerID, caddyHTTPServerID} {
+		var server map[string]interface{}
+		err := caddyRequest(cfg.CaddyAdmin, http.MethodGet, "/id/"+serverID, nil, &server)
+		if err != nil && err != errCaddyNotFound {
+			log.Printf("Error reconciling Caddy config: %v", err)
+			return
+		}
+		routes, _ := server["routes"].([]interface{})
+		for _, r := range routes {
+			if id := caddyID(r); strings.HasPrefix(id, caddyIDPrefix) {
+				actual[id] = r
+				serverOf[id] = serverID
+			}
+		}
+		errs, _ := server["errors"].(map[string]interface{})
+		routes, _ = errs["routes"].([]interface{})
+		for _, r := range routes {
+			if id := caddyID(r); strings.HasPrefix(id, caddyIDPrefix) {
+				errorRoutes[id] = r
+				serverOf[id] = serverID
+			}
+		}
+	}
+
+	for domain, rec := range lb.records {
+		if rec.paused {
+			continue
+		}
+		serverID := caddyRouteServer(&rec.opts)
+		drifted := false
+		if route := buildErrorRoute(rec.hosts, rec.port, &rec.opts); route != nil {
+			id := caddyID(route)
+			if serverOf[id] != serverID || !sameJSON(errorRoutes[id], route) {
+				drifted = true
+			}
+			delete(errorRoutes, id)
+		}
+		if route := buildRedirectRoute(rec.hosts, cfg.httpsPort(), &rec.opts); route != nil {
+			id := caddyID(route)
+			if serverOf[id] != caddyHTTPServerID || !sameJSON(actual[id], route) {
+				drifted = true
+			}
+			delete(actual, id)
+		}
+		for _, r := range buildRoutes(rec.hosts, rec.port, &rec.opts) {
+			id := caddyID(r)
+			if serverOf[id] != serverID || !sameJSON(actual[id], r) {
+				drifted = true
+			}
+			delete(actual, id)
+		}
+		for id := range actual {
+			if strings.HasPrefix(id, caddyIDPrefix+domain+":") {
+				drifted = true
+				delete(actual, id)
+			}
+		}
+		if !drifted {
+			continue
+		}
+
+		log.Printf("Caddy routes for %s are missing or changed, re-applying", domain)
+		if err := addCaddyServerBlock(rec.hosts, rec.port, &rec.opts, cfg); err != nil {
+			log.Printf("Error re-applying Caddy routes for %s: %v", domain, err)
+		}
+	}
+
+	// Whatever is left belongs to domains that aren't registered, such as
+	// those of a previous run.
+	for id := range errorRoutes {
+		actual[id] = errorRoutes[id]
+	}
+	for id := range actual {
+		log.Printf("Removing stale Caddy route %s", id)
+		err := caddyRequest(cfg.CaddyAdmin, http.MethodDelete, "/id/"+id, nil, nil)
+		if err != nil && err != errCaddyNotFound {
+			log.Printf("Error removing stale Caddy route %s: %v", id, err)
+		}
+	}
+}
+
+// sameJSON reports whether actual, decoded from Caddy's JSON, matches
+// want once want is encoded the same way.
+func sameJSON(actual, want interface{}) bool {
+	if actual == nil {
+		return false
+	}
+	data, err := json.Marshal(want)
+	if err != nil {
+		return false
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(actual, decoded)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// resolvePath is how one resolution path answered for a name. Skipped
+// says why the path wasn't tried.
+type resolvePath struct {
+	Path      string   `json:"path"`
+	Addresses []string `json:"addresses,omitempty"`
+	// From is the responder or server that answered.
+	From    string `json:"from,omitempty"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// resolveResult is the result of resolve.
+type resolveResult struct {
+	Name string `json:"name"`
+	// Registered is whether the daemon serves the name, and DaemonRunning
+	// whether it could be asked.
+	Registered    bool          `json:"registered"`
+	DaemonRunning bool          `json:"daemon_running"`
+	Paths         []resolvePath `json:"paths"`
+	// Answered lists the paths that resolved the name.
+	Answered []string `json:"answered"`
+}
+
+func resolveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "resolve <domain>",
+		Args:  rangeArgs(1, 1, "usage: localbase resolve <domain>"),
+		Short: "Show how a domain resolves on this machine",
+		Long: `Resolve a domain every way localbase makes it resolvable: an mDNS query, a
+query to localbase's DNS server, a hosts file lookup, and the OS resolver
+that browsers use. Each path is reported with the addresses it answered,
+who answered and how long it took, or why it failed. It exits 1 if no path
+resolves the domain.`,
+		// A domain that doesn't resolve is not a usage error.
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			if timeout <= 0 {
+				return usageErrorf("--timeout must be positive")
+			}
+			cfg, err := readConfig()
+			if err != nil {
+				return fmt.Errorf("failed to read config: %v", err)
+			}
+
+			name := qualifyDomain(args[0], cfg.suffix())
+			if name == "" {
+				return usageErrorf("usage: localbase resolve <domain>")
+			}
+			result := resolveDomain(name, cfg, timeout)
+
+			var d Domain
+			err = call("get", &GetParams{Domain: name}, &d)
+			result.DaemonRunning = exitCode(err) != ExitDaemonNotRunning
+			result.Registered = err == nil
+
+			if err := printResult(cmd, result, func() { printResolve(result) }); err != nil {
+				return err
+			}
+			if len(result.Answered) == 0 {
+				return fmt.Errorf("%s doesn't resolve", name)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Duration("timeout", 2*time.Second, "how long to wait for each path to answer")
+	return cmd
+}
+
+// resolveDomain tries every resolution path for name at once.
+func resolveDomain(name string, cfg *Config, timeout time.Duration) *resolveResult {
+	lookups := []func(string, *Config, time.Duration) resolvePath{
+		resolveMDNS, resolveDNSServer, resolveHostsFile, resolveOS,
+	}
+	result := &resolveResult{Name: name, Paths: make([]resolvePath, len(lookups)), Answered: []string{}}
+	var wg sync.WaitGroup
+	for i, lookup := range lookups {
+		wg.Add(1)
+		go func(i int, lookup func(string, *Config, time.Duration) resolvePath) {
+			defer wg.Done()
+			result.Paths[i] = lookup(name, cfg, timeout)
+		}(i, lookup)
+	}
+	wg.Wait()
+	for _, p := range result.Paths {
+		if len(p.Addresses) > 0 {
+			result.Answered = append(result.Answered, p.Path)
+		}
+	}
+	return result
+}
+
+// resolveMDNS sends a one-shot mDNS query for name on every multicast
+// interface, taking the first answer.
+func resolveMDNS(name string, cfg *Config, timeout time.Duration) resolvePath {
+	p := resolvePath{Path: "mdns"}
+	if !strings.HasSuffix(name, ".local") {
+		p.Skipped = "only .local names resolve over mdns"
+		return p
+	}
+
+	query := new(dns.Msg)
+	query.Question = []dns.Question{
+		{Name: dns.Fqdn(name), Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: dns.Fqdn(name), Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+
+	// As with discover, the query comes from an ephemeral port, so the
+	// answer comes back unicast.
+	var conns []net.PacketConn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	start := time.Now()
+	if c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero}); err == nil {
+		conns = append(conns, c)
+		pc := ipv4.NewPacketConn(c)
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+				pc.WriteTo(packet, &ipv4.ControlMessage{IfIndex: iface.Index}, mdnsGroupIPv4)
+			}
+		}
+	}
+	if c, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified}); err == nil {
+		conns = append(conns, c)
+		pc := ipv6.NewPacketConn(c)
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+				pc.WriteTo(packet, &ipv6.ControlMessage{IfIndex: iface.Index}, mdnsGroupIPv6)
+			}
+		}
+	}
+	if len(conns) == 0 {
+		p.Error = "failed to open a socket for mdns"
+		return p
+	}
+
+	answered := make(chan resolvePath, len(conns))
+	deadline := start.Add(timeout)
+	for _, c := range conns {
+		c.SetReadDeadline(deadline)
+		go func(c net.PacketConn) {
+			buf := make([]byte, 9000)
+			for {
+				n, src, err := c.ReadFrom(buf)
+				if err != nil {
+					answered <- p
+					return
+				}
+				var msg dns.Msg
+				if msg.Unpack(buf[:n]) != nil || !msg.Response {
+					continue
+				}
+				got := p
+				got.Addresses = answerAddrs(&msg, name)
+				if len(got.Addresses) > 0 {
+					got.From = src.(*net.UDPAddr).IP.String()
+					got.Latency = roundLatency(time.Since(start))
+					answered <- got
+					return
+				}
+			}
+		}(c)
+	}
+	for range conns {
+		if got := <-answered; len(got.Addresses) > 0 {
+			return got
+		}
+	}
+	p.Error = fmt.Sprintf("no answer within %s", timeout)
+	return p
+}
+
+// resolveDNSServer asks localbase's DNS server, if it is configured.
+func resolveDNSServer(name string, cfg *Config, timeout time.Duration) resolvePath {
+	p := resolvePath{Path: "dns"}
+	if cfg.DNSAddress == "" {
+		p.Skipped = "the dns server is off, start localbase with --dns"
+		return p
+	}
+	host, port, err := net.SplitHostPort(cfg.DNSAddress)
+	if err != nil {
+		p.Error = fmt.Sprintf("invalid dns address %s: %v", cfg.DNSAddress, err)
+		return p
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	p.From = net.JoinHostPort(host, port)
+
+	client := &dns.Client{Timeout: timeout}
+	start := time.Now()
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(name), qtype)
+		resp, _, err := client.Exchange(query, p.From)
+		if err != nil {
+			p.Error = err.Error()
+			return p
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			p.Error = dns.RcodeToString[resp.Rcode]
+			return p
+		}
+		p.Addresses = append(p.Addresses, answerAddrs(resp, name)...)
+	}
+	if len(p.Addresses) == 0 {
+		p.Error = "no addresses"
+		return p
+	}
+	p.Latency = roundLatency(time.Since(start))
+	return p
+}
+
+// resolveHostsFile looks name up in the hosts file localbase writes to.
+func resolveHostsFile(name string, cfg *Config, timeout time.Duration) resolvePath {
+	path := cfg.HostsFile
+	if path == "" {
+		path = defaultHostsFile()
+	}
+	p := resolvePath{Path: "hosts", From: path}
+
+	start := time.Now()
+	f, err := os.Open(path)
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, host := range fields[1:] {
+			if strings.EqualFold(strings.TrimSuffix(host, "."), name) {
+				p.Addresses = appendUnique(p.Addresses, fields[0])
+			}
+		}
+	}
+	if len(p.Addresses) == 0 {
+		p.Error = "not listed"
+		return p
+	}
+	p.Latency = roundLatency(time.Since(start))
+	return p
+}
+
+// resolveOS resolves name the way other programs on this machine do.
+func resolveOS(name string, cfg *Config, timeout time.Duration) resolvePath {
+	p := resolvePath{Path: "os"}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	p.Latency = roundLatency(time.Since(start))
+	for _, a := range addrs {
+		p.Addresses = append(p.Addresses, a.IP.String())
+	}
+	return p
+}
+
+// answerAddrs returns the addresses msg has for name.
+func answerAddrs(msg *dns.Msg, name string) []string {
+	var addrs []string
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		if !strings.EqualFold(strings.TrimSuffix(rr.Header().Name, "."), name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = appendUnique(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = appendUnique(addrs, rr.AAAA.String())
+		}
+	}
+	return addrs
+}
+
+func roundLatency(d time.Duration) string {
+	return d.Round(100 * time.Microsecond).String()
+}
+
+func printResolve(result *resolveResult) {
+	fmt.Println(result.Name)
+	switch {
+	case !result.DaemonRunning:
+		fmt.Println("  daemon: not running")
+	case result.Registered:
+		fmt.Println("  daemon: registered")
+	default:
+		fmt.Println("  daemon: not registered")
+	}
+	for _, p := range result.Paths {
+		fmt.Printf("  %s: ", p.Path)
+		switch {
+		case p.Skipped != "":
+			fmt.Printf("skipped, %s\n", p.Skipped)
+		case len(p.Addresses) > 0:
+			fmt.Print(strings.Join(p.Addresses, ", "))
+			if p.From != "" {
+				fmt.Printf(" from %s", p.From)
+			}
+			fmt.Printf(" in %s\n", p.Latency)
+		default:
+			fmt.Printf("failed, %s\n", p.Error)
+		}
+	}
+	if len(result.Answered) > 0 {
+		fmt.Printf("Resolved by: %s\n", strings.Join(result.Answered, ", "))
+		return
+	}
+	switch {
+	case !result.DaemonRunning:
+		fmt.Println("Hint: start localbase with localbase start")
+	case !result.Registered:
+		fmt.Printf("Hint: add it with localbase add %s --port <port>\n", result.Name)
+	case strings.HasSuffix(result.Name, ".local"):
+		fmt.Println("Hint: nothing answered over mdns, check that a firewall allows udp port 5353")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// resolverMarker heads every resolver config file localbase writes, so it
+// never overwrites or removes one it didn't write.
+const resolverMarker = "# managed by localbase, removed when it stops"
+
+const (
+	// macResolverDir holds a file per domain naming the nameserver macOS
+	// sends the domain's queries to.
+	macResolverDir = "/etc/resolver"
+	// resolvedDropIn is the systemd-resolved config localbase installs.
+	resolvedDropIn = "/etc/systemd/resolved.conf.d/localbase.conf"
+)
+
+// resolverDomains returns the domains the DNS server answers for: the DNS
+// TLDs, and the default suffix unless mDNS or loopback already covers it.
+func resolverDomains(cfg *Config) []string {
+	var domains []string
+	for _, tld := range cfg.DNSTLDs {
+		domains = appendUnique(domains, strings.Trim(tld, "."))
+	}
+	if suffix := cfg.suffix(); suffix != "local" && suffix != "localhost" && !strings.HasSuffix(suffix, ".localhost") {
+		domains = appendUnique(domains, suffix)
+	}
+	return domains
+}
+
+// installResolver points the system resolver at the DNS server at addr for
+// domains, returning a func that undoes it.
+func installResolver(addr string, domains []string) (func(), error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns address %s: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		return installMacResolver(host, port, domains)
+	case "linux":
+		return installResolvedDropIn(host, port, domains)
+	default:
+		return nil, fmt.Errorf("not supported on %s", runtime.GOOS)
+	}
+}
+
+// installMacResolver writes a file to /etc/resolver for each domain. A
+// domain that already has a file localbase didn't write is left alone.
+func installMacResolver(host, port string, domains []string) (func(), error) {
+	if err := os.MkdirAll(macResolverDir, 0755); err != nil {
+		return nil, resolverError(macResolverDir, err)
+	}
+
+	var written []string
+	undo := func() {
+		for _, path := range written {
+			removeResolverFile(path)
+		}
+	}
+	content := fmt.Sprintf("%s\nnameserver %s\nport %s\n", resolverMarker, host, port)
+	for _, domain := range domains {
+		path := filepath.Join(macResolverDir, domain)
+		if data, err := os.ReadFile(path); err == nil && !strings.HasPrefix(string(data), resolverMarker) {
+			log.Printf("Warning: %s exists and wasn't written by localbase, leaving it alone", path)
+			continue
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			undo()
+			return nil, resolverError(path, err)
+		}
+		written = append(written, path)
+	}
+	return undo, nil
+}
+
+// installResolvedDropIn has systemd-resolved route queries for domains to
+// the DNS server, with a drop-in config naming it as a DNS server for
+// those domains only.
+func installResolvedDropIn(host, port string, domains []string) (func(), error) {
+	if _, err := os.Stat("/run/systemd/resolve"); err != nil {
+		return nil, fmt.Errorf("systemd-resolved isn't running")
+	}
+	if data, err := os.ReadFile(resolvedDropIn); err == nil && !strings.HasPrefix(string(data), resolverMarker) {
+		return nil, fmt.Errorf("%s exists and wasn't written by localbase", resolvedDropIn)
+	}
+
+	routes := make([]string, len(domains))
+	for i, domain := range domains {
+		routes[i] = "~" + domain
+	}
+	content := fmt.Sprintf("%s\n[Resolve]\nDNS=%s\nDomains=%s\n", resolverMarker, net.JoinHostPort(host, port), strings.Join(routes, " "))
+
+	if err := os.MkdirAll(filepath.Dir(resolvedDropIn), 0755); err != nil {
+		return nil, resolverError(filepath.Dir(resolvedDropIn), err)
+	}
+	if err := os.WriteFile(resolvedDropIn, []byte(content), 0644); err != nil {
+		return nil, resolverError(resolvedDropIn, err)
+	}
+	if err := reloadResolved(); err != nil {
+		os.Remove(resolvedDropIn)
+		return nil, err
+	}
+	return func() {
+		removeResolverFile(resolvedDropIn)
+		if err := reloadResolved(); err != nil {
+			log.Printf("Error reloading systemd-resolved: %v", err)
+		}
+	}, nil
+}
+
+func reloadResolved() error {
+	out, err := exec.Command("systemctl", "reload-or-restart", "systemd-resolved").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to reload systemd-resolved: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// removeResolverFile removes the resolver config at path if localbase
+// wrote it.
+func removeResolverFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.HasPrefix(string(data), resolverMarker) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Error removing %s: %v", path, err)
+	}
+}
+
+func resolverError(path string, err error) error {
+	if os.IsPermission(err) {
+		return fmt.Errorf("writing %s requires root, start localbase with sudo or pass --resolver=false", path)
+	}
+	return err
+}
@@ -0,0 +1,882 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/noelukwa/localbase/pkg/client"
+)
+
+func run(cfg *Config) {
+
+	caddyClient.Timeout = cfg.CaddyTimeout.orDefault(defaultCaddyTimeout)
+	caddyOrigin = cfg.CaddyOrigin
+	includeInterfaces, excludeInterfaces = cfg.Interfaces, cfg.ExcludeInterfaces
+	reflectInterfaces = cfg.MDNSReflect
+	staticRoots = cfg.StaticRoots
+	if wd, err := os.Getwd(); err == nil && len(staticRoots) == 0 && filepath.Dir(wd) != wd {
+		// A daemon started as a service runs in /, which would allow
+		// every directory.
+		staticRoots = []string{wd}
+	}
+	networkPolicies = cfg.Networks
+	if cfg.DefaultNetworkPolicy != "" {
+		defaultNetworkPolicy = cfg.DefaultNetworkPolicy
+	}
+	caddyProc, err := startManagedCaddy(cfg.CaddyAdmin)
+	if err != nil {
+		log.Fatalf("failed to ensure Caddy is running: %v", err)
+	}
+	if err := ensureCaddyRunning(cfg.CaddyAdmin, caddyClient.Timeout); err != nil {
+		if caddyProc != nil {
+			caddyProc.Process.Kill()
+		}
+		log.Fatalf("failed to ensure Caddy is running: %v", err)
+	}
+
+	lb := NewLocalBase()
+	lb.requireAuth = cfg.RequireAuth
+	lb.suffix = cfg.suffix()
+	if version, err := detectCaddyVersion(); err != nil {
+		log.Printf("Warning: couldn't detect the Caddy version, not checking compatibility: %v", err)
+	} else if version.less(minCaddyVersion) {
+		log.Fatalf("caddy %s is too old, localbase needs caddy %s or later; upgrade caddy, e.g. with localbase caddy install --force", version, minCaddyVersion)
+	} else {
+		log.Printf("Caddy version: %s", version)
+		lb.caddyVersion = version
+	}
+	mdnsMode := cfg.MDNS
+	if mdnsMode == "" || mdnsMode == "auto" {
+		// Where avahi-daemon runs it owns the mDNS port, so names are
+		// registered with it rather than answered by a second responder.
+		// Network policies and reflection need the builtin responder.
+		mdnsMode = "builtin"
+		if len(cfg.Networks) == 0 && cfg.DefaultNetworkPolicy != networkPublic && len(cfg.MDNSReflect) == 0 && avahiRunning() {
+			mdnsMode = "avahi"
+		}
+	}
+	switch mdnsMode {
+	case "off":
+		log.Println("mdns: off, .local names resolve only through the hosts file or dns server")
+	case "native":
+		native, err := newNativeMDNS()
+		if err != nil {
+			log.Fatalf("failed to start native mdns: %v", err)
+		}
+		lb.mdns = native
+		log.Println("mdns: advertising through the system's responder")
+	case "avahi":
+		avahi, err := newAvahiMDNS()
+		if err != nil {
+			log.Fatalf("failed to register with avahi: %v", err)
+		}
+		lb.mdns = avahi
+		log.Println("mdns: advertising through avahi-daemon")
+	default:
+		if responder, err := newMDNSResponder(cfg.MDNSTTL.orDefault(defaultMDNSTTL)); err != nil {
+			log.Printf("Warning: mdns responder disabled, .local names won't resolve: %v", err)
+		} else {
+			responder.onConflict = func(name, from string) {
+				lb.events.publish(Event{Type: EventNameConflict, Domain: name, IP: from})
+			}
+			responder.serve()
+			lb.mdns = responder
+			if names := responder.interfaceNames(); names != "" {
+				log.Printf("mdns: answering on %s", names)
+			} else {
+				log.Println("mdns: no interface to answer on yet")
+			}
+		}
+	}
+	if cfg.LLMNR {
+		if responder, err := newLLMNRResponder(lb); err != nil {
+			log.Printf("Warning: llmnr responder disabled: %v", err)
+		} else {
+			responder.serve()
+			defer responder.close()
+			lb.llmnr = responder
+			log.Printf("llmnr: answering on %s", responder.interfaceNames())
+		}
+	}
+	// Clears out routes left in Caddy by a previous run.
+	lb.reconcile(cfg)
+
+	if cfg.HostsFile != "" {
+		if err := lb.UseHostsFile(cfg.HostsFile); err != nil {
+			log.Fatalf("failed to enable hosts file backend: %v", err)
+		}
+		log.Println("managing hosts file", cfg.HostsFile)
+	}
+
+	listener, err := listenAdmin(cfg)
+	if err != nil {
+		log.Fatalf("failed to start localbase server: %v", err)
+	}
+	defer listener.Close()
+
+	if path, err := getAuditFile(); err != nil {
+		log.Printf("audit log disabled: %v", err)
+	} else if lb.audit, err = openAuditLog(path, lb.suffix); err != nil {
+		log.Printf("audit log disabled: %v", err)
+	}
+	defer lb.audit.Close()
+
+	if err := writePIDFile(); err != nil {
+		log.Fatalf("failed to write pid file: %v", err)
+	}
+	defer removePIDFile()
+
+	_, address := cfg.adminAddr()
+	log.Println("localBase server started. listening on", address)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go lb.watchIP(ctx, cfg.MDNSRefreshInterval.orDefault(defaultMDNSRefreshInterval))
+	go lb.watchUpstreams(ctx)
+	go lb.watchCaddy(ctx, cfg.CaddyAdmin)
+	go lb.watchReconcile(ctx, cfg)
+	go lb.deliverWebhooks(ctx)
+
+	if cfg.DockerDiscovery {
+		go newDockerWatcher(lb).Run(ctx)
+		log.Println("docker discovery enabled")
+	}
+
+	if cfg.DNSAddress != "" {
+		var forwarder *dnsForwarder
+		if !cfg.DisableDNSForward {
+			forwarder = newDNSForwarder(cfg.DNSAddress, cfg.DNSUpstreams)
+		}
+		dnsSrv := newDNSServer(lb, cfg.DNSAddress, cfg.DNSTLDs, forwarder)
+		dnsSrv.Start()
+		defer dnsSrv.Shutdown()
+
+		log.Println("localbase dns listening on", cfg.DNSAddress)
+		switch {
+		case forwarder == nil:
+		case len(cfg.DNSUpstreams) > 0:
+			log.Printf("dns forwards other names to %s", strings.Join(cfg.DNSUpstreams, ", "))
+		default:
+			log.Println("dns forwards other names to the system's resolvers")
+		}
+		domains := resolverDomains(cfg)
+		var undo func()
+		if !cfg.DisableResolver {
+			if undo, err = installResolver(cfg.DNSAddress, domains); err != nil {
+				log.Printf("Warning: failed to configure the system resolver: %v", err)
+			}
+		}
+		if undo != nil {
+			defer undo()
+			log.Printf("system resolver sends .%s queries to localbase dns", strings.Join(domains, ", ."))
+		} else {
+			for _, domain := range domains {
+				log.Printf("to resolve .%s domains, %s", domain, resolverHint(cfg.DNSAddress, domain))
+			}
+		}
+	}
+
+	var api *http.Server
+	if cfg.APIAddress != "" {
+		api = &http.Server{
+			Addr:    cfg.APIAddress,
+			Handler: newAPIHandler(lb, cfg.CORSOrigins),
+			// Ends event streams, which never finish on their own, once
+			// the daemon starts shutting down.
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		}
+		go func() {
+			log.Println("localbase api listening on", cfg.APIAddress)
+			if err := api.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("api server error: %v", err)
+			}
+		}()
+		defer api.Close()
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		sig := <-c
+		lb.audit.record(&AuditEntry{Client: "signal " + sig.String(), Action: "shutdown", Outcome: "ok"})
+		cancel()
+	}()
+
+	doneChan := make(chan struct{})
+	var stopOnce sync.Once
+	srv := &adminServer{
+		lb:             lb,
+		limiter:        newClientLimiter(cfg.RateLimit, cfg.MaxClientConns),
+		readTimeout:    cfg.ReadTimeout.orDefault(defaultReadTimeout),
+		maxMessageSize: cfg.MaxMessageSize,
+		stop: func() {
+			stopOnce.Do(func() { close(doneChan) })
+		},
+		conns: make(map[net.Conn]bool),
+	}
+	if srv.maxMessageSize <= 0 {
+		srv.maxMessageSize = defaultMaxMessageSize
+	}
+	connections := make(chan net.Conn)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					log.Printf("error accepting connection: %v\n", err)
+					continue
+				}
+			}
+
+			select {
+			case connections <- conn:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case conn := <-connections:
+			go srv.handleConnection(conn)
+		case <-doneChan:
+			cancel()
+		case <-ctx.Done():
+			log.Println("shutting down localbase")
+
+			// Stop taking requests and let in-flight ones finish before
+			// tearing anything down.
+			listener.Close()
+			drainTimeout := cfg.DrainTimeout.orDefault(defaultDrainTimeout)
+			if n := srv.drain(drainTimeout); n > 0 {
+				log.Printf("Warning: %d requests still running after %s, shutting down anyway", n, drainTimeout)
+			}
+			if api != nil {
+				shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), drainTimeout)
+				api.Shutdown(shutdownCtx)
+				cancelShutdown()
+			}
+
+			lb.Shutdown()
+			srv.closeAll()
+			if caddyProc != nil {
+				stopManagedCaddy(caddyProc)
+			}
+			return
+		}
+	}
+}
+
+// adminServer serves the admin protocol, tracking open connections and
+// in-flight requests so shutdown can drain them.
+type adminServer struct {
+	lb          *LocalBase
+	limiter     *clientLimiter
+	readTimeout time.Duration
+	// maxMessageSize bounds each request and response line.
+	maxMessageSize int
+	stop           func()
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	requests int
+	draining bool
+	drained  chan struct{}
+}
+
+// track registers conn, reporting false once the server is draining.
+func (s *adminServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *adminServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// begin marks a request as in flight, reporting false once the server is
+// draining.
+func (s *adminServer) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	s.requests++
+	return true
+}
+
+func (s *adminServer) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests--
+	if s.draining && s.requests == 0 {
+		close(s.drained)
+	}
+}
+
+// drain stops reading new requests and waits up to timeout for in-flight
+// ones to finish. It returns how many are still running.
+func (s *adminServer) drain(timeout time.Duration) int {
+	s.mu.Lock()
+	s.draining = true
+	s.drained = make(chan struct{})
+	if s.requests == 0 {
+		close(s.drained)
+	}
+	for conn := range s.conns {
+		// Unblock reads so idle connections stop waiting for requests.
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.drained:
+	case <-time.After(timeout):
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// closeAll closes every open connection.
+func (s *adminServer) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// handleConnection serves requests from conn until the client hangs up.
+// Requests are served concurrently and answered as they complete, so
+// clients match responses to requests by ID. A connection whose first
+// request is subscribe is dedicated to streaming events instead.
+func (s *adminServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+
+	lb, limiter, readTimeout := s.lb, s.limiter, s.readTimeout
+	key := clientKey(conn)
+	if !limiter.connect(key) {
+		log.Printf("Warning: rejecting connection from %s, too many open connections", key)
+		// Answer the first request rather than closing on it unread, which
+		// would reset the connection before the client saw the error.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		msg, framed, _ := client.ReadMessage(bufio.NewReader(conn), s.maxMessageSize)
+		data, _ := json.Marshal(Response{
+			JSONRPC: protocolVersion,
+			ID:      requestID(msg),
+			Error:   newRPCError(errorf(CodeRateLimited, "too many open connections")),
+		})
+		client.WriteMessage(conn, data, framed)
+		return
+	}
+	defer limiter.disconnect(key)
+
+	// Each message is a line or framed, see client.ReadMessage, and is
+	// answered the same way. Requests and line responses are bounded by
+	// maxMessageSize, while framed responses are streamed in chunks of
+	// any total size.
+	r := bufio.NewReader(conn)
+
+	var mu sync.Mutex
+	write := func(v interface{}, framed bool) {
+		data, err := json.Marshal(v)
+		if err == nil && !framed && len(data) >= s.maxMessageSize {
+			data, err = json.Marshal(tooLargeResponse(v, s.maxMessageSize))
+		}
+		if err != nil {
+			log.Printf("error encoding response: %v", err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err := client.WriteMessage(conn, data, framed); err != nil {
+			log.Printf("error writing response: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	inFlight := make(chan struct{}, maxInFlight)
+
+	peer := describeClient(conn)
+	for first := true; ; first = false {
+		// Idle connections are closed once readTimeout passes without a
+		// request.
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		msg, framed, err := client.ReadMessage(r, s.maxMessageSize)
+		if errors.Is(err, client.ErrMessageTooLarge) {
+			write(Response{
+				JSONRPC: protocolVersion,
+				Error:   newRPCError(errorf(CodeInvalidRequest, "request exceeds the %d byte message limit", s.maxMessageSize)),
+			}, framed)
+			// The rest of a framed request was skipped, but a line can't
+			// be told apart from the next.
+			if framed {
+				continue
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		if req, ok := subscribeRequest(msg); ok && first {
+			serveSubscription(conn, lb, req, framed)
+			return
+		}
+
+		if !limiter.allow(key) {
+			write(Response{
+				JSONRPC: protocolVersion,
+				ID:      requestID(msg),
+				Error:   newRPCError(errorf(CodeRateLimited, "rate limit exceeded, slow down")),
+			}, framed)
+			continue
+		}
+
+		if !s.begin() {
+			write(Response{
+				JSONRPC: protocolVersion,
+				ID:      requestID(msg),
+				Error:   newRPCError(errorf(CodeInternal, "daemon is shutting down")),
+			}, framed)
+			return
+		}
+
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.end()
+			defer func() { <-inFlight }()
+
+			out, stopping := serveLine(lb, peer, msg)
+			write(out, framed)
+
+			// Stop only once the response is written so the client isn't
+			// left reading from a connection closed by shutdown.
+			if stopping {
+				s.stop()
+			}
+		}()
+	}
+}
+
+// tooLargeResponse replaces resp, a Response or a batch of them, with an
+// error for each request, keeping their IDs so clients can match them.
+func tooLargeResponse(resp interface{}, limit int) interface{} {
+	tooLarge := func(id json.RawMessage) Response {
+		return Response{
+			JSONRPC: protocolVersion,
+			ID:      id,
+			Error:   newRPCError(errorf(CodeInvalidRequest, "response exceeds the %d byte message limit, page through list with a limit", limit)),
+		}
+	}
+	switch resp := resp.(type) {
+	case Response:
+		return tooLarge(resp.ID)
+	case []Response:
+		out := make([]Response, len(resp))
+		for i, r := range resp {
+			out[i] = tooLarge(r.ID)
+		}
+		return out
+	}
+	return tooLarge(nil)
+}
+
+// requestID returns the ID of the request in line, if it has one.
+func requestID(line []byte) json.RawMessage {
+	var req Request
+	json.Unmarshal(line, &req)
+	return req.ID
+}
+
+// serveLine serves a single request or a batch, reporting whether it
+// included a successful stop request.
+func serveLine(lb *LocalBase, client string, line []byte) (interface{}, bool) {
+	if line[0] != '[' {
+		return serveRaw(lb, client, line)
+	}
+
+	// A batch: every request gets a response, in order.
+	var batch []json.RawMessage
+	if err := json.Unmarshal(line, &batch); err != nil {
+		return parseErrorResponse(err), false
+	}
+	if len(batch) == 0 {
+		return Response{JSONRPC: protocolVersion, Error: newRPCError(errorf(CodeInvalidRequest, "empty batch"))}, false
+	}
+
+	var stopping bool
+	responses := make([]Response, len(batch))
+	for i, raw := range batch {
+		var stop bool
+		responses[i], stop = serveRaw(lb, client, raw)
+		stopping = stopping || stop
+	}
+	return responses, stopping
+}
+
+// serveRaw decodes and serves a single request, reporting whether it was a
+// successful stop request.
+func serveRaw(lb *LocalBase, client string, raw []byte) (Response, bool) {
+	var req Request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return parseErrorResponse(err), false
+	}
+	req.client = client
+	resp := Response{JSONRPC: protocolVersion, ID: req.ID}
+	resp.Result, resp.Error = serveRPC(lb, &req)
+	return resp, req.Method == "stop" && resp.Error == nil
+}
+
+// subscribeRequest reports whether line is a subscribe request.
+func subscribeRequest(line []byte) (*Request, bool) {
+	var req Request
+	if err := json.Unmarshal(line, &req); err != nil || req.Method != "subscribe" {
+		return nil, false
+	}
+	return &req, true
+}
+
+// serveSubscription acknowledges a subscribe request and then streams
+// events to conn as JSON-RPC notifications until the client disconnects
+// or the daemon shuts down. Messages are framed if the request was.
+func serveSubscription(conn net.Conn, lb *LocalBase, req *Request, framed bool) {
+	send := func(v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return client.WriteMessage(conn, data, framed)
+	}
+	resp := Response{JSONRPC: protocolVersion, ID: req.ID}
+
+	var params SubscribeParams
+	if req.JSONRPC != "" && req.JSONRPC != protocolVersion {
+		resp.Error = newRPCError(errorf(CodeInvalidRequest, "unsupported protocol version %q", req.JSONRPC))
+	} else if err := lb.authorize(req); err != nil {
+		resp.Error = newRPCError(err)
+	} else if len(req.Params) > 0 {
+		if err := decodeParams(req, &params); err != nil {
+			resp.Error = newRPCError(err)
+		}
+	}
+	if resp.Error != nil {
+		send(resp)
+		return
+	}
+
+	// Subscribers stay connected without sending anything.
+	conn.SetReadDeadline(time.Time{})
+
+	events := lb.events.subscribe(params.Events)
+	defer lb.events.unsubscribe(events)
+
+	resp.Result = json.RawMessage(`{"subscribed":true}`)
+	if err := send(resp); err != nil {
+		return
+	}
+
+	// The client sends nothing more, so a read only returns once it hangs
+	// up.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if !req.inScope(ev.Domain) {
+				continue
+			}
+			if err := send(&Notification{JSONRPC: protocolVersion, Method: "event", Params: ev}); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func parseErrorResponse(err error) Response {
+	resp := Response{JSONRPC: protocolVersion, Error: newRPCError(errorf(CodeInvalidRequest, "invalid request: %v", err))}
+	resp.Error.Code = rpcParseError
+	return resp
+}
+
+// serveRPC checks the protocol version of req and dispatches it. Requests
+// from clients predating JSON-RPC carry no version and are still served.
+func serveRPC(lb *LocalBase, req *Request) (json.RawMessage, *RPCError) {
+	if req.JSONRPC != "" && req.JSONRPC != protocolVersion {
+		return nil, newRPCError(errorf(CodeInvalidRequest, "unsupported protocol version %q", req.JSONRPC))
+	}
+	result, err := dispatch(lb, req)
+	if err != nil {
+		return nil, newRPCError(err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, newRPCError(err)
+	}
+	return data, nil
+}
+
+// dispatch serves req, recording changes to the daemon in the audit log.
+func dispatch(lb *LocalBase, req *Request) (interface{}, error) {
+	if err := lb.authorize(req); err != nil {
+		lb.audit.auditRequest(req, nil, err)
+		return nil, err
+	}
+	result, err := serveMethod(lb, req)
+	lb.audit.auditRequest(req, result, err)
+	return result, err
+}
+
+func serveMethod(lb *LocalBase, req *Request) (interface{}, error) {
+	switch req.Method {
+	case "hello":
+		var params HelloParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return negotiate(&params)
+	case "add":
+		var params AddParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		if params.Domain == "" {
+			return nil, errorf(CodeInvalidRequest, "domain is required")
+		}
+		switch {
+		case params.Dir != "" && params.Port != 0:
+			return nil, errorf(CodeInvalidRequest, "a domain serves either a port or a dir, not both")
+		case params.Dir == "" && (params.Port <= 0 || params.Port > 65535):
+			return nil, errorf(CodeInvalidRequest, "invalid port number: %d", params.Port)
+		}
+		seen := map[int]bool{params.Port: true}
+		for _, port := range params.ExtraPorts {
+			if seen[port] {
+				return nil, errorf(CodeInvalidRequest, "port %d is listed more than once", port)
+			}
+			seen[port] = true
+		}
+		if err := validateDomainInfo(&params.DomainInfo); err != nil {
+			return nil, err
+		}
+		if err := validateRouteOptions(&params.RouteOptions); err != nil {
+			return nil, err
+		}
+		if err := lb.checkCaddySupport(&params.RouteOptions); err != nil {
+			return nil, err
+		}
+		d, err := lb.Add(&params)
+		if err == nil {
+			lb.journalChange("add", d, 0)
+		}
+		return d, err
+	case "pause", "resume":
+		var params PauseParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		if params.Domain == "" {
+			return nil, errorf(CodeInvalidRequest, "domain is required")
+		}
+		change := lb.Resume
+		if req.Method == "pause" {
+			change = lb.Pause
+		}
+		d, err := change(params.Domain)
+		if err == nil {
+			lb.journalChange(req.Method, d, 0)
+		}
+		return d, err
+	case "update":
+		var params UpdateParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		if params.Domain == "" {
+			return nil, errorf(CodeInvalidRequest, "domain is required")
+		}
+		if params.Port <= 0 || params.Port > 65535 {
+			return nil, errorf(CodeInvalidRequest, "invalid port number: %d", params.Port)
+		}
+		before, err := lb.Get(params.Domain)
+		if err != nil {
+			return nil, err
+		}
+		d, err := lb.Update(&params)
+		if err == nil {
+			lb.journalChange("update", d, before.Port)
+		}
+		return d, err
+	case "remove":
+		var params RemoveParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		if params.Domain == "" {
+			return nil, errorf(CodeInvalidRequest, "domain is required")
+		}
+		d, err := lb.Remove(params.Domain)
+		if err == nil {
+			lb.journalChange("remove", d, 0)
+		}
+		return d, err
+	case "undo":
+		return lb.Undo()
+	case "history":
+		return lb.History(), nil
+	case "get":
+		var params GetParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		if params.Domain == "" {
+			return nil, errorf(CodeInvalidRequest, "domain is required")
+		}
+		d, err := lb.Get(params.Domain)
+		if err != nil {
+			return nil, err
+		}
+		domains := []Domain{*d}
+		addUpstreamStatus(domains)
+		return &domains[0], nil
+	case "share":
+		var params ShareParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		if params.Domain == "" {
+			return nil, errorf(CodeInvalidRequest, "domain is required")
+		}
+		return lb.Share(params.Domain)
+	case "list":
+		var params ListParams
+		if len(req.Params) > 0 {
+			if err := decodeParams(req, &params); err != nil {
+				return nil, err
+			}
+		}
+		if params.Limit < 0 {
+			return nil, errorf(CodeInvalidRequest, "invalid limit: %d", params.Limit)
+		}
+		page := listPage(req.scoped(lb.List()), &params)
+		addUpstreamStatus(page.Domains)
+		return page, nil
+	case "status":
+		return lb.Status()
+	case "health":
+		return lb.Health()
+	case "stop":
+		return nil, nil
+	case "subscribe":
+		return nil, errorf(CodeInvalidRequest, "subscribe must be the only request on its connection")
+	default:
+		return nil, errorf(CodeInvalidRequest, "unknown method %q", req.Method)
+	}
+}
+
+// listPage returns the page of domains, which are sorted by name, after
+// params.Cursor.
+func listPage(domains []Domain, params *ListParams) *ListResult {
+	start := sort.Search(len(domains), func(i int) bool {
+		return domains[i].Domain > params.Cursor
+	})
+	domains = domains[start:]
+
+	result := &ListResult{Domains: domains}
+	if params.Limit > 0 && len(domains) > params.Limit {
+		result.Domains = domains[:params.Limit]
+		result.Next = result.Domains[params.Limit-1].Domain
+	}
+	return result
+}
+
+// negotiate picks the highest protocol version supported by both the
+// client and the daemon, along with the features both support. Clients
+// that list no features get every feature the daemon has.
+func negotiate(params *HelloParams) (*HelloResult, error) {
+	version := 0
+	for _, v := range params.Versions {
+		if v >= minProtocolVersion && v <= maxProtocolVersion && v > version {
+			version = v
+		}
+	}
+	if version == 0 {
+		return nil, errorf(CodeInvalidRequest, "no common protocol version, daemon supports %d to %d", minProtocolVersion, maxProtocolVersion)
+	}
+	if len(params.Features) == 0 {
+		return &HelloResult{Version: version, Features: protocolFeatures}, nil
+	}
+	wanted := make(map[string]bool, len(params.Features))
+	for _, f := range params.Features {
+		wanted[f] = true
+	}
+	features := []string{}
+	for _, f := range protocolFeatures {
+		if wanted[f] {
+			features = append(features, f)
+		}
+	}
+	return &HelloResult{Version: version, Features: features}, nil
+}
+
+func decodeParams(req *Request, v interface{}) error {
+	if len(req.Params) == 0 {
+		return errorf(CodeInvalidRequest, "missing params for %s", req.Method)
+	}
+	if err := json.Unmarshal(req.Params, v); err != nil {
+		return errorf(CodeInvalidRequest, "invalid params for %s: %v", req.Method, err)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/noelukwa/localbase/pkg/client"
+)
+
+// testDaemon returns a LocalBase serving the given domains, each on port
+// 3000, without Caddy or any resolver.
+func testDaemon(domains ...string) *LocalBase {
+	lb := NewLocalBase()
+	for _, d := range domains {
+		lb.records[d] = &Record{hosts: []string{d}, port: 3000}
+	}
+	return lb
+}
+
+// dialTestServer serves a connection to lb, returning the client end and
+// a reader of its response lines.
+func dialTestServer(t *testing.T, lb *LocalBase, maxMessageSize int) (net.Conn, *bufio.Scanner) {
+	s := &adminServer{
+		lb:             lb,
+		limiter:        newClientLimiter(1000, 8),
+		readTimeout:    time.Minute,
+		maxMessageSize: maxMessageSize,
+		stop:           func() {},
+		conns:          make(map[net.Conn]bool),
+	}
+	client, server := net.Pipe()
+	go s.handleConnection(server)
+	t.Cleanup(func() { client.Close() })
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(client)
+	scanner.Buffer(nil, 1<<20)
+	return client, scanner
+}
+
+// roundTrip writes line and returns the next response line. The write
+// runs on its own, as a pipe has no buffer and the daemon stops reading an
+// oversized request before answering it.
+func roundTrip(t *testing.T, conn net.Conn, scanner *bufio.Scanner, line string) string {
+	t.Helper()
+	go fmt.Fprintln(conn, line)
+	if !scanner.Scan() {
+		t.Fatalf("no response to %s: %v", line, scanner.Err())
+	}
+	return scanner.Text()
+}
+
+func TestServeFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		// batch is set if the answer is an array of responses.
+		batch bool
+		want  []wantResponse
+	}{
+		{
+			name:    "request",
+			request: `{"jsonrpc":"2.0","id":1,"method":"get","params":{"domain":"a"}}`,
+			want:    []wantResponse{{id: "1", domain: "a.local"}},
+		},
+		{
+			name:    "string id",
+			request: `{"jsonrpc":"2.0","id":"abc","method":"get","params":{"domain":"a.local"}}`,
+			want:    []wantResponse{{id: `"abc"`, domain: "a.local"}},
+		},
+		{
+			name:    "error",
+			request: `{"jsonrpc":"2.0","id":2,"method":"get","params":{"domain":"missing"}}`,
+			want:    []wantResponse{{id: "2", code: CodeDomainNotFound}},
+		},
+		{
+			name:    "unknown method",
+			request: `{"jsonrpc":"2.0","id":3,"method":"frobnicate"}`,
+			want:    []wantResponse{{id: "3", code: CodeInvalidRequest}},
+		},
+		{
+			name:    "unsupported version",
+			request: `{"jsonrpc":"1.0","id":4,"method":"list"}`,
+			want:    []wantResponse{{id: "4", code: CodeInvalidRequest}},
+		},
+		{
+			name:    "invalid json",
+			request: `{"jsonrpc":"2.0","id":5,`,
+			want:    []wantResponse{{id: "null", code: CodeInvalidRequest}},
+		},
+		{
+			name:    "batch",
+			request: `[{"jsonrpc":"2.0","id":1,"method":"get","params":{"domain":"a"}},{"jsonrpc":"2.0","id":2,"method":"get","params":{"domain":"missing"}},{"jsonrpc":"2.0","id":3,"method":"get","params":{"domain":"b"}}]`,
+			batch:   true,
+			want:    []wantResponse{{id: "1", domain: "a.local"}, {id: "2", code: CodeDomainNotFound}, {id: "3", domain: "b.local"}},
+		},
+		{
+			name:    "batch with invalid request",
+			request: `[{"jsonrpc":"2.0","id":1,"method":"get","params":{"domain":"a"}},42]`,
+			batch:   true,
+			want:    []wantResponse{{id: "1", domain: "a.local"}, {id: "null", code: CodeInvalidRequest}},
+		},
+		{
+			name:    "empty batch",
+			request: `[]`,
+			want:    []wantResponse{{id: "null", code: CodeInvalidRequest}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, scanner := dialTestServer(t, testDaemon("a.local", "b.local"), defaultMaxMessageSize)
+			line := roundTrip(t, conn, scanner, tt.request)
+
+			checkResponses(t, line, tt.batch, tt.want)
+		})
+	}
+}
+
+// checkResponses checks line, an array of responses if batch is set and a
+// single response otherwise, against want.
+func checkResponses(t *testing.T, line string, batch bool, want []wantResponse) {
+	t.Helper()
+	var responses []Response
+	if batch {
+		if err := json.Unmarshal([]byte(line), &responses); err != nil {
+			t.Fatalf("batch answered with %s: %v", line, err)
+		}
+	} else {
+		var resp Response
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatalf("invalid response %s: %v", line, err)
+		}
+		responses = []Response{resp}
+	}
+	if len(responses) != len(want) {
+		t.Fatalf("got %d responses, want %d: %s", len(responses), len(want), line)
+	}
+	for i, w := range want {
+		w.check(t, &responses[i])
+	}
+}
+
+// wantResponse is the ID a response should have, along with either the
+// code of its error or the domain it returns.
+type wantResponse struct {
+	id     string
+	domain string
+	code   ErrorCode
+}
+
+func (w wantResponse) check(t *testing.T, resp *Response) {
+	t.Helper()
+	id := string(resp.ID)
+	if id == "" {
+		id = "null"
+	}
+	if id != w.id {
+		t.Errorf("got id %s, want %s", id, w.id)
+	}
+	if resp.JSONRPC != protocolVersion {
+		t.Errorf("got jsonrpc %q, want %q", resp.JSONRPC, protocolVersion)
+	}
+	if w.code != "" {
+		if resp.Error == nil || resp.Error.Err().Code != w.code {
+			t.Errorf("response %s: got error %+v, want code %s", id, resp.Error, w.code)
+		}
+		return
+	}
+	if resp.Error != nil {
+		t.Errorf("response %s: unexpected error %s", id, resp.Error.Message)
+		return
+	}
+	var d Domain
+	if err := json.Unmarshal(resp.Result, &d); err != nil || d.Domain != w.domain {
+		t.Errorf("response %s: got %s, want domain %s", id, resp.Result, w.domain)
+	}
+}
+
+func TestServeMatchesIDs(t *testing.T) {
+	domains := []string{"a.local", "b.local", "c.local", "d.local"}
+	conn, scanner := dialTestServer(t, testDaemon(domains...), defaultMaxMessageSize)
+
+	// Requests are served concurrently, so responses may come in any
+	// order, each with its request's ID. Blank lines are skipped.
+	var lines []string
+	for i, d := range domains {
+		lines = append(lines, fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"get","params":{"domain":%q}}`, i+10, d), "")
+	}
+	if _, err := fmt.Fprintln(conn, strings.Join(lines, "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for range domains {
+		if !scanner.Scan() {
+			t.Fatalf("missing responses: %v", scanner.Err())
+		}
+		var resp Response
+		var d Domain
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil || resp.Error != nil {
+			t.Fatalf("unexpected response %s", scanner.Text())
+		}
+		json.Unmarshal(resp.Result, &d)
+		got[string(resp.ID)] = d.Domain
+	}
+	for i, d := range domains {
+		if id := fmt.Sprint(i + 10); got[id] != d {
+			t.Errorf("response %s: got %q, want %q", id, got[id], d)
+		}
+	}
+}
+
+func TestServeRejectsTooManyConnections(t *testing.T) {
+	s := &adminServer{
+		lb:             testDaemon("a.local"),
+		limiter:        newClientLimiter(1000, 1),
+		readTimeout:    time.Minute,
+		maxMessageSize: defaultMaxMessageSize,
+		stop:           func() {},
+		conns:          make(map[net.Conn]bool),
+	}
+	// Every pipe connection has the same key, so with one already counted
+	// the next is refused.
+	s.limiter.connect("pipe")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(client)
+	line := roundTrip(t, client, scanner, `{"jsonrpc":"2.0","id":1,"method":"list"}`)
+	checkResponses(t, line, false, []wantResponse{{id: "1", code: CodeRateLimited}})
+}
+func TestServeMessageLimit(t *testing.T) {
+	var domains []string
+	for i := 0; i < 20; i++ {
+		domains = append(domains, fmt.Sprintf("domain-%02d.local", i))
+	}
+	const limit = 512
+
+	tests := []struct {
+		name    string
+		request string
+		batch   bool
+		want    []wantResponse
+	}{
+		{
+			name:    "response too large",
+			request: `{"jsonrpc":"2.0","id":7,"method":"list"}`,
+			want:    []wantResponse{{id: "7", code: CodeInvalidRequest}},
+		},
+		{
+			name:    "batch response too large",
+			request: `[{"jsonrpc":"2.0","id":1,"method":"list"},{"jsonrpc":"2.0","id":2,"method":"get","params":{"domain":"domain-00"}}]`,
+			batch:   true,
+			want:    []wantResponse{{id: "1", code: CodeInvalidRequest}, {id: "2", code: CodeInvalidRequest}},
+		},
+		{
+			name:    "page under the limit",
+			request: `{"jsonrpc":"2.0","id":8,"method":"get","params":{"domain":"domain-00"}}`,
+			want:    []wantResponse{{id: "8", domain: "domain-00.local"}},
+		},
+		{
+			name:    "request too large",
+			request: `{"jsonrpc":"2.0","id":9,"method":"get","params":{"domain":"` + strings.Repeat("x", limit) + `"}}`,
+			want:    []wantResponse{{id: "null", code: CodeInvalidRequest}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, scanner := dialTestServer(t, testDaemon(domains...), limit)
+			line := roundTrip(t, conn, scanner, tt.request)
+
+			checkResponses(t, line, tt.batch, tt.want)
+		})
+	}
+}
+
+// TestServeFramedMessages checks that framed requests are answered framed,
+// with responses streamed past the message limit, and that a framed
+// request over the limit leaves the connection usable.
+func TestServeFramedMessages(t *testing.T) {
+	var domains []string
+	for i := 0; i < 20; i++ {
+		domains = append(domains, fmt.Sprintf("domain-%02d.local", i))
+	}
+	const limit = 512
+	conn, _ := dialTestServer(t, testDaemon(domains...), limit)
+	r := bufio.NewReader(conn)
+	framedTrip := func(request string) string {
+		t.Helper()
+		go client.WriteMessage(conn, []byte(request), true)
+		msg, framed, err := client.ReadMessage(r, 0)
+		if err != nil || !framed {
+			t.Fatalf("got %s, framed %v, error %v for %s", msg, framed, err, request)
+		}
+		return string(msg)
+	}
+
+	var list struct{ Result ListResult }
+	if err := json.Unmarshal([]byte(framedTrip(`{"jsonrpc":"2.0","id":1,"method":"list"}`)), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Result.Domains) != len(domains) {
+		t.Errorf("got %d domains, want all %d", len(list.Result.Domains), len(domains))
+	}
+
+	tooLarge := `{"jsonrpc":"2.0","id":2,"method":"get","params":{"domain":"` + strings.Repeat("x", limit) + `"}}`
+	checkResponses(t, framedTrip(tooLarge), false, []wantResponse{{id: "null", code: CodeInvalidRequest}})
+	get := `{"jsonrpc":"2.0","id":3,"method":"get","params":{"domain":"domain-00"}}`
+	checkResponses(t, framedTrip(get), false, []wantResponse{{id: "3", domain: "domain-00.local"}})
+}
+
+func TestListPage(t *testing.T) {
+	var domains []Domain
+	for _, d := range []string{"a.local", "b.local", "c.local", "d.local", "e.local"} {
+		domains = append(domains, Domain{Domain: d})
+	}
+	tests := []struct {
+		name   string
+		params ListParams
+		want   []string
+		next   string
+	}{
+		{name: "everything", want: []string{"a.local", "b.local", "c.local", "d.local", "e.local"}},
+		{name: "first page", params: ListParams{Limit: 2}, want: []string{"a.local", "b.local"}, next: "b.local"},
+		{name: "middle page", params: ListParams{Cursor: "b.local", Limit: 2}, want: []string{"c.local", "d.local"}, next: "d.local"},
+		{name: "last page", params: ListParams{Cursor: "d.local", Limit: 2}, want: []string{"e.local"}},
+		{name: "exact last page", params: ListParams{Cursor: "c.local", Limit: 2}, want: []string{"d.local", "e.local"}},
+		{name: "cursor between names", params: ListParams{Cursor: "bb.local", Limit: 1}, want: []string{"c.local"}, next: "c.local"},
+		{name: "cursor past the end", params: ListParams{Cursor: "z.local"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := listPage(domains, &tt.params)
+			got := []string{}
+			for _, d := range result.Domains {
+				got = append(got, d.Domain)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if result.Next != tt.next {
+				t.Errorf("got next %q, want %q", result.Next, tt.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+)
+
+// systemdUnitName and launchdLabel name the login service, one per
+// profile.
+func systemdUnitName() string {
+	return profileName("localbase") + ".service"
+}
+
+func launchdLabel() string {
+	return profileName("com.noelukwa.localbase")
+}
+
+var systemdUnitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=localbase local domain manager
+After=network-online.target
+
+[Service]
+ExecStart={{.ExecStart}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=default.target
+`))
+
+var launchdPlistTemplate = template.Must(template.New("plist").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{.Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+{{- range .Args}}
+		<string>{{.}}</string>
+{{- end}}
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>{{.LogFile}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{.LogFile}}</string>
+</dict>
+</plist>
+`))
+
+func serviceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "service",
+		Short: "Manage the localbase login service",
+		Long: `Install localbase as a systemd user service (Linux) or launchd agent
+(macOS) so the daemon starts at login and restarts on failure.`,
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use: "install [-- start flags...]",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 && cmd.ArgsLenAtDash() != 0 {
+				return usageErrorf("usage: localbase service install [-- start flags...]")
+			}
+			return nil
+		},
+		Short: "Install and start the login service",
+		Long: `Install and start the login service. Arguments after -- are passed to
+localbase start, e.g. localbase service install -- --api localhost:2026`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			exe, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			startArgs := []string{exe, "start"}
+			if profile != "" {
+				startArgs = append(startArgs, "--profile", profile)
+			}
+			startArgs = append(startArgs, args...)
+
+			switch runtime.GOOS {
+			case "linux":
+				return installSystemdService(startArgs)
+			case "darwin":
+				return installLaunchdService(startArgs)
+			default:
+				return fmt.Errorf("service install is not supported on %s", runtime.GOOS)
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "uninstall",
+		Args:  noArgs,
+		Short: "Stop and remove the login service",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch runtime.GOOS {
+			case "linux":
+				return uninstallSystemdService()
+			case "darwin":
+				return uninstallLaunchdService()
+			default:
+				return fmt.Errorf("service uninstall is not supported on %s", runtime.GOOS)
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Args:  noArgs,
+		Short: "Show the login service status",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch runtime.GOOS {
+			case "linux":
+				return runServiceCommand("systemctl", "--user", "status", systemdUnitName())
+			case "darwin":
+				return runServiceCommand("launchctl", "list", launchdLabel())
+			default:
+				return fmt.Errorf("service status is not supported on %s", runtime.GOOS)
+			}
+		},
+	})
+
+	return cmd
+}
+
+func systemdUnitPath() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "systemd", "user", systemdUnitName()), nil
+}
+
+func installSystemdService(args []string) error {
+	path, err := systemdUnitPath()
+	if err != nil {
+		return err
+	}
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = systemdQuote(arg)
+	}
+
+	var buf bytes.Buffer
+	if err := systemdUnitTemplate.Execute(&buf, map[string]string{
+		"ExecStart": strings.Join(quoted, " "),
+	}); err != nil {
+		return err
+	}
+
+	if err := writeServiceFile(path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	if err := runServiceCommand("systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	if err := runServiceCommand("systemctl", "--user", "enable", "--now", systemdUnitName()); err != nil {
+		return err
+	}
+	fmt.Println("Installed service:", path)
+	return nil
+}
+
+func uninstallSystemdService() error {
+	path, err := systemdUnitPath()
+	if err != nil {
+		return err
+	}
+
+	if err := runServiceCommand("systemctl", "--user", "disable", "--now", systemdUnitName()); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := runServiceCommand("systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	fmt.Println("Removed service:", path)
+	return nil
+}
+
+// systemdQuote quotes s for use in an ExecStart line.
+func systemdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\$%") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func launchdPlistPath() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel()+".plist"), nil
+}
+
+func installLaunchdService(args []string) error {
+	path, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+
+	configDir, err := getConfigDir()
+	if err != nil {
+		return err
+	}
+
+	escaped := make([]string, len(args))
+	for i, arg := range args {
+		escaped[i] = xmlEscape(arg)
+	}
+
+	var buf bytes.Buffer
+	if err := launchdPlistTemplate.Execute(&buf, map[string]interface{}{
+		"Label":   launchdLabel(),
+		"Args":    escaped,
+		"LogFile": xmlEscape(filepath.Join(configDir, "service.log")),
+	}); err != nil {
+		return err
+	}
+
+	if err := writeServiceFile(path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	// Unload first so reinstalling picks up the new plist.
+	exec.Command("launchctl", "unload", path).Run()
+	if err := runServiceCommand("launchctl", "load", "-w", path); err != nil {
+		return err
+	}
+	fmt.Println("Installed service:", path)
+	return nil
+}
+
+func uninstallLaunchdService() error {
+	path, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+
+	if err := runServiceCommand("launchctl", "unload", "-w", path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Println("Removed service:", path)
+	return nil
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	template.HTMLEscape(&buf, []byte(s))
+	return buf.String()
+}
+
+func writeServiceFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func runServiceCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noelukwa/localbase/pkg/client"
+	qrcode "github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+)
+
+// Share types shared with the client package.
+type (
+	ShareParams = client.ShareParams
+	ShareResult = client.ShareResult
+)
+
+// shareDialTimeout is how long share waits to connect to Caddy on the LAN
+// address.
+const shareDialTimeout = 2 * time.Second
+
+// Share makes the domain serving hostname reachable from other devices on
+// the LAN: it exposes the domain to the LAN if it wasn't added with
+// --expose-lan, announces its .local names again, and checks that Caddy
+// listens on the LAN address. What would keep other devices from the
+// domain is reported as warnings.
+func (lb *LocalBase) Share(hostname string) (*ShareResult, error) {
+	config, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	lb.mu.Lock()
+	primary, rec, err := lb.find(hostname)
+	if err != nil {
+		lb.mu.Unlock()
+		return nil, err
+	}
+	if rec.paused {
+		lb.mu.Unlock()
+		return nil, errorf(CodeInvalidRequest, "%s is paused, resume it first", primary)
+	}
+	// The name asked for is shared if other devices can resolve it,
+	// otherwise the domain's first .local name.
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+	if !lb.serves(name) {
+		name = qualifyDomain(name, lb.suffix)
+	}
+	if !strings.HasSuffix(name, ".local") || !lb.serves(name) {
+		name = ""
+		if len(rec.adverts) > 0 {
+			name = strings.TrimSuffix(rec.adverts[0].name, ".")
+		}
+	}
+	if name == "" {
+		lb.mu.Unlock()
+		return nil, errorf(CodeInvalidRequest, "%s has no .local name, so other devices can't resolve it, add it again with a .local alias", primary)
+	}
+	if lb.mdns == nil {
+		lb.mu.Unlock()
+		return nil, errorf(CodeInvalidRequest, "mdns isn't running, so other devices can't resolve %s, start localbase with --mdns builtin", name)
+	}
+	if lb.ip == "" {
+		localIP, err := getLocalIP()
+		if err != nil {
+			lb.mu.Unlock()
+			return nil, fmt.Errorf("failed to get local IP: %v", err)
+		}
+		lb.setIP(localIP, getLocalIPv6(localIP))
+	}
+	if !rec.opts.ExposeLAN {
+		rec.opts.ExposeLAN = true
+		if err := addCaddyServerBlock(rec.hosts, rec.port, &rec.opts, config); err != nil {
+			rec.opts.ExposeLAN = false
+			lb.mu.Unlock()
+			return nil, fmt.Errorf("failed to expose %s to the LAN: %v", primary, err)
+		}
+		rec.setAdverts(primary)
+		log.Printf("Exposed domain to the LAN: %s", primary)
+		lb.events.publish(Event{Type: EventDomainUpdated, Domain: primary, Port: rec.port})
+	}
+	lb.mdns.add(rec.adverts...)
+	result := &ShareResult{Domain: primary, URL: rec.url(name), IP: lb.ip, IPv6: lb.ip6}
+	port := rec.httpsPort
+	if rec.opts.NoTLS {
+		port = rec.httpPort
+	}
+	serverID := caddyRouteServer(&rec.opts)
+	lb.mu.Unlock()
+
+	result.Warnings = checkLANListener(config.CaddyAdmin, serverID, result.IP, port)
+	return result, nil
+}
+
+// warnLANListener logs what would keep other devices from reaching d, a
+// domain exposed to the LAN, through Caddy.
+func (lb *LocalBase) warnLANListener(d *Domain) {
+	config, err := readConfig()
+	if err != nil {
+		log.Printf("Error reading config: %v", err)
+		return
+	}
+	lb.mu.Lock()
+	ip := lb.ip
+	lb.mu.Unlock()
+	port, serverID := config.httpsPort(), caddyServerID
+	if d.NoTLS {
+		port, serverID = config.httpPort(), caddyHTTPServerID
+	}
+	for _, warning := range checkLANListener(config.CaddyAdmin, serverID, ip, port) {
+		log.Printf("Warning: %s is exposed to the LAN, but %s", d.Domain, warning)
+	}
+}
+
+// checkLANListener checks that the localbase server serverID listens on
+// port at ip, in its config and by connecting to it, returning what is
+// wrong.
+func checkLANListener(caddyAdmin, serverID, ip string, port int) []string {
+	var warnings []string
+	var server map[string]interface{}
+	if err := caddyRequest(caddyAdmin, http.MethodGet, "/id/"+serverID, nil, &server); err != nil {
+		return append(warnings, fmt.Sprintf("couldn't read Caddy's config: %v", err))
+	}
+
+	listen, _ := server["listen"].([]interface{})
+	var bound []string
+	lan := false
+	for _, l := range listen {
+		addr, _ := l.(string)
+		host, p, ok := parseCaddyListen(addr)
+		if !ok || p != port {
+			continue
+		}
+		bound = append(bound, addr)
+		if h := net.ParseIP(host); host == "" || h != nil && (h.IsUnspecified() || h.Equal(net.ParseIP(ip))) {
+			lan = true
+		}
+	}
+	switch {
+	case len(bound) == 0:
+		warnings = append(warnings, fmt.Sprintf("Caddy doesn't listen on port %d", port))
+	case !lan:
+		warnings = append(warnings, fmt.Sprintf("Caddy only listens on %s, not on the LAN address %s", strings.Join(bound, ", "), ip))
+	}
+
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", addr, shareDialTimeout)
+	if err != nil {
+		return append(warnings, fmt.Sprintf("nothing answers on %s: %v", addr, err))
+	}
+	conn.Close()
+	return warnings
+}
+
+// parseCaddyListen splits a Caddy listener address, [network/]host:port,
+// into its host and port. Port ranges and unix sockets aren't parsed.
+func parseCaddyListen(addr string) (string, int, bool) {
+	if network, rest, ok := strings.Cut(addr, "/"); ok {
+		if !strings.HasPrefix(network, "tcp") && !strings.HasPrefix(network, "udp") {
+			return "", 0, false
+		}
+		addr = rest
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, false
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, false
+	}
+	return host, port, true
+}
+
+func shareCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "share <domain>",
+		Args:  rangeArgs(1, 1, "usage: localbase share <domain>"),
+		Short: "Share a domain with phones and other devices on the LAN",
+		Long: `Make a domain reachable from other devices on the LAN, for testing on a phone:
+the domain is exposed to the LAN as if added with --expose-lan, its .local
+names are announced again, and Caddy is checked to listen on the LAN
+address. The url is printed along with a QR code to scan. Devices warn
+about the certificate of an https domain until they trust Caddy's local CA.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			invert, _ := cmd.Flags().GetBool("invert")
+
+			var result ShareResult
+			if err := call("share", &ShareParams{Domain: args[0]}, &result); err != nil {
+				return err
+			}
+			qr, err := qrcode.New(result.URL, qrcode.Medium)
+			if err != nil {
+				return fmt.Errorf("failed to make a QR code: %v", err)
+			}
+			return printResult(cmd, &result, func() {
+				for _, w := range result.Warnings {
+					fmt.Printf("Warning: %s\n", w)
+				}
+				fmt.Print(qr.ToSmallString(invert))
+				fmt.Printf("Sharing %s on the LAN at %s\n", result.Domain, result.URL)
+				addrs := result.IP
+				if result.IPv6 != "" {
+					addrs += ", " + result.IPv6
+				}
+				fmt.Printf("  resolves to: %s\n", addrs)
+			})
+		},
+	}
+	cmd.Flags().Bool("invert", false, "invert the QR code's colors, for terminals with a light background")
+	return cmd
+}
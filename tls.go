@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func getCertFiles() (certFile, keyFile string, err error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(configDir, "cert.pem"), filepath.Join(configDir, "key.pem"), nil
+}
+
+// loadDaemonCert loads the daemon's TLS certificate, generating a
+// self-signed one on first use.
+func loadDaemonCert() (tls.Certificate, error) {
+	certFile, keyFile, err := getCertFiles()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		return cert, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return tls.Certificate{}, fmt.Errorf("failed to load %s: %v", certFile, err)
+	}
+
+	if err := generateDaemonCert(certFile, keyFile); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate certificate: %v", err)
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+func generateDaemonCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localbase daemon"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost", hostname},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certError reports a daemon certificate that can't be trusted, as
+// opposed to a daemon that can't be reached.
+type certError struct {
+	err error
+}
+
+func (e *certError) Error() string {
+	return e.err.Error()
+}
+
+// getKnownDaemonsFile returns the file of certificate fingerprints the
+// cli pinned for the daemons it connected to over TLS.
+func getKnownDaemonsFile() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "known_daemons.json"), nil
+}
+
+// loadKnownDaemons returns the pinned fingerprint of each daemon address.
+func loadKnownDaemons() (map[string]string, error) {
+	path, err := getKnownDaemonsFile()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return known, nil
+		}
+		return nil, err
+	}
+	if err := decodeStateFile(path, data, "daemons", &known); err != nil {
+		return nil, fmt.Errorf("invalid known daemons file %s: %v", path, err)
+	}
+	return known, nil
+}
+
+// pinDaemon records the fingerprint of the daemon at address.
+func pinDaemon(address, fingerprint string) error {
+	known, err := loadKnownDaemons()
+	if err != nil {
+		return err
+	}
+	known[address] = fingerprint
+	path, err := getKnownDaemonsFile()
+	if err != nil {
+		return err
+	}
+	return writeStateFile(path, "daemons", known)
+}
+
+// clientTLSConfig verifies the daemon at address by pinning its
+// certificate, trust on first use: the first certificate it presents is
+// recorded in known_daemons.json, and any other is refused from then on.
+// The daemon's self-signed certificate can't be verified against a CA.
+// A daemon on this machine must present the cert.pem it generated in the
+// config dir, so nothing else can take its place even on first contact.
+func clientTLSConfig(address string) (*tls.Config, error) {
+	certFile, _, err := getCertFiles()
+	if err != nil {
+		return nil, err
+	}
+	var local []byte
+	if host, _, err := net.SplitHostPort(address); err == nil && loopbackHost(host) {
+		data, err := os.ReadFile(certFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, &certError{fmt.Errorf("failed to read daemon certificate: %v", err)}
+		}
+		if err == nil {
+			block, _ := pem.Decode(data)
+			if block == nil || block.Type != "CERTIFICATE" {
+				return nil, &certError{fmt.Errorf("invalid daemon certificate %s", certFile)}
+			}
+			local = block.Bytes
+		}
+	}
+	known, err := loadKnownDaemons()
+	if err != nil {
+		return nil, &certError{err}
+	}
+	knownFile, err := getKnownDaemonsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		// Verification is done against the pinned certificate below.
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return &certError{fmt.Errorf("daemon at %s presented no certificate", address)}
+			}
+			got := rawCerts[0]
+			sum := sha256.Sum256(got)
+			fingerprint := hex.EncodeToString(sum[:])
+
+			switch {
+			case local != nil && bytes.Equal(got, local):
+				return nil
+			case local != nil:
+				return &certError{fmt.Errorf("daemon certificate %s does not match %s (%s), another process may be listening on %s",
+					certFingerprint(got), certFingerprint(local), certFile, address)}
+			case known[address] == fingerprint:
+				return nil
+			case known[address] != "":
+				return &certError{fmt.Errorf("daemon certificate %s at %s does not match the one pinned on first use; if the daemon was reinstalled, remove %s from %s",
+					certFingerprint(got), address, address, knownFile)}
+			}
+			if err := pinDaemon(address, fingerprint); err != nil {
+				return &certError{fmt.Errorf("failed to pin daemon certificate: %v", err)}
+			}
+			fmt.Fprintf(os.Stderr, "Trusting daemon certificate %s at %s on first use\n", certFingerprint(got), address)
+			return nil
+		},
+	}, nil
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
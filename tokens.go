@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// tokenEnv is the environment variable the CLI reads its token from.
+const tokenEnv = "LOCALBASE_TOKEN"
+
+var defaultTokenMethods = []string{"add", "update", "remove", "pause", "resume", "get", "list", "status", "health"}
+
+// Token is a named API key limited to some methods and, optionally, to
+// domains starting with Prefix. Only a hash of the secret is stored.
+type Token struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Allow     []string  `json:"allow"`
+	Prefix    string    `json:"prefix,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func getTokensFile() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "tokens.json"), nil
+}
+
+func loadTokens() ([]Token, error) {
+	path, err := getTokensFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var tokens []Token
+	if err := decodeStateFile(path, data, "tokens", &tokens); err != nil {
+		return nil, fmt.Errorf("invalid tokens file %s: %v", path, err)
+	}
+	return tokens, nil
+}
+
+func saveTokens(tokens []Token) error {
+	path, err := getTokensFile()
+	if err != nil {
+		return err
+	}
+	return writeStateFile(path, "tokens", tokens)
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// findToken returns the token whose secret is secret, or nil.
+func findToken(tokens []Token, secret string) *Token {
+	hash := hashToken(secret)
+	for i := range tokens {
+		if subtle.ConstantTimeCompare([]byte(tokens[i].Hash), []byte(hash)) == 1 {
+			return &tokens[i]
+		}
+	}
+	return nil
+}
+
+func (t *Token) allows(method string) bool {
+	for _, m := range t.Allow {
+		if m == method || m == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// admin reports whether t may call every method on every domain.
+func (t *Token) admin() bool {
+	return t.Prefix == "" && t.allows("*")
+}
+
+// authorize checks that req may be served. Requests without a token are
+// trusted unless the daemon requires auth, since only the local user can
+// reach the admin socket. hello is always allowed so clients can
+// negotiate before authenticating.
+func (lb *LocalBase) authorize(req *Request) error {
+	if req.Method == "hello" {
+		return nil
+	}
+	if req.Auth == "" {
+		if lb.requireAuth {
+			return errorf(CodeUnauthorized, "a token is required, set %s", tokenEnv)
+		}
+		return nil
+	}
+
+	tokens, err := loadTokens()
+	if err != nil {
+		return err
+	}
+	token := findToken(tokens, req.Auth)
+	if token == nil {
+		return errorf(CodeUnauthorized, "invalid or revoked token")
+	}
+	req.client += " token " + token.Name
+
+	if !token.allows(req.Method) {
+		return errorf(CodeUnauthorized, "token %s may not call %s", token.Name, req.Method)
+	}
+
+	var params struct {
+		Domain  string          `json:"domain"`
+		Aliases []string        `json:"aliases"`
+		Dir     string          `json:"dir"`
+		Caddy   json.RawMessage `json:"caddy"`
+	}
+	json.Unmarshal(req.Params, &params)
+	// Raw Caddy handlers can do anything Caddy can, like serve any file or
+	// proxy anywhere, so they take an admin token.
+	if len(params.Caddy) > 0 && string(params.Caddy) != "null" && !token.admin() {
+		return errorf(CodeUnauthorized, "token %s may not set caddy, which needs a token allowed * without a prefix", token.Name)
+	}
+	if token.Prefix == "" {
+		return nil
+	}
+	switch req.Method {
+	case "undo", "history", "status", "health":
+		// These act on or report about every domain.
+		return errorf(CodeUnauthorized, "token %s is limited to domains starting with %q and may not call %s", token.Name, token.Prefix, req.Method)
+	}
+	req.prefix = token.Prefix
+	// Files reach beyond the token's domains.
+	if params.Dir != "" {
+		return errorf(CodeUnauthorized, "token %s is limited to domains starting with %q and may not set dir", token.Name, token.Prefix)
+	}
+	// An alias acts on its whole record, so the domain and every alias of
+	// the record a name refers to must be in scope too.
+	names := append([]string{params.Domain}, params.Aliases...)
+	if params.Domain != "" {
+		names = append(names, lb.recordNames(params.Domain)...)
+	}
+	for _, name := range names {
+		if !req.inScope(name) {
+			return errorf(CodeUnauthorized, "token %s may only manage domains starting with %q", token.Name, token.Prefix)
+		}
+	}
+	return nil
+}
+
+// inScope reports whether req may see name, which it may unless it was
+// sent with a prefixed token and name doesn't start with the prefix. An
+// empty name, like that of an event about no domain, is in scope.
+func (req *Request) inScope(name string) bool {
+	return req.prefix == "" || name == "" || strings.HasPrefix(domainLabel(name), req.prefix)
+}
+
+// scoped returns the domains req may see.
+func (req *Request) scoped(domains []Domain) []Domain {
+	if req.prefix == "" {
+		return domains
+	}
+	in := []Domain{}
+	for _, d := range domains {
+		if req.inScope(d.Domain) {
+			in = append(in, d)
+		}
+	}
+	return in
+}
+
+func tokenCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manage API tokens",
+		Long: `Manage named tokens for scripts and CI. Clients send a token by setting
+LOCALBASE_TOKEN, or as a bearer token to the REST API. The daemon limits each
+token to the methods and domain prefix it was created with.`,
+	}
+	cmd.AddCommand(tokenCreateCmd(), tokenListCmd(), tokenRevokeCmd())
+	return cmd
+}
+
+func tokenCreateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create <name>",
+		Args:  rangeArgs(1, 1, "usage: localbase token create <name> [--allow methods] [--prefix prefix]"),
+		Short: "Create a token and print its secret",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			allow, _ := cmd.Flags().GetStringSlice("allow")
+			prefix, _ := cmd.Flags().GetString("prefix")
+
+			tokens, err := loadTokens()
+			if err != nil {
+				return err
+			}
+			for _, t := range tokens {
+				if t.Name == args[0] {
+					return usageErrorf("token %s already exists", args[0])
+				}
+			}
+
+			buf := make([]byte, 24)
+			if _, err := rand.Read(buf); err != nil {
+				return err
+			}
+			secret := "lb_" + hex.EncodeToString(buf)
+
+			tokens = append(tokens, Token{
+				Name:      args[0],
+				Hash:      hashToken(secret),
+				Allow:     allow,
+				Prefix:    prefix,
+				CreatedAt: time.Now(),
+			})
+			if err := saveTokens(tokens); err != nil {
+				return err
+			}
+
+			result := map[string]string{"name": args[0], "token": secret}
+			return printResult(cmd, result, func() {
+				fmt.Println(secret)
+				fmt.Fprintf(os.Stderr, "Created token %s. It is only shown once; use it with %s=<token>.\n", args[0], tokenEnv)
+			})
+		},
+	}
+	cmd.Flags().StringSlice("allow", defaultTokenMethods, "methods the token may call, or * for all")
+	cmd.Flags().String("prefix", "", "only allow domains starting with this prefix")
+	return cmd
+}
+
+func tokenListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Args:  noArgs,
+		Short: "List tokens",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tokens, err := loadTokens()
+			if err != nil {
+				return err
+			}
+			sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+
+			// Hashes stay out of the output.
+			type tokenInfo struct {
+				Name      string    `json:"name"`
+				Allow     []string  `json:"allow"`
+				Prefix    string    `json:"prefix,omitempty"`
+				CreatedAt time.Time `json:"created_at"`
+			}
+			infos := make([]tokenInfo, len(tokens))
+			for i, t := range tokens {
+				infos[i] = tokenInfo{Name: t.Name, Allow: t.Allow, Prefix: t.Prefix, CreatedAt: t.CreatedAt}
+			}
+
+			return printResult(cmd, infos, func() {
+				if len(infos) == 0 {
+					fmt.Println("No tokens")
+					return
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tALLOW\tPREFIX\tCREATED")
+				for _, t := range infos {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Name, strings.Join(t.Allow, ","), t.Prefix, t.CreatedAt.Local().Format(time.DateTime))
+				}
+				w.Flush()
+			})
+		},
+	}
+}
+
+func tokenRevokeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <name>",
+		Args:  rangeArgs(1, 1, "usage: localbase token revoke <name>"),
+		Short: "Revoke a token",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tokens, err := loadTokens()
+			if err != nil {
+				return err
+			}
+			for i, t := range tokens {
+				if t.Name == args[0] {
+					tokens = append(tokens[:i], tokens[i+1:]...)
+					if err := saveTokens(tokens); err != nil {
+						return err
+					}
+					fmt.Printf("Revoked token %s\n", args[0])
+					return nil
+				}
+			}
+			return fmt.Errorf("no token named %s", args[0])
+		},
+	}
+}
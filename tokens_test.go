@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// testTokens saves tokens under a temporary home, returning the secret of
+// each by name.
+func testTokens(t *testing.T, tokens ...Token) map[string]string {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+
+	secrets := make(map[string]string, len(tokens))
+	for i := range tokens {
+		secret := "lb_" + tokens[i].Name
+		tokens[i].Hash = hashToken(secret)
+		secrets[tokens[i].Name] = secret
+	}
+	if err := saveTokens(tokens); err != nil {
+		t.Fatal(err)
+	}
+	return secrets
+}
+
+func TestAuthorize(t *testing.T) {
+	secrets := testTokens(t,
+		Token{Name: "admin", Allow: []string{"*"}},
+		Token{Name: "ci", Allow: []string{"*"}, Prefix: "e2e-"},
+		Token{Name: "reader", Allow: []string{"get", "list"}},
+	)
+	lb := testDaemon("e2e-web.local", "shop.local")
+	lb.records["e2e-api.local"] = &Record{aliases: []string{"legacy.local"}, hosts: []string{"e2e-api.local"}, port: 3000}
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		params string
+		ok     bool
+	}{
+		{name: "hello needs no token", method: "hello", ok: true},
+		{name: "no token", method: "remove", params: `{"domain":"shop"}`, ok: true},
+		{name: "revoked token", token: "lb_gone", method: "list"},
+		{name: "allowed method", token: "reader", method: "get", params: `{"domain":"shop"}`, ok: true},
+		{name: "disallowed method", token: "reader", method: "remove", params: `{"domain":"shop"}`},
+		{name: "domain in prefix", token: "ci", method: "remove", params: `{"domain":"e2e-web.local"}`, ok: true},
+		{name: "domain outside prefix", token: "ci", method: "remove", params: `{"domain":"shop.local"}`},
+		{name: "new alias outside prefix", token: "ci", method: "add", params: `{"domain":"e2e-new.local","port":3000,"aliases":["shop2.local"]}`},
+		{name: "record alias outside prefix", token: "ci", method: "remove", params: `{"domain":"e2e-api.local"}`},
+		{name: "record of alias outside prefix", token: "ci", method: "remove", params: `{"domain":"legacy.local"}`},
+		{name: "dir with prefix", token: "ci", method: "add", params: `{"domain":"e2e-files.local","dir":"/"}`},
+		{name: "undo with prefix", token: "ci", method: "undo"},
+		{name: "history with prefix", token: "ci", method: "history"},
+		{name: "status with prefix", token: "ci", method: "status"},
+		{name: "list with prefix", token: "ci", method: "list", ok: true},
+		{name: "caddy with admin", token: "admin", method: "add", params: `{"domain":"raw.local","port":3000,"caddy":[{"handler":"static_response"}]}`, ok: true},
+		{name: "caddy with prefix", token: "ci", method: "add", params: `{"domain":"e2e-raw.local","port":3000,"caddy":[{"handler":"static_response"}]}`},
+		{name: "null caddy with prefix", token: "ci", method: "add", params: `{"domain":"e2e-raw.local","port":3000,"caddy":null}`, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{Method: tt.method, Params: json.RawMessage(tt.params), Auth: tt.token}
+			if secret, ok := secrets[tt.token]; ok {
+				req.Auth = secret
+			}
+			err := lb.authorize(req)
+			if tt.ok && err != nil {
+				t.Errorf("got %v, want the request allowed", err)
+			}
+			var e *Error
+			if !tt.ok && !(errors.As(err, &e) && e.Code == CodeUnauthorized) {
+				t.Errorf("got %v, want an unauthorized error", err)
+			}
+		})
+	}
+}
+
+func TestPrefixTokenScope(t *testing.T) {
+	secrets := testTokens(t, Token{Name: "ci", Allow: []string{"*"}, Prefix: "e2e-"})
+	lb := testDaemon("a.local", "e2e-api.local", "e2e-web.local", "shop.local")
+
+	result, err := dispatch(lb, &Request{Method: "list", Auth: secrets["ci"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range result.(*ListResult).Domains {
+		got = append(got, d.Domain)
+	}
+	if len(got) != 2 || got[0] != "e2e-api.local" || got[1] != "e2e-web.local" {
+		t.Errorf("got %v, want only the domains starting with e2e-", got)
+	}
+
+	req := &Request{Method: "subscribe", Auth: secrets["ci"]}
+	if err := lb.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"e2e-web.local": true, "shop.local": false, "": true} {
+		if got := req.inScope(name); got != want {
+			t.Errorf("inScope(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
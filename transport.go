@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// addrEnv is the environment variable the CLI reads a remote daemon's TCP
+// address from, for daemons started with --allow-lan.
+const addrEnv = "LOCALBASE_ADDR"
+
+// defaultSocketPath returns the unix socket the daemon listens on by
+// default, or "" where unix sockets aren't the default transport.
+func defaultSocketPath() (string, error) {
+	if runtime.GOOS == "windows" {
+		return "", nil
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, profileName("localbase")+".sock"), nil
+	}
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "localbase.sock"), nil
+}
+
+// defaultPipe returns the named pipe the daemon listens on by default, or
+// "" where named pipes aren't supported.
+func defaultPipe() string {
+	if defaultPipeName == "" {
+		return ""
+	}
+	return profileName(defaultPipeName)
+}
+
+// adminAddr returns the network and address of the admin protocol. A
+// named pipe or unix socket takes precedence over TCP when set.
+func (c *Config) adminAddr() (network, address string) {
+	switch {
+	case c.Pipe != "":
+		return "pipe", c.Pipe
+	case c.Socket != "":
+		return "unix", c.Socket
+	}
+	return "tcp", c.AdminAddress
+}
+
+// validateAdminAddr refuses a TCP admin address reachable from other
+// machines unless AllowLAN is set, which in turn requires TLS and token
+// auth.
+func validateAdminAddr(cfg *Config) error {
+	network, address := cfg.adminAddr()
+	if network != "tcp" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid admin address %q: %v", address, err)
+	}
+	if loopbackHost(host) {
+		return nil
+	}
+	if !cfg.AllowLAN {
+		return fmt.Errorf("admin address %s is reachable from the network, use --allow-lan to allow it", address)
+	}
+	if !cfg.TLS || !cfg.RequireAuth {
+		return fmt.Errorf("admin address %s is reachable from the network and requires TLS and token auth", address)
+	}
+	return nil
+}
+
+// listenAdmin listens for admin protocol connections. A unix socket is
+// only accessible to the current user, and a stale socket left by a daemon
+// that didn't shut down cleanly is replaced.
+func listenAdmin(cfg *Config) (net.Listener, error) {
+	network, address := cfg.adminAddr()
+	switch network {
+	case "pipe":
+		return listenPipe(address)
+	case "tcp":
+		if !cfg.TLS {
+			return net.Listen(network, address)
+		}
+		cert, err := loadDaemonCert()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Admin protocol certificate: %s", certFingerprint(cert.Certificate[0]))
+		return tls.Listen(network, address, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+	}
+
+	if _, err := os.Stat(address); err == nil {
+		if conn, err := net.DialTimeout("unix", address, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another daemon", address)
+		}
+		if err := os.Remove(address); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+		return nil, err
+	}
+	return listenUnix(address)
+}
+
+// dialAdmin connects to the daemon's admin protocol.
+func dialAdmin(cfg *Config, timeout time.Duration) (net.Conn, error) {
+	network, address := cfg.adminAddr()
+	switch {
+	case network == "pipe":
+		return dialPipe(address, timeout)
+	case network == "tcp" && cfg.TLS:
+		tlsConfig, err := clientTLSConfig(address)
+		if err != nil {
+			return nil, err
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, tlsConfig)
+	}
+	return net.DialTimeout(network, address, timeout)
+}
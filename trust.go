@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+)
+
+// caddyRootName names the Caddy root certificate in trust stores.
+const caddyRootName = "localbase-caddy-root"
+
+// linuxTrustStores are the anchor dirs of the common Linux distributions'
+// trust stores, and the command that rebuilds each store.
+var linuxTrustStores = []struct {
+	dir    string
+	update []string
+}{
+	{"/usr/local/share/ca-certificates", []string{"update-ca-certificates"}},
+	{"/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}},
+	{"/etc/ca-certificates/trust-source/anchors", []string{"trust", "extract-compat"}},
+	{"/usr/share/pki/trust/anchors", []string{"update-ca-certificates"}},
+}
+
+// trustInfo is the trust status of Caddy's root certificate.
+type trustInfo struct {
+	Subject     string `json:"subject"`
+	Fingerprint string `json:"fingerprint"`
+	Trusted     bool   `json:"trusted"`
+}
+
+func trustCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trust",
+		Args:  noArgs,
+		Short: "Trust Caddy's local certificate authority",
+		Long: `Install the root certificate of Caddy's local CA, which signs the certificates
+of .local domains, into the system trust store, and into Firefox and Chrome's
+NSS databases when certutil is installed, so browsers stop warning about them.
+Installing usually needs root. With --check, only report whether the root is
+trusted, exiting non-zero if it isn't.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			check, _ := cmd.Flags().GetBool("check")
+			caddyAdmin, _ := cmd.Flags().GetString("caddy")
+			if caddyAdmin == "" {
+				cfg, err := readConfig()
+				if err != nil {
+					return err
+				}
+				caddyAdmin = cfg.CaddyAdmin
+				caddyOrigin = cfg.CaddyOrigin
+			}
+
+			data, cert, err := getCaddyRootCert(caddyAdmin)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(cert.Raw)
+			info := trustInfo{
+				Subject:     cert.Subject.CommonName,
+				Fingerprint: hex.EncodeToString(sum[:]),
+				Trusted:     isCertTrusted(cert),
+			}
+
+			if check || info.Trusted {
+				if err := printResult(cmd, &info, func() {
+					if info.Trusted {
+						fmt.Printf("%s is trusted\n", info.Subject)
+					} else {
+						fmt.Printf("%s is not trusted, run localbase trust\n", info.Subject)
+					}
+				}); err != nil {
+					return err
+				}
+				if !info.Trusted {
+					return fmt.Errorf("caddy root certificate is not trusted")
+				}
+				return nil
+			}
+
+			configDir, err := getConfigDir()
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(configDir, caddyRootName+".crt")
+			if err := os.MkdirAll(configDir, 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				return err
+			}
+
+			if err := installRootCert(path); err != nil {
+				return err
+			}
+			installNSSRootCert(path)
+
+			info.Trusted = true
+			return printResult(cmd, &info, func() {
+				fmt.Printf("Trusted %s (sha256 %s)\n", info.Subject, info.Fingerprint)
+				fmt.Println("Restart your browser for it to pick up the change")
+			})
+		},
+	}
+	cmd.Flags().Bool("check", false, "only check whether the root certificate is trusted")
+	cmd.Flags().StringP("caddy", "c", "", "caddy admin address, a url or unix//path/to/admin.sock (defaults to the daemon's)")
+	return cmd
+}
+
+// getCaddyRootCert fetches the root certificate of Caddy's local CA, as PEM
+// and parsed.
+func getCaddyRootCert(caddyAdmin string) ([]byte, *x509.Certificate, error) {
+	resp, err := caddyGet(caddyAdmin, "/pki/ca/local")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reach Caddy at %s: %v", caddyAdmin, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to get Caddy's local CA: %s", body)
+	}
+
+	var ca struct {
+		RootCertificate string `json:"root_certificate"`
+	}
+	if err := json.Unmarshal(body, &ca); err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode([]byte(ca.RootCertificate))
+	if block == nil {
+		return nil, nil, fmt.Errorf("caddy returned no root certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(ca.RootCertificate), cert, nil
+}
+
+// isCertTrusted reports whether the system trusts cert as a root.
+func isCertTrusted(cert *x509.Certificate) bool {
+	_, err := cert.Verify(x509.VerifyOptions{})
+	return err == nil
+}
+
+func installRootCert(path string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return runServiceCommand("security", "add-trusted-cert", "-d", "-r", "trustRoot",
+			"-k", "/Library/Keychains/System.keychain", path)
+	case "windows":
+		return runServiceCommand("certutil", "-addstore", "-f", "ROOT", path)
+	case "linux":
+		for _, store := range linuxTrustStores {
+			if info, err := os.Stat(store.dir); err != nil || !info.IsDir() {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			dest := filepath.Join(store.dir, caddyRootName+".crt")
+			if err := os.WriteFile(dest, data, 0644); err != nil {
+				return fmt.Errorf("failed to write %s, try again with sudo: %v", dest, err)
+			}
+			return runServiceCommand(store.update[0], store.update[1:]...)
+		}
+		return fmt.Errorf("no known trust store found, add %s to your system's trust store manually", path)
+	default:
+		return fmt.Errorf("trust is not supported on %s, add %s to your system's trust store manually", runtime.GOOS, path)
+	}
+}
+
+// installNSSRootCert adds the certificate at path to the NSS databases of
+// Chrome on Linux and of Firefox, which don't use the system trust store.
+// Failures are only logged since the system store is already updated.
+func installNSSRootCert(path string) {
+	dbs := nssDatabases()
+	if len(dbs) == 0 {
+		return
+	}
+	if _, err := exec.LookPath("certutil"); err != nil || runtime.GOOS == "windows" {
+		log.Printf("Warning: install certutil (nss tools) to trust the certificate in Firefox and Chrome")
+		return
+	}
+	for _, db := range dbs {
+		out, err := exec.Command("certutil", "-A", "-d", "sql:"+db, "-t", "C,,", "-n", caddyRootName, "-i", path).CombinedOutput()
+		if err != nil {
+			log.Printf("Warning: failed to add certificate to %s: %v: %s", db, err, out)
+		}
+	}
+}
+
+// nssDatabases returns the NSS databases of the current user's browsers.
+func nssDatabases() []string {
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil
+	}
+	patterns := []string{filepath.Join(home, ".pki", "nssdb")}
+	switch runtime.GOOS {
+	case "darwin":
+		patterns = append(patterns, filepath.Join(home, "Library", "Application Support", "Firefox", "Profiles", "*"))
+	case "linux":
+		patterns = append(patterns,
+			filepath.Join(home, ".mozilla", "firefox", "*"),
+			filepath.Join(home, "snap", "firefox", "common", ".mozilla", "firefox", "*"))
+	}
+
+	var dbs []string
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, dir := range matches {
+			if _, err := os.Stat(filepath.Join(dir, "cert9.db")); err == nil {
+				dbs = append(dbs, dir)
+			}
+		}
+	}
+	return dbs
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// journalSize is how many changes undo can go back.
+const journalSize = 20
+
+// journalChange records a change a client made, for undo. Changes the
+// daemon makes itself, such as docker discovery's, aren't recorded. Like
+// the domains, the journal only lasts as long as the daemon.
+func (lb *LocalBase) journalChange(action string, d *Domain, prevPort int) {
+	lb.journalMu.Lock()
+	defer lb.journalMu.Unlock()
+
+	lb.journal = append(lb.journal, Change{Time: time.Now(), Action: action, Domain: *d, PrevPort: prevPort})
+	if len(lb.journal) > journalSize {
+		lb.journal = lb.journal[len(lb.journal)-journalSize:]
+	}
+}
+
+// History returns the changes undo can revert, most recent first.
+func (lb *LocalBase) History() *HistoryResult {
+	lb.journalMu.Lock()
+	defer lb.journalMu.Unlock()
+
+	changes := make([]Change, 0, len(lb.journal))
+	for i := len(lb.journal) - 1; i >= 0; i-- {
+		changes = append(changes, lb.journal[i])
+	}
+	return &HistoryResult{Changes: changes}
+}
+
+// Undo reverts the most recent change, re-creating the Caddy routes and
+// mDNS records of a removed domain. A change that can't be reverted any
+// more, because its domain has since been removed or taken, is dropped;
+// one that fails otherwise is kept to retry.
+func (lb *LocalBase) Undo() (*UndoResult, error) {
+	lb.journalMu.Lock()
+	defer lb.journalMu.Unlock()
+
+	if len(lb.journal) == 0 {
+		return nil, errorf(CodeInvalidRequest, "nothing to undo")
+	}
+	change := lb.journal[len(lb.journal)-1]
+	d := &change.Domain
+
+	var domain *Domain
+	var err error
+	switch change.Action {
+	case "add":
+		_, err = lb.Remove(d.Domain)
+	case "remove":
+		_, suffix, _ := strings.Cut(d.Domain, ".")
+		domain, err = lb.Add(&AddParams{Domain: d.Domain, Port: d.Port, Aliases: d.Aliases, Suffix: suffix,
+			DomainInfo: d.DomainInfo, RouteOptions: d.RouteOptions})
+		if err == nil && d.Paused {
+			if paused, err := lb.Pause(d.Domain); err != nil {
+				log.Printf("Error pausing %s again: %v", d.Domain, err)
+			} else {
+				domain = paused
+			}
+		}
+	case "update":
+		domain, err = lb.Update(&UpdateParams{Domain: d.Domain, Port: change.PrevPort})
+	case "pause":
+		domain, err = lb.Resume(d.Domain)
+	case "resume":
+		domain, err = lb.Pause(d.Domain)
+	default:
+		err = errorf(CodeInternal, "unknown change %q", change.Action)
+	}
+
+	var e *Error
+	stale := errors.As(err, &e) && (e.Code == CodeDomainNotFound || e.Code == CodeDomainExists)
+	if err != nil && !stale {
+		return nil, fmt.Errorf("failed to undo %s of %s: %v", change.Action, d.Domain, err)
+	}
+	lb.journal = lb.journal[:len(lb.journal)-1]
+	if stale {
+		return nil, errorf(e.Code, "can't undo %s of %s: %s", change.Action, d.Domain, e.Message)
+	}
+	log.Printf("Undid %s of %s", change.Action, d.Domain)
+	return &UndoResult{Undone: change, Domain: domain}, nil
+}
+
+func undoCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "undo",
+		Args:  rangeArgs(0, 0, "usage: localbase undo [--list]"),
+		Short: "Revert the last change to the domains",
+		Long: fmt.Sprintf(`Revert the most recent add, remove, update, pause or resume. Undoing a
+remove registers the domain again with its port, aliases and options. The
+daemon remembers the last %d changes until it stops. --list shows them,
+most recent first.`, journalSize),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if list, _ := cmd.Flags().GetBool("list"); list {
+				var history HistoryResult
+				if err := call("history", nil, &history); err != nil {
+					return err
+				}
+				return printResult(cmd, &history, func() {
+					if len(history.Changes) == 0 {
+						fmt.Println("Nothing to undo")
+						return
+					}
+					for _, c := range history.Changes {
+						fmt.Printf("%s  %s\n", c.Time.Local().Format("15:04:05"), describeChange(&c))
+					}
+				})
+			}
+
+			var result UndoResult
+			if err := call("undo", nil, &result); err != nil {
+				return err
+			}
+			return printResult(cmd, &result, func() {
+				fmt.Printf("Undid %s\n", describeChange(&result.Undone))
+				if result.Domain != nil {
+					printDomainDetails(result.Domain)
+				}
+			})
+		},
+	}
+	cmd.Flags().Bool("list", false, "list the changes undo can revert instead")
+	return cmd
+}
+
+// describeChange describes c in a line, e.g. "update api.local (port 4000 -> 4001)".
+func describeChange(c *Change) string {
+	d := &c.Domain
+	switch c.Action {
+	case "update":
+		return fmt.Sprintf("update %s (port %d -> %d)", d.Domain, c.PrevPort, d.Port)
+	case "add", "remove":
+		return fmt.Sprintf("%s %s (%s)", c.Action, d.Domain, domainTarget(d))
+	}
+	return c.Action + " " + d.Domain
+}
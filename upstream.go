@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	upstreamProbeInterval = 5 * time.Second
+	upstreamProbeTimeout  = 500 * time.Millisecond
+)
+
+// Upstream states reported for a domain.
+const (
+	UpstreamUp   = "up"
+	UpstreamDown = "down"
+)
+
+// watchUpstreams periodically probes the port behind each registered domain
+// and records whether anything is listening on it.
+func (lb *LocalBase) watchUpstreams(ctx context.Context) {
+	ticker := time.NewTicker(upstreamProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		lb.probeUpstreams()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (lb *LocalBase) probeUpstreams() {
+	lb.mu.Lock()
+	ports := make(map[string]int, len(lb.records))
+	for domain, rec := range lb.records {
+		if rec.opts.Dir == "" && !rec.paused {
+			ports[domain] = rec.port
+		}
+	}
+	lb.mu.Unlock()
+
+	states := make(map[string]string, len(ports))
+	for domain, port := range ports {
+		states[domain] = probeUpstream(port)
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for domain, state := range states {
+		rec, ok := lb.records[domain]
+		if !ok || rec.port != ports[domain] || rec.upstream == state {
+			continue
+		}
+		if state == UpstreamDown {
+			log.Printf("Warning: upstream for %s is down (port %d)", domain, rec.port)
+			lb.events.publish(Event{Type: EventUpstreamDown, Domain: domain, Port: rec.port})
+		} else if rec.upstream != "" {
+			log.Printf("Upstream for %s is back up (port %d)", domain, rec.port)
+			lb.events.publish(Event{Type: EventUpstreamUp, Domain: domain, Port: rec.port})
+		}
+		rec.upstream = state
+	}
+}
+
+// addUpstreamStatus sets Caddy's view of the upstreams of domains with a
+// health check. Caddy is only asked when one of them has one.
+func addUpstreamStatus(domains []Domain) {
+	checked := false
+	for _, d := range domains {
+		checked = checked || d.HealthCheck != nil
+	}
+	if !checked {
+		return
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return
+	}
+	statuses, err := getCaddyUpstreams(config.CaddyAdmin)
+	if err != nil {
+		log.Printf("Error getting Caddy upstreams: %v", err)
+		return
+	}
+
+	for i := range domains {
+		d := &domains[i]
+		if d.HealthCheck == nil {
+			continue
+		}
+		for _, port := range append([]int{d.Port}, d.ExtraPorts...) {
+			addr := fmt.Sprintf("localhost:%d", port)
+			status, ok := statuses[addr]
+			if !ok {
+				status = UpstreamStatus{Address: addr}
+			}
+			d.Upstreams = append(d.Upstreams, status)
+		}
+	}
+}
+
+// probeUpstream reports whether something accepts connections on port.
+func probeUpstream(port int) string {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), upstreamProbeTimeout)
+	if err != nil {
+		return UpstreamDown
+	}
+	conn.Close()
+	return UpstreamUp
+}
@@ -1,26 +1,253 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 )
 
 type Config struct {
-	CaddyAdmin   string `json:"caddy_admin"`
-	AdminAddress string `json:"admin_address"`
+	// Version is the format of the config file, upgraded on load.
+	Version    int    `json:"version"`
+	CaddyAdmin string `json:"caddy_admin"`
+	// CaddyOrigin is the Origin, and Host, sent to the Caddy admin API, for
+	// Caddy admin configs that restrict origins. Empty means the admin
+	// address itself.
+	CaddyOrigin string `json:"caddy_origin,omitempty"`
+	// AdminAddress is the TCP address of the admin protocol, used when
+	// Socket is empty.
+	AdminAddress string `json:"admin_address,omitempty"`
+	// Socket is the unix socket path of the admin protocol.
+	Socket string `json:"socket,omitempty"`
+	// Pipe is the Windows named pipe of the admin protocol.
+	Pipe string `json:"pipe,omitempty"`
+	// TLS serves the TCP admin protocol over TLS with a self-signed
+	// certificate that clients pin.
+	TLS bool `json:"tls,omitempty"`
+	// AllowLAN lets the TCP admin protocol listen on every interface, so
+	// the daemon can be managed from other machines. It requires TLS and
+	// RequireAuth.
+	AllowLAN bool `json:"allow_lan,omitempty"`
+	// DisableHTTP3 turns off HTTP/3 (QUIC) on the Caddy server localbase
+	// manages, which Caddy serves by default.
+	DisableHTTP3 bool `json:"disable_http3,omitempty"`
+	// HTTPPort and HTTPSPort are the ports localbase's Caddy servers listen
+	// on, for when 80 and 443 are taken or need privileges. Zero means 80
+	// and 443.
+	HTTPPort  int `json:"http_port,omitempty"`
+	HTTPSPort int `json:"https_port,omitempty"`
+	// CaddyConfigWarnSize is the serialized Caddy config size, in bytes,
+	// above which status reports a warning. Zero disables the warning.
+	CaddyConfigWarnSize int `json:"caddy_config_warn_size,omitempty"`
+	// APIAddress is the address of the REST admin API. Empty disables it.
+	APIAddress string `json:"api_address,omitempty"`
+	// CORSOrigins are the browser origins, such as a browser extension,
+	// allowed to call the REST API.
+	CORSOrigins []string `json:"cors_origins,omitempty"`
+	// Suffix is the suffix of domains added without one, e.g. "test" or
+	// "dev.localhost". Empty means "local". Names outside .local resolve
+	// through the hosts file or DNS server rather than mDNS.
+	Suffix string `json:"suffix,omitempty"`
+	// Interfaces limits the network interfaces localbase takes its address
+	// from and answers mDNS on to those matching these patterns, e.g. en0
+	// or eth*. Empty means any but the defaultExcludeInterfaces.
+	Interfaces []string `json:"interfaces,omitempty"`
+	// ExcludeInterfaces are patterns of interfaces never used, in addition
+	// to the defaultExcludeInterfaces when Interfaces is empty.
+	ExcludeInterfaces []string `json:"exclude_interfaces,omitempty"`
+	// Networks marks networks private or public. mDNS is only answered on
+	// interfaces on private networks.
+	Networks []NetworkPolicy `json:"networks,omitempty"`
+	// DefaultNetworkPolicy is the policy of networks no entry of Networks
+	// matches, "private" or "public". Empty means "private".
+	DefaultNetworkPolicy string `json:"default_network_policy,omitempty"`
+	// MDNS is how .local names are advertised: "builtin", localbase's own
+	// responder, "avahi", through avahi-daemon (Linux only), "native", the
+	// OS's (Windows only), "off", or "auto", avahi where avahi-daemon runs
+	// and builtin elsewhere. Empty means "auto".
+	MDNS string `json:"mdns,omitempty"`
+	// LLMNR answers LLMNR queries for the single-label names of domains,
+	// for Windows machines that don't use mDNS.
+	LLMNR bool `json:"llmnr,omitempty"`
+	// MDNSReflect are patterns of container and VM bridge interfaces, e.g.
+	// docker0 or virbr*, that mDNS is also answered and announced on, so
+	// containers and VMs resolve the names. Network policies don't apply
+	// to them.
+	MDNSReflect []string `json:"mdns_reflect,omitempty"`
+	// MDNSRefreshInterval is how often the daemon checks whether the local
+	// address changed, in case the OS didn't report it, re-announcing the
+	// names when it did.
+	MDNSRefreshInterval Duration `json:"mdns_refresh_interval,omitempty"`
+	// MDNSTTL is the TTL of the names' address and SRV records, how long
+	// other machines cache them without asking again.
+	MDNSTTL Duration `json:"mdns_ttl,omitempty"`
+	// DNSAddress is the address of the built-in DNS server. Empty disables it.
+	DNSAddress string `json:"dns_address,omitempty"`
+	// DNSTLDs are the TLDs the DNS server answers for, e.g. "test".
+	DNSTLDs []string `json:"dns_tlds,omitempty"`
+	// DisableDNSForward has the DNS server refuse queries for names it
+	// doesn't manage, rather than forward them upstream.
+	DisableDNSForward bool `json:"disable_dns_forward,omitempty"`
+	// DNSUpstreams are the resolvers the DNS server forwards to, as
+	// host:port. Empty means the system's.
+	DNSUpstreams []string `json:"dns_upstreams,omitempty"`
+	// DisableResolver stops the daemon from pointing the system resolver
+	// at the DNS server for its TLDs, via /etc/resolver on macOS or a
+	// systemd-resolved drop-in on Linux.
+	DisableResolver bool `json:"disable_resolver,omitempty"`
+	// HostsFile is a hosts file to write registered domains into, for
+	// environments where mDNS doesn't work. Empty disables it.
+	HostsFile string `json:"hosts_file,omitempty"`
+	// StaticRoots are the directories, with everything under them, that
+	// static domains may serve. Empty allows the directory the daemon was
+	// started in.
+	StaticRoots []string `json:"static_roots,omitempty"`
+	// DockerDiscovery registers domains for containers labeled with
+	// localbase.domain and localbase.port.
+	DockerDiscovery bool `json:"docker_discovery,omitempty"`
+	// LogFormat is the daemon log format, "text" or "json".
+	LogFormat string `json:"log_format,omitempty"`
+	// LogLevel is the least severe level the daemon logs, "info", "warn"
+	// or "error". Empty means info.
+	LogLevel string `json:"log_level,omitempty"`
+	// RateLimit is the number of admin requests per second allowed from
+	// each client, with bursts of twice that. Zero disables the limit.
+	RateLimit float64 `json:"rate_limit"`
+	// MaxClientConns caps the admin connections open at once from each
+	// client. Zero disables the limit.
+	MaxClientConns int `json:"max_client_conns"`
+	// RequireAuth rejects admin requests that don't carry an API token.
+	RequireAuth bool `json:"require_auth,omitempty"`
+	// ClientTimeout bounds how long the CLI waits to connect to the daemon
+	// and get a response.
+	ClientTimeout Duration `json:"client_timeout,omitempty"`
+	// ReadTimeout is how long the daemon keeps an idle admin connection
+	// open waiting for the next request.
+	ReadTimeout Duration `json:"read_timeout,omitempty"`
+	// CaddyTimeout bounds each request to the Caddy admin API, and how long
+	// the daemon waits for Caddy to come up at start.
+	CaddyTimeout Duration `json:"caddy_timeout,omitempty"`
+	// DrainTimeout is how long shutdown waits for in-flight requests.
+	DrainTimeout Duration `json:"drain_timeout,omitempty"`
+	// MaxMessageSize bounds each admin request, and each response sent as
+	// a line, in bytes.
+	MaxMessageSize int `json:"max_message_size,omitempty"`
+	// LogFile is a file the daemon logs to, rotated as it grows. Detached
+	// daemons log to localbase.log in the config dir if it is not set.
+	LogFile string `json:"log_file,omitempty"`
+}
+
+// Default timeouts, used when the config doesn't set them.
+const (
+	defaultClientTimeout = 10 * time.Second
+	defaultReadTimeout   = 30 * time.Second
+	defaultCaddyTimeout  = 10 * time.Second
+	defaultDrainTimeout  = 10 * time.Second
+)
+
+// Default admin limits, start's --rate-limit and --max-conns.
+const (
+	defaultRateLimit      = 50
+	defaultMaxClientConns = 32
+)
+
+// Default mDNS timings, used when the config doesn't set them. The TTL is
+// the one RFC 6762 recommends for host records.
+const (
+	defaultMDNSRefreshInterval = 15 * time.Second
+	defaultMDNSTTL             = 120 * time.Second
+)
+
+// Duration is a time.Duration written to the config as a string like
+// "10s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// orDefault returns d, or def if d is unset.
+func (d Duration) orDefault(def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// suffix returns the suffix of domains added without one.
+func (c *Config) suffix() string {
+	if c.Suffix == "" {
+		return "local"
+	}
+	return c.Suffix
+}
+
+func (c *Config) httpPort() int {
+	if c.HTTPPort == 0 {
+		return 80
+	}
+	return c.HTTPPort
+}
+
+func (c *Config) httpsPort() int {
+	if c.HTTPSPort == 0 {
+		return 443
+	}
+	return c.HTTPSPort
 }
 
 func defaultConfig() *Config {
-	return &Config{
+	cfg := &Config{
 		CaddyAdmin:   "http://localhost:2019",
 		AdminAddress: "localhost:2025",
 	}
+	cfg.Socket, _ = defaultSocketPath()
+	cfg.Pipe = defaultPipe()
+	return cfg
+}
+
+// profileEnv names the profile to use when --profile isn't given.
+const profileEnv = "LOCALBASE_PROFILE"
+
+// profile is the profile the CLI and daemon use. Each profile has its own
+// config dir, and with it its own config, domains, daemon and tokens.
+// Empty is the default profile.
+var profile string
+
+// validateProfile checks that name is a single lowercase DNS label, so it
+// is safe in paths and service names.
+func validateProfile(name string) error {
+	if name != "" && (strings.Contains(name, ".") || !validDomainName(name)) {
+		return fmt.Errorf("invalid profile %q, want lowercase letters, digits and dashes, e.g. work", name)
+	}
+	return nil
+}
+
+// profileName appends the profile to name, for names such as the daemon's
+// socket that profiles can't share.
+func profileName(name string) string {
+	if profile == "" {
+		return name
+	}
+	return name + "-" + profile
 }
 
 func getConfigDir() (string, error) {
@@ -38,69 +265,270 @@ func getConfigDir() (string, error) {
 	default:
 		configDir = filepath.Join(home, ".config", "localbase")
 	}
+	if profile != "" {
+		configDir = filepath.Join(configDir, "profiles", profile)
+	}
 
 	return configDir, nil
 }
 
 func saveConfig(cfg *Config) error {
-	configDir, err := getConfigDir()
+	configFile, err := getConfigFile()
 	if err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(configDir, 0755); err != nil {
+	cfg.Version = configVersion
+	data, err := encodeConfig(configFile, cfg)
+	if err != nil {
 		return err
 	}
 
-	configFile := filepath.Join(configDir, "config.json")
+	return writeFileAtomic(configFile, data, 0644)
+}
+
+// runningConfig is the config the daemon was started with, its flags
+// merged with the config file and environment, set in the daemon's
+// process only.
+var runningConfig *Config
+
+// normalize puts the values of start's merged config in their canonical
+// form.
+func (c *Config) normalize() {
+	c.Suffix = strings.ToLower(strings.Trim(c.Suffix, "."))
+	if c.AllowLAN {
+		c.TLS = true
+		c.RequireAuth = true
+	}
+	if len(c.DNSUpstreams) > 0 {
+		upstreams := make([]string, len(c.DNSUpstreams))
+		for i, u := range c.DNSUpstreams {
+			upstreams[i] = u
+			if p, err := parseDNSUpstream(u); err == nil {
+				upstreams[i] = p
+			}
+		}
+		c.DNSUpstreams = upstreams
+	}
+}
+
+// readConfig returns the config the daemon runs with in the daemon, and
+// elsewhere reads the config file, or the default config if there is none,
+// with the environment's keys on top. Keys it doesn't know and values of
+// the wrong type are skipped; start and config validate report them.
+func readConfig() (*Config, error) {
+	if runningConfig != nil {
+		cfg := *runningConfig
+		return &cfg, nil
+	}
 
-	data, err := json.MarshalIndent(cfg, "", "  ")
+	configFile, err := getConfigFile()
 	if err != nil {
-		return err
+		return &Config{}, err
 	}
 
-	return os.WriteFile(configFile, data, 0644)
+	upgradeConfigFile(configFile)
+	cfg, keys, _, err := loadConfigFile(configFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return &Config{}, err
+		}
+		cfg, keys = defaultConfig(), map[string]bool{}
+	}
+	applyConfigEnv(cfg, keys)
+	return cfg, nil
 }
 
-func readConfig() (*Config, error) {
+func getPIDFile() (string, error) {
 	configDir, err := getConfigDir()
 	if err != nil {
-		return &Config{}, err
+		return "", err
+	}
+	return filepath.Join(configDir, "localbase.pid"), nil
+}
+
+func writePIDFile() error {
+	pidFile, err := getPIDFile()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(pidFile), 0755); err != nil {
+		return err
 	}
 
-	configFile := filepath.Join(configDir, "config.json")
-	data, err := os.ReadFile(configFile)
+	return os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+// readPIDFile returns the PID recorded by the running daemon, or 0 if no
+// PID file exists.
+func readPIDFile() (int, error) {
+	pidFile, err := getPIDFile()
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := os.ReadFile(pidFile)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return defaultConfig(), nil
+			return 0, nil
 		}
-		return &Config{}, err
+		return 0, err
 	}
 
-	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return &Config{}, err
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s: %v", pidFile, err)
+	}
+	return pid, nil
+}
+
+func removePIDFile() error {
+	pidFile, err := getPIDFile()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// defaultExcludeInterfaces are interfaces skipped unless Interfaces names
+// them: VPN tunnels and container and VM bridges, whose addresses other
+// machines on the LAN usually can't reach.
+var defaultExcludeInterfaces = []string{
+	"tun*", "utun*", "tap*", "wg*", "ppp*", "ipsec*", "tailscale*", "zt*",
+	"docker*", "br-*", "veth*", "virbr*", "vboxnet*", "vmnet*", "awdl*", "llw*",
+}
+
+// includeInterfaces and excludeInterfaces are the daemon's Interfaces and
+// ExcludeInterfaces, and reflectInterfaces its MDNSReflect, set at start.
+var includeInterfaces, excludeInterfaces, reflectInterfaces []string
+
+// interfaceAllowed reports whether the interface name may be used to pick
+// the local address and to answer mDNS on.
+func interfaceAllowed(name string) bool {
+	if matchInterface(excludeInterfaces, name) {
+		return false
+	}
+	if len(includeInterfaces) == 0 {
+		return !matchInterface(defaultExcludeInterfaces, name)
 	}
+	return matchInterface(includeInterfaces, name)
+}
+
+func matchInterface(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
 
-	return &cfg, nil
+// validateInterfacePatterns checks that patterns are valid globs.
+func validateInterfacePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid interface pattern %q", pattern)
+		}
+	}
+	return nil
 }
 
 func getLocalIP() (string, error) {
-	addrs, err := net.InterfaceAddrs()
+	ifaces, err := net.Interfaces()
 	if err != nil {
 		return "", err
 	}
-	for _, addr := range addrs {
-		var ip net.IP
-		switch v := addr.(type) {
-		case *net.IPNet:
-			ip = v.IP
-		case *net.IPAddr:
-			ip = v.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || !interfaceAllowed(iface.Name) {
+			continue
 		}
-		if ip != nil && !ip.IsLoopback() && ip.To4() != nil {
-			return ip.String(), nil
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
 		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+				return ipnet.IP.String(), nil
+			}
+		}
+	}
+	if len(includeInterfaces) > 0 {
+		return "", fmt.Errorf("no IPv4 address found on interfaces %s", strings.Join(includeInterfaces, ", "))
 	}
 	return "", fmt.Errorf("no suitable local IP address found")
 }
+
+// getLocalIPv6 returns an IPv6 address of the interface that has ip4,
+// preferring global and unique local addresses over link-local ones. It
+// returns "" if that interface has no IPv6 address.
+func getLocalIPv6(ip4 string) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		if !interfaceAllowed(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		has4 := false
+		var global, linkLocal net.IP
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP
+			switch {
+			case ip.To4() != nil:
+				has4 = has4 || ip.String() == ip4
+			case ip.IsGlobalUnicast():
+				if global == nil {
+					global = ip
+				}
+			case ip.IsLinkLocalUnicast():
+				if linkLocal == nil {
+					linkLocal = ip
+				}
+			}
+		}
+		if !has4 {
+			continue
+		}
+		if global != nil {
+			return global.String()
+		}
+		if linkLocal != nil {
+			return linkLocal.String()
+		}
+		return ""
+	}
+	return ""
+}
+
+// localOwner returns user@host for the current user and machine, as
+// advertised to discover.
+func localOwner() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+		if i := strings.LastIndex(name, `\`); i >= 0 {
+			// Windows usernames are DOMAIN\user.
+			name = name[i+1:]
+		}
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return name + "@" + host
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func watchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Args:  noArgs,
+		Short: "Stream daemon events",
+		Long: `Print events from the daemon as they happen: domain_added, domain_updated,
+domain_removed, ip_changed, caddy_restarted, upstream_down, upstream_up and
+name_conflict.
+With -o json, each event is printed as one line of JSON.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			types, _ := cmd.Flags().GetStringSlice("event")
+			format, _ := cmd.Flags().GetString("output")
+
+			enc := json.NewEncoder(os.Stdout)
+			return subscribe(types, func(ev *Event) error {
+				if format == "json" {
+					return enc.Encode(ev)
+				}
+				return printResult(cmd, ev, func() {
+					fmt.Println(formatEvent(ev))
+				})
+			})
+		},
+	}
+	cmd.Flags().StringSlice("event", nil, "only show events of this type (repeatable)")
+	return cmd
+}
+
+func formatEvent(ev *Event) string {
+	line := fmt.Sprintf("%s %s", ev.Time.Format("15:04:05"), ev.Type)
+	if ev.Domain != "" {
+		line += " " + ev.Domain
+	}
+	if ev.Port != 0 {
+		line += fmt.Sprintf(" (port %d)", ev.Port)
+	}
+	if ev.IP != "" {
+		line += " " + ev.IP
+	}
+	if ev.IPv6 != "" {
+		line += " " + ev.IPv6
+	}
+	return line
+}
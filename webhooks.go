@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// webhookAttempts is how many times a delivery is tried before giving up,
+// backing off exponentially from webhookBackoff between attempts.
+const (
+	webhookAttempts = 4
+	webhookBackoff  = time.Second
+)
+
+// signatureHeader carries the hex HMAC-SHA256 of the request body, keyed
+// with the webhook's secret.
+const signatureHeader = "X-Localbase-Signature"
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook is a URL the daemon POSTs events to. Events limits it to some
+// event types; it receives every event when empty.
+type Webhook struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events,omitempty"`
+}
+
+// webhookPayload is the body of a webhook request. Text makes it usable
+// as-is with Slack incoming webhooks.
+type webhookPayload struct {
+	Event
+	Text string `json:"text"`
+}
+
+func getWebhooksFile() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "webhooks.json"), nil
+}
+
+func loadWebhooks() ([]Webhook, error) {
+	path, err := getWebhooksFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var hooks []Webhook
+	if err := decodeStateFile(path, data, "webhooks", &hooks); err != nil {
+		return nil, fmt.Errorf("invalid webhooks file %s: %v", path, err)
+	}
+	return hooks, nil
+}
+
+func saveWebhooks(hooks []Webhook) error {
+	path, err := getWebhooksFile()
+	if err != nil {
+		return err
+	}
+	return writeStateFile(path, "webhooks", hooks)
+}
+
+func (h *Webhook) wants(eventType string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, t := range h.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverWebhooks posts every event to the configured webhooks until the
+// daemon shuts down. The webhooks file is read per event, so changes take
+// effect without a restart.
+func (lb *LocalBase) deliverWebhooks(ctx context.Context) {
+	events := lb.events.subscribe(nil)
+	defer lb.events.unsubscribe(events)
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			hooks, err := loadWebhooks()
+			if err != nil {
+				log.Printf("Error loading webhooks: %v", err)
+				continue
+			}
+			for _, h := range hooks {
+				if h.wants(ev.Type) {
+					go deliverWebhook(ctx, h, ev)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliverWebhook posts ev to h, retrying failed deliveries and 5xx or 429
+// responses.
+func deliverWebhook(ctx context.Context, h Webhook, ev Event) {
+	body, err := json.Marshal(&webhookPayload{Event: ev, Text: "localbase: " + formatEvent(&ev)})
+	if err != nil {
+		log.Printf("Error encoding webhook %s: %v", h.Name, err)
+		return
+	}
+
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(ctx, &h, ev.Type, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Error delivering %s to webhook %s, giving up: %v", ev.Type, h.Name, err)
+			return
+		}
+		log.Printf("Error delivering %s to webhook %s, retrying in %s: %v", ev.Type, h.Name, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func postWebhook(ctx context.Context, h *Webhook, eventType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "localbase")
+	req.Header.Set("X-Localbase-Event", eventType)
+	if h.Secret != "" {
+		req.Header.Set(signatureHeader, "sha256="+signWebhook(h.Secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		// Retrying won't fix a rejected request.
+		log.Printf("Webhook %s rejected %s: %s", h.Name, eventType, resp.Status)
+	}
+	return nil
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "webhook",
+		Short: "Manage webhooks",
+		Long: `Manage URLs the daemon POSTs events to as JSON. Each request carries the event
+type in X-Localbase-Event and, when the webhook has a secret, an HMAC-SHA256
+of the body in X-Localbase-Signature as sha256=<hex>. The body's text field
+makes it work as-is with Slack incoming webhooks. Failed deliveries are
+retried with backoff.`,
+	}
+	cmd.AddCommand(webhookAddCmd(), webhookListCmd(), webhookRemoveCmd())
+	return cmd
+}
+
+func webhookAddCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add <name> <url>",
+		Args:  rangeArgs(2, 2, "usage: localbase webhook add <name> <url> [--event type] [--secret secret]"),
+		Short: "Add a webhook",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			events, _ := cmd.Flags().GetStringSlice("event")
+			secret, _ := cmd.Flags().GetString("secret")
+			noSecret, _ := cmd.Flags().GetBool("no-secret")
+
+			u, err := url.Parse(args[1])
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return usageErrorf("invalid webhook url %q", args[1])
+			}
+
+			hooks, err := loadWebhooks()
+			if err != nil {
+				return err
+			}
+			for _, h := range hooks {
+				if h.Name == args[0] {
+					return usageErrorf("webhook %s already exists", args[0])
+				}
+			}
+
+			generated := false
+			if secret == "" && !noSecret {
+				buf := make([]byte, 24)
+				if _, err := rand.Read(buf); err != nil {
+					return err
+				}
+				secret = hex.EncodeToString(buf)
+				generated = true
+			}
+
+			hooks = append(hooks, Webhook{Name: args[0], URL: args[1], Secret: secret, Events: events})
+			if err := saveWebhooks(hooks); err != nil {
+				return err
+			}
+
+			result := map[string]string{"name": args[0], "url": args[1]}
+			if generated {
+				result["secret"] = secret
+			}
+			return printResult(cmd, result, func() {
+				fmt.Printf("Added webhook %s\n", args[0])
+				if generated {
+					fmt.Printf("Signing secret: %s\n", secret)
+				}
+			})
+		},
+	}
+	cmd.Flags().StringSlice("event", nil, "only send events of this type (repeatable, default all)")
+	cmd.Flags().String("secret", "", "secret for signing requests (generated if not set)")
+	cmd.Flags().Bool("no-secret", false, "don't sign requests")
+	return cmd
+}
+
+func webhookListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Args:  noArgs,
+		Short: "List webhooks",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hooks, err := loadWebhooks()
+			if err != nil {
+				return err
+			}
+			sort.Slice(hooks, func(i, j int) bool { return hooks[i].Name < hooks[j].Name })
+
+			// Secrets stay out of the output.
+			type webhookInfo struct {
+				Name   string   `json:"name"`
+				URL    string   `json:"url"`
+				Signed bool     `json:"signed"`
+				Events []string `json:"events,omitempty"`
+			}
+			infos := make([]webhookInfo, len(hooks))
+			for i, h := range hooks {
+				infos[i] = webhookInfo{Name: h.Name, URL: h.URL, Signed: h.Secret != "", Events: h.Events}
+			}
+
+			return printResult(cmd, infos, func() {
+				if len(infos) == 0 {
+					fmt.Println("No webhooks")
+					return
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tURL\tSIGNED\tEVENTS")
+				for _, h := range infos {
+					events := strings.Join(h.Events, ",")
+					if events == "" {
+						events = "all"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", h.Name, h.URL, h.Signed, events)
+				}
+				w.Flush()
+			})
+		},
+	}
+}
+
+func webhookRemoveCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <name>",
+		Args:  rangeArgs(1, 1, "usage: localbase webhook remove <name>"),
+		Short: "Remove a webhook",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hooks, err := loadWebhooks()
+			if err != nil {
+				return err
+			}
+			for i, h := range hooks {
+				if h.Name == args[0] {
+					hooks = append(hooks[:i], hooks[i+1:]...)
+					if err := saveWebhooks(hooks); err != nil {
+						return err
+					}
+					fmt.Printf("Removed webhook %s\n", args[0])
+					return nil
+				}
+			}
+			return fmt.Errorf("no webhook named %s", args[0])
+		},
+	}
+}